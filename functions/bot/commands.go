@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// commandCall is what a command handler gets to work with. firstRun is set when
+// the message came from a user the bot hadn't seen before.
+type commandCall struct {
+	bot      *tgbotapi.BotAPI
+	message  *tgbotapi.Message
+	db       *sql.DB
+	firstRun bool
+}
+
+// botCommand is one of the bot's slash commands. handle returns the text to reply
+// with, or "" when it already sent its own reply.
+type botCommand struct {
+	name        string
+	args        string
+	description string
+	handle      func(c commandCall) string
+}
+
+// botCommands lists every command in /help order. It drives handleMessage, the
+// /help text and which commands SAVE_COMMANDS never saves as notes, so a new
+// command only needs an entry here. It's filled in init because /help reads it.
+var botCommands []botCommand
+
+func init() {
+	botCommands = []botCommand{
+		{name: "start", description: "Get started", handle: func(c commandCall) string {
+			return welcomeMessage(c.firstRun)
+		}},
+		{name: "help", description: "Show this help message", handle: func(c commandCall) string {
+			return helpText()
+		}},
+		{name: "miniapp", description: "Open mini-app to view your tags", handle: func(c commandCall) string {
+			sendMiniAppButton(c.bot, c.message)
+			return ""
+		}},
+		{name: "tags", description: "List your tags with message counts", handle: func(c commandCall) string {
+			sendTagList(c.bot, c.message, c.db)
+			return ""
+		}},
+		{name: "reset", description: "Delete all your saved data", handle: func(c commandCall) string {
+			sendResetPrompt(c.bot, c.message)
+			return ""
+		}},
+		{name: "export", description: "Get all your saved data as a JSON file", handle: func(c commandCall) string {
+			sendDataExport(c.bot, c.message, c.db)
+			return ""
+		}},
+		{name: "deletemydata", description: "Delete your account and everything saved", handle: func(c commandCall) string {
+			sendDeleteMyDataPrompt(c.bot, c.message)
+			return ""
+		}},
+		{name: "usage", description: "Show how often you use each command", handle: func(c commandCall) string {
+			return usageResponse(c.db, c.message.From.ID)
+		}},
+		{name: "stats", description: "Show how much you've saved", handle: func(c commandCall) string {
+			return statsResponse(c.db, c.message.From.ID)
+		}},
+		{name: "note", args: "<text>", description: "Reply to a saved message to add a note (no text clears it)", handle: func(c commandCall) string {
+			return noteResponse(c.db, c.message)
+		}},
+		{name: "autodelete", args: "<days|off>", description: "Delete untagged messages after this many days", handle: func(c commandCall) string {
+			return autoDeleteResponse(c.db, c.message.From.ID, c.message.CommandArguments())
+		}},
+		{name: "show", args: "<tag>", description: "Show a tag and rename it", handle: func(c commandCall) string {
+			sendTagOverview(c.bot, c.message, c.db)
+			return ""
+		}},
+		{name: "deletetag", description: "Delete a tag and remove it from its messages", handle: func(c commandCall) string {
+			sendDeleteTagPrompt(c.bot, c.message)
+			return ""
+		}},
+		{name: "renametag", description: "Rename a tag, keeping its messages", handle: func(c commandCall) string {
+			sendRenameTagCommandPrompt(c.bot, c.message)
+			return ""
+		}},
+		{name: "digest", args: "<daily|weekly|off>", description: "Get a summary of your saves", handle: func(c commandCall) string {
+			return digestResponse(c.db, c.message.From.ID, c.message.CommandArguments())
+		}},
+		{name: "ignore", args: "<types|off>", description: "Don't save some message types, e.g. /ignore sticker voice", handle: func(c commandCall) string {
+			return ignoreResponse(c.db, c.message.From.ID, c.message.CommandArguments())
+		}},
+		{name: "revoke", description: "Sign out of the mini-app on every device", handle: func(c commandCall) string {
+			return revokeResponse(c.db, c.message.From.ID)
+		}},
+		{name: "sametags", description: "Reply to a saved message to give it the tags of the message it replies to", handle: func(c commandCall) string {
+			return sameTagsResponse(c.db, c.message)
+		}},
+		{name: "untag", description: "Reply to a saved message to remove one of its tags", handle: func(c commandCall) string {
+			sendUntagPrompt(c.bot, c.message, c.db)
+			return ""
+		}},
+		{name: "search", args: "<#hashtag|text>", description: "Find your saved messages", handle: func(c commandCall) string {
+			return searchResponse(c.db, c.message.From.ID, c.message.CommandArguments())
+		}},
+	}
+}
+
+// findCommand returns the registered command called name, or nil
+func findCommand(name string) *botCommand {
+	for i := range botCommands {
+		if botCommands[i].name == name {
+			return &botCommands[i]
+		}
+	}
+	return nil
+}
+
+// helpText is the /help reply, listing botCommands
+func helpText() string {
+	var text strings.Builder
+	text.WriteString("Available commands:")
+	for _, command := range botCommands {
+		text.WriteString("\n/" + command.name)
+		if command.args != "" {
+			text.WriteString(" " + command.args)
+		}
+		text.WriteString(" - " + command.description)
+	}
+	text.WriteString("\n\nYou can also send me any message or forward content to me.")
+	return text.String()
+}
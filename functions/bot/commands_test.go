@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestBotCommands tests that every registered command is listed in /help and
+// never saved as a note
+func TestBotCommands(t *testing.T) {
+	t.Setenv("SAVE_COMMANDS", "true")
+
+	help := helpText()
+	seen := map[string]bool{}
+	for _, command := range botCommands {
+		assert.False(t, seen[command.name], "Duplicate command /%s", command.name)
+		seen[command.name] = true
+
+		assert.NotNil(t, command.handle, command.name)
+		assert.Contains(t, help, "\n/"+command.name+" ", command.name)
+		if found := findCommand(command.name); assert.NotNil(t, found) {
+			assert.Equal(t, command.description, found.description)
+		}
+
+		message := createTelegramMessage(1, 12345, "testuser", "/"+command.name+" some text")
+		message.Entities[0].Length = len(command.name) + 1
+		assert.Nil(t, commandNote(message), "/%s should never be saved as a note", command.name)
+	}
+
+	assert.Nil(t, findCommand("todo"))
+	assert.True(t, strings.HasPrefix(help, "Available commands:\n/start - Get started\n/help - Show this help message\n"))
+	assert.Contains(t, help, "\n/search <#hashtag|text> - Find your saved messages\n")
+}
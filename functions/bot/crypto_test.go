@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+
+	"telegram-content-organizer-shared/storage"
+	"telegram-content-organizer-shared/textcrypt"
+)
+
+// useTextCipher makes stored text use c for the rest of the test
+func useTextCipher(t *testing.T, c *textcrypt.Cipher) {
+	t.Cleanup(textcrypt.Use(c))
+}
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+// TestSaveMessageEncrypted tests that saveMessage encrypts and export decrypts
+func TestSaveMessageEncrypted(t *testing.T) {
+	c, err := textcrypt.NewCipher("k1", map[string][]byte{"k1": testKey(1)})
+	assert.NoError(t, err)
+	useTextCipher(t, c)
+
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+
+	message := createTestMessageStruct(1, user, "secret note #work https://example.com")
+	assert.NoError(t, saveMessage(db, message))
+	photo := createTestPhotoMessage(2, user, "secret caption", tgbotapi.PhotoSize{FileID: "photo"})
+	assert.NoError(t, saveMessage(db, photo))
+
+	var storedText, storedCaption sql.NullString
+	assert.NoError(t, db.QueryRow(`SELECT text_content FROM messages WHERE telegram_message_id = 1`).Scan(&storedText))
+	assert.NoError(t, db.QueryRow(`SELECT caption FROM messages WHERE telegram_message_id = 2`).Scan(&storedCaption))
+	assert.True(t, strings.HasPrefix(storedText.String, textcrypt.Prefix))
+	assert.True(t, strings.HasPrefix(storedCaption.String, textcrypt.Prefix))
+
+	// URLs, hashtags and mentions are extracted from the plain text, then
+	// encrypted item by item
+	var hashtags pq.StringArray
+	assert.NoError(t, db.QueryRow(`SELECT hashtags FROM messages WHERE telegram_message_id = 1`).Scan(&hashtags))
+	if assert.Len(t, hashtags, 1) {
+		assert.True(t, strings.HasPrefix(hashtags[0], textcrypt.Prefix))
+	}
+
+	quote := RawMessageFields{Quote: &struct {
+		Text string `json:"text"`
+	}{Text: "secret quote"}}
+	assert.NoError(t, saveRawMessageFields(db, user.ID, 1, quote))
+	var storedQuote sql.NullString
+	assert.NoError(t, db.QueryRow(`SELECT quote_text FROM messages WHERE telegram_message_id = 1`).Scan(&storedQuote))
+	assert.True(t, strings.HasPrefix(storedQuote.String, textcrypt.Prefix))
+
+	export, err := storage.ExportUserData(db, user.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, export.Messages, 2) {
+		assert.Equal(t, "secret note #work https://example.com", *export.Messages[0].TextContent)
+		assert.Equal(t, []string{"work"}, export.Messages[0].Hashtags)
+		assert.Equal(t, []string{"https://example.com"}, export.Messages[0].URLs)
+		assert.Equal(t, "secret quote", *export.Messages[0].QuoteText)
+		assert.Equal(t, "secret caption", *export.Messages[1].Caption)
+	}
+
+	results, err := searchMessages(db, user.ID, "#work")
+	assert.NoError(t, err)
+	assert.Len(t, results, 1, "Hashtag search decrypts hashtags")
+}
+
+// TestStoredBodiesEncrypted tests that raw updates and stashed messages are
+// encrypted like message text
+func TestStoredBodiesEncrypted(t *testing.T) {
+	c, err := textcrypt.NewCipher("k1", map[string][]byte{"k1": testKey(1)})
+	assert.NoError(t, err)
+	useTextCipher(t, c)
+
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+
+	body := `{"update_id": 1001, "message": {"text": "secret plans"}}`
+	assert.NoError(t, saveRawUpdate(db, 1001, user.ID, body, time.Hour))
+	var stored string
+	assert.NoError(t, db.QueryRow(`SELECT body FROM raw_updates WHERE update_id = 1001`).Scan(&stored))
+	assert.NotContains(t, stored, "secret plans")
+	got, err := getRawUpdate(db, 1001)
+	assert.NoError(t, err)
+	assert.Equal(t, body, got)
+
+	assert.NoError(t, stashPendingMessage(db, createTestMessageStruct(2, user, "secret pending")))
+	assert.NoError(t, db.QueryRow(`SELECT body FROM pending_messages`).Scan(&stored))
+	assert.NotContains(t, stored, "secret pending")
+	saved, err := retryPendingMessages(db, user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, saved)
+
+	results, err := searchMessages(db, user.ID, "pending")
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+}
@@ -2,51 +2,64 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+
+	"telegram-content-organizer-shared/storage"
+	"telegram-content-organizer-shared/textcrypt"
 )
 
 func initDB() (*sql.DB, error) {
 	dbURL := os.Getenv("DATABASE_URL")
 	if dbURL == "" {
-		return nil, fmt.Errorf("DATABASE_URL  environment variable not set")
+		return nil, fmt.Errorf("DATABASE_URL environment variable not set")
 	}
 
 	db, err := sql.Open("postgres", dbURL)
 	if err != nil {
 		return nil, err
 	}
+	storage.ConfigurePool(db, storage.LoadPoolConfig())
 
 	if err = db.Ping(); err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	return db, nil
 }
 
+// truncateText cuts text to at most maxLength characters and appends "..." if
+// it did. The cut always lands between characters, never inside one.
 func truncateText(text string, maxLength int) string {
-	if len(text) <= maxLength {
-		return text
+	count := 0
+	for i := range text {
+		if count >= maxLength {
+			return text[:i] + "..."
+		}
+		count++
 	}
-	return text[:maxLength] + "..."
+	return text
 }
 
 func saveUser(db *sql.DB, user *tgbotapi.User) error {
-	query := `
-		INSERT INTO users (telegram_id, username, first_name, last_name, created_at, updated_at, is_active)
-		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, true)
-		ON CONFLICT (telegram_id) 
-		DO UPDATE SET 
-			username = EXCLUDED.username,
-			first_name = EXCLUDED.first_name,
-			last_name = EXCLUDED.last_name,
-			updated_at = CURRENT_TIMESTAMP`
+	_, err := upsertUser(db, user)
+	return err
+}
 
+// upsertUser saves the user's profile and reports whether this created the user,
+// i.e. it's the first time the bot sees them
+func upsertUser(db *sql.DB, user *tgbotapi.User) (bool, error) {
 	var username, firstName, lastName sql.NullString
 	if user.UserName != "" {
 		username = sql.NullString{String: user.UserName, Valid: true}
@@ -58,70 +71,1013 @@ func saveUser(db *sql.DB, user *tgbotapi.User) error {
 		lastName = sql.NullString{String: user.LastName, Valid: true}
 	}
 
-	_, err := db.Exec(query, user.ID, username, firstName, lastName)
+	insertQuery := `
+		INSERT INTO users (telegram_id, username, first_name, last_name, created_at, updated_at, is_active)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, true)
+		ON CONFLICT (telegram_id) DO NOTHING`
+	result, err := db.Exec(insertQuery, user.ID, username, firstName, lastName)
+	if err != nil {
+		return false, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if inserted > 0 {
+		return true, nil
+	}
+
+	updateQuery := `
+		UPDATE users SET
+			username = $2,
+			first_name = $3,
+			last_name = $4,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE telegram_id = $1`
+	_, err = db.Exec(updateQuery, user.ID, username, firstName, lastName)
+	return false, err
+}
+
+// setUserActive records whether the user currently has the bot unblocked
+func setUserActive(db *sql.DB, telegramID int64, active bool) error {
+	query := `UPDATE users SET is_active = $2, updated_at = CURRENT_TIMESTAMP WHERE telegram_id = $1`
+	_, err := db.Exec(query, telegramID, active)
 	return err
 }
 
-func saveMessage(db *sql.DB, message *tgbotapi.Message) error {
+// storedTexts are a message's text columns and the URLs, hashtags and mentions
+// extracted from them, encoded for storage
+type storedTexts struct {
+	textContent sql.NullString
+	caption     sql.NullString
+	fullText    sql.NullString
+	truncated   bool
+	urls        []string
+	hashtags    []string
+	mentions    []string
+}
 
-	var textContent, caption sql.NullString
+// newStoredTexts keeps 150-character previews of the text and caption, plus the
+// whole text or caption up to MAX_STORED_TEXT. URLs, hashtags and mentions come
+// from the full text and caption, not just the previews.
+func newStoredTexts(message *tgbotapi.Message) (storedTexts, error) {
+	var texts storedTexts
 
 	// Store only previews/snippets of text content
 	if message.Text != "" {
 		preview := truncateText(message.Text, 150)
-		textContent = sql.NullString{String: preview, Valid: true}
+		texts.textContent = sql.NullString{String: preview, Valid: true}
 	}
 	if message.Caption != "" {
 		preview := truncateText(message.Caption, 150)
-		caption = sql.NullString{String: preview, Valid: true}
+		texts.caption = sql.NullString{String: preview, Valid: true}
+	}
+
+	// Keep the whole text or caption too, up to MAX_STORED_TEXT
+	if text := message.Text + message.Caption; text != "" {
+		texts.fullText.String, texts.truncated = storage.LimitStoredText(text, storage.MaxStoredText())
+		texts.fullText.Valid = true
+	}
+
+	// Encrypt text at rest when TEXT_ENCRYPTION_KEY is configured
+	var err error
+	if texts.textContent, err = textcrypt.Encode(texts.textContent); err != nil {
+		return texts, fmt.Errorf("failed to encode text: %v", err)
+	}
+	if texts.caption, err = textcrypt.Encode(texts.caption); err != nil {
+		return texts, fmt.Errorf("failed to encode caption: %v", err)
+	}
+	if texts.fullText, err = textcrypt.Encode(texts.fullText); err != nil {
+		return texts, fmt.Errorf("failed to encode full text: %v", err)
+	}
+	if texts.urls, err = textcrypt.EncodeList(extractURLs(message.Text, message.Caption)); err != nil {
+		return texts, fmt.Errorf("failed to encode urls: %v", err)
+	}
+	if texts.hashtags, err = textcrypt.EncodeList(extractHashtags(message.Text, message.Caption)); err != nil {
+		return texts, fmt.Errorf("failed to encode hashtags: %v", err)
+	}
+	if texts.mentions, err = textcrypt.EncodeList(extractMentions(message.Text, message.Caption)); err != nil {
+		return texts, fmt.Errorf("failed to encode mentions: %v", err)
+	}
+	return texts, nil
+}
+
+// MessageTooLargeError reports a message value longer than its column allows.
+// Text and captions never cause it: they are cut to previews and MAX_STORED_TEXT.
+type MessageTooLargeError struct {
+	Column string
+	Length int
+	Limit  int
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("%s is %d characters, over the column limit of %d", e.Column, e.Length, e.Limit)
+}
+
+// checkColumnLimits returns a MessageTooLargeError for the first value longer
+// than its VARCHAR column in the messages table
+func checkColumnLimits(message *tgbotapi.Message, file FileMetadata, location LocationData, forwardedFrom *string) error {
+	var from string
+	if forwardedFrom != nil {
+		from = *forwardedFrom
+	}
+
+	columns := []struct {
+		name  string
+		value string
+		limit int
+	}{
+		{"file_id", file.FileID.String, 255},
+		{"file_name", file.FileName.String, 255},
+		{"mime_type", file.MimeType.String, 100},
+		{"thumb_file_id", file.ThumbFileID.String, 255},
+		{"forwarded_from", from, 255},
+		{"media_group_id", message.MediaGroupID, 64},
+		{"venue_title", location.VenueTitle.String, 255},
+	}
+	for _, column := range columns {
+		if length := utf8.RuneCountInString(column.value); length > column.limit {
+			return &MessageTooLargeError{Column: column.name, Length: length, Limit: column.limit}
+		}
+	}
+	return nil
+}
+
+// saveMessage stores the message. A message is identified by the user and its
+// Telegram message ID, so saving the same one again (a redelivered webhook, a
+// retry) updates the existing row: its ID, tags, note and created_at are kept.
+// The bot's messages have source_chat_id 0; imported ones never match them.
+func saveMessage(db *sql.DB, message *tgbotapi.Message) error {
+	_, err := upsertMessage(db, message)
+	return err
+}
+
+// upsertMessage is saveMessage, also reporting whether the message was new
+// rather than already saved. The insert skips a saved message and only the
+// statement that created the row gets its ID back, so of two deliveries of one
+// update handled at once, exactly one reports created.
+func upsertMessage(db *sql.DB, message *tgbotapi.Message) (created bool, err error) {
+	texts, err := newStoredTexts(message)
+	if err != nil {
+		return false, err
 	}
 
 	// Extract file metadata
 	messageType := getMessageType(message)
+	if messageType == MessageTypeUnknown {
+		messageLogger(message).Info("Saving message with unrecognized content", "message_type", messageType)
+	}
 	fileMetadata := extractFileMetadata(message, messageType)
-
-	// Extract metadata from FULL text and caption (not just previews)
-	urls := extractURLs(message.Text, message.Caption)
-	hashtags := extractHashtags(message.Text, message.Caption)
-	mentions := extractMentions(message.Text, message.Caption)
+	location := extractLocation(message)
 
 	// Handle forwarded message data
 	forwardedDate, forwardedFrom := generateForwardedTimes(message)
+	forwardedChatUsername, forwardedMessageID := forwardedPost(message)
 
-	query := `
+	// Reject values the database would refuse before archiving anything
+	if err := checkColumnLimits(message, fileMetadata, location, forwardedFrom); err != nil {
+		return false, err
+	}
+
+	// Archive the file itself when STORE_MEDIA is enabled
+	archivedKey := mediaArchive.archive(message.From.ID, fileMetadata)
+
+	// Keep the replied-to message so threaded notes retain their context
+	var replyToMessageID sql.NullInt64
+	if message.ReplyToMessage != nil {
+		replyToMessageID = sql.NullInt64{Int64: int64(message.ReplyToMessage.MessageID), Valid: true}
+	}
+
+	// Items of an album share a media group ID
+	mediaGroupID := sql.NullString{String: message.MediaGroupID, Valid: message.MediaGroupID != ""}
+
+	insert := `
 		INSERT INTO messages (
-			user_id, telegram_message_id, message_type, text_content, caption,
+			user_id, telegram_message_id, message_type, text_content, caption, full_text, text_truncated,
 			file_id, file_name, file_size, mime_type, duration,
-			forwarded_date, forwarded_from, urls, hashtags, mentions, created_at
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, CURRENT_TIMESTAMP)`
+			width, height, thumb_file_id, thumb_width, thumb_height,
+			forwarded_date, forwarded_from, urls, hashtags, mentions, has_spoiler, reply_to_message_id, media_key, media_group_id,
+			latitude, longitude, venue_title, venue_address, forwarded_chat_username, forwarded_message_id, created_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26,
+			$27, $28, $29, $30, $31, $32, CURRENT_TIMESTAMP)`
+	update := `
+		ON CONFLICT (user_id, source_chat_id, telegram_message_id) DO UPDATE SET
+			message_type = EXCLUDED.message_type,
+			text_content = EXCLUDED.text_content,
+			caption = EXCLUDED.caption,
+			full_text = EXCLUDED.full_text,
+			text_truncated = EXCLUDED.text_truncated,
+			file_id = EXCLUDED.file_id,
+			file_name = EXCLUDED.file_name,
+			file_size = EXCLUDED.file_size,
+			mime_type = EXCLUDED.mime_type,
+			duration = EXCLUDED.duration,
+			width = EXCLUDED.width,
+			height = EXCLUDED.height,
+			thumb_file_id = EXCLUDED.thumb_file_id,
+			thumb_width = EXCLUDED.thumb_width,
+			thumb_height = EXCLUDED.thumb_height,
+			forwarded_date = EXCLUDED.forwarded_date,
+			forwarded_from = EXCLUDED.forwarded_from,
+			urls = EXCLUDED.urls,
+			hashtags = EXCLUDED.hashtags,
+			mentions = EXCLUDED.mentions,
+			has_spoiler = EXCLUDED.has_spoiler,
+			reply_to_message_id = EXCLUDED.reply_to_message_id,
+			media_key = COALESCE(EXCLUDED.media_key, messages.media_key),
+			media_group_id = EXCLUDED.media_group_id,
+			latitude = EXCLUDED.latitude,
+			longitude = EXCLUDED.longitude,
+			venue_title = EXCLUDED.venue_title,
+			venue_address = EXCLUDED.venue_address,
+			forwarded_chat_username = EXCLUDED.forwarded_chat_username,
+			forwarded_message_id = EXCLUDED.forwarded_message_id`
 
-	_, err := db.Exec(query,
-		message.From.ID, message.MessageID, string(messageType), textContent, caption,
+	args := []interface{}{
+		message.From.ID, message.MessageID, string(messageType), texts.textContent, texts.caption, texts.fullText, texts.truncated,
 		fileMetadata.FileID, fileMetadata.FileName, fileMetadata.FileSize, fileMetadata.MimeType, fileMetadata.Duration,
+		fileMetadata.Width, fileMetadata.Height, fileMetadata.ThumbFileID, fileMetadata.ThumbWidth, fileMetadata.ThumbHeight,
 		forwardedDate, forwardedFrom,
-		"{"+strings.Join(urls, ",")+"}",
-		"{"+strings.Join(hashtags, ",")+"}",
-		"{"+strings.Join(mentions, ",")+"}")
+		textArray(texts.urls), textArray(texts.hashtags), textArray(texts.mentions),
+		hasSpoilerEntity(message), replyToMessageID, archivedKey, mediaGroupID,
+		location.Latitude, location.Longitude, location.VenueTitle, location.VenueAddress,
+		forwardedChatUsername, forwardedMessageID,
+	}
+
+	stop := timeMetric("db_query_duration", "query", "save_message")
+	var id int64
+	err = db.QueryRow(insert+`
+		ON CONFLICT (user_id, source_chat_id, telegram_message_id) DO NOTHING
+		RETURNING id`, args...).Scan(&id)
+	created = err == nil
+	if err == sql.ErrNoRows {
+		// Already saved, so refresh the existing row
+		_, err = db.Exec(insert+update, args...)
+	}
+	stop()
+	if err != nil {
+		return false, err
+	}
+
+	countMetric("messages_saved", "message_type", string(messageType))
+	return created, nil
+}
+
+// updateMessage refreshes the text of an already saved message after the user
+// edited it: previews, full text and the URLs, hashtags and mentions extracted
+// from it. It returns sql.ErrNoRows when the message was never saved.
+func updateMessage(db *sql.DB, message *tgbotapi.Message) error {
+	texts, err := newStoredTexts(message)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE messages SET
+			text_content = $3,
+			caption = $4,
+			full_text = $5,
+			text_truncated = $6,
+			urls = $7,
+			hashtags = $8,
+			mentions = $9
+		WHERE user_id = $1 AND source_chat_id = 0 AND telegram_message_id = $2`
 
+	stop := timeMetric("db_query_duration", "query", "update_message")
+	result, err := db.Exec(query, message.From.ID, message.MessageID,
+		texts.textContent, texts.caption, texts.fullText, texts.truncated,
+		textArray(texts.urls), textArray(texts.hashtags), textArray(texts.mentions))
+	stop()
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// saveRawMessageFields stores RawMessageFields on an already saved message
+func saveRawMessageFields(db *sql.DB, userID int64, telegramMessageID int, fields RawMessageFields) error {
+	var quoteText sql.NullString
+	if fields.Quote != nil && fields.Quote.Text != "" {
+		quoteText = sql.NullString{String: fields.Quote.Text, Valid: true}
+	}
+	quoteText, err := textcrypt.Encode(quoteText)
+	if err != nil {
+		return fmt.Errorf("failed to encode quote: %v", err)
+	}
+
+	var storyChatID, storyID sql.NullInt64
+	if fields.Story != nil {
+		storyChatID = sql.NullInt64{Int64: fields.Story.Chat.ID, Valid: true}
+		storyID = sql.NullInt64{Int64: int64(fields.Story.ID), Valid: true}
+	}
+
+	query := `
+		UPDATE messages
+		SET has_spoiler = has_spoiler OR $3, quote_text = $4, story_chat_id = $5, story_id = $6,
+			message_type = CASE WHEN message_type = $7 THEN $8 ELSE message_type END
+		WHERE user_id = $1 AND source_chat_id = 0 AND telegram_message_id = $2`
+	_, err = db.Exec(query, userID, telegramMessageID, fields.HasMediaSpoiler, quoteText, storyChatID, storyID,
+		string(MessageTypeUnknown), string(fields.messageType(MessageTypeUnknown)))
 	return err
 }
 
+// setMessageNote stores the user's own note on a saved message. An empty note
+// clears it. Notes are encrypted like message text.
+func setMessageNote(db *sql.DB, messageID int64, note string) error {
+	var value sql.NullString
+	if note != "" {
+		value = sql.NullString{String: note, Valid: true}
+	}
+
+	value, err := textcrypt.Encode(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode note: %v", err)
+	}
+
+	_, err = db.Exec(`UPDATE messages SET user_note = $1 WHERE id = $2`, value, messageID)
+	return err
+}
+
+// defaultRawUpdateTTL is how long raw updates are kept when RAW_UPDATES_TTL_HOURS is unset
+const defaultRawUpdateTTL = 72 * time.Hour
+
+// rawUpdateTTL reports whether STORE_RAW_UPDATES is on and how long stored
+// updates live. Raw updates hold full message content, so keep the TTL short.
+func rawUpdateTTL() (time.Duration, bool) {
+	enabled, err := strconv.ParseBool(os.Getenv("STORE_RAW_UPDATES"))
+	if err != nil || !enabled {
+		return 0, false
+	}
+	hours, err := strconv.Atoi(os.Getenv("RAW_UPDATES_TTL_HOURS"))
+	if err != nil || hours <= 0 {
+		return defaultRawUpdateTTL, true
+	}
+	return time.Duration(hours) * time.Hour, true
+}
+
+// saveRawUpdate stores the raw update body keyed by update_id, encrypted like
+// message text. The maintenance job deletes it once it expires.
+func saveRawUpdate(db *sql.DB, updateID int, userID int64, body string, ttl time.Duration) error {
+	now := time.Now().UTC()
+	encoded, err := textcrypt.Encode(sql.NullString{String: body, Valid: true})
+	if err != nil {
+		return fmt.Errorf("failed to encode update: %v", err)
+	}
+
+	query := `
+		INSERT INTO raw_updates (update_id, user_id, body, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (update_id) DO NOTHING`
+	_, err = db.Exec(query, updateID, userID, encoded, now, now.Add(ttl))
+	return err
+}
+
+// getRawUpdate returns the stored body of an update that hasn't expired yet
+func getRawUpdate(db *sql.DB, updateID int) (string, error) {
+	var body sql.NullString
+	query := `SELECT body FROM raw_updates WHERE update_id = $1 AND expires_at >= $2`
+	err := db.QueryRow(query, updateID, time.Now().UTC()).Scan(&body)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("raw update %d not found or expired", updateID)
+	}
+	if err != nil {
+		return "", err
+	}
+	body, err = textcrypt.Decode(body)
+	return body.String, err
+}
+
+// mediaGroupTTL is how long a media_groups record outlives the album's first
+// item. Telegram delivers the items of an album within seconds of each other.
+const mediaGroupTTL = time.Hour
+
+// claimMediaGroup records the album mediaGroupID for the user and reports whether
+// this call was the first to do so. The primary key makes the claim atomic, so
+// only one of the album's concurrently handled items gets the tag prompt. An
+// expired record the maintenance job hasn't deleted yet is claimed again.
+func claimMediaGroup(db *sql.DB, userID int64, mediaGroupID string, telegramMessageID int) (bool, error) {
+	now := time.Now().UTC()
+	query := `
+		INSERT INTO media_groups (user_id, media_group_id, telegram_message_id, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, media_group_id) DO UPDATE SET
+			telegram_message_id = EXCLUDED.telegram_message_id,
+			created_at = EXCLUDED.created_at,
+			expires_at = EXCLUDED.expires_at
+		WHERE media_groups.expires_at < EXCLUDED.created_at`
+	result, err := db.Exec(query, userID, mediaGroupID, telegramMessageID, now, now.Add(mediaGroupTTL))
+	if err != nil {
+		return false, err
+	}
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return claimed > 0, nil
+}
+
+// purgeExpired deletes raw updates and media group records past their
+// expires_at and returns how many rows went. Reads skip expired rows, so it only
+// needs to run periodically, from the maintenance job.
+func purgeExpired(db *sql.DB) (int64, error) {
+	now := time.Now().UTC()
+	var deleted int64
+	for _, table := range []string{"raw_updates", "media_groups"} {
+		result, err := db.Exec(`DELETE FROM `+table+` WHERE expires_at < $1`, now)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to purge %s: %v", table, err)
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += rows
+	}
+	return deleted, nil
+}
+
+// saveMessageAttempts and saveRetryBackoff bound how long a save retries through a
+// brief database blip; the backoff doubles after each failed attempt
+const saveMessageAttempts = 3
+
+var saveRetryBackoff = 200 * time.Millisecond
+
+// saveMessageFunc is the insert saveMessageWithRetry retries; tests swap it to
+// simulate transient failures
+var saveMessageFunc = upsertMessage
+
+// saveMessageWithRetry saves the message, retrying with backoff. created reports
+// whether the message wasn't saved before, as with upsertMessage. If every
+// attempt fails the message is stashed in pending_messages so it isn't lost;
+// stashed reports whether that happened, and err is set only when stashing
+// failed too. A MessageTooLargeError is returned right away: retrying can't fix it.
+func saveMessageWithRetry(db *sql.DB, message *tgbotapi.Message) (created, stashed bool, err error) {
+	backoff := saveRetryBackoff
+	for attempt := 1; attempt <= saveMessageAttempts; attempt++ {
+		if created, err = saveMessageFunc(db, message); err == nil {
+			return created, false, nil
+		}
+		// Saving it again won't make it fit
+		var tooLarge *MessageTooLargeError
+		if errors.As(err, &tooLarge) {
+			return false, false, err
+		}
+		messageLogger(message).Warn("Error saving message", "attempt", attempt, "attempts", saveMessageAttempts, "error", err)
+		if attempt < saveMessageAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	if stashErr := stashPendingMessage(db, message); stashErr != nil {
+		return false, false, fmt.Errorf("save failed: %v; stash failed: %v", err, stashErr)
+	}
+	countMetric("messages_stashed")
+	return false, true, nil
+}
+
+// stashPendingMessage keeps the whole message as JSON for retryPendingMessages,
+// encrypted like message text
+func stashPendingMessage(db *sql.DB, message *tgbotapi.Message) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	encoded, err := textcrypt.Encode(sql.NullString{String: string(body), Valid: true})
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %v", err)
+	}
+	query := `INSERT INTO pending_messages (user_id, body, created_at) VALUES ($1, $2, $3)`
+	_, err = db.Exec(query, message.From.ID, encoded, time.Now().UTC())
+	return err
+}
+
+// retryPendingMessages saves the user's stashed messages, oldest first, and
+// removes the ones that made it. It returns how many were saved.
+func retryPendingMessages(db *sql.DB, userID int64) (int, error) {
+	rows, err := db.Query(`SELECT id, body FROM pending_messages WHERE user_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	type pendingMessage struct {
+		id   int64
+		body sql.NullString
+	}
+	var pending []pendingMessage
+	for rows.Next() {
+		var p pendingMessage
+		if err := rows.Scan(&p.id, &p.body); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	saved := 0
+	for _, p := range pending {
+		body, err := textcrypt.Decode(p.body)
+		if err != nil {
+			return saved, err
+		}
+		var message tgbotapi.Message
+		if err := json.Unmarshal([]byte(body.String), &message); err != nil {
+			userLogger(userID).Warn("Dropping unreadable pending message", "pending_message_id", p.id, "error", err)
+		} else if err := saveMessage(db, &message); err != nil {
+			return saved, err
+		} else {
+			saved++
+		}
+		if _, err := db.Exec(`DELETE FROM pending_messages WHERE id = $1`, p.id); err != nil {
+			return saved, err
+		}
+	}
+	return saved, nil
+}
+
+type CommandUsage struct {
+	Command    string
+	Count      int
+	LastUsedAt time.Time
+}
+
+// maxCommandLength keeps arbitrary unknown commands from bloating command_usage
+const maxCommandLength = 64
+
+func recordCommandUsage(db *sql.DB, userID int64, command string) error {
+	command = strings.ToLower(command)
+	if command == "" || len(command) > maxCommandLength {
+		return nil
+	}
+
+	query := `
+		INSERT INTO command_usage (user_id, command, count, last_used_at)
+		VALUES ($1, $2, 1, CURRENT_TIMESTAMP)
+		ON CONFLICT (user_id, command)
+		DO UPDATE SET count = command_usage.count + 1, last_used_at = CURRENT_TIMESTAMP`
+	_, err := db.Exec(query, userID, command)
+	return err
+}
+
+// getCommandUsage returns the user's command counts, most used first
+func getCommandUsage(db *sql.DB, userID int64) ([]CommandUsage, error) {
+	query := `SELECT command, count, last_used_at FROM command_usage WHERE user_id = $1 ORDER BY count DESC, command`
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usage []CommandUsage
+	for rows.Next() {
+		var u CommandUsage
+		if err := rows.Scan(&u.Command, &u.Count, &u.LastUsedAt); err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+// UserStats summarizes a user's saved content for /stats
+type UserStats struct {
+	TotalMessages  int
+	MessagesByType map[MessageType]int
+	TagCount       int
+	FirstSavedAt   *time.Time // nil when nothing is saved
+}
+
+// getUserStats counts the user's messages, per type too, and tags, and finds
+// when the first message was saved
+func getUserStats(db *sql.DB, userID int64) (*UserStats, error) {
+	stats := &UserStats{MessagesByType: map[MessageType]int{}}
+
+	rows, err := db.Query(`SELECT message_type, COUNT(*) FROM messages WHERE user_id = $1 GROUP BY message_type`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count messages: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var messageType string
+		var count int
+		if err := rows.Scan(&messageType, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan message count: %v", err)
+		}
+		stats.MessagesByType[MessageType(messageType)] = count
+		stats.TotalMessages += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := db.QueryRow(`SELECT COUNT(*) FROM tags WHERE user_id = $1`, userID).Scan(&stats.TagCount); err != nil {
+		return nil, fmt.Errorf("failed to count tags: %v", err)
+	}
+
+	var firstSavedAt time.Time
+	err = db.QueryRow(`SELECT created_at FROM messages WHERE user_id = $1 ORDER BY created_at LIMIT 1`, userID).Scan(&firstSavedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to find first message: %v", err)
+	}
+	if err == nil {
+		stats.FirstSavedAt = &firstSavedAt
+	}
+	return stats, nil
+}
+
+// maxUntaggedRetentionDays caps the auto-delete threshold at about ten years
+const maxUntaggedRetentionDays = 3650
+
+// setUntaggedRetention sets how many days untagged messages are kept before
+// purgeOldUntagged deletes them. 0 turns auto-deletion off, which is the default.
+func setUntaggedRetention(db *sql.DB, userID int64, days int) error {
+	if days < 0 || days > maxUntaggedRetentionDays {
+		return fmt.Errorf("retention must be between 0 and %d days", maxUntaggedRetentionDays)
+	}
+
+	var value sql.NullInt64
+	if days > 0 {
+		value = sql.NullInt64{Int64: int64(days), Valid: true}
+	}
+
+	query := `UPDATE users SET untagged_retention_days = $2, updated_at = CURRENT_TIMESTAMP WHERE telegram_id = $1`
+	_, err := db.Exec(query, userID, value)
+	return err
+}
+
+// revokeMiniAppSessions moves the user's min_auth_date to now, so the mini-app
+// rejects any initData signed before it. Now is passed in UTC: CURRENT_TIMESTAMP
+// follows the database's time zone, which the mini-app's comparison doesn't.
+func revokeMiniAppSessions(db *sql.DB, userID int64) error {
+	query := `UPDATE users SET min_auth_date = $2, updated_at = CURRENT_TIMESTAMP WHERE telegram_id = $1`
+	_, err := db.Exec(query, userID, time.Now().UTC())
+	return err
+}
+
+// getUntaggedRetention returns the user's auto-delete threshold in days, 0 when off
+func getUntaggedRetention(db *sql.DB, userID int64) (int, error) {
+	var days sql.NullInt64
+	err := db.QueryRow(`SELECT untagged_retention_days FROM users WHERE telegram_id = $1`, userID).Scan(&days)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return int(days.Int64), err
+}
+
+// maxSearchResults bounds the matches searchMessages returns
+const maxSearchResults = 10
+
+// MessageResponse is a saved message as search results show it
+type MessageResponse struct {
+	ID                int64
+	TelegramMessageID int64
+	MessageType       MessageType
+	TextContent       *string
+	Caption           *string
+	Hashtags          []string
+	ForwardedFrom     *string
+	// OriginalLink is the t.me link of a forwarded public channel post, or ""
+	OriginalLink string
+	CreatedAt    time.Time
+}
+
+// searchMessages returns the user's newest messages matching query, at most
+// maxSearchResults. A query starting with "#" matches a hashtag; anything else
+// matches the whole text or caption. Both ignore case. The database does the
+// matching, except for text encrypted at rest: then rows are decoded and matched
+// one at a time as they arrive.
+func searchMessages(db *sql.DB, userID int64, query string) ([]MessageResponse, error) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	hashtag, isHashtag := strings.CutPrefix(query, "#")
+	if query == "" || (isHashtag && hashtag == "") {
+		return nil, nil
+	}
+
+	args := []interface{}{userID}
+	var filter, limit string
+	if !textcrypt.Enabled() {
+		// Messages saved before full_text only have their previews. Hashtags are
+		// matched in the array's text form, {go,"recipes"} with quotes around some
+		// items, which both Postgres and the SQLite tests produce.
+		if isHashtag {
+			args = append(args, "%,"+escapeLike(hashtag)+",%")
+			filter = ` AND replace(replace(replace(lower(CAST(hashtags AS TEXT)), '"', ''), '{', ','), '}', ',') LIKE $2 ESCAPE '\'`
+		} else {
+			args = append(args, "%"+escapeLike(query)+"%")
+			filter = ` AND lower(COALESCE(full_text, COALESCE(text_content, '') || ' ' || COALESCE(caption, ''))) LIKE $2 ESCAPE '\'`
+		}
+		limit = fmt.Sprintf(" LIMIT %d", maxSearchResults)
+	}
+
+	rows, err := db.Query(`
+		SELECT id, telegram_message_id, message_type, text_content, caption, full_text,
+			hashtags, forwarded_from, forwarded_chat_username, forwarded_message_id, created_at
+		FROM messages
+		WHERE user_id = $1`+filter+`
+		ORDER BY created_at DESC, id DESC`+limit, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %v", err)
+	}
+	defer rows.Close()
+
+	var results []MessageResponse
+	for len(results) < maxSearchResults && rows.Next() {
+		var msg MessageResponse
+		var messageType string
+		var textContent, caption, fullText, forwardedFrom, forwardedChatUsername sql.NullString
+		var forwardedMessageID sql.NullInt64
+		var hashtags pq.StringArray
+		if err := rows.Scan(&msg.ID, &msg.TelegramMessageID, &messageType, &textContent, &caption, &fullText,
+			&hashtags, &forwardedFrom, &forwardedChatUsername, &forwardedMessageID, &msg.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %v", err)
+		}
+		msg.MessageType = MessageType(messageType)
+		if msg.Hashtags, err = textcrypt.DecodeList(hashtags); err != nil {
+			return nil, fmt.Errorf("failed to decode hashtags of message %d: %v", msg.ID, err)
+		}
+
+		if isHashtag {
+			if !slices.ContainsFunc(msg.Hashtags, func(h string) bool { return strings.ToLower(h) == hashtag }) {
+				continue
+			}
+		}
+
+		if textContent, err = textcrypt.Decode(textContent); err != nil {
+			return nil, fmt.Errorf("failed to decode text of message %d: %v", msg.ID, err)
+		}
+		if caption, err = textcrypt.Decode(caption); err != nil {
+			return nil, fmt.Errorf("failed to decode caption of message %d: %v", msg.ID, err)
+		}
+
+		if !isHashtag {
+			if fullText, err = textcrypt.Decode(fullText); err != nil {
+				return nil, fmt.Errorf("failed to decode full text of message %d: %v", msg.ID, err)
+			}
+			// Messages saved before full_text only have their previews
+			text := fullText.String
+			if !fullText.Valid {
+				text = textContent.String + " " + caption.String
+			}
+			if !strings.Contains(strings.ToLower(text), query) {
+				continue
+			}
+		}
+
+		msg.TextContent = storage.NullStringPtr(textContent)
+		msg.Caption = storage.NullStringPtr(caption)
+		msg.ForwardedFrom = storage.NullStringPtr(forwardedFrom)
+		if forwardedChatUsername.Valid && forwardedMessageID.Valid {
+			msg.OriginalLink = originalMessageLink(forwardedChatUsername.String, forwardedMessageID.Int64)
+		}
+		results = append(results, msg)
+	}
+	return results, rows.Err()
+}
+
+// escapeLike escapes the LIKE wildcards in value, for patterns with ESCAPE '\'
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+// uniqueViolation is the Postgres error code for a unique constraint violation
+const uniqueViolation = "23505"
+
+// sqliteConstraintUnique is SQLite's extended code for the same, from the test database
+const sqliteConstraintUnique = 2067
+
+// isUniqueViolation reports whether err is a unique constraint violation
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == uniqueViolation
+	}
+	var sqliteErr interface{ Code() int }
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqliteConstraintUnique
+}
+
+// textArray encodes values as a Postgres text[], quoting elements that contain
+// commas or braces. No values is an empty array rather than NULL.
+func textArray(values []string) interface{} {
+	if values == nil {
+		values = []string{}
+	}
+	return pq.Array(values)
+}
+
+// setIgnoredMessageTypes sets the message types the bot doesn't save for the
+// user. An empty list saves everything, which is the default.
+func setIgnoredMessageTypes(db *sql.DB, userID int64, types []MessageType) error {
+	// NULL rather than an empty array, like users who never set it
+	var value interface{}
+	if len(types) > 0 {
+		names := make([]string, len(types))
+		for i, messageType := range types {
+			names[i] = string(messageType)
+		}
+		value = textArray(names)
+	}
+
+	query := `UPDATE users SET ignored_message_types = $2, updated_at = CURRENT_TIMESTAMP WHERE telegram_id = $1`
+	_, err := db.Exec(query, userID, value)
+	return err
+}
+
+// getIgnoredMessageTypes returns the message types the bot doesn't save for the user
+func getIgnoredMessageTypes(db *sql.DB, userID int64) ([]MessageType, error) {
+	var names pq.StringArray
+	err := db.QueryRow(`SELECT ignored_message_types FROM users WHERE telegram_id = $1`, userID).Scan(&names)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	types := make([]MessageType, len(names))
+	for i, name := range names {
+		types[i] = MessageType(name)
+	}
+	return types, nil
+}
+
+// isMessageTypeIgnored reports whether the user chose not to save messages of this type
+func isMessageTypeIgnored(db *sql.DB, userID int64, messageType MessageType) (bool, error) {
+	ignored, err := getIgnoredMessageTypes(db, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, t := range ignored {
+		if t == messageType {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// purgeOldUntagged deletes messages without any tag that are older than their
+// owner's untagged_retention_days. Users who haven't opted in are skipped. The
+// maintenance job runs it; it returns the number of deleted messages.
+func purgeOldUntagged(db *sql.DB) (int64, error) {
+	rows, err := db.Query(`SELECT telegram_id, untagged_retention_days FROM users WHERE untagged_retention_days > 0`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query retention settings: %v", err)
+	}
+
+	retention := make(map[int64]int)
+	for rows.Next() {
+		var userID int64
+		var days int
+		if err := rows.Scan(&userID, &days); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan retention setting: %v", err)
+		}
+		retention[userID] = days
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	now := time.Now().UTC()
+	var deleted int64
+	for userID, days := range retention {
+		cutoff := now.AddDate(0, 0, -days)
+		rows, err := db.Query(`
+			DELETE FROM messages
+			WHERE user_id = $1 AND created_at < $2
+			  AND NOT EXISTS (SELECT 1 FROM message_tags mt WHERE mt.message_id = messages.id)
+			RETURNING media_key`,
+			userID, cutoff)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to purge untagged messages of user %d: %v", userID, err)
+		}
+		var mediaKeys []string
+		for rows.Next() {
+			var key sql.NullString
+			if err := rows.Scan(&key); err != nil {
+				rows.Close()
+				return deleted, err
+			}
+			deleted++
+			if key.Valid {
+				mediaKeys = append(mediaKeys, key.String)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return deleted, err
+		}
+
+		// The same file saved twice shares its key, so keep objects still in use
+		unused, err := unusedMediaKeys(db, userID, mediaKeys)
+		if err != nil {
+			return deleted, err
+		}
+		mediaArchive.remove(unused)
+	}
+
+	return deleted, nil
+}
+
+// unusedMediaKeys returns the keys no remaining message of the user refers to
+func unusedMediaKeys(db *sql.DB, userID int64, keys []string) ([]string, error) {
+	var unused []string
+	for _, key := range keys {
+		var used bool
+		err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM messages WHERE user_id = $1 AND media_key = $2)`, userID, key).Scan(&used)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check media key: %v", err)
+		}
+		if !used {
+			unused = append(unused, key)
+		}
+	}
+	return unused, nil
+}
+
+// deleteAllUserData removes every message, tag and message-tag link owned by the
+// user, then the media archived for the messages. When removeUser is set the
+// user row is removed too.
+func deleteAllUserData(db *sql.DB, userID int64, removeUser bool) (storage.DeletedUserData, error) {
+	deleted, err := storage.DeleteUserData(db, userID, removeUser)
+	if err != nil {
+		return deleted, err
+	}
+	mediaArchive.remove(deleted.MediaKeys)
+	return deleted, nil
+}
+
+// generateForwardedTimes returns the forward date (always UTC, so it compares with
+// created_at regardless of the Lambda's zone) and a display name for the original sender.
 func generateForwardedTimes(message *tgbotapi.Message) (*time.Time, *string) {
 	var forwardedDate *time.Time
 	var forwardedFrom *string
-	if message.ForwardFrom != nil {
-		if message.ForwardDate != 0 {
-			date := time.Unix(int64(message.ForwardDate), 0)
-			forwardedDate = &date
-		}
-		from := message.ForwardFrom.FirstName
+
+	var from string
+	switch {
+	case message.ForwardFrom != nil:
+		from = message.ForwardFrom.FirstName
 		if message.ForwardFrom.LastName != "" {
 			from += " " + message.ForwardFrom.LastName
 		}
 		if message.ForwardFrom.UserName != "" {
 			from += " (@" + message.ForwardFrom.UserName + ")"
 		}
+	case message.ForwardFromChat != nil:
+		// Forwarded from a channel, or anonymously from a group
+		from = channelName(message.ForwardFromChat)
+	default:
+		return nil, nil
+	}
+
+	if message.ForwardDate != 0 {
+		date := time.Unix(int64(message.ForwardDate), 0).UTC()
+		forwardedDate = &date
+	}
+	if from != "" {
 		forwardedFrom = &from
 	}
 	return forwardedDate, forwardedFrom
 }
+
+// forwardedPost returns the public username and message ID of the channel post
+// a message was forwarded from, the parts of its t.me link. Posts from private
+// channels and forwards from users or groups have no link, so both are null.
+func forwardedPost(message *tgbotapi.Message) (sql.NullString, sql.NullInt64) {
+	chat := message.ForwardFromChat
+	if chat == nil || chat.UserName == "" || message.ForwardFromMessageID == 0 {
+		return sql.NullString{}, sql.NullInt64{}
+	}
+	return sql.NullString{String: chat.UserName, Valid: true},
+		sql.NullInt64{Int64: int64(message.ForwardFromMessageID), Valid: true}
+}
+
+// originalMessageLink is the t.me link to a public channel post
+func originalMessageLink(username string, messageID int64) string {
+	return fmt.Sprintf("https://t.me/%s/%d", username, messageID)
+}
+
+// channelName formats a chat as "Channel Name (@channelusername)", leaving out
+// whichever part it doesn't have
+func channelName(chat *tgbotapi.Chat) string {
+	switch {
+	case chat.Title != "" && chat.UserName != "":
+		return chat.Title + " (@" + chat.UserName + ")"
+	case chat.UserName != "":
+		return "@" + chat.UserName
+	default:
+		return chat.Title
+	}
+}
@@ -2,15 +2,20 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 	_ "modernc.org/sqlite"
+
+	"telegram-content-organizer-shared/storage"
 )
 
 // Test helper functions
@@ -48,6 +53,15 @@ func createTestForwardedMessage(messageID int, user *tgbotapi.User, text string,
 	return msg
 }
 
+// createTestChannelForwardedMessage creates a message forwarded from a channel post
+func createTestChannelForwardedMessage(chat *tgbotapi.Chat, forwardDate int) *tgbotapi.Message {
+	message := createTestMessageStruct(1, createTestUserStruct(123, "user", "Test", "User"), "channel post")
+	message.ForwardFromChat = chat
+	message.ForwardFromMessageID = 42
+	message.ForwardDate = forwardDate
+	return message
+}
+
 // createTestPhotoMessage creates a test message with photo
 func createTestPhotoMessage(messageID int, user *tgbotapi.User, caption string, photos ...tgbotapi.PhotoSize) *tgbotapi.Message {
 	return &tgbotapi.Message{
@@ -131,10 +145,40 @@ func TestTruncateText(t *testing.T) {
 		},
 		{
 			name:      "Unicode text",
-			text:      "Hello世界", 
-			maxLength: 8,
+			text:      "Hello世界",
+			maxLength: 6,
 			expected:  "Hello世...",
 		},
+		{
+			name:      "Unicode text within limit",
+			text:      "Hello世界",
+			maxLength: 7,
+			expected:  "Hello世界",
+		},
+		{
+			name:      "CJK at the boundary",
+			text:      "日本語のテキスト",
+			maxLength: 3,
+			expected:  "日本語...",
+		},
+		{
+			name:      "Emoji at the boundary",
+			text:      "Tagged 🎵🎸 music",
+			maxLength: 8,
+			expected:  "Tagged 🎵...",
+		},
+		{
+			name:      "Negative max length",
+			text:      "Hello",
+			maxLength: -1,
+			expected:  "...",
+		},
+		{
+			name:      "Empty text with zero max length",
+			text:      "",
+			maxLength: 0,
+			expected:  "",
+		},
 		{
 			name:      "Text with newlines and spaces",
 			text:      "Line 1\nLine 2\n\nLine 3",
@@ -153,10 +197,11 @@ func TestTruncateText(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			result := truncateText(tt.text, tt.maxLength)
 			assert.Equal(t, tt.expected, result)
-			
+			assert.True(t, utf8.ValidString(result), "Result must be valid UTF-8")
+
 			// Verify result doesn't exceed expected length (accounting for "...")
 			if tt.maxLength > 0 {
-				assert.LessOrEqual(t, len(result), tt.maxLength+3) // +3 for "..."
+				assert.LessOrEqual(t, utf8.RuneCountInString(result), tt.maxLength+3) // +3 for "..."
 			}
 		})
 	}
@@ -239,6 +284,30 @@ func TestGenerateForwardedTimes(t *testing.T) {
 			expectDate:       false,
 			expectedFromText: "Forward User (@forward_user)",
 		},
+		{
+			name:             "Forward from a public channel",
+			message:          createTestChannelForwardedMessage(&tgbotapi.Chat{ID: -100123, Type: "channel", Title: "Go News", UserName: "gonews"}, 1640995200),
+			expectDate:       true,
+			expectedFromText: "Go News (@gonews)",
+		},
+		{
+			name:             "Forward from a private channel",
+			message:          createTestChannelForwardedMessage(&tgbotapi.Chat{ID: -100456, Type: "channel", Title: "Family"}, 1640995200),
+			expectDate:       true,
+			expectedFromText: "Family",
+		},
+		{
+			name:             "Forward from a channel without a title",
+			message:          createTestChannelForwardedMessage(&tgbotapi.Chat{ID: -100789, Type: "channel", UserName: "untitled"}, 1640995200),
+			expectDate:       true,
+			expectedFromText: "@untitled",
+		},
+		{
+			name:             "Channel forward with zero timestamp",
+			message:          createTestChannelForwardedMessage(&tgbotapi.Chat{ID: -100123, Type: "channel", Title: "Go News", UserName: "gonews"}, 0),
+			expectDate:       false,
+			expectedFromText: "Go News (@gonews)",
+		},
 	}
 
 	for _, tt := range tests {
@@ -248,8 +317,9 @@ func TestGenerateForwardedTimes(t *testing.T) {
 			if tt.expectDate {
 				assert.NotNil(t, forwardedDate, "Expected forwarded date to be set")
 				if tt.message.ForwardDate != 0 {
-					expectedTime := time.Unix(int64(tt.message.ForwardDate), 0)
+					expectedTime := time.Unix(int64(tt.message.ForwardDate), 0).UTC()
 					assert.Equal(t, expectedTime, *forwardedDate)
+					assert.Equal(t, time.UTC, forwardedDate.Location(), "Forwarded date should be UTC")
 				}
 			} else {
 				assert.Nil(t, forwardedDate, "Expected forwarded date to be nil")
@@ -265,6 +335,24 @@ func TestGenerateForwardedTimes(t *testing.T) {
 	}
 }
 
+// TestUpsertUserFirstRun tests that only the first save of a user reports it as new
+func TestUpsertUserFirstRun(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	created, err := upsertUser(db, createTestUserStruct(123, "first", "First", "Run"))
+	assert.NoError(t, err)
+	assert.True(t, created, "first save should create the user")
+
+	created, err = upsertUser(db, createTestUserStruct(123, "returning", "Returning", "User"))
+	assert.NoError(t, err)
+	assert.False(t, created, "second save should update the existing user")
+
+	username, firstName, _, _ := getUserFromDB(t, db, 123)
+	assert.Equal(t, "returning", username.String)
+	assert.Equal(t, "Returning", firstName.String)
+}
+
 // TestSaveUser tests user persistence functionality
 func TestSaveUser(t *testing.T) {
 	tests := []struct {
@@ -363,6 +451,137 @@ func TestSaveUser(t *testing.T) {
 	}
 }
 
+// TestSetUserActive tests toggling a user's active status
+func TestSetUserActive(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	otherUser := createTestUserStruct(456, "other", "Other", "User")
+	assert.NoError(t, saveUser(db, user))
+	assert.NoError(t, saveUser(db, otherUser))
+
+	assert.NoError(t, setUserActive(db, user.ID, false))
+	_, _, _, isActive := getUserFromDB(t, db, user.ID)
+	assert.False(t, isActive)
+
+	_, _, _, otherActive := getUserFromDB(t, db, otherUser.ID)
+	assert.True(t, otherActive, "Other users should not be affected")
+
+	assert.NoError(t, setUserActive(db, user.ID, true))
+	_, _, _, isActive = getUserFromDB(t, db, user.ID)
+	assert.True(t, isActive)
+}
+
+// TestCommandUsage tests that command counts increment per invocation and stay per-user
+func TestCommandUsage(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	otherUserID := int64(456)
+	createTestUser(t, db, userID, "user")
+	createTestUser(t, db, otherUserID, "other")
+
+	for _, command := range []string{"help", "stats", "help", "HELP", "start"} {
+		assert.NoError(t, recordCommandUsage(db, userID, command))
+	}
+	assert.NoError(t, recordCommandUsage(db, otherUserID, "help"))
+
+	// Overlong commands are ignored
+	assert.NoError(t, recordCommandUsage(db, userID, strings.Repeat("x", maxCommandLength+1)))
+
+	usage, err := getCommandUsage(db, userID)
+	assert.NoError(t, err)
+	assert.Len(t, usage, 3)
+	assert.Equal(t, "help", usage[0].Command)
+	assert.Equal(t, 3, usage[0].Count)
+	assert.Equal(t, "start", usage[1].Command)
+	assert.Equal(t, 1, usage[1].Count)
+	assert.Equal(t, "stats", usage[2].Command)
+	assert.Equal(t, 1, usage[2].Count)
+
+	otherUsage, err := getCommandUsage(db, otherUserID)
+	assert.NoError(t, err)
+	assert.Len(t, otherUsage, 1)
+	assert.Equal(t, 1, otherUsage[0].Count)
+
+	// Reset removes the user's usage too
+	_, err = deleteAllUserData(db, userID, false)
+	assert.NoError(t, err)
+	usage, err = getCommandUsage(db, userID)
+	assert.NoError(t, err)
+	assert.Empty(t, usage)
+}
+
+func TestRawUpdateTTL(t *testing.T) {
+	t.Setenv("STORE_RAW_UPDATES", "")
+	_, enabled := rawUpdateTTL()
+	assert.False(t, enabled)
+
+	t.Setenv("STORE_RAW_UPDATES", "true")
+	ttl, enabled := rawUpdateTTL()
+	assert.True(t, enabled)
+	assert.Equal(t, defaultRawUpdateTTL, ttl)
+
+	t.Setenv("RAW_UPDATES_TTL_HOURS", "6")
+	ttl, _ = rawUpdateTTL()
+	assert.Equal(t, 6*time.Hour, ttl)
+
+	t.Setenv("RAW_UPDATES_TTL_HOURS", "-1")
+	ttl, _ = rawUpdateTTL()
+	assert.Equal(t, defaultRawUpdateTTL, ttl)
+}
+
+func TestRawUpdates(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	createTestUser(t, db, userID, "user")
+
+	body := `{"update_id": 1001}`
+	assert.NoError(t, saveRawUpdate(db, 1001, userID, body, time.Hour))
+
+	// Telegram redelivers updates; the first copy wins
+	assert.NoError(t, saveRawUpdate(db, 1001, userID, `{"update_id": 1001, "dup": true}`, time.Hour))
+
+	stored, err := getRawUpdate(db, 1001)
+	assert.NoError(t, err)
+	assert.Equal(t, body, stored)
+
+	// Expired updates are not returned and get purged by the maintenance job
+	assert.NoError(t, saveRawUpdate(db, 1002, userID, `{"update_id": 1002}`, -time.Minute))
+	_, err = getRawUpdate(db, 1002)
+	assert.Error(t, err)
+
+	deleted, err := purgeExpired(db)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	var count int
+	assert.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM raw_updates WHERE update_id = 1002`).Scan(&count))
+	assert.Equal(t, 0, count)
+
+	// Replaying a stored update with nothing to handle is a no-op
+	assert.NoError(t, replayRawUpdate(nil, db, 1001))
+	assert.Error(t, replayRawUpdate(nil, db, 9999))
+
+	// Raw updates follow the same deletion policy as the rest of the user's data
+	_, err = deleteAllUserData(db, userID, false)
+	assert.NoError(t, err)
+	assert.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM raw_updates WHERE user_id = $1`, userID).Scan(&count))
+	assert.Equal(t, 0, count)
+}
+
+func TestUpdateSenderID(t *testing.T) {
+	from := &tgbotapi.User{ID: 123}
+
+	assert.Equal(t, int64(123), updateSenderID(tgbotapi.Update{Message: &tgbotapi.Message{From: from}}))
+	assert.Equal(t, int64(123), updateSenderID(tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{From: from}}))
+	assert.Equal(t, int64(123), updateSenderID(tgbotapi.Update{MyChatMember: &tgbotapi.ChatMemberUpdated{From: *from}}))
+	assert.Equal(t, int64(0), updateSenderID(tgbotapi.Update{Message: &tgbotapi.Message{}}))
+}
+
 // TestSaveMessage tests message persistence functionality
 func TestSaveMessage(t *testing.T) {
 	tests := []struct {
@@ -462,6 +681,497 @@ func TestSaveMessage(t *testing.T) {
 	}
 }
 
+// TestSaveMessageSpoiler tests that spoiler media and text are flagged
+// TestSaveMessageFullText tests that full_text keeps the text up to MAX_STORED_TEXT
+func TestSaveMessageFullText(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+
+	getFullText := func(telegramMessageID int) (string, bool) {
+		var fullText string
+		var truncated bool
+		query := `SELECT full_text, text_truncated FROM messages WHERE user_id = ? AND telegram_message_id = ?`
+		assert.NoError(t, db.QueryRow(query, user.ID, telegramMessageID).Scan(&fullText, &truncated))
+		return fullText, truncated
+	}
+
+	// Within the default limit the whole text is kept
+	long := strings.Repeat("a", 1000)
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(1, user, long)))
+	fullText, truncated := getFullText(1)
+	assert.Equal(t, long, fullText)
+	assert.False(t, truncated)
+
+	// Captions are kept the same way
+	assert.NoError(t, saveMessage(db, createTestPhotoMessage(2, user, "a caption", tgbotapi.PhotoSize{FileID: "photo2"})))
+	fullText, truncated = getFullText(2)
+	assert.Equal(t, "a caption", fullText)
+	assert.False(t, truncated)
+
+	// Over MAX_STORED_TEXT the text is cut and flagged
+	t.Setenv("MAX_STORED_TEXT", "10")
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(3, user, "ééééééééééé and more")))
+	fullText, truncated = getFullText(3)
+	assert.Equal(t, "éééééééééé", fullText)
+	assert.True(t, truncated)
+}
+
+// TestSaveMessageLongText tests that a long note keeps both its list preview
+// and its whole text
+func TestSaveMessageLongText(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+
+	text := strings.Repeat("long note ", 200)
+	assert.Len(t, text, 2000)
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(1, user, text)))
+
+	var preview, fullText string
+	var truncated bool
+	query := `SELECT text_content, full_text, text_truncated FROM messages WHERE user_id = ? AND telegram_message_id = 1`
+	assert.NoError(t, db.QueryRow(query, user.ID).Scan(&preview, &fullText, &truncated))
+	assert.Equal(t, text[:150]+"...", preview)
+	assert.Equal(t, text, fullText)
+	assert.False(t, truncated)
+}
+
+// TestUpdateMessage tests that an edit refreshes the saved text in place
+func TestUpdateMessage(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+
+	original := createTestMessageStruct(1, user, "draft #todo https://old.example.com @alice")
+	assert.NoError(t, saveMessage(db, original))
+	var messageID int64
+	assert.NoError(t, db.QueryRow(`SELECT id FROM messages WHERE telegram_message_id = 1`).Scan(&messageID))
+	createTestMessageTag(t, db, messageID, createTestTag(t, db, user.ID, "work", ""))
+
+	edited := createTestMessageStruct(1, user, "final #done https://new.example.com "+strings.Repeat("x", 200))
+	assert.NoError(t, updateMessage(db, edited))
+
+	export, err := storage.ExportUserData(db, user.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, export.Messages, 1, "An edit doesn't insert a duplicate") {
+		message := export.Messages[0]
+		assert.Equal(t, messageID, message.ID)
+		assert.Equal(t, truncateText(edited.Text, 150), *message.TextContent)
+		assert.Equal(t, []string{"https://new.example.com"}, message.URLs)
+		assert.Equal(t, []string{"done"}, message.Hashtags)
+		assert.Empty(t, message.Mentions)
+		assert.Equal(t, []string{"work"}, message.Tags, "Tags are kept")
+	}
+	var fullText string
+	assert.NoError(t, db.QueryRow(`SELECT full_text FROM messages WHERE id = ?`, messageID).Scan(&fullText))
+	assert.Equal(t, edited.Text, fullText)
+
+	// A message that was never saved isn't created by its edit
+	assert.ErrorIs(t, updateMessage(db, createTestMessageStruct(2, user, "never saved")), sql.ErrNoRows)
+	assert.Equal(t, 1, countRows(t, db, "messages"))
+}
+
+func TestSearchMessages(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	other := createTestUserStruct(456, "other", "Other", "User")
+	assert.NoError(t, saveUser(db, user))
+	assert.NoError(t, saveUser(db, other))
+
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(1, user, "Pancakes #Recipes #breakfast")))
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(2, user, "Buy milk and eggs")))
+	assert.NoError(t, saveMessage(db, createTestPhotoMessage(3, user, "Soup for dinner #recipes", tgbotapi.PhotoSize{FileID: "soup"})))
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(4, user, strings.Repeat("long ", 40)+"hidden MILK at the end")))
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(5, user, "#recipesbook is another tag")))
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(1, other, "Someone else's milk #recipes")))
+
+	telegramIDs := func(query string) []int64 {
+		results, err := searchMessages(db, user.ID, query)
+		assert.NoError(t, err)
+		var ids []int64
+		for _, msg := range results {
+			ids = append(ids, msg.TelegramMessageID)
+		}
+		return ids
+	}
+
+	// Hashtags match whole tags, ignoring case; newest first
+	assert.Equal(t, []int64{3, 1}, telegramIDs("#RECIPES"))
+	assert.Nil(t, telegramIDs("#dinner"), "Words in the text aren't hashtags")
+
+	// Text matches substrings anywhere in the text or caption, ignoring case
+	assert.Equal(t, []int64{4, 2}, telegramIDs("milk"))
+	assert.Equal(t, []int64{3}, telegramIDs("soup FOR"))
+	assert.Nil(t, telegramIDs("nothing like this"))
+	assert.Nil(t, telegramIDs("#"))
+	assert.Nil(t, telegramIDs("m_lk"), "LIKE wildcards match literally")
+	assert.Nil(t, telegramIDs("%"))
+
+	results, err := searchMessages(db, user.ID, "soup")
+	assert.NoError(t, err)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, MessageTypePhoto, results[0].MessageType)
+		assert.Nil(t, results[0].TextContent)
+		assert.Equal(t, "Soup for dinner #recipes", *results[0].Caption)
+	}
+
+	// At most maxSearchResults are returned
+	for i := 10; i < 10+maxSearchResults; i++ {
+		assert.NoError(t, saveMessage(db, createTestMessageStruct(i, user, fmt.Sprintf("milk %d", i))))
+	}
+	assert.Len(t, telegramIDs("milk"), maxSearchResults)
+}
+
+func TestSaveMessageSpoiler(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+
+	getHasSpoiler := func(telegramMessageID int) bool {
+		var hasSpoiler bool
+		query := `SELECT has_spoiler FROM messages WHERE user_id = ? AND telegram_message_id = ?`
+		err := db.QueryRow(query, user.ID, telegramMessageID).Scan(&hasSpoiler)
+		assert.NoError(t, err)
+		return hasSpoiler
+	}
+
+	// Plain photo defaults to false
+	plainPhoto := createTestPhotoMessage(1, user, "", tgbotapi.PhotoSize{FileID: "photo1"})
+	assert.NoError(t, saveMessage(db, plainPhoto))
+	assert.False(t, getHasSpoiler(1))
+
+	// Spoiler photo (has_media_spoiler) is flagged after saving
+	spoilerPhoto := createTestPhotoMessage(2, user, "", tgbotapi.PhotoSize{FileID: "photo2"})
+	assert.NoError(t, saveMessage(db, spoilerPhoto))
+	assert.NoError(t, saveRawMessageFields(db, user.ID, spoilerPhoto.MessageID, RawMessageFields{HasMediaSpoiler: true}))
+	assert.True(t, getHasSpoiler(2))
+	assert.False(t, getHasSpoiler(1), "Other messages should not be flagged")
+
+	// Spoiler entity in the caption is flagged on save
+	captionSpoiler := createTestPhotoMessage(3, user, "plot twist", tgbotapi.PhotoSize{FileID: "photo3"})
+	captionSpoiler.CaptionEntities = []tgbotapi.MessageEntity{{Type: "spoiler", Offset: 0, Length: 10}}
+	assert.NoError(t, saveMessage(db, captionSpoiler))
+	assert.True(t, getHasSpoiler(3))
+}
+
+// TestSaveMessageQuotedReply tests that replies keep the replied-to message and quote
+func TestSaveMessageQuotedReply(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+
+	getReplyContext := func(telegramMessageID int) (sql.NullInt64, sql.NullString) {
+		var replyTo sql.NullInt64
+		var quote sql.NullString
+		query := `SELECT reply_to_message_id, quote_text FROM messages WHERE user_id = ? AND telegram_message_id = ?`
+		err := db.QueryRow(query, user.ID, telegramMessageID).Scan(&replyTo, &quote)
+		assert.NoError(t, err)
+		return replyTo, quote
+	}
+
+	// Plain message has no reply context
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(1, user, "Original note")))
+	replyTo, quote := getReplyContext(1)
+	assert.False(t, replyTo.Valid)
+	assert.False(t, quote.Valid)
+
+	// Quoted reply stores both the replied-to ID and the quote
+	body := []byte(`{"update_id":1,"message":{"message_id":2,"text":"Follow-up","reply_to_message":{"message_id":1},"quote":{"text":"Original","position":0}}}`)
+	reply := createTestMessageStruct(2, user, "Follow-up")
+	reply.ReplyToMessage = &tgbotapi.Message{MessageID: 1}
+
+	assert.NoError(t, saveMessage(db, reply))
+	assert.NoError(t, saveRawMessageFields(db, user.ID, reply.MessageID, parseRawMessageFields(body)))
+
+	replyTo, quote = getReplyContext(2)
+	assert.Equal(t, int64(1), replyTo.Int64)
+	assert.True(t, quote.Valid)
+	assert.Equal(t, "Original", quote.String)
+}
+
+// TestSaveMessageUnknownType tests that unrecognized messages are stored with a marker type
+func TestSaveMessageUnknownType(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+
+	message := createTestMessageStruct(1, user, "")
+	message.Dice = &tgbotapi.Dice{Emoji: "🎲", Value: 4}
+	assert.NoError(t, saveMessage(db, message))
+
+	var messageType string
+	var textContent sql.NullString
+	query := `SELECT message_type, text_content FROM messages WHERE user_id = ? AND telegram_message_id = ?`
+	assert.NoError(t, db.QueryRow(query, user.ID, 1).Scan(&messageType, &textContent))
+	assert.Equal(t, string(MessageTypeUnknown), messageType)
+	assert.False(t, textContent.Valid)
+}
+
+// TestSaveMessageLocation tests that locations and venues keep their coordinates
+func TestSaveMessageLocation(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+
+	location := createTestMessageStruct(1, user, "")
+	location.Location = &tgbotapi.Location{Latitude: 52.52, Longitude: 13.405}
+	assert.NoError(t, saveMessage(db, location))
+
+	venue := createTestMessageStruct(2, user, "")
+	venue.Location = &tgbotapi.Location{Latitude: 48.8584, Longitude: 2.2945}
+	venue.Venue = &tgbotapi.Venue{
+		Location: tgbotapi.Location{Latitude: 48.8584, Longitude: 2.2945},
+		Title:    "Eiffel Tower",
+		Address:  "Champ de Mars, Paris",
+	}
+	assert.NoError(t, saveMessage(db, venue))
+
+	var messageType string
+	var latitude, longitude sql.NullFloat64
+	var venueTitle, venueAddress sql.NullString
+	query := `SELECT message_type, latitude, longitude, venue_title, venue_address FROM messages WHERE user_id = ? AND telegram_message_id = ?`
+
+	assert.NoError(t, db.QueryRow(query, user.ID, 1).Scan(&messageType, &latitude, &longitude, &venueTitle, &venueAddress))
+	assert.Equal(t, string(MessageTypeLocation), messageType)
+	assert.Equal(t, 52.52, latitude.Float64)
+	assert.Equal(t, 13.405, longitude.Float64)
+	assert.False(t, venueTitle.Valid)
+	assert.False(t, venueAddress.Valid)
+
+	assert.NoError(t, db.QueryRow(query, user.ID, 2).Scan(&messageType, &latitude, &longitude, &venueTitle, &venueAddress))
+	assert.Equal(t, string(MessageTypeLocation), messageType)
+	assert.Equal(t, 48.8584, latitude.Float64)
+	assert.Equal(t, 2.2945, longitude.Float64)
+	assert.Equal(t, "Eiffel Tower", venueTitle.String)
+	assert.Equal(t, "Champ de Mars, Paris", venueAddress.String)
+
+	// Other messages have no coordinates
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(3, user, "Hello")))
+	assert.NoError(t, db.QueryRow(query, user.ID, 3).Scan(&messageType, &latitude, &longitude, &venueTitle, &venueAddress))
+	assert.False(t, latitude.Valid)
+	assert.False(t, longitude.Valid)
+}
+
+func TestSaveMessageStory(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+
+	body := `{"update_id":1,"message":{"message_id":1,"story":{"chat":{"id":-100123,"type":"channel"},"id":42}}}`
+	story := createTestMessageStruct(1, user, "")
+	assert.NoError(t, saveMessage(db, story))
+	assert.NoError(t, saveRawMessageFields(db, user.ID, story.MessageID, parseRawMessageFields([]byte(body))))
+
+	var messageType string
+	var storyChatID, storyID sql.NullInt64
+	query := `SELECT message_type, story_chat_id, story_id FROM messages WHERE user_id = ? AND telegram_message_id = ?`
+	assert.NoError(t, db.QueryRow(query, user.ID, 1).Scan(&messageType, &storyChatID, &storyID))
+	assert.Equal(t, string(MessageTypeStory), messageType)
+	assert.Equal(t, int64(-100123), storyChatID.Int64)
+	assert.Equal(t, int64(42), storyID.Int64)
+
+	// Other types keep their type and have no story reference
+	photo := createTestPhotoMessage(2, user, "", tgbotapi.PhotoSize{FileID: "photo"})
+	assert.NoError(t, saveMessage(db, photo))
+	assert.NoError(t, saveRawMessageFields(db, user.ID, photo.MessageID, RawMessageFields{HasMediaSpoiler: true}))
+	assert.NoError(t, db.QueryRow(query, user.ID, 2).Scan(&messageType, &storyChatID, &storyID))
+	assert.Equal(t, string(MessageTypePhoto), messageType)
+	assert.False(t, storyChatID.Valid)
+	assert.False(t, storyID.Valid)
+}
+
+// TestSaveMessageTwice tests that saving a message again updates its single row
+func TestSaveMessageTwice(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+
+	created, err := upsertMessage(db, createTestMessageStruct(1, user, "first"))
+	assert.NoError(t, err)
+	assert.True(t, created)
+	firstID, err := getMessageByTelegramID(db, user.ID, 1)
+	assert.NoError(t, err)
+	tagID := createTestTag(t, db, user.ID, "work", "")
+	_, err = tagMessage(db, firstID, tagID)
+	assert.NoError(t, err)
+
+	created, err = upsertMessage(db, createTestMessageStruct(1, user, "second"))
+	assert.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, 1, countRows(t, db, "messages"))
+
+	id, err := getMessageByTelegramID(db, user.ID, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, firstID, id, "The row keeps its ID, so tags stay attached")
+	assert.Equal(t, 1, countRows(t, db, "message_tags"))
+
+	var text string
+	assert.NoError(t, db.QueryRow(`SELECT text_content FROM messages WHERE id = ?`, id).Scan(&text))
+	assert.Equal(t, "second", text)
+
+	// The same Telegram message ID from another user is a different message
+	other := createTestUserStruct(456, "other", "Other", "User")
+	assert.NoError(t, saveUser(db, other))
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(1, other, "mine")))
+	otherID, err := getMessageByTelegramID(db, other.ID, 1)
+	assert.NoError(t, err)
+	assert.NotEqual(t, firstID, otherID)
+
+	// Imported messages are numbered in their own chat, so message 2 from an
+	// export is left alone when the bot saves its own message 2
+	_, err = db.Exec(`INSERT INTO messages (user_id, source_chat_id, telegram_message_id, message_type, text_content)
+		VALUES (?, 777, 2, 'text', 'imported')`, user.ID)
+	assert.NoError(t, err)
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(2, user, "from the bot")))
+	savedID, err := getMessageByTelegramID(db, user.ID, 2)
+	assert.NoError(t, err)
+	assert.NoError(t, db.QueryRow(`SELECT text_content FROM messages WHERE id = ?`, savedID).Scan(&text))
+	assert.Equal(t, "from the bot", text)
+	assert.NoError(t, db.QueryRow(`SELECT text_content FROM messages WHERE source_chat_id = 777`).Scan(&text))
+	assert.Equal(t, "imported", text)
+}
+
+// stubSaveMessage makes the first `failures` saves fail and counts the attempts
+func stubSaveMessage(t *testing.T, failures int) *int {
+	calls := 0
+	saveMessageFunc = func(db *sql.DB, message *tgbotapi.Message) (bool, error) {
+		calls++
+		if calls <= failures {
+			return false, errors.New("connection reset by peer")
+		}
+		return upsertMessage(db, message)
+	}
+	backoff := saveRetryBackoff
+	saveRetryBackoff = 0
+	t.Cleanup(func() {
+		saveMessageFunc = upsertMessage
+		saveRetryBackoff = backoff
+	})
+	return &calls
+}
+
+func countRows(t *testing.T, db *sql.DB, table string) int {
+	var count int
+	assert.NoError(t, db.QueryRow("SELECT COUNT(*) FROM "+table).Scan(&count))
+	return count
+}
+
+func TestSaveMessageWithRetry(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+
+	// The first insert fails, the retry succeeds
+	calls := stubSaveMessage(t, 1)
+	created, stashed, err := saveMessageWithRetry(db, createTestMessageStruct(1, user, "hello"))
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.False(t, stashed)
+	assert.Equal(t, 2, *calls)
+	assert.Equal(t, 1, countRows(t, db, "messages"))
+	assert.Equal(t, 0, countRows(t, db, "pending_messages"))
+
+	// Saving it again updates the row rather than creating one
+	created, stashed, err = saveMessageWithRetry(db, createTestMessageStruct(1, user, "hello again"))
+	assert.NoError(t, err)
+	assert.False(t, created)
+	assert.False(t, stashed)
+	assert.Equal(t, 1, countRows(t, db, "messages"))
+}
+
+func TestSaveMessageWithRetryStashes(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+
+	calls := stubSaveMessage(t, saveMessageAttempts)
+	created, stashed, err := saveMessageWithRetry(db, createTestMessageStruct(1, user, "keep me"))
+	assert.NoError(t, err)
+	assert.False(t, created)
+	assert.True(t, stashed)
+	assert.Equal(t, saveMessageAttempts, *calls)
+	assert.Equal(t, 0, countRows(t, db, "messages"))
+	assert.Equal(t, 1, countRows(t, db, "pending_messages"))
+
+	// The stashed message is saved once the database is back
+	saved, err := retryPendingMessages(db, user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, saved)
+	assert.Equal(t, 0, countRows(t, db, "pending_messages"))
+
+	var text string
+	assert.NoError(t, db.QueryRow(`SELECT text_content FROM messages WHERE telegram_message_id = 1`).Scan(&text))
+	assert.Equal(t, "keep me", text)
+}
+
+// TestSaveMessageTooLarge tests that values longer than their column are rejected
+// with a MessageTooLargeError before the insert, and never retried or stashed
+func TestSaveMessageTooLarge(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+
+	document := func(id int, fileName string) *tgbotapi.Message {
+		message := createTestMessageStruct(id, user, "")
+		message.Document = &tgbotapi.Document{FileID: "doc", FileName: fileName}
+		return message
+	}
+
+	// The limit counts characters, not bytes
+	assert.NoError(t, saveMessage(db, document(1, strings.Repeat("é", 255))))
+
+	err := saveMessage(db, document(2, strings.Repeat("a", 300)+".pdf"))
+	var tooLarge *MessageTooLargeError
+	if assert.ErrorAs(t, err, &tooLarge) {
+		assert.Equal(t, "file_name", tooLarge.Column)
+		assert.Equal(t, 304, tooLarge.Length)
+		assert.Equal(t, 255, tooLarge.Limit)
+	}
+
+	// Long text is cut to previews, never rejected
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(3, user, strings.Repeat("a", 10000))))
+
+	album := createTestPhotoMessage(4, user, "", tgbotapi.PhotoSize{FileID: "photo"})
+	album.MediaGroupID = strings.Repeat("1", 65)
+	assert.ErrorAs(t, saveMessage(db, album), &tooLarge)
+	assert.Equal(t, "media_group_id", tooLarge.Column)
+
+	calls := stubSaveMessage(t, 0)
+	_, stashed, err := saveMessageWithRetry(db, document(5, strings.Repeat("a", 300)))
+	assert.ErrorAs(t, err, &tooLarge)
+	assert.False(t, stashed)
+	assert.Equal(t, 1, *calls)
+	assert.Equal(t, 2, countRows(t, db, "messages"))
+	assert.Equal(t, 0, countRows(t, db, "pending_messages"))
+}
+
 // TestInitDB tests database initialization functionality
 func TestInitDB(t *testing.T) {
 	tests := []struct {
@@ -565,16 +1275,10 @@ func TestDatabaseEdgeCases(t *testing.T) {
 	})
 
 	t.Run("TruncateText with negative max length", func(t *testing.T) {
-		// This will panic as expected since the function uses text[:maxLength]
-		defer func() {
-			if r := recover(); r != nil {
-				assert.Contains(t, fmt.Sprintf("%v", r), "slice bounds out of range")
-			}
-		}()
-		
-		// This should panic - document the expected behavior
-		truncateText("Hello World", -1)
-		t.Error("Expected panic but function completed normally")
+		// A negative limit cuts everything rather than panicking
+		assert.NotPanics(t, func() {
+			assert.Equal(t, "...", truncateText("Hello World", -1))
+		})
 	})
 
 	t.Run("GenerateForwardedTimes with nil message", func(t *testing.T) {
@@ -670,6 +1374,32 @@ func TestDatabaseEdgeCases(t *testing.T) {
 	})
 }
 
+// TestSaveMessageArrayEscaping tests that URLs with commas and braces round-trip
+// as single array elements
+func TestSaveMessageArrayEscaping(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+
+	text := `Maps https://example.com/map?ll=55.75,37.62 and https://example.com/{id}/"quoted"/page @alice`
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(1, user, text)))
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(2, user, "no links")))
+
+	export, err := storage.ExportUserData(db, user.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, export.Messages, 2) {
+		assert.Equal(t, []string{"https://example.com/map?ll=55.75,37.62", `https://example.com/{id}/"quoted"/page`}, export.Messages[0].URLs)
+		assert.Equal(t, []string{"alice"}, export.Messages[0].Mentions)
+		assert.Empty(t, export.Messages[1].URLs)
+	}
+
+	var urls string
+	assert.NoError(t, db.QueryRow(`SELECT urls FROM messages WHERE telegram_message_id = 2`).Scan(&urls))
+	assert.Equal(t, "{}", urls, "No URLs is an empty array, not NULL")
+}
+
 // TestIntegrationWorkflows tests complete user and message save workflows
 func TestIntegrationWorkflows(t *testing.T) {
 	t.Run("Complete user and message workflow", func(t *testing.T) {
@@ -770,4 +1500,138 @@ func TestIntegrationWorkflows(t *testing.T) {
 			assert.Equal(t, 3, userMessages)
 		}
 	})
-}
\ No newline at end of file
+}
+// TestPurgeOldUntagged tests that only old untagged messages of opted-in users are deleted
+func TestPurgeOldUntagged(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	optedIn, optedOut := int64(123), int64(456)
+	createTestUser(t, db, optedIn, "opted_in")
+	createTestUser(t, db, optedOut, "opted_out")
+	assert.NoError(t, setUntaggedRetention(db, optedIn, 30))
+
+	insertMessage := func(userID, telegramMessageID int64, age time.Duration) int64 {
+		result, err := db.Exec(`INSERT INTO messages (user_id, telegram_message_id, message_type, created_at) VALUES (?, ?, 'text', ?)`,
+			userID, telegramMessageID, time.Now().UTC().Add(-age))
+		assert.NoError(t, err)
+		id, err := result.LastInsertId()
+		assert.NoError(t, err)
+		return id
+	}
+
+	day := 24 * time.Hour
+	oldUntagged := insertMessage(optedIn, 1, 40*day)
+	oldTagged := insertMessage(optedIn, 2, 40*day)
+	recentUntagged := insertMessage(optedIn, 3, 5*day)
+	otherUsersOld := insertMessage(optedOut, 1, 400*day)
+
+	tagID := createTestTag(t, db, optedIn, "keep", "")
+	_, err := tagMessage(db, oldTagged, tagID)
+	assert.NoError(t, err)
+
+	deleted, err := purgeOldUntagged(db)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+
+	exists := func(id int64) bool {
+		var count int
+		assert.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM messages WHERE id = ?`, id).Scan(&count))
+		return count == 1
+	}
+	assert.False(t, exists(oldUntagged))
+	assert.True(t, exists(oldTagged), "Tagged messages are never purged")
+	assert.True(t, exists(recentUntagged), "Messages newer than the threshold are kept")
+	assert.True(t, exists(otherUsersOld), "Users who didn't opt in are skipped")
+
+	// Turning the setting off stops further purges
+	assert.NoError(t, setUntaggedRetention(db, optedIn, 0))
+	insertMessage(optedIn, 4, 40*day)
+	deleted, err = purgeOldUntagged(db)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), deleted)
+}
+
+// TestAutoDeleteResponse tests the /autodelete setting command
+func TestAutoDeleteResponse(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	createTestUser(t, db, userID, "user")
+
+	assert.Contains(t, autoDeleteResponse(db, userID, ""), "Auto-delete is off")
+
+	assert.Contains(t, autoDeleteResponse(db, userID, " 30 "), "older than 30 days")
+	days, err := getUntaggedRetention(db, userID)
+	assert.NoError(t, err)
+	assert.Equal(t, 30, days)
+	assert.Contains(t, autoDeleteResponse(db, userID, ""), "deleted after 30 days")
+
+	for _, invalid := range []string{"0", "-5", "abc", "3651"} {
+		assert.Contains(t, autoDeleteResponse(db, userID, invalid), "Please give a number of days", invalid)
+	}
+	days, _ = getUntaggedRetention(db, userID)
+	assert.Equal(t, 30, days, "Invalid input leaves the setting unchanged")
+
+	assert.Contains(t, autoDeleteResponse(db, userID, "OFF"), "turned off")
+	days, err = getUntaggedRetention(db, userID)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, days)
+}
+
+// TestGetUserStats tests the counts behind /stats for mixed message types
+func TestGetUserStats(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	other := createTestUserStruct(456, "other", "Other", "User")
+	assert.NoError(t, saveUser(db, user))
+	assert.NoError(t, saveUser(db, other))
+
+	stats, err := getUserStats(db, user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, stats.TotalMessages)
+	assert.Empty(t, stats.MessagesByType)
+	assert.Nil(t, stats.FirstSavedAt)
+
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(1, user, "first")))
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(2, user, "second")))
+	assert.NoError(t, saveMessage(db, createTestPhotoMessage(3, user, "", tgbotapi.PhotoSize{FileID: "photo", Width: 90, Height: 90})))
+	document := createTestMessageStruct(4, user, "")
+	document.Document = &tgbotapi.Document{FileID: "doc", FileName: "report.pdf"}
+	assert.NoError(t, saveMessage(db, document))
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(1, other, "not mine")))
+	_, err = db.Exec(`UPDATE messages SET created_at = '2024-03-05 10:00:00' WHERE user_id = ? AND telegram_message_id = 2`, user.ID)
+	assert.NoError(t, err)
+
+	createTestTag(t, db, user.ID, "work", "")
+	createTestTag(t, db, user.ID, "music", "")
+	createTestTag(t, db, other.ID, "work", "")
+
+	stats, err = getUserStats(db, user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, stats.TotalMessages)
+	assert.Equal(t, map[MessageType]int{MessageTypeText: 2, MessageTypePhoto: 1, MessageTypeDocument: 1}, stats.MessagesByType)
+	assert.Equal(t, 2, stats.TagCount)
+	if assert.NotNil(t, stats.FirstSavedAt) {
+		assert.Equal(t, "2024-03-05", stats.FirstSavedAt.UTC().Format("2006-01-02"))
+	}
+}
+
+func TestIsUniqueViolation(t *testing.T) {
+	assert.True(t, isUniqueViolation(&pq.Error{Code: uniqueViolation}))
+	assert.True(t, isUniqueViolation(fmt.Errorf("rename: %w", &pq.Error{Code: uniqueViolation})))
+	assert.False(t, isUniqueViolation(&pq.Error{Code: "23503"}))
+	assert.False(t, isUniqueViolation(errors.New("UNIQUE constraint failed")))
+	assert.False(t, isUniqueViolation(nil))
+
+	db := setupTestDB(t)
+	defer db.Close()
+	createTestUser(t, db, 123, "testuser")
+	_, err := db.Exec(`INSERT INTO tags (user_id, name) VALUES (123, 'work')`)
+	assert.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO tags (user_id, name) VALUES (123, 'Work')`)
+	assert.True(t, isUniqueViolation(err), "SQLite: %v", err)
+}
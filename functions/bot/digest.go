@@ -0,0 +1,275 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Digest frequencies users can opt into with /digest
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// maxDigestTags is how many trending tags a digest lists
+const maxDigestTags = 5
+
+// digestPeriod returns how far back a digest of the given frequency looks
+func digestPeriod(frequency string) (time.Duration, bool) {
+	switch frequency {
+	case DigestDaily:
+		return 24 * time.Hour, true
+	case DigestWeekly:
+		return 7 * 24 * time.Hour, true
+	default:
+		return 0, false
+	}
+}
+
+// setDigestFrequency opts the user into daily or weekly digests; "" opts out,
+// which is the default
+func setDigestFrequency(db *sql.DB, userID int64, frequency string) error {
+	var value sql.NullString
+	if frequency != "" {
+		if _, ok := digestPeriod(frequency); !ok {
+			return fmt.Errorf("unknown digest frequency: %s", frequency)
+		}
+		value = sql.NullString{String: frequency, Valid: true}
+	}
+
+	query := `UPDATE users SET digest_frequency = $2, updated_at = CURRENT_TIMESTAMP WHERE telegram_id = $1`
+	_, err := db.Exec(query, userID, value)
+	return err
+}
+
+// getDigestFrequency returns the user's digest frequency, "" when not opted in
+func getDigestFrequency(db *sql.DB, userID int64) (string, error) {
+	var frequency sql.NullString
+	err := db.QueryRow(`SELECT digest_frequency FROM users WHERE telegram_id = $1`, userID).Scan(&frequency)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return frequency.String, err
+}
+
+// digestTypeCount is the number of new saves of one message type
+type digestTypeCount struct {
+	Type  MessageType
+	Count int
+}
+
+// digestTagCount is how often a tag was applied during the digest period
+type digestTagCount struct {
+	Name  string
+	Count int
+}
+
+// buildDigest summarizes the user's activity since the given time: how many
+// messages were saved (by type), how many of them are still untagged, and the
+// tags applied most often. It returns "" when there was no activity, so
+// callers can skip sending.
+func buildDigest(db *sql.DB, userID int64, since time.Time) (string, error) {
+	typeRows, err := db.Query(`
+		SELECT message_type, COUNT(*) FROM messages
+		WHERE user_id = $1 AND created_at >= $2
+		GROUP BY message_type`, userID, since)
+	if err != nil {
+		return "", fmt.Errorf("failed to count new messages: %v", err)
+	}
+	var types []digestTypeCount
+	total := 0
+	for typeRows.Next() {
+		var t digestTypeCount
+		if err := typeRows.Scan(&t.Type, &t.Count); err != nil {
+			typeRows.Close()
+			return "", fmt.Errorf("failed to scan message count: %v", err)
+		}
+		types = append(types, t)
+		total += t.Count
+	}
+	typeRows.Close()
+	if err := typeRows.Err(); err != nil {
+		return "", err
+	}
+
+	var untagged int
+	err = db.QueryRow(`
+		SELECT COUNT(*) FROM messages m
+		WHERE m.user_id = $1 AND m.created_at >= $2
+		  AND NOT EXISTS (SELECT 1 FROM message_tags mt WHERE mt.message_id = m.id)`, userID, since).Scan(&untagged)
+	if err != nil {
+		return "", fmt.Errorf("failed to count untagged messages: %v", err)
+	}
+
+	tagRows, err := db.Query(`
+		SELECT t.name, COUNT(*) FROM message_tags mt
+		JOIN tags t ON t.id = mt.tag_id
+		WHERE t.user_id = $1 AND mt.created_at >= $2
+		GROUP BY t.id, t.name`, userID, since)
+	if err != nil {
+		return "", fmt.Errorf("failed to count tag usage: %v", err)
+	}
+	var tags []digestTagCount
+	for tagRows.Next() {
+		var t digestTagCount
+		if err := tagRows.Scan(&t.Name, &t.Count); err != nil {
+			tagRows.Close()
+			return "", fmt.Errorf("failed to scan tag usage: %v", err)
+		}
+		tags = append(tags, t)
+	}
+	tagRows.Close()
+	if err := tagRows.Err(); err != nil {
+		return "", err
+	}
+
+	if total == 0 && len(tags) == 0 {
+		return "", nil
+	}
+	return formatDigest(since, types, untagged, tags), nil
+}
+
+// formatDigest renders the digest text. Counts are listed most frequent first,
+// ties by name, so the text is stable for the same data.
+func formatDigest(since time.Time, types []digestTypeCount, untagged int, tags []digestTagCount) string {
+	sort.Slice(types, func(i, j int) bool {
+		if types[i].Count != types[j].Count {
+			return types[i].Count > types[j].Count
+		}
+		return types[i].Type < types[j].Type
+	})
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+		return tags[i].Name < tags[j].Name
+	})
+
+	total := 0
+	for _, t := range types {
+		total += t.Count
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "📬 Your digest since %s\n\n", since.UTC().Format("Mon, Jan 2"))
+
+	switch total {
+	case 0:
+		b.WriteString("No new saves.\n")
+	case 1:
+		b.WriteString("You saved 1 message")
+	default:
+		fmt.Fprintf(&b, "You saved %d messages", total)
+	}
+	if total > 0 {
+		parts := make([]string, len(types))
+		for i, t := range types {
+			parts[i] = fmt.Sprintf("%s %d", typeEmoji(t.Type), t.Count)
+		}
+		fmt.Fprintf(&b, ": %s\n", strings.Join(parts, " · "))
+	}
+	if untagged > 0 {
+		fmt.Fprintf(&b, "%d still untagged. Tag them so they're easy to find later.\n", untagged)
+	}
+
+	if len(tags) > 0 {
+		b.WriteString("\n🔥 Trending tags:\n")
+		for i, t := range tags {
+			if i == maxDigestTags {
+				break
+			}
+			fmt.Fprintf(&b, "• %s +%d\n", t.Name, t.Count)
+		}
+	}
+
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// digestResponse handles "/digest <daily|weekly|off>". Without arguments it shows
+// the current setting.
+func digestResponse(db *sql.DB, userID int64, args string) string {
+	args = strings.ToLower(strings.TrimSpace(args))
+
+	if args == "" {
+		frequency, err := getDigestFrequency(db, userID)
+		if err != nil {
+			userLogger(userID).Error("Error getting digest setting", "error", err)
+			return "Sorry, I couldn't load your digest setting."
+		}
+		if frequency == "" {
+			return "Digests are off. Use /digest daily or /digest weekly to get a summary of your saves."
+		}
+		return fmt.Sprintf("You get a %s digest. Use /digest off to stop it.", frequency)
+	}
+
+	frequency := ""
+	if args != "off" {
+		if _, ok := digestPeriod(args); !ok {
+			return "Please choose daily, weekly or off."
+		}
+		frequency = args
+	}
+
+	if err := setDigestFrequency(db, userID, frequency); err != nil {
+		userLogger(userID).Error("Error saving digest setting", "error", err)
+		return "Sorry, I couldn't save your digest setting. Please try again."
+	}
+
+	if frequency == "" {
+		return "📬 Digests turned off."
+	}
+	return fmt.Sprintf("📬 You'll get a %s digest of your saves and trending tags.", frequency)
+}
+
+// sendDigests sends the digest to every user opted into the given frequency who
+// had activity during the period. The maintenance job runs it for the frequency
+// its trigger names; it returns the number of digests sent.
+func sendDigests(bot *tgbotapi.BotAPI, db *sql.DB, frequency string) (int, error) {
+	period, ok := digestPeriod(frequency)
+	if !ok {
+		return 0, fmt.Errorf("unknown digest frequency: %s", frequency)
+	}
+
+	rows, err := db.Query(`SELECT telegram_id FROM users WHERE digest_frequency = $1 AND is_active = true`, frequency)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query digest subscribers: %v", err)
+	}
+	var userIDs []int64
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan digest subscriber: %v", err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	since := time.Now().UTC().Add(-period)
+	sent := 0
+	for _, userID := range userIDs {
+		text, err := buildDigest(db, userID, since)
+		if err != nil {
+			userLogger(userID).Error("Error building digest", "error", err)
+			continue
+		}
+		if text == "" {
+			continue
+		}
+		// Private chats share the user's ID
+		if _, err := bot.Send(tgbotapi.NewMessage(userID, text)); err != nil {
+			userLogger(userID).Error("Error sending digest", "error", err)
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestBuildDigest tests the digest summary for seeded activity
+func TestBuildDigest(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID, otherID := int64(123), int64(456)
+	createTestUser(t, db, userID, "digest_user")
+	createTestUser(t, db, otherID, "other_user")
+
+	now := time.Now().UTC()
+	since := now.Add(-7 * 24 * time.Hour)
+
+	insertMessage := func(userID, telegramMessageID int64, messageType MessageType, createdAt time.Time) int64 {
+		result, err := db.Exec(`INSERT INTO messages (user_id, telegram_message_id, message_type, created_at) VALUES (?, ?, ?, ?)`,
+			userID, telegramMessageID, string(messageType), createdAt)
+		assert.NoError(t, err)
+		id, err := result.LastInsertId()
+		assert.NoError(t, err)
+		return id
+	}
+	tag := func(messageID, tagID int64, createdAt time.Time) {
+		_, err := db.Exec(`INSERT INTO message_tags (message_id, tag_id, created_at) VALUES (?, ?, ?)`, messageID, tagID, createdAt)
+		assert.NoError(t, err)
+	}
+
+	work := createTestTag(t, db, userID, "work", "")
+	music := createTestTag(t, db, userID, "music", "")
+	old := createTestTag(t, db, userID, "old", "")
+
+	recent := now.Add(-time.Hour)
+	text1 := insertMessage(userID, 1, MessageTypeText, recent)
+	text2 := insertMessage(userID, 2, MessageTypeText, recent)
+	photo := insertMessage(userID, 3, MessageTypePhoto, recent)
+	insertMessage(userID, 4, MessageTypeText, recent) // untagged
+	oldMessage := insertMessage(userID, 5, MessageTypeDocument, now.Add(-30*24*time.Hour))
+	insertMessage(otherID, 1, MessageTypeVideo, recent)
+
+	tag(text1, work, recent)
+	tag(text2, work, recent)
+	tag(photo, music, recent)
+	tag(oldMessage, old, now.Add(-30*24*time.Hour))
+	// Tagging an old message during the period still counts towards trending tags
+	tag(oldMessage, music, recent)
+
+	digest, err := buildDigest(db, userID, since)
+	assert.NoError(t, err)
+	assert.Equal(t, "📬 Your digest since "+since.Format("Mon, Jan 2")+"\n\n"+
+		"You saved 4 messages: 💬 3 · 📷 1\n"+
+		"1 still untagged. Tag them so they're easy to find later.\n\n"+
+		"🔥 Trending tags:\n"+
+		"• music +2\n"+
+		"• work +2", digest)
+	assert.NotContains(t, digest, "old")
+	assert.NotContains(t, digest, "🎥", "Other users' saves are not counted")
+
+	t.Run("No activity", func(t *testing.T) {
+		digest, err := buildDigest(db, userID, now.Add(time.Minute))
+		assert.NoError(t, err)
+		assert.Equal(t, "", digest)
+	})
+}
+
+// TestFormatDigest tests digest formatting edge cases
+func TestFormatDigest(t *testing.T) {
+	since := time.Date(2025, 1, 6, 9, 0, 0, 0, time.UTC)
+
+	t.Run("Single save without tags", func(t *testing.T) {
+		digest := formatDigest(since, []digestTypeCount{{Type: MessageTypeVoice, Count: 1}}, 0, nil)
+		assert.Equal(t, "📬 Your digest since Mon, Jan 6\n\nYou saved 1 message: 🎤 1", digest)
+	})
+
+	t.Run("Only tagging activity", func(t *testing.T) {
+		digest := formatDigest(since, nil, 0, []digestTagCount{{Name: "work", Count: 3}})
+		assert.Equal(t, "📬 Your digest since Mon, Jan 6\n\nNo new saves.\n\n🔥 Trending tags:\n• work +3", digest)
+	})
+
+	t.Run("Trending tags are capped", func(t *testing.T) {
+		var tags []digestTagCount
+		for i := 0; i < maxDigestTags+3; i++ {
+			tags = append(tags, digestTagCount{Name: string(rune('a' + i)), Count: i + 1})
+		}
+		digest := formatDigest(since, nil, 0, tags)
+		assert.Contains(t, digest, "• h +8")
+		assert.NotContains(t, digest, "• c +3")
+	})
+}
+
+// TestDigestResponse tests the /digest setting command
+func TestDigestResponse(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	createTestUser(t, db, userID, "digest_user")
+
+	assert.Contains(t, digestResponse(db, userID, ""), "Digests are off")
+
+	assert.Contains(t, digestResponse(db, userID, "Weekly"), "weekly digest")
+	frequency, err := getDigestFrequency(db, userID)
+	assert.NoError(t, err)
+	assert.Equal(t, DigestWeekly, frequency)
+	assert.Contains(t, digestResponse(db, userID, ""), "You get a weekly digest")
+
+	assert.Equal(t, "Please choose daily, weekly or off.", digestResponse(db, userID, "hourly"))
+	frequency, err = getDigestFrequency(db, userID)
+	assert.NoError(t, err)
+	assert.Equal(t, DigestWeekly, frequency, "Invalid input keeps the current setting")
+
+	assert.Equal(t, "📬 Digests turned off.", digestResponse(db, userID, "off"))
+	frequency, err = getDigestFrequency(db, userID)
+	assert.NoError(t, err)
+	assert.Equal(t, "", frequency)
+
+	assert.Error(t, setDigestFrequency(db, userID, "monthly"))
+}
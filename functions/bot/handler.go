@@ -2,50 +2,134 @@ package main
 
 import (
 	"database/sql"
-	"log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"telegram-content-organizer-shared/storage"
 )
 
-func handleMessage(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB) {
-	log.Printf("[%s] %s", message.From.UserName, message.Text)
+// handleMessage handles a private or group message. updateID is quoted to the
+// user as a reference when something fails.
+func handleMessage(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB, updateID int) {
+	logger := messageLogger(message).With("update_id", updateID)
+
+	// Service messages and some system updates come without a sender or chat
+	if message.From == nil || message.Chat == nil {
+		logger.Info("Skipping message without sender or chat")
+		return
+	}
+
+	// Message text is personal, so it's only logged on request
+	withText(logger.With("username", message.From.UserName), "text", message.Text).Info("Received message")
+
+	// Personal notes only make sense in private chats
+	if !isPrivateChat(message.Chat) {
+		handleGroupMessage(bot, message)
+		return
+	}
 
 	// Save user to database
-	if err := saveUser(db, message.From); err != nil {
-		log.Printf("Error saving user: %v", err)
+	firstRun, err := upsertUser(db, message.From)
+	if err != nil {
+		logger.Error("Error saving user", "error", err)
+	}
+
+	// Save anything stashed during an earlier database outage
+	if saved, err := retryPendingMessages(db, message.From.ID); err != nil {
+		logger.Error("Error retrying pending messages", "error", err)
+	} else if saved > 0 {
+		logger.Info("Saved pending messages", "count", saved)
+	}
+
+	// Optionally keep command messages (e.g. "/todo buy milk") as regular notes
+	if note := commandNote(message); note != nil {
+		message = note
 	}
 
 	var responseText string
 
 	if message.IsCommand() {
-		switch message.Command() {
-		case "start":
-			responseText = "Hello! I'm your Telegram Content Organizer bot. Send me any message or forward content to me!"
-		case "help":
-			responseText = "Available commands:\n/start - Get started\n/help - Show this help message\n/miniapp - Open mini-app to view your tags\n\nYou can also send me any message or forward content to me."
-		case "miniapp":
-			sendMiniAppButton(bot, message)
-			return
-		default:
+		if err := recordCommandUsage(db, message.From.ID, message.Command()); err != nil {
+			logger.Error("Error recording command usage", "error", err)
+		}
+
+		command := findCommand(message.Command())
+		if command == nil {
 			responseText = "Unknown command. Use /help to see available commands."
+		} else {
+			responseText = command.handle(commandCall{bot: bot, message: message, db: db, firstRun: firstRun})
+			if responseText == "" {
+				// The command sent its own reply
+				return
+			}
 		}
 	} else {
+		// Check if this is a reply to our reset confirmation prompt
+		if isReplyToBot(message) && strings.Contains(message.ReplyToMessage.Text, resetPromptMarker) {
+			handleResetConfirmation(bot, message, db)
+			return
+		}
+
+		// Check if this is a reply to our /deletemydata confirmation prompt
+		if isReplyToBot(message) && strings.Contains(message.ReplyToMessage.Text, deleteMyDataPromptMarker) {
+			handleDeleteMyDataConfirmation(bot, message, db)
+			return
+		}
+
+		// Check if this is a reply to our delete tag prompt
+		if isReplyToBot(message) && strings.Contains(message.ReplyToMessage.Text, deleteTagPromptMarker) {
+			handleDeleteTagReply(bot, message, db)
+			return
+		}
+
+		// Check if this is a reply to our /renametag prompt
+		if isReplyToBot(message) && strings.Contains(message.ReplyToMessage.Text, renameTagCommandMarker) {
+			handleRenameTagCommandReply(bot, message, db)
+			return
+		}
+
+		// Check if this is a reply to our rename prompt
+		if isReplyToBot(message) && strings.HasPrefix(message.ReplyToMessage.Text, renameTagPromptText) {
+			handleRenameTagReply(bot, message, db)
+			return
+		}
+
 		// Check if this is a reply to our tag selection message
-		if message.ReplyToMessage != nil && message.ReplyToMessage.From.IsBot {
-			// Check if the reply is to a tag selection message by checking message content
-			if strings.Contains(message.ReplyToMessage.Text, "Choose a tag by typing") ||
-				strings.Contains(message.ReplyToMessage.Text, "You don't have any tags yet") ||
-				strings.Contains(message.ReplyToMessage.Text, "[MSG_ID:") {
-				handleTagSelection(bot, message, db)
-				return
-			}
+		if isTagSelectionReply(message) {
+			handleTagSelection(bot, message, db)
+			return
 		}
 
-		// Save message to database for all non-command messages
-		if err := saveMessage(db, message); err != nil {
-			log.Printf("Error saving message: %v", err)
-			responseText = "Sorry, I couldn't save your message. Please try again."
+		// Save message to database for all non-command messages, except types the user ignores
+		if messageType, ignored := ignoredMessageType(db, message); ignored {
+			responseText = fmt.Sprintf("Ignored (%s). Use /ignore to choose which types are saved.", strings.ReplaceAll(string(messageType), "_", " "))
+		} else if created, stashed, err := saveMessageWithRetry(db, message); err != nil {
+			logger.Error("Error saving message", "error", err)
+			var tooLarge *MessageTooLargeError
+			if errors.As(err, &tooLarge) {
+				responseText = "That message is too large for me to store."
+			} else {
+				responseText = saveFailedText(updateID)
+			}
+		} else if stashed {
+			responseText = "I couldn't save your message right now, but I kept it and will save it automatically with your next message."
+		} else if !created {
+			// A redelivered update; its first delivery already showed the tag prompt
+			return
+		} else if isLaterAlbumItem(db, message) {
+			// The album's first item already shows the tag prompt for all of it
+			return
 		} else {
 			// Show tag selection after saving message
 			showTagSelection(bot, message, db)
@@ -57,28 +141,594 @@ func handleMessage(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB)
 	msg.ReplyToMessageID = message.MessageID
 
 	if _, err := bot.Send(msg); err != nil {
-		log.Printf("Error sending message: %v", err)
+		logger.Error("Error sending message", "error", err)
+	}
+}
+
+// saveFailedText tells the user their message was not saved. The reference is the
+// update ID, which finds the failure in the logs.
+func saveFailedText(updateID int) string {
+	return fmt.Sprintf("❌ Sorry, I couldn't save your message. Please send it again.\nIf this keeps happening, mention reference #%d when reporting it.", updateID)
+}
+
+// isReplyToBot reports whether the message replies to a bot's message. The replied-to
+// message has no From for channel posts and some service messages.
+func isReplyToBot(message *tgbotapi.Message) bool {
+	return message.ReplyToMessage != nil && message.ReplyToMessage.From != nil && message.ReplyToMessage.From.IsBot
+}
+
+// isTagSelectionReply reports whether the message answers a tag selection prompt.
+// Only plain text counts as an answer: tag names and list numbers are typed. A
+// photo, sticker or any other non-text message sent as a reply is new content,
+// so it falls through to the normal save and tag flow instead.
+func isTagSelectionReply(message *tgbotapi.Message) bool {
+	if !isReplyToBot(message) {
+		return false
+	}
+
+	// Check if the reply is to a tag selection message by checking message content
+	prompt := message.ReplyToMessage.Text
+	if !strings.Contains(prompt, "Choose a tag by typing") &&
+		!strings.Contains(prompt, "You don't have any tags yet") &&
+		!strings.Contains(prompt, "[MSG_ID:") {
+		return false
+	}
+
+	return getMessageType(message) == MessageTypeText
+}
+
+// saveCommandsEnabled reports whether SAVE_COMMANDS is set to a true value
+func saveCommandsEnabled() bool {
+	enabled, err := strconv.ParseBool(os.Getenv("SAVE_COMMANDS"))
+	return err == nil && enabled
+}
+
+// commandNote returns a copy of a command message with the command stripped so it
+// can be saved as a note. It returns nil when SAVE_COMMANDS is off, the message is
+// not a command, the command is one of the bot's own in botCommands, or nothing
+// follows the command.
+func commandNote(message *tgbotapi.Message) *tgbotapi.Message {
+	if !saveCommandsEnabled() || !message.IsCommand() {
+		return nil
+	}
+
+	if findCommand(message.Command()) != nil {
+		return nil
+	}
+
+	text := strings.TrimSpace(message.CommandArguments())
+	if text == "" {
+		return nil
+	}
+
+	note := *message
+	note.Text = text
+	note.Entities = nil
+	return &note
+}
+
+// defaultWelcomeMessage is the /start reply for returning users unless WELCOME_MESSAGE overrides it
+const defaultWelcomeMessage = "Hello! I'm your Telegram Content Organizer bot. Send me any message or forward content to me!"
+
+// defaultOnboardingMessage is the /start reply for new users unless ONBOARDING_MESSAGE overrides it
+const defaultOnboardingMessage = "👋 Welcome to the Telegram Content Organizer!\n\n" +
+	"1. Send or forward me anything: notes, links, photos, videos, documents.\n" +
+	"2. Pick a tag from the buttons I reply with, or create a new one.\n" +
+	"3. Browse everything by tag in the mini-app: tap the Menu Button (☰) next to the message field, or use /miniapp.\n\n" +
+	"Use /help to see all commands."
+
+// welcomeMessage returns the /start reply: the extended onboarding on a user's
+// first /start, the short welcome afterwards
+func welcomeMessage(firstRun bool) string {
+	if firstRun {
+		if message := os.Getenv("ONBOARDING_MESSAGE"); message != "" {
+			return message
+		}
+		return defaultOnboardingMessage
+	}
+	if message := os.Getenv("WELCOME_MESSAGE"); message != "" {
+		return message
+	}
+	return defaultWelcomeMessage
+}
+
+// defaultGroupChatReply is sent to commands in groups unless GROUP_CHAT_REPLY overrides it
+const defaultGroupChatReply = "I only work in direct messages. Open a private chat with me to save and tag your content."
+
+func groupChatReply() string {
+	if reply := os.Getenv("GROUP_CHAT_REPLY"); reply != "" {
+		return reply
+	}
+	return defaultGroupChatReply
+}
+
+func isPrivateChat(chat *tgbotapi.Chat) bool {
+	return chat != nil && chat.IsPrivate()
+}
+
+// handleGroupMessage answers commands in group chats and ignores everything else,
+// so the bot doesn't reply to every message when group privacy mode is off
+func handleGroupMessage(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
+	if !message.IsCommand() {
+		return
+	}
+
+	msg := tgbotapi.NewMessage(message.Chat.ID, groupChatReply())
+	msg.ReplyToMessageID = message.MessageID
+
+	if _, err := bot.Send(msg); err != nil {
+		messageLogger(message).Error("Error sending group reply", "error", err)
+	}
+}
+
+// handleEditedMessage keeps a saved message's text in sync when the user edits it.
+// Edits of messages the bot never saved, like commands, are ignored.
+func handleEditedMessage(message *tgbotapi.Message, db *sql.DB) {
+	if !isPrivateChat(message.Chat) || message.From == nil {
+		return
+	}
+
+	logger := slog.Default().With("update_type", "edited_message", "user_id", message.From.ID, "message_id", message.MessageID)
+	err := updateMessage(db, message)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.Info("Ignoring edit of unsaved message")
+		return
+	}
+	if err != nil {
+		logger.Error("Error updating edited message", "error", err)
+		return
+	}
+	countMetric("messages_edited")
+}
+
+// Membership changes reported by membershipChange
+const (
+	membershipAdded   = "added"
+	membershipRemoved = "removed"
+)
+
+func isActiveMemberStatus(status string) bool {
+	switch status {
+	case "creator", "administrator", "member", "restricted":
+		return true
+	}
+	return false
+}
+
+// membershipChange reports whether the bot was added to or removed from a chat,
+// or "" when the update doesn't change membership (e.g. a permissions change)
+func membershipChange(update *tgbotapi.ChatMemberUpdated) string {
+	wasMember := isActiveMemberStatus(update.OldChatMember.Status)
+	isMember := isActiveMemberStatus(update.NewChatMember.Status)
+
+	switch {
+	case !wasMember && isMember:
+		return membershipAdded
+	case wasMember && !isMember:
+		return membershipRemoved
+	default:
+		return ""
+	}
+}
+
+// handleMyChatMember tracks the bot's own membership. In private chats this is the
+// user blocking or unblocking the bot; in groups it's the bot being added or removed.
+func handleMyChatMember(bot *tgbotapi.BotAPI, update *tgbotapi.ChatMemberUpdated, db *sql.DB) {
+	change := membershipChange(update)
+	if change == "" {
+		return
+	}
+
+	logger := slog.Default().With("update_type", "my_chat_member", "user_id", update.From.ID, "chat_id", update.Chat.ID)
+	if update.Chat.IsPrivate() {
+		active := change == membershipAdded
+		logger.Info("User set bot active", "active", active)
+		if err := setUserActive(db, update.From.ID, active); err != nil {
+			logger.Error("Error updating user active status", "error", err)
+		}
+		return
+	}
+
+	switch change {
+	case membershipAdded:
+		logger.Info("Bot added to chat", "chat_type", update.Chat.Type)
+		msg := tgbotapi.NewMessage(update.Chat.ID, groupChatReply())
+		if _, err := bot.Send(msg); err != nil {
+			logger.Error("Error sending group greeting", "error", err)
+		}
+	case membershipRemoved:
+		// Nothing is stored for group chats, so there is nothing to clean up
+		logger.Info("Bot removed from chat", "chat_type", update.Chat.Type)
+	}
+}
+
+func usageResponse(db *sql.DB, userID int64) string {
+	usage, err := getCommandUsage(db, userID)
+	if err != nil {
+		userLogger(userID).Error("Error getting command usage", "error", err)
+		return "Sorry, I couldn't load your command usage."
+	}
+
+	var b strings.Builder
+	b.WriteString("📊 Your command usage:\n")
+	for _, u := range usage {
+		fmt.Fprintf(&b, "\n/%s — %d (last used %s)", u.Command, u.Count, u.LastUsedAt.UTC().Format("2006-01-02"))
+	}
+	return b.String()
+}
+
+// statsResponse answers /stats with an overview of the user's saved content.
+// Message types are listed most frequent first, ties by name.
+func statsResponse(db *sql.DB, userID int64) string {
+	stats, err := getUserStats(db, userID)
+	if err != nil {
+		userLogger(userID).Error("Error getting stats", "error", err)
+		return "Sorry, I couldn't load your stats."
+	}
+	if stats.TotalMessages == 0 {
+		return fmt.Sprintf("📊 You haven't saved any messages yet, and you have %d tags. Send or forward me something to start.", stats.TagCount)
+	}
+
+	types := make([]MessageType, 0, len(stats.MessagesByType))
+	for messageType := range stats.MessagesByType {
+		types = append(types, messageType)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if stats.MessagesByType[types[i]] != stats.MessagesByType[types[j]] {
+			return stats.MessagesByType[types[i]] > stats.MessagesByType[types[j]]
+		}
+		return types[i] < types[j]
+	})
+
+	var b strings.Builder
+	b.WriteString("📊 Your stats:\n\n")
+	fmt.Fprintf(&b, "Messages saved: %d\n", stats.TotalMessages)
+	for _, messageType := range types {
+		fmt.Fprintf(&b, "%s %s: %d\n", typeEmoji(messageType), typeLabel(messageType), stats.MessagesByType[messageType])
+	}
+	fmt.Fprintf(&b, "\nTags: %d\n", stats.TagCount)
+	fmt.Fprintf(&b, "First saved: %s", stats.FirstSavedAt.UTC().Format("2006-01-02"))
+	return b.String()
+}
+
+// noteResponse handles "/note <text>" sent as a reply to a saved message. The
+// reply target is the user's original message, looked up by its Telegram ID.
+func noteResponse(db *sql.DB, message *tgbotapi.Message) string {
+	if message.ReplyToMessage == nil {
+		return "Reply to one of your saved messages with /note <text> to add a note, or /note alone to clear it."
+	}
+
+	messageID, err := getMessageByTelegramID(db, message.From.ID, int64(message.ReplyToMessage.MessageID))
+	if err != nil {
+		messageLogger(message).Error("Error finding message to annotate", "error", err)
+		return "Could not find that message. Notes can only be added to messages you've saved."
+	}
+
+	note := strings.TrimSpace(message.CommandArguments())
+	if err := setMessageNote(db, messageID, note); err != nil {
+		messageLogger(message).Error("Error saving note", "error", err)
+		return "Sorry, I couldn't save your note. Please try again."
+	}
+
+	if note == "" {
+		return "📝 Note cleared."
+	}
+	return "📝 Note saved."
+}
+
+// sameTagsResponse handles "/sametags" sent as a reply to a saved message: that
+// message gets all the tags of the saved message it itself replies to, so a
+// follow-up lands under the same tags as what it follows up on.
+func sameTagsResponse(db *sql.DB, message *tgbotapi.Message) string {
+	if message.ReplyToMessage == nil {
+		return "Reply /sametags to a saved message that answers another one, and I'll give it the same tags."
+	}
+
+	targetID, err := getMessageByTelegramID(db, message.From.ID, int64(message.ReplyToMessage.MessageID))
+	if err != nil {
+		messageLogger(message).Error("Error finding message to tag", "error", err)
+		return "Could not find that message. Tags can only be copied to messages you've saved."
+	}
+
+	sourceID, err := getRepliedMessageID(db, targetID)
+	if err == sql.ErrNoRows {
+		return "That message doesn't reply to one of your saved messages, so there are no tags to copy."
+	}
+	if err != nil {
+		messageLogger(message).Error("Error finding replied-to message", "error", err)
+		return "Sorry, I couldn't copy the tags. Please try again."
+	}
+
+	if err := copyMessageTags(db, sourceID, targetID); err != nil {
+		messageLogger(message).Error("Error copying tags", "error", err)
+		return "Sorry, I couldn't copy the tags. Please try again."
+	}
+
+	names, err := getMessageTagNames(db, targetID)
+	if err != nil {
+		messageLogger(message).Error("Error getting message tags", "error", err)
+		return "🏷 Tags copied."
+	}
+	if len(names) == 0 {
+		return "The message it replies to has no tags to copy."
+	}
+	return fmt.Sprintf("🏷 Tagged with %s.", strings.Join(names, ", "))
+}
+
+// autoDeleteResponse handles "/autodelete <days|off>". Without arguments it shows
+// the current setting.
+func autoDeleteResponse(db *sql.DB, userID int64, args string) string {
+	args = strings.ToLower(strings.TrimSpace(args))
+
+	if args == "" {
+		days, err := getUntaggedRetention(db, userID)
+		if err != nil {
+			userLogger(userID).Error("Error getting retention setting", "error", err)
+			return "Sorry, I couldn't load your auto-delete setting."
+		}
+		if days == 0 {
+			return "Auto-delete is off. Use /autodelete <days> to delete untagged messages older than that."
+		}
+		return fmt.Sprintf("Untagged messages are deleted after %d days. Use /autodelete off to keep them.", days)
+	}
+
+	days := 0
+	if args != "off" {
+		var err error
+		days, err = strconv.Atoi(args)
+		if err != nil || days < 1 || days > maxUntaggedRetentionDays {
+			return fmt.Sprintf("Please give a number of days between 1 and %d, or 'off'.", maxUntaggedRetentionDays)
+		}
+	}
+
+	if err := setUntaggedRetention(db, userID, days); err != nil {
+		userLogger(userID).Error("Error saving retention setting", "error", err)
+		return "Sorry, I couldn't save your auto-delete setting. Please try again."
+	}
+
+	if days == 0 {
+		return "🗑️ Auto-delete turned off. Untagged messages are kept."
+	}
+	return fmt.Sprintf("🗑️ Untagged messages older than %d days will be deleted automatically. Tagged messages are always kept.", days)
+}
+
+// ignoredMessageType returns the message's type and whether the user ignores it.
+// Messages are saved when the setting can't be read.
+func ignoredMessageType(db *sql.DB, message *tgbotapi.Message) (MessageType, bool) {
+	messageType := getMessageType(message)
+	ignored, err := isMessageTypeIgnored(db, message.From.ID, messageType)
+	if err != nil {
+		messageLogger(message).Error("Error checking ignored message types", "error", err)
+		return messageType, false
+	}
+	return messageType, ignored
+}
+
+// ignoreResponse handles "/ignore <types|off>", which replaces the list of message
+// types that aren't saved. Without arguments it shows the current setting.
+func ignoreResponse(db *sql.DB, userID int64, args string) string {
+	fields := strings.FieldsFunc(strings.ToLower(args), func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+
+	if len(fields) == 0 {
+		types, err := getIgnoredMessageTypes(db, userID)
+		if err != nil {
+			userLogger(userID).Error("Error getting ignored message types", "error", err)
+			return "Sorry, I couldn't load your ignored message types."
+		}
+		if len(types) == 0 {
+			return "All message types are saved. Use /ignore <types> to skip some, e.g. /ignore sticker voice."
+		}
+		return fmt.Sprintf("Ignored message types: %s. Use /ignore off to save everything.", joinMessageTypes(types))
+	}
+
+	var types []MessageType
+	if !(len(fields) == 1 && fields[0] == "off") {
+		for _, field := range fields {
+			messageType, ok := parseMessageType(field)
+			if !ok {
+				return fmt.Sprintf("Unknown message type '%s'. Choose from: %s.", field, joinMessageTypes(knownMessageTypes))
+			}
+			if !slices.Contains(types, messageType) {
+				types = append(types, messageType)
+			}
+		}
+	}
+
+	if err := setIgnoredMessageTypes(db, userID, types); err != nil {
+		userLogger(userID).Error("Error saving ignored message types", "error", err)
+		return "Sorry, I couldn't save your ignored message types. Please try again."
+	}
+
+	if len(types) == 0 {
+		return "✅ All message types are saved again."
+	}
+	return fmt.Sprintf("🙈 I won't save these message types anymore: %s.", joinMessageTypes(types))
+}
+
+func joinMessageTypes(types []MessageType) string {
+	names := make([]string, len(types))
+	for i, messageType := range types {
+		names[i] = string(messageType)
+	}
+	return strings.Join(names, ", ")
+}
+
+// maxExportDocumentSize is the largest file a bot may upload to Telegram
+const maxExportDocumentSize = 50 << 20
+
+// sendDataExport sends everything stored about the user as a JSON document, in
+// the shape of the mini-app's GET /api/user/export
+func sendDataExport(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB) {
+	logger := messageLogger(message)
+	export, err := storage.ExportUserData(db, message.From.ID)
+	if err != nil {
+		logger.Error("Error exporting data", "error", err)
+		sendErrorMessage(bot, message, "Sorry, I couldn't export your data. Please try again.")
+		return
+	}
+
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		logger.Error("Error encoding export", "error", err)
+		sendErrorMessage(bot, message, "Sorry, I couldn't export your data. Please try again.")
+		return
+	}
+
+	// Larger exports would have to be split into several documents, e.g. the
+	// messages in chunks that are each valid JSON on their own
+	if len(data) > maxExportDocumentSize {
+		logger.Warn("Export is over the upload limit", "bytes", len(data))
+		sendErrorMessage(bot, message, "Sorry, your data is too large to send as one file.")
+		return
+	}
+
+	file := tgbotapi.FileBytes{
+		Name:  fmt.Sprintf("export-%s.json", export.ExportedAt.Format("2006-01-02")),
+		Bytes: data,
+	}
+	doc := tgbotapi.NewDocument(message.Chat.ID, file)
+	doc.ReplyToMessageID = message.MessageID
+	doc.Caption = fmt.Sprintf("📦 Your data: %d messages and %d tags, exported %s UTC.",
+		len(export.Messages), len(export.Tags), export.ExportedAt.Format(time.DateTime))
+
+	if _, err := bot.Send(doc); err != nil {
+		logger.Error("Error sending export", "error", err)
+	}
+}
+
+// resetPromptMarker identifies replies to the /reset confirmation prompt
+const resetPromptMarker = "[RESET]"
+
+func sendResetPrompt(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
+	responseText := "⚠️ This will permanently delete all your saved messages and tags.\n\n" +
+		"Type DELETE to confirm, or DELETE ACCOUNT to also remove your account. Anything else cancels.\n\n" +
+		resetPromptMarker
+
+	msg := tgbotapi.NewMessage(message.Chat.ID, responseText)
+	msg.ReplyToMessageID = message.MessageID
+	msg.ReplyMarkup = tgbotapi.ForceReply{ForceReply: true, Selective: true}
+
+	if _, err := bot.Send(msg); err != nil {
+		messageLogger(message).Error("Error sending reset prompt", "error", err)
+	}
+}
+
+func handleResetConfirmation(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB) {
+	var removeUser bool
+	switch strings.TrimSpace(message.Text) {
+	case "DELETE":
+		removeUser = false
+	case "DELETE ACCOUNT":
+		removeUser = true
+	default:
+		sendErrorMessage(bot, message, "Reset cancelled. Your data was not changed.")
+		return
+	}
+
+	logger := messageLogger(message)
+	if _, err := deleteAllUserData(db, message.From.ID, removeUser); err != nil {
+		logger.Error("Error deleting user data", "error", err)
+		sendErrorMessage(bot, message, "Sorry, I couldn't delete your data. Please try again.")
+		return
+	}
+
+	logger.Info("Deleted all user data", "account_removed", removeUser)
+	msg := tgbotapi.NewMessage(message.Chat.ID, "🗑️ All your saved messages and tags have been deleted.")
+	if _, err := bot.Send(msg); err != nil {
+		logger.Error("Error sending reset confirmation", "error", err)
+	}
+}
+
+// deleteMyDataPromptMarker identifies replies to the /deletemydata confirmation prompt
+const deleteMyDataPromptMarker = "[DELETE_MY_DATA]"
+
+func sendDeleteMyDataPrompt(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
+	responseText := "⚠️ This will permanently delete your account with all your saved messages and tags. Use /export first to keep a copy.\n\n" +
+		"Type YES to confirm. Anything else cancels.\n\n" +
+		deleteMyDataPromptMarker
+
+	msg := tgbotapi.NewMessage(message.Chat.ID, responseText)
+	msg.ReplyToMessageID = message.MessageID
+	msg.ReplyMarkup = tgbotapi.ForceReply{ForceReply: true, Selective: true}
+
+	if _, err := bot.Send(msg); err != nil {
+		messageLogger(message).Error("Error sending delete my data prompt", "error", err)
+	}
+}
+
+func handleDeleteMyDataConfirmation(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB) {
+	if strings.TrimSpace(message.Text) != "YES" {
+		sendErrorMessage(bot, message, "Deletion cancelled. Your data was not changed.")
+		return
+	}
+
+	logger := messageLogger(message)
+	deleted, err := deleteAllUserData(db, message.From.ID, true)
+	if err != nil {
+		logger.Error("Error deleting user data", "error", err)
+		sendErrorMessage(bot, message, "Sorry, I couldn't delete your data. Please try again.")
+		return
+	}
+
+	logger.Info("Deleted account",
+		"messages", deleted.Messages, "tags", deleted.Tags, "tag_links", deleted.MessageTags)
+	responseText := fmt.Sprintf("🗑️ Your data has been deleted:\n\nMessages: %d\nTags: %d\nTag links: %d\nAccount records: %d",
+		deleted.Messages, deleted.Tags, deleted.MessageTags, deleted.Users)
+	msg := tgbotapi.NewMessage(message.Chat.ID, responseText)
+	if _, err := bot.Send(msg); err != nil {
+		logger.Error("Error sending delete my data confirmation", "error", err)
 	}
 }
 
 func handleCallbackQuery(bot *tgbotapi.BotAPI, callbackQuery *tgbotapi.CallbackQuery, db *sql.DB) {
-	// Answer the callback query to stop the loading animation
-	callback := tgbotapi.NewCallback(callbackQuery.ID, "")
-	if _, err := bot.Request(callback); err != nil {
-		log.Printf("Error answering callback query: %v", err)
+	// Answer the callback query exactly once, whichever path the handlers take
+	// (early returns and panics included), so the button's loading animation
+	// always stops. answerText is shown as a toast when set.
+	logger := callbackLogger(callbackQuery)
+	var answerText string
+	defer func() {
+		callback := tgbotapi.NewCallback(callbackQuery.ID, answerText)
+		if _, err := bot.Request(callback); err != nil {
+			logger.Error("Error answering callback query", "error", err)
+		}
+	}()
+
+	// Inline-mode buttons have no message, and every handler needs the sender and chat
+	if callbackQuery.From == nil || callbackQuery.Message == nil || callbackQuery.Message.Chat == nil {
+		logger.Info("Skipping callback query without sender or message")
+		return
 	}
 
-	// Parse callback data format: "tag:tagID:messageID" or "new_tag:messageID"
+	// Parse callback data format: "tag:tagID:messageID", "tagb:tagID:messageID", "new_tag:messageID",
+	// "new_tag_yes:messageID"/"new_tag_no:messageID", "tag_search:messageID", "tag_done:messageID",
+	// "rename_tag:tagID" or "untag:tagID:messageID"
 	data := callbackQuery.Data
-	log.Printf("Received callback data: %s", data)
+	logger.Info("Received callback data", "data", data)
 
-	if strings.HasPrefix(data, "tag:") {
+	// The prefix before the first ":" is the callback kind, e.g. "tag" or "new_tag_yes"
+	kind, _, _ := strings.Cut(data, ":")
+
+	if strings.HasPrefix(data, "tag:") || strings.HasPrefix(data, "tagb:") || strings.HasPrefix(data, "tagt:") {
 		handleTagCallback(bot, callbackQuery, db)
 	} else if strings.HasPrefix(data, "new_tag:") {
 		handleNewTagCallback(bot, callbackQuery, db)
+	} else if strings.HasPrefix(data, "tag_search:") {
+		handleTagSearchCallback(bot, callbackQuery, db)
+	} else if strings.HasPrefix(data, "tag_done:") {
+		handleTagDoneCallback(bot, callbackQuery, db)
+	} else if strings.HasPrefix(data, "rename_tag:") {
+		handleRenameTagCallback(bot, callbackQuery, db)
+	} else if strings.HasPrefix(data, "untag:") {
+		handleUntagCallback(bot, callbackQuery, db)
+	} else if strings.HasPrefix(data, "new_tag_yes:") || strings.HasPrefix(data, "new_tag_no:") {
+		handleNewTagConfirmCallback(bot, callbackQuery, db)
 	} else {
-		log.Printf("Unknown callback data format: %s", data)
+		logger.Warn("Unknown callback data format", "data", data)
+		kind = "unknown"
+		answerText = "This button is no longer supported."
 	}
+
+	countMetric("callback_handled", "kind", kind)
 }
 
 func sendMiniAppButton(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
@@ -105,6 +755,60 @@ Alternatively, you can try this direct link (may require Telegram context):`
 	msg.ReplyMarkup = keyboard
 
 	if _, err := bot.Send(msg); err != nil {
-		log.Printf("Error sending mini-app button: %v", err)
+		messageLogger(message).Error("Error sending mini-app button", "error", err)
+	}
+}
+
+// searchResponse handles "/search <query>": "#tag" finds messages with that
+// hashtag, anything else finds messages containing the text
+func searchResponse(db *sql.DB, userID int64, args string) string {
+	query := strings.TrimSpace(args)
+	if query == "" || query == "#" {
+		return "Usage: /search <#hashtag|text>, e.g. /search #recipes or /search milk"
+	}
+
+	results, err := searchMessages(db, userID, query)
+	if err != nil {
+		userLogger(userID).Error("Error searching messages", "error", err)
+		return "Sorry, I couldn't search your messages. Please try again."
+	}
+	if len(results) == 0 {
+		return fmt.Sprintf("🔍 Nothing found for %q.", query)
+	}
+
+	var b strings.Builder
+	switch len(results) {
+	case 1:
+		fmt.Fprintf(&b, "🔍 1 match for %q:\n", query)
+	case maxSearchResults:
+		fmt.Fprintf(&b, "🔍 Newest %d matches for %q:\n", len(results), query)
+	default:
+		fmt.Fprintf(&b, "🔍 %d matches for %q:\n", len(results), query)
+	}
+	for i, msg := range results {
+		fmt.Fprintf(&b, "\n%d. %s %s · %s", i+1, typeEmoji(msg.MessageType), typeLabel(msg.MessageType), msg.CreatedAt.UTC().Format("Jan 2, 2006"))
+		if msg.ForwardedFrom != nil {
+			fmt.Fprintf(&b, " · from %s", *msg.ForwardedFrom)
+		}
+		if msg.TextContent != nil {
+			fmt.Fprintf(&b, "\n%s", *msg.TextContent)
+		} else if msg.Caption != nil {
+			fmt.Fprintf(&b, "\n%s", *msg.Caption)
+		}
+		if msg.OriginalLink != "" {
+			fmt.Fprintf(&b, "\n🔗 %s", msg.OriginalLink)
+		}
+		b.WriteString("\n")
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// revokeResponse handles "/revoke", which signs the user out of every open
+// mini-app session. The mini-app rejects initData issued before min_auth_date.
+func revokeResponse(db *sql.DB, userID int64) string {
+	if err := revokeMiniAppSessions(db, userID); err != nil {
+		userLogger(userID).Error("Error revoking mini-app sessions", "error", err)
+		return "Sorry, I couldn't sign you out of the mini-app. Please try again."
 	}
+	return "🔒 Signed out of the mini-app on every device. Open it again with /miniapp to sign back in."
 }
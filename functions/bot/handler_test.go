@@ -2,15 +2,24 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
-	_ "modernc.org/sqlite"
+
+	"telegram-content-organizer-shared/storage"
+	"telegram-content-organizer-shared/storagetest"
 )
 
 // MockBotAPI is a mock implementation of the Telegram Bot API
@@ -39,71 +48,7 @@ type BotAPI interface {
 
 // setupTestDB creates an in-memory SQLite database for testing
 func setupTestDB(t *testing.T) *sql.DB {
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatalf("Failed to create test database: %v", err)
-	}
-
-	// Create test tables based on the PostgreSQL schema
-	schema := `
-		CREATE TABLE users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			telegram_id INTEGER UNIQUE NOT NULL,
-			username TEXT,
-			first_name TEXT,
-			last_name TEXT,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			is_active BOOLEAN DEFAULT TRUE
-		);
-
-		CREATE TABLE messages (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id INTEGER NOT NULL,
-			telegram_message_id INTEGER NOT NULL,
-			message_type TEXT NOT NULL,
-			text_content TEXT,
-			caption TEXT,
-			file_id TEXT,
-			file_name TEXT,
-			file_size INTEGER,
-			mime_type TEXT,
-			duration INTEGER,
-			forwarded_date TIMESTAMP,
-			forwarded_from TEXT,
-			urls TEXT,
-			hashtags TEXT,
-			mentions TEXT,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (user_id) REFERENCES users (telegram_id)
-		);
-
-		CREATE TABLE tags (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id INTEGER NOT NULL,
-			name TEXT NOT NULL,
-			color TEXT,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			UNIQUE(user_id, name),
-			FOREIGN KEY (user_id) REFERENCES users (telegram_id)
-		);
-
-		CREATE TABLE message_tags (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			message_id INTEGER NOT NULL,
-			tag_id INTEGER NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			UNIQUE(message_id, tag_id),
-			FOREIGN KEY (message_id) REFERENCES messages (id),
-			FOREIGN KEY (tag_id) REFERENCES tags (id)
-		);
-	`
-
-	if _, err := db.Exec(schema); err != nil {
-		t.Fatalf("Failed to create test schema: %v", err)
-	}
-
-	return db
+	return storagetest.OpenDB(t)
 }
 
 // createTestUser creates a test user in the database
@@ -270,12 +215,237 @@ func TestHandleMessage(t *testing.T) {
 	}
 }
 
+// TestCommandNote tests that command messages are saved only when SAVE_COMMANDS is set
+func TestCommandNote(t *testing.T) {
+	tests := []struct {
+		name       string
+		flag       string
+		text       string
+		expectNote bool
+		expectText string
+	}{
+		{
+			name:       "Flag unset",
+			flag:       "",
+			text:       "/todo buy milk",
+			expectNote: false,
+		},
+		{
+			name:       "Flag disabled",
+			flag:       "false",
+			text:       "/todo buy milk",
+			expectNote: false,
+		},
+		{
+			name:       "Flag enabled",
+			flag:       "true",
+			text:       "/todo buy milk",
+			expectNote: true,
+			expectText: "buy milk",
+		},
+		{
+			name:       "Start command is never saved",
+			flag:       "true",
+			text:       "/start",
+			expectNote: false,
+		},
+		{
+			name:       "Help command is never saved",
+			flag:       "true",
+			text:       "/help me",
+			expectNote: false,
+		},
+		{
+			name:       "Note command is never saved",
+			flag:       "true",
+			text:       "/note read later",
+			expectNote: false,
+		},
+		{
+			name:       "Reset command is never saved",
+			flag:       "true",
+			text:       "/reset everything",
+			expectNote: false,
+		},
+		{
+			name:       "Usage command is never saved",
+			flag:       "true",
+			text:       "/usage please",
+			expectNote: false,
+		},
+		{
+			name:       "Command without text",
+			flag:       "true",
+			text:       "/todo",
+			expectNote: false,
+		},
+		{
+			name:       "Regular message",
+			flag:       "true",
+			text:       "buy milk",
+			expectNote: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SAVE_COMMANDS", tt.flag)
+
+			message := createTelegramMessage(1, 12345, "testuser", tt.text)
+			if strings.HasPrefix(tt.text, "/") {
+				// Command entity covers only the command itself
+				message.Entities[0].Length = len(strings.Fields(tt.text)[0])
+			}
+
+			note := commandNote(message)
+			if !tt.expectNote {
+				assert.Nil(t, note)
+				return
+			}
+
+			assert.NotNil(t, note)
+			assert.Equal(t, tt.expectText, note.Text)
+			assert.False(t, note.IsCommand())
+			assert.Equal(t, tt.text, message.Text, "Original message should not be modified")
+
+			db := setupTestDB(t)
+			defer db.Close()
+
+			createTestUser(t, db, note.From.ID, note.From.UserName)
+			assert.NoError(t, saveMessage(db, note))
+
+			_, textContent, _ := getMessageFromDB(t, db, note.From.ID, note.MessageID)
+			assert.Equal(t, tt.expectText, textContent.String)
+		})
+	}
+}
+
+// TestNoteResponse tests setting and clearing a note by replying with /note
+func TestNoteResponse(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(12345)
+	createTestUser(t, db, userID, "testuser")
+	messageID := createTestMessage(t, db, userID, 100)
+
+	noteCommand := func(text string, replyTo int) *tgbotapi.Message {
+		message := createTelegramMessage(200, userID, "testuser", text)
+		message.Entities[0].Length = len(strings.Fields(text)[0])
+		if replyTo != 0 {
+			message.ReplyToMessage = createTelegramMessage(replyTo, userID, "testuser", "Test message")
+		}
+		return message
+	}
+	storedNote := func() sql.NullString {
+		var note sql.NullString
+		assert.NoError(t, db.QueryRow(`SELECT user_note FROM messages WHERE id = ?`, messageID).Scan(&note))
+		return note
+	}
+
+	assert.Equal(t, "📝 Note saved.", noteResponse(db, noteCommand("/note  worth re-reading ", 100)))
+	assert.Equal(t, sql.NullString{String: "worth re-reading", Valid: true}, storedNote())
+
+	assert.Equal(t, "📝 Note cleared.", noteResponse(db, noteCommand("/note", 100)))
+	assert.False(t, storedNote().Valid)
+
+	t.Run("Not a reply", func(t *testing.T) {
+		assert.Contains(t, noteResponse(db, noteCommand("/note hi", 0)), "Reply to one of your saved messages")
+	})
+
+	t.Run("Reply to a message that wasn't saved", func(t *testing.T) {
+		assert.Contains(t, noteResponse(db, noteCommand("/note hi", 999)), "Could not find that message")
+	})
+
+	t.Run("Export includes the note", func(t *testing.T) {
+		noteResponse(db, noteCommand("/note keep", 100))
+		export, err := storage.ExportUserData(db, userID)
+		assert.NoError(t, err)
+		assert.Len(t, export.Messages, 1)
+		assert.Equal(t, "keep", *export.Messages[0].UserNote)
+	})
+}
+
+// TestIsPrivateChat tests the private vs group context branching
+func TestIsPrivateChat(t *testing.T) {
+	tests := []struct {
+		name     string
+		chat     *tgbotapi.Chat
+		expected bool
+	}{
+		{name: "Private chat", chat: &tgbotapi.Chat{ID: 1, Type: "private"}, expected: true},
+		{name: "Group chat", chat: &tgbotapi.Chat{ID: -1, Type: "group"}, expected: false},
+		{name: "Supergroup chat", chat: &tgbotapi.Chat{ID: -100, Type: "supergroup"}, expected: false},
+		{name: "Channel", chat: &tgbotapi.Chat{ID: -200, Type: "channel"}, expected: false},
+		{name: "Nil chat", chat: nil, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, isPrivateChat(tt.chat))
+		})
+	}
+}
+
+// TestGroupChatReply tests the configurable group reply
+func TestGroupChatReply(t *testing.T) {
+	t.Setenv("GROUP_CHAT_REPLY", "")
+	assert.Equal(t, defaultGroupChatReply, groupChatReply())
+
+	t.Setenv("GROUP_CHAT_REPLY", "DM me instead")
+	assert.Equal(t, "DM me instead", groupChatReply())
+}
+
+// TestWelcomeMessage tests the onboarding for first-time users and the short welcome afterwards
+func TestWelcomeMessage(t *testing.T) {
+	t.Setenv("WELCOME_MESSAGE", "")
+	t.Setenv("ONBOARDING_MESSAGE", "")
+	assert.Equal(t, defaultOnboardingMessage, welcomeMessage(true))
+	assert.Equal(t, defaultWelcomeMessage, welcomeMessage(false))
+	assert.Contains(t, welcomeMessage(true), "/miniapp")
+
+	t.Setenv("WELCOME_MESSAGE", "Welcome back!")
+	t.Setenv("ONBOARDING_MESSAGE", "Nice to meet you!")
+	assert.Equal(t, "Nice to meet you!", welcomeMessage(true))
+	assert.Equal(t, "Welcome back!", welcomeMessage(false))
+}
+
+// TestMembershipChange tests detection of the bot being added to or removed from a chat
+func TestMembershipChange(t *testing.T) {
+	tests := []struct {
+		name      string
+		oldStatus string
+		newStatus string
+		expected  string
+	}{
+		{name: "Added to group", oldStatus: "left", newStatus: "member", expected: membershipAdded},
+		{name: "Added as admin", oldStatus: "left", newStatus: "administrator", expected: membershipAdded},
+		{name: "Unblocked in private chat", oldStatus: "kicked", newStatus: "member", expected: membershipAdded},
+		{name: "Removed from group", oldStatus: "member", newStatus: "left", expected: membershipRemoved},
+		{name: "Blocked in private chat", oldStatus: "member", newStatus: "kicked", expected: membershipRemoved},
+		{name: "Promoted to admin", oldStatus: "member", newStatus: "administrator", expected: ""},
+		{name: "Restricted", oldStatus: "member", newStatus: "restricted", expected: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			update := &tgbotapi.ChatMemberUpdated{
+				Chat:          tgbotapi.Chat{ID: -1, Type: "group"},
+				OldChatMember: tgbotapi.ChatMember{Status: tt.oldStatus},
+				NewChatMember: tgbotapi.ChatMember{Status: tt.newStatus},
+			}
+			assert.Equal(t, tt.expected, membershipChange(update))
+		})
+	}
+}
+
 // TestHandleMessageWithReply tests handling of replies to tag selection messages
 func TestHandleMessageWithReply(t *testing.T) {
 	tests := []struct {
 		name              string
 		replyToText       string
 		messageText       string
+		nilFrom           bool
 		expectTagHandling bool
 	}{
 		{
@@ -302,6 +472,13 @@ func TestHandleMessageWithReply(t *testing.T) {
 			messageText:       "regular reply",
 			expectTagHandling: false,
 		},
+		{
+			name:              "Reply to message without sender (channel post)",
+			replyToText:       "Channel post mentioning [MSG_ID:64]",
+			messageText:       "reply to channel post",
+			nilFrom:           true,
+			expectTagHandling: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -324,6 +501,9 @@ func TestHandleMessageWithReply(t *testing.T) {
 				},
 				Text: tt.replyToText,
 			}
+			if tt.nilFrom {
+				replyMessage.From = nil
+			}
 
 			message := createTelegramMessage(101, userID, "testuser", tt.messageText)
 			message.ReplyToMessage = replyMessage
@@ -340,12 +520,146 @@ func TestHandleMessageWithReply(t *testing.T) {
 			}
 
 			// Execute
-			handleMessageWithBotAPI(mockBot, message, db)
+			assert.NotPanics(t, func() {
+				handleMessageWithBotAPI(mockBot, message, db)
+			})
 
 			// Verify
 			mockBot.AssertExpectations(t)
+
+			if !tt.expectTagHandling {
+				// Non-tag replies are saved as regular messages
+				var count int
+				err := db.QueryRow("SELECT COUNT(*) FROM messages WHERE telegram_message_id = ?", message.MessageID).Scan(&count)
+				assert.NoError(t, err)
+				assert.Equal(t, 1, count, "Reply should be saved as a regular message")
+			}
+		})
+	}
+}
+
+// TestIsReplyToBot tests reply detection, including replies without a sender
+func TestIsReplyToBot(t *testing.T) {
+	message := createTelegramMessage(1, 12345, "testuser", "reply")
+	assert.False(t, isReplyToBot(message), "Not a reply")
+
+	message.ReplyToMessage = &tgbotapi.Message{MessageID: 2, From: &tgbotapi.User{ID: 999999, IsBot: true}}
+	assert.True(t, isReplyToBot(message), "Reply to bot")
+
+	message.ReplyToMessage = &tgbotapi.Message{MessageID: 2, From: &tgbotapi.User{ID: 54321}}
+	assert.False(t, isReplyToBot(message), "Reply to user")
+
+	message.ReplyToMessage = &tgbotapi.Message{MessageID: 2, From: nil}
+	assert.NotPanics(t, func() {
+		assert.False(t, isReplyToBot(message), "Reply without sender")
+	})
+}
+
+// TestIsTagSelectionReply tests telling tag choices from new content sent as a reply
+func TestIsTagSelectionReply(t *testing.T) {
+	prompt := &tgbotapi.Message{MessageID: 2, From: &tgbotapi.User{ID: 999999, IsBot: true}, Text: "Choose a tag by typing its name [MSG_ID:1]"}
+
+	message := createTelegramMessage(3, 12345, "testuser", "work")
+	assert.False(t, isTagSelectionReply(message), "Not a reply")
+
+	message.ReplyToMessage = prompt
+	assert.True(t, isTagSelectionReply(message), "Text reply to the prompt")
+
+	message.ReplyToMessage = &tgbotapi.Message{MessageID: 2, From: prompt.From, Text: "✅ Saved"}
+	assert.False(t, isTagSelectionReply(message), "Reply to another bot message")
+
+	photo := createTelegramMessage(3, 12345, "testuser", "")
+	photo.Photo = []tgbotapi.PhotoSize{{FileID: "photo", Width: 90, Height: 90}}
+	photo.Caption = "work"
+	photo.ReplyToMessage = prompt
+	assert.False(t, isTagSelectionReply(photo), "Photo reply is new content, even with a caption")
+
+	sticker := createTelegramMessage(3, 12345, "testuser", "")
+	sticker.Sticker = &tgbotapi.Sticker{FileID: "sticker"}
+	sticker.ReplyToMessage = prompt
+	assert.False(t, isTagSelectionReply(sticker), "Sticker reply is new content")
+}
+
+// TestHandleMessagePhotoReplyToTagPrompt tests that a photo sent as a reply to a
+// tag prompt is saved and gets its own prompt instead of an empty tag name error
+func TestHandleMessagePhotoReplyToTagPrompt(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(12345)
+	createTestUser(t, db, userID, "testuser")
+	createTestMessage(t, db, userID, 1)
+	tagID := createTestTag(t, db, userID, "work", "")
+
+	photo := createTelegramMessage(3, userID, "testuser", "")
+	photo.Chat.Type = "private"
+	photo.Photo = []tgbotapi.PhotoSize{{FileID: "small", Width: 90, Height: 90}, {FileID: "large", Width: 800, Height: 600}}
+	photo.ReplyToMessage = &tgbotapi.Message{
+		MessageID: 2,
+		From:      &tgbotapi.User{ID: 999999, IsBot: true},
+		Text:      "Choose a tag by typing its name [MSG_ID:1]",
+	}
+
+	bot, called := newTestBotAPI(t)
+	handleMessage(bot, photo, db, 1)
+
+	_, err := getMessageByTelegramID(db, userID, 3)
+	assert.NoError(t, err, "The photo is saved")
+
+	assert.Equal(t, 0, countRows(t, db, "message_tags"), "The earlier message isn't tagged")
+
+	requests := called()
+	if assert.NotEmpty(t, requests) {
+		prompt := requests[len(requests)-1].Params
+		assert.NotEqual(t, "Please enter a tag name.", prompt.Get("text"))
+		assert.Contains(t, prompt.Get("reply_markup"), fmt.Sprintf("tag:%d:3", tagID), "The photo gets its own tag prompt")
+	}
+}
+
+// TestHandleMessageSaveFailure tests that a failed save is reported exactly once,
+// with the update ID as reference, and never followed by a tag prompt
+func TestHandleMessageSaveFailure(t *testing.T) {
+	userID := int64(12345)
+
+	tests := []struct {
+		name         string
+		stashFails   bool
+		expectedText string
+	}{
+		{name: "Save and stash fail", stashFails: true, expectedText: saveFailedText(42)},
+		{name: "Stashed for later", stashFails: false, expectedText: "I couldn't save your message right now, but I kept it and will save it automatically with your next message."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := setupTestDB(t)
+			defer db.Close()
+			createTestUser(t, db, userID, "testuser")
+			createTestTag(t, db, userID, "work", "")
+
+			stubSaveMessage(t, saveMessageAttempts)
+			if tt.stashFails {
+				_, err := db.Exec(`DROP TABLE pending_messages`)
+				assert.NoError(t, err)
+			}
+
+			message := createTelegramMessage(1, userID, "testuser", "hello")
+			message.Chat.Type = "private"
+
+			bot, called := newTestBotAPI(t)
+			handleMessage(bot, message, db, 42)
+
+			requests := called()
+			assert.Equal(t, 1, countMethod(requests, "sendMessage"))
+			if assert.Len(t, requests, 1) {
+				assert.Equal(t, tt.expectedText, requests[0].Params.Get("text"))
+				assert.Empty(t, requests[0].Params.Get("reply_markup"), "No tag prompt for an unsaved message")
+			}
+			assert.Equal(t, 0, countRows(t, db, "messages"))
 		})
 	}
+
+	assert.Contains(t, saveFailedText(42), "reference #42")
 }
 
 // Helper function that accepts BotAPI interface for testing
@@ -377,7 +691,7 @@ func handleMessageWithBotAPI(bot BotAPI, message *tgbotapi.Message, db *sql.DB)
 
 	// Handle non-command messages
 	// Check if this is a reply to our tag selection message
-	if message.ReplyToMessage != nil && message.ReplyToMessage.From.IsBot {
+	if isReplyToBot(message) {
 		// Check if the reply is to a tag selection message by checking message content
 		if containsTagSelectionPattern(message.ReplyToMessage.Text) {
 			// In real implementation, this would call handleTagSelection
@@ -501,6 +815,27 @@ func TestHandleCallbackQuery(t *testing.T) {
 			expectRouting:  true,
 			expectedRoute:  "new_tag",
 		},
+		{
+			name:           "Confirm new tag callback",
+			callbackData:   "new_tag_yes:456",
+			expectCallback: true,
+			expectRouting:  true,
+			expectedRoute:  "new_tag_yes",
+		},
+		{
+			name:           "Deny new tag callback",
+			callbackData:   "new_tag_no:456",
+			expectCallback: true,
+			expectRouting:  true,
+			expectedRoute:  "new_tag_no",
+		},
+		{
+			name:           "Tag search callback",
+			callbackData:   "tag_search:456",
+			expectCallback: true,
+			expectRouting:  true,
+			expectedRoute:  "tag_search",
+		},
 		{
 			name:           "Unknown callback format",
 			callbackData:   "unknown:format",
@@ -599,6 +934,144 @@ func TestHandleCallbackQueryErrors(t *testing.T) {
 	}
 }
 
+// testBotRequest is one Bot API call received by the newTestBotAPI server
+type testBotRequest struct {
+	Method string
+	Params url.Values
+	// Files holds the contents of uploaded files by form field, e.g. "document"
+	Files map[string][]byte
+}
+
+// newTestBotAPI returns a bot talking to a fake Bot API server that answers every
+// request with success and records the calls in order
+func newTestBotAPI(t *testing.T) (*tgbotapi.BotAPI, func() []testBotRequest) {
+	return newFailingTestBotAPI(t, nil)
+}
+
+// newFailingTestBotAPI is newTestBotAPI with the methods in failures answering
+// with a Bad Request error carrying the given description
+func newFailingTestBotAPI(t *testing.T, failures map[string]string) (*tgbotapi.BotAPI, func() []testBotRequest) {
+	var mu sync.Mutex
+	var requests []testBotRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		method := path.Base(r.URL.Path)
+		request := testBotRequest{Method: method, Params: r.PostForm}
+		// Uploads are sent as multipart forms
+		if err := r.ParseMultipartForm(32 << 20); err == nil {
+			request.Params = url.Values(r.MultipartForm.Value)
+			request.Files = make(map[string][]byte)
+			for field, headers := range r.MultipartForm.File {
+				if f, err := headers[0].Open(); err == nil {
+					request.Files[field], _ = io.ReadAll(f)
+					f.Close()
+				}
+			}
+		}
+		mu.Lock()
+		requests = append(requests, request)
+		mu.Unlock()
+		if description, ok := failures[method]; ok {
+			fmt.Fprintf(w, `{"ok":false,"error_code":400,"description":%q}`, description)
+			return
+		}
+		w.Write([]byte(`{"ok":true,"result":{}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	bot, err := tgbotapi.NewBotAPIWithAPIEndpoint("test-token", server.URL+"/bot%s/%s")
+	if err != nil {
+		t.Fatalf("Failed to create test bot: %v", err)
+	}
+
+	called := func() []testBotRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		// Skip the getMe call made by the constructor
+		return append([]testBotRequest(nil), requests[1:]...)
+	}
+	return bot, called
+}
+
+// countMethod counts how often method appears in called
+func countMethod(called []testBotRequest, method string) int {
+	count := 0
+	for _, r := range called {
+		if r.Method == method {
+			count++
+		}
+	}
+	return count
+}
+
+// TestHandleCallbackQueryAlwaysAnswers tests that every callback path answers the query exactly once
+func TestHandleCallbackQueryAlwaysAnswers(t *testing.T) {
+	userID := int64(12345)
+
+	tests := []struct {
+		name         string
+		callbackData string
+		setup        func(t *testing.T, db *sql.DB) string
+	}{
+		{
+			name: "Tagging fails",
+			setup: func(t *testing.T, db *sql.DB) string {
+				createTestMessage(t, db, userID, 456)
+				tagID, err := getOrCreateTag(db, userID, "work")
+				assert.NoError(t, err)
+				_, err = db.Exec(`DROP TABLE message_tags`)
+				assert.NoError(t, err)
+				return fmt.Sprintf("tag:%d:456", tagID)
+			},
+		},
+		{
+			name: "Original message missing",
+			setup: func(t *testing.T, db *sql.DB) string {
+				return "tag:1:999"
+			},
+		},
+		{
+			name: "Malformed tag data",
+			setup: func(t *testing.T, db *sql.DB) string {
+				return "tag:invalid"
+			},
+		},
+		{
+			name: "Done with original message missing",
+			setup: func(t *testing.T, db *sql.DB) string {
+				return "tag_done:999"
+			},
+		},
+		{
+			name: "Malformed new_tag data",
+			setup: func(t *testing.T, db *sql.DB) string {
+				return "new_tag:invalid:extra"
+			},
+		},
+		{
+			name: "Unknown data",
+			setup: func(t *testing.T, db *sql.DB) string {
+				return "unknown:format"
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := setupTestDB(t)
+			defer db.Close()
+			createTestUser(t, db, userID, "testuser")
+
+			bot, called := newTestBotAPI(t)
+			data := tt.setup(t, db)
+
+			handleCallbackQuery(bot, createCallbackQuery("callback123", userID, "testuser", data), db)
+
+			assert.Equal(t, 1, countMethod(called(), "answerCallbackQuery"))
+		})
+	}
+}
+
 // Helper function that accepts BotAPI interface for testing callback queries
 func handleCallbackQueryWithBotAPI(bot BotAPI, callbackQuery *tgbotapi.CallbackQuery) {
 	// Answer the callback query to stop the loading animation
@@ -624,8 +1097,518 @@ func handleCallbackQueryWithBotAPI(bot BotAPI, callbackQuery *tgbotapi.CallbackQ
 			// Invalid format - just log
 			fmt.Printf("Invalid new_tag callback format: %s\n", data)
 		}
+	} else if strings.HasPrefix(data, "tag_search:") {
+		bot.Send(tgbotapi.NewMessage(callbackQuery.Message.Chat.ID, "Tag search handled"))
+	} else if strings.HasPrefix(data, "new_tag_yes:") || strings.HasPrefix(data, "new_tag_no:") {
+		bot.Send(tgbotapi.NewMessage(callbackQuery.Message.Chat.ID, "New tag confirmation handled"))
 	} else {
 		// Unknown callback format - just log it
 		fmt.Printf("Unknown callback data format: %s\n", data)
 	}
 }
+
+// TestIgnoredMessageType tests skipping message types the user ignores
+func TestIgnoredMessageType(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	createTestUser(t, db, userID, "ignore_user")
+
+	user := &tgbotapi.User{ID: userID}
+	sticker := &tgbotapi.Message{From: user, Sticker: &tgbotapi.Sticker{FileID: "sticker"}}
+	text := &tgbotapi.Message{From: user, Text: "hello"}
+
+	// All types are saved by default
+	messageType, ignored := ignoredMessageType(db, sticker)
+	assert.Equal(t, MessageTypeSticker, messageType)
+	assert.False(t, ignored)
+
+	assert.NoError(t, setIgnoredMessageTypes(db, userID, []MessageType{MessageTypeSticker, MessageTypeVoice}))
+
+	_, ignored = ignoredMessageType(db, sticker)
+	assert.True(t, ignored, "Stickers are ignored")
+	messageType, ignored = ignoredMessageType(db, text)
+	assert.Equal(t, MessageTypeText, messageType)
+	assert.False(t, ignored, "Text is still saved")
+
+	// Other users keep their own setting
+	other := &tgbotapi.Message{From: &tgbotapi.User{ID: 456}, Sticker: &tgbotapi.Sticker{FileID: "sticker"}}
+	_, ignored = ignoredMessageType(db, other)
+	assert.False(t, ignored)
+
+	assert.NoError(t, setIgnoredMessageTypes(db, userID, nil))
+	_, ignored = ignoredMessageType(db, sticker)
+	assert.False(t, ignored, "Clearing the list saves everything again")
+
+	var cleared bool
+	assert.NoError(t, db.QueryRow(`SELECT ignored_message_types IS NULL FROM users WHERE telegram_id = ?`, userID).Scan(&cleared))
+	assert.True(t, cleared, "A cleared list is stored as NULL")
+}
+
+// TestIgnoreResponse tests the /ignore setting command
+func TestIgnoreResponse(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	createTestUser(t, db, userID, "ignore_user")
+
+	assert.Contains(t, ignoreResponse(db, userID, ""), "All message types are saved")
+
+	assert.Equal(t, "🙈 I won't save these message types anymore: sticker, voice.", ignoreResponse(db, userID, "Sticker, voice sticker"))
+	types, err := getIgnoredMessageTypes(db, userID)
+	assert.NoError(t, err)
+	assert.Equal(t, []MessageType{MessageTypeSticker, MessageTypeVoice}, types)
+	assert.Contains(t, ignoreResponse(db, userID, ""), "Ignored message types: sticker, voice.")
+
+	assert.Contains(t, ignoreResponse(db, userID, "sticker dice"), "Unknown message type 'dice'")
+	types, err = getIgnoredMessageTypes(db, userID)
+	assert.NoError(t, err)
+	assert.Equal(t, []MessageType{MessageTypeSticker, MessageTypeVoice}, types, "Invalid input keeps the current setting")
+
+	assert.Equal(t, "✅ All message types are saved again.", ignoreResponse(db, userID, "off"))
+	types, err = getIgnoredMessageTypes(db, userID)
+	assert.NoError(t, err)
+	assert.Empty(t, types)
+}
+
+func TestRevokeResponse(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	createTestUser(t, db, userID, "revoke_user")
+
+	getMinAuthDate := func() sql.NullTime {
+		var minAuthDate sql.NullTime
+		assert.NoError(t, db.QueryRow(`SELECT min_auth_date FROM users WHERE telegram_id = ?`, userID).Scan(&minAuthDate))
+		return minAuthDate
+	}
+	assert.False(t, getMinAuthDate().Valid, "Sessions aren't limited until the user revokes them")
+
+	assert.Contains(t, revokeResponse(db, userID), "Signed out of the mini-app")
+	minAuthDate := getMinAuthDate()
+	assert.True(t, minAuthDate.Valid)
+	assert.WithinDuration(t, time.Now(), minAuthDate.Time, time.Minute)
+
+	db.Close()
+	assert.Contains(t, revokeResponse(db, userID), "Sorry")
+}
+
+func TestSameTagsResponse(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	createTestUser(t, db, userID, "sametags_user")
+	original := createTestMessage(t, db, userID, 10)
+	followUp := createTestMessage(t, db, userID, 11)
+	unrelated := createTestMessage(t, db, userID, 12)
+	_, err := db.Exec(`UPDATE messages SET reply_to_message_id = 10 WHERE id = ?`, followUp)
+	assert.NoError(t, err)
+
+	work := createTestTag(t, db, userID, "work", "")
+	music := createTestTag(t, db, userID, "music", "")
+	books := createTestTag(t, db, userID, "books", "")
+	createTestMessageTag(t, db, original, work)
+	createTestMessageTag(t, db, original, music)
+	createTestMessageTag(t, db, followUp, music)
+	createTestMessageTag(t, db, followUp, books)
+
+	command := func(replyTo int) *tgbotapi.Message {
+		message := createTelegramMessage(20, userID, "sametags_user", "/sametags")
+		message.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: 9}}
+		if replyTo != 0 {
+			message.ReplyToMessage = &tgbotapi.Message{MessageID: replyTo}
+		}
+		return message
+	}
+
+	assert.Contains(t, sameTagsResponse(db, command(0)), "Reply /sametags to a saved message")
+	assert.Contains(t, sameTagsResponse(db, command(99)), "Could not find that message")
+	assert.Contains(t, sameTagsResponse(db, command(12)), "doesn't reply to one of your saved messages")
+
+	// Overlapping tags are kept once and the follow-up keeps its own tags
+	assert.Equal(t, "🏷 Tagged with books, music, work.", sameTagsResponse(db, command(11)))
+	assert.Equal(t, "🏷 Tagged with books, music, work.", sameTagsResponse(db, command(11)), "Copying again is a no-op")
+	assert.Equal(t, 5, countRows(t, db, "message_tags"))
+
+	names, err := getMessageTagNames(db, original)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"music", "work"}, names, "The original is untouched")
+
+	// Nothing to copy from an untagged message
+	_, err = db.Exec(`UPDATE messages SET reply_to_message_id = 11 WHERE id = ?`, unrelated)
+	assert.NoError(t, err)
+	_, err = db.Exec(`DELETE FROM message_tags`)
+	assert.NoError(t, err)
+	assert.Contains(t, sameTagsResponse(db, command(12)), "no tags to copy")
+}
+
+// TestHandleEditedMessage tests that edits only touch saved private messages
+func TestHandleEditedMessage(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(1, user, "before")))
+
+	getText := func() string {
+		export, err := storage.ExportUserData(db, user.ID)
+		assert.NoError(t, err)
+		assert.Len(t, export.Messages, 1)
+		return *export.Messages[0].TextContent
+	}
+
+	edit := createTelegramMessage(1, user.ID, user.UserName, "after")
+	edit.Chat.Type = "private"
+	handleEditedMessage(edit, db)
+	assert.Equal(t, "after", getText())
+
+	// An edit in a group chat isn't a note
+	groupEdit := createTelegramMessage(1, user.ID, user.UserName, "from a group")
+	groupEdit.Chat.Type = "group"
+	handleEditedMessage(groupEdit, db)
+	assert.Equal(t, "after", getText())
+
+	// Editing an unsaved message, e.g. a command, saves nothing
+	unsaved := createTelegramMessage(2, user.ID, user.UserName, "/help")
+	unsaved.Chat.Type = "private"
+	handleEditedMessage(unsaved, db)
+	assert.Equal(t, 1, countRows(t, db, "messages"))
+}
+
+func TestSearchResponse(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+
+	assert.Contains(t, searchResponse(db, user.ID, "  "), "Usage: /search")
+	assert.Equal(t, `🔍 Nothing found for "milk".`, searchResponse(db, user.ID, "milk"))
+
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(1, user, "Buy milk")))
+	forwarded := createTestMessageStruct(2, user, "Milk prices are up")
+	forwarded.ForwardFromChat = &tgbotapi.Chat{ID: -100123, Type: "channel", Title: "News", UserName: "news"}
+	forwarded.ForwardFromMessageID = 42
+	assert.NoError(t, saveMessage(db, forwarded))
+	private := createTestMessageStruct(3, user, "Milk is free")
+	private.ForwardFromChat = &tgbotapi.Chat{ID: -100456, Type: "channel", Title: "Private"}
+	private.ForwardFromMessageID = 7
+	assert.NoError(t, saveMessage(db, private))
+
+	response := searchResponse(db, user.ID, "milk")
+	assert.True(t, strings.HasPrefix(response, `🔍 3 matches for "milk":`), response)
+	assert.Contains(t, response, "1. 💬 Message · ")
+	assert.Contains(t, response, " · from Private\nMilk is free\n\n2. ", "Private channels have no link")
+	assert.Contains(t, response, " · from News (@news)\nMilk prices are up\n🔗 https://t.me/news/42\n")
+	assert.Contains(t, response, "\n3. 💬 Message · ")
+	assert.True(t, strings.HasSuffix(response, "\nBuy milk"), response)
+}
+
+// TestHandleMessageAlbum tests that a two-photo album is saved as two linked rows
+// with a single tag prompt, and that tagging one item tags the album
+func TestHandleMessageAlbum(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(12345)
+	createTestUser(t, db, userID, "testuser")
+	photo := func(messageID int, mediaGroupID string) *tgbotapi.Message {
+		message := createTelegramMessage(messageID, userID, "testuser", "")
+		message.Chat.Type = "private"
+		message.Photo = []tgbotapi.PhotoSize{{FileID: fmt.Sprintf("photo%d", messageID), Width: 800, Height: 600}}
+		message.MediaGroupID = mediaGroupID
+		return message
+	}
+
+	prompts := 0
+	for _, message := range []*tgbotapi.Message{photo(1, "album1"), photo(2, "album1")} {
+		bot, called := newTestBotAPI(t)
+		handleMessage(bot, message, db, message.MessageID)
+		prompts += countMethod(called(), "sendMessage")
+	}
+	assert.Equal(t, 1, prompts, "Only the album's first item gets a tag prompt")
+
+	var linked int
+	assert.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM messages WHERE user_id = ? AND media_group_id = 'album1'`, userID).Scan(&linked))
+	assert.Equal(t, 2, linked)
+
+	// Tapping a tag on the prompt tags both photos
+	tagID := createTestTag(t, db, userID, "trip", "")
+	bot, _ := newTestBotAPI(t)
+	handleTagCallback(bot, createCallbackQuery("callback1", userID, "testuser", fmt.Sprintf("tag:%d:1", tagID)), db)
+	count, err := countTagMessages(db, tagID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// An item delivered after tagging takes the album's tags
+	bot, called := newTestBotAPI(t)
+	handleMessage(bot, photo(3, "album1"), db, 3)
+	assert.Equal(t, 0, countMethod(called(), "sendMessage"))
+	count, err = countTagMessages(db, tagID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	// A separate photo and another album each get their own prompt
+	for _, message := range []*tgbotapi.Message{photo(4, ""), photo(5, "album2")} {
+		bot, called := newTestBotAPI(t)
+		handleMessage(bot, message, db, message.MessageID)
+		assert.Equal(t, 1, countMethod(called(), "sendMessage"))
+	}
+	count, err = countTagMessages(db, tagID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count, "Tags don't spread outside the album")
+
+	// Untagging one item untags the album
+	firstID, err := getMessageByTelegramID(db, userID, 1)
+	assert.NoError(t, err)
+	removed, err := untagMessage(db, firstID, tagID)
+	assert.NoError(t, err)
+	assert.True(t, removed)
+	count, err = countTagMessages(db, tagID)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+// TestStatsResponse tests the /stats text
+func TestStatsResponse(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+
+	assert.Contains(t, statsResponse(db, user.ID), "You haven't saved any messages yet")
+
+	assert.NoError(t, saveMessage(db, createTestPhotoMessage(1, user, "", tgbotapi.PhotoSize{FileID: "photo", Width: 90, Height: 90})))
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(2, user, "note")))
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(3, user, "another")))
+	createTestTag(t, db, user.ID, "work", "")
+	_, err := db.Exec(`UPDATE messages SET created_at = '2024-03-05 10:00:00' WHERE user_id = ?`, user.ID)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "📊 Your stats:\n\nMessages saved: 3\n💬 Message: 2\n📷 Photo: 1\n\nTags: 1\nFirst saved: 2024-03-05", statsResponse(db, user.ID))
+}
+
+// TestHandleMessageWithoutSender tests that messages missing From or Chat are
+// skipped without a panic, a reply or a database write
+func TestHandleMessageWithoutSender(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	for name, message := range map[string]*tgbotapi.Message{
+		"No sender": {MessageID: 1, Chat: &tgbotapi.Chat{ID: 123, Type: "private"}, Text: "hello"},
+		"No chat":   {MessageID: 2, From: &tgbotapi.User{ID: 123, UserName: "testuser"}, Text: "hello"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			bot, called := newTestBotAPI(t)
+			assert.NotPanics(t, func() { handleMessage(bot, message, db, 1) })
+			assert.Empty(t, called())
+			assert.Equal(t, 0, countRows(t, db, "users"))
+			assert.Equal(t, 0, countRows(t, db, "messages"))
+		})
+	}
+}
+
+// TestHandleCallbackQueryWithoutSender tests that callbacks missing From or their
+// message are only answered
+func TestHandleCallbackQueryWithoutSender(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	noSender := createCallbackQuery("callback1", 123, "testuser", "tag:1:456")
+	noSender.From = nil
+	inline := createCallbackQuery("callback2", 123, "testuser", "tag:1:456")
+	inline.Message = nil
+	inline.InlineMessageID = "inline"
+
+	for name, callbackQuery := range map[string]*tgbotapi.CallbackQuery{"No sender": noSender, "Inline message": inline} {
+		t.Run(name, func(t *testing.T) {
+			bot, called := newTestBotAPI(t)
+			assert.NotPanics(t, func() { handleCallbackQuery(bot, callbackQuery, db) })
+			requests := called()
+			assert.Equal(t, 1, countMethod(requests, "answerCallbackQuery"))
+			assert.Len(t, requests, 1)
+			assert.Equal(t, 0, countRows(t, db, "message_tags"))
+		})
+	}
+}
+
+// TestExportCommand tests that /export sends the user's tags and messages as a JSON document
+func TestExportCommand(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	createTestUser(t, db, userID, "testuser")
+	work := createTestTag(t, db, userID, "work", "#FF0000")
+	createTestTag(t, db, userID, "music", "")
+	messageID := createTestMessage(t, db, userID, 10)
+	createTestMessageTag(t, db, messageID, work)
+	createTestMessage(t, db, userID, 11)
+
+	// Another user's data stays out of the export
+	createTestUser(t, db, 456, "other")
+	createTestTag(t, db, 456, "secret", "")
+	createTestMessage(t, db, 456, 12)
+
+	command := createTelegramMessage(20, userID, "testuser", "/export")
+	command.Chat.Type = "private"
+	bot, called := newTestBotAPI(t)
+	handleMessage(bot, command, db, 1)
+
+	requests := called()
+	if !assert.Len(t, requests, 1) {
+		return
+	}
+	assert.Equal(t, "sendDocument", requests[0].Method)
+	assert.Equal(t, "20", requests[0].Params.Get("reply_to_message_id"))
+	assert.Contains(t, requests[0].Params.Get("caption"), "2 messages and 2 tags")
+
+	var export storage.UserDataExport
+	if !assert.NoError(t, json.Unmarshal(requests[0].Files["document"], &export)) {
+		return
+	}
+	if assert.NotNil(t, export.User) {
+		assert.Equal(t, userID, export.User.TelegramID)
+	}
+	if assert.Len(t, export.Tags, 2) {
+		assert.Equal(t, "music", export.Tags[0].Name)
+		assert.Equal(t, "work", export.Tags[1].Name)
+	}
+	if assert.Len(t, export.Messages, 2) {
+		assert.Equal(t, int64(10), export.Messages[0].TelegramMessageID)
+		assert.Equal(t, []string{"work"}, export.Messages[0].Tags)
+		assert.Equal(t, int64(11), export.Messages[1].TelegramMessageID)
+		assert.Equal(t, []string{}, export.Messages[1].Tags)
+	}
+
+	// A failing export is reported instead of sending a document
+	db.Close()
+	bot, called = newTestBotAPI(t)
+	handleMessage(bot, command, db, 1)
+	requests = called()
+	assert.Equal(t, 0, countMethod(requests, "sendDocument"))
+	if assert.NotEmpty(t, requests) {
+		assert.Contains(t, requests[len(requests)-1].Params.Get("text"), "couldn't export your data")
+	}
+}
+
+// TestDeleteMyDataCommand tests that /deletemydata only deletes after a YES reply
+func TestDeleteMyDataCommand(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID, otherUserID := int64(123), int64(456)
+	for _, id := range []int64{userID, otherUserID} {
+		createTestUser(t, db, id, fmt.Sprintf("user%d", id))
+		for i := int64(1); i <= 2; i++ {
+			messageID := createTestMessage(t, db, id, i)
+			tagID := createTestTag(t, db, id, fmt.Sprintf("tag%d", i), "")
+			createTestMessageTag(t, db, messageID, tagID)
+		}
+	}
+
+	// counts returns the user's users, messages, tags and message_tags rows
+	counts := func(id int64) [4]int {
+		var c [4]int
+		queries := []string{
+			`SELECT COUNT(*) FROM users WHERE telegram_id = ?`,
+			`SELECT COUNT(*) FROM messages WHERE user_id = ?`,
+			`SELECT COUNT(*) FROM tags WHERE user_id = ?`,
+			`SELECT COUNT(*) FROM message_tags mt JOIN tags t ON t.id = mt.tag_id WHERE t.user_id = ?`,
+		}
+		for i, query := range queries {
+			assert.NoError(t, db.QueryRow(query, id).Scan(&c[i]))
+		}
+		return c
+	}
+
+	command := createTelegramMessage(20, userID, "user123", "/deletemydata")
+	command.Chat.Type = "private"
+	bot, called := newTestBotAPI(t)
+	handleMessage(bot, command, db, 1)
+	requests := called()
+	if !assert.Len(t, requests, 1) {
+		return
+	}
+	prompt := requests[0].Params.Get("text")
+	assert.Contains(t, prompt, deleteMyDataPromptMarker)
+	assert.Contains(t, requests[0].Params.Get("reply_markup"), `"force_reply":true`)
+	assert.Equal(t, [4]int{1, 2, 2, 2}, counts(userID))
+
+	reply := func(text string) []testBotRequest {
+		answer := createTelegramMessage(21, userID, "user123", text)
+		answer.Chat.Type = "private"
+		answer.ReplyToMessage = &tgbotapi.Message{MessageID: 30, Text: prompt, From: &tgbotapi.User{ID: 1, IsBot: true}}
+		bot, called := newTestBotAPI(t)
+		handleMessage(bot, answer, db, 2)
+		return called()
+	}
+
+	// Anything but YES cancels
+	for _, text := range []string{"no", "yes", "DELETE"} {
+		requests = reply(text)
+		if assert.Len(t, requests, 1) {
+			assert.Contains(t, requests[0].Params.Get("text"), "Deletion cancelled")
+		}
+		assert.Equal(t, [4]int{1, 2, 2, 2}, counts(userID))
+	}
+
+	requests = reply("YES")
+	if assert.Len(t, requests, 1) {
+		text := requests[0].Params.Get("text")
+		assert.Contains(t, text, "Messages: 2")
+		assert.Contains(t, text, "Tags: 2")
+		assert.Contains(t, text, "Tag links: 2")
+		assert.Contains(t, text, "Account records: 1")
+	}
+	assert.Equal(t, [4]int{0, 0, 0, 0}, counts(userID))
+	assert.Equal(t, [4]int{1, 2, 2, 2}, counts(otherUserID))
+}
+
+// TestHandleMessageTooLarge tests that an oversized message gets a friendly reply
+func TestHandleMessageTooLarge(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	message := createTelegramMessage(10, 123, "testuser", "")
+	message.Chat.Type = "private"
+	message.Document = &tgbotapi.Document{FileID: "doc", FileName: strings.Repeat("a", 300)}
+
+	bot, called := newTestBotAPI(t)
+	handleMessage(bot, message, db, 1)
+
+	requests := called()
+	if assert.Len(t, requests, 1) {
+		assert.Equal(t, "That message is too large for me to store.", requests[0].Params.Get("text"))
+	}
+	assert.Equal(t, 0, countRows(t, db, "messages"))
+	assert.Equal(t, 0, countRows(t, db, "pending_messages"))
+}
+
+// TestHandleMessageRedelivered tests that an update Telegram delivers again, e.g.
+// after a webhook timeout, is stored once and prompts for tags only once
+func TestHandleMessageRedelivered(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	message := createTelegramMessage(10, 123, "testuser", "Buy milk #groceries")
+	message.Chat.Type = "private"
+
+	bot, called := newTestBotAPI(t)
+	handleMessage(bot, message, db, 1)
+	handleMessage(bot, message, db, 1)
+
+	assert.Equal(t, 1, countRows(t, db, "messages"))
+	assert.Equal(t, 0, countRows(t, db, "pending_messages"))
+	requests := called()
+	assert.Equal(t, 1, countMethod(requests, "sendMessage"), "Only the first delivery shows the tag prompt")
+	for _, request := range requests {
+		assert.NotContains(t, request.Params.Get("text"), "couldn't save")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func init() {
+	// Set up structured JSON logging like the mini-app API
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	}))
+	slog.SetDefault(logger)
+}
+
+// logMessageTextEnabled reports whether LOG_MESSAGE_TEXT is set to a true
+// value. Message text and update bodies stay out of the logs unless it is.
+func logMessageTextEnabled() bool {
+	enabled, err := strconv.ParseBool(os.Getenv("LOG_MESSAGE_TEXT"))
+	return err == nil && enabled
+}
+
+// updateType names the kind of update for the update_type log field
+func updateType(update tgbotapi.Update) string {
+	switch {
+	case update.Message != nil:
+		return "message"
+	case update.EditedMessage != nil:
+		return "edited_message"
+	case update.CallbackQuery != nil:
+		return "callback_query"
+	case update.MyChatMember != nil:
+		return "my_chat_member"
+	}
+	return "other"
+}
+
+// updateLogger returns a logger carrying the update's ID and type, and the
+// sender and message when the update has them
+func updateLogger(update tgbotapi.Update) *slog.Logger {
+	logger := slog.Default().With("update_id", update.UpdateID, "update_type", updateType(update))
+	if userID := updateSenderID(update); userID != 0 {
+		logger = logger.With("user_id", userID)
+	}
+
+	var message *tgbotapi.Message
+	switch {
+	case update.Message != nil:
+		message = update.Message
+	case update.EditedMessage != nil:
+		message = update.EditedMessage
+	case update.CallbackQuery != nil:
+		message = update.CallbackQuery.Message
+	}
+	if message != nil {
+		logger = logger.With("message_id", message.MessageID)
+	}
+	return logger
+}
+
+// messageLogger returns a logger carrying the message's sender and ID, for code
+// handling a message update
+func messageLogger(message *tgbotapi.Message) *slog.Logger {
+	logger := slog.Default().With("update_type", "message", "message_id", message.MessageID)
+	if message.From != nil {
+		logger = logger.With("user_id", message.From.ID)
+	}
+	return logger
+}
+
+// callbackLogger returns a logger carrying the user who pressed a button and the
+// message the button belongs to
+func callbackLogger(callbackQuery *tgbotapi.CallbackQuery) *slog.Logger {
+	logger := slog.Default().With("update_type", "callback_query", "callback_query_id", callbackQuery.ID)
+	if callbackQuery.From != nil {
+		logger = logger.With("user_id", callbackQuery.From.ID)
+	}
+	if callbackQuery.Message != nil {
+		logger = logger.With("message_id", callbackQuery.Message.MessageID)
+	}
+	return logger
+}
+
+// userLogger returns a logger carrying the user, for code working on their data
+// outside of one message
+func userLogger(userID int64) *slog.Logger {
+	return slog.Default().With("user_id", userID)
+}
+
+// withText adds text the user typed, like a message or a tag name, to the
+// logger's fields. It's left out unless LOG_MESSAGE_TEXT is set.
+func withText(logger *slog.Logger, key, text string) *slog.Logger {
+	if !logMessageTextEnabled() {
+		return logger
+	}
+	return logger.With(key, text)
+}
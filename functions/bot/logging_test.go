@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// captureLogs collects JSON log records emitted for the rest of the test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+func parseLogRecords(t *testing.T, output string) []map[string]any {
+	var records []map[string]any
+	for _, raw := range strings.Split(strings.TrimSpace(output), "\n") {
+		if raw == "" {
+			continue
+		}
+		var record map[string]any
+		assert.NoError(t, json.Unmarshal([]byte(raw), &record), raw)
+		records = append(records, record)
+	}
+	return records
+}
+
+func findLogRecord(records []map[string]any, msg string) map[string]any {
+	for _, record := range records {
+		if record["msg"] == msg {
+			return record
+		}
+	}
+	return nil
+}
+
+// TestUpdateLogs tests that update logs are JSON records carrying the update's
+// fields, with message text only when LOG_MESSAGE_TEXT is set
+func TestUpdateLogs(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	bot, _ := newTestBotAPI(t)
+
+	update := func(updateID, messageID int) tgbotapi.Update {
+		message := createTelegramMessage(messageID, 12345, "testuser", "my secret plans")
+		message.Chat.Type = "private"
+		return tgbotapi.Update{UpdateID: updateID, Message: message}
+	}
+
+	t.Run("Text is left out by default", func(t *testing.T) {
+		output := captureLogs(t)
+
+		processUpdate(bot, update(2001, 10), nil, db)
+
+		records := parseLogRecords(t, output.String())
+		processing := findLogRecord(records, "Processing message")
+		if !assert.NotNil(t, processing) {
+			return
+		}
+		assert.Equal(t, "message", processing["update_type"])
+		assert.Equal(t, float64(2001), processing["update_id"])
+		assert.Equal(t, float64(12345), processing["user_id"])
+		assert.Equal(t, float64(10), processing["message_id"])
+
+		received := findLogRecord(records, "Received message")
+		if !assert.NotNil(t, received) {
+			return
+		}
+		assert.Equal(t, float64(12345), received["user_id"])
+		assert.Equal(t, float64(10), received["message_id"])
+		assert.NotContains(t, received, "text")
+		assert.NotContains(t, output.String(), "my secret plans")
+	})
+
+	t.Run("Text is logged when enabled", func(t *testing.T) {
+		t.Setenv("LOG_MESSAGE_TEXT", "true")
+		output := captureLogs(t)
+
+		processUpdate(bot, update(2002, 11), nil, db)
+
+		received := findLogRecord(parseLogRecords(t, output.String()), "Received message")
+		if !assert.NotNil(t, received) {
+			return
+		}
+		assert.Equal(t, "my secret plans", received["text"])
+	})
+
+	t.Run("Malformed body is left out by default", func(t *testing.T) {
+		captureMetrics(t)
+		output := captureLogs(t)
+
+		_, err := Handler(context.Background(), events.APIGatewayProxyRequest{Body: `{"message": {"text": "my secret plans"`})
+		assert.NoError(t, err)
+
+		record := findLogRecord(parseLogRecords(t, output.String()), "Error parsing update")
+		if !assert.NotNil(t, record) {
+			return
+		}
+		assert.Equal(t, "ERROR", record["level"])
+		assert.NotContains(t, record, "body")
+	})
+}
+
+// TestUpdateType tests the update_type log field
+func TestUpdateType(t *testing.T) {
+	tests := []struct {
+		update   tgbotapi.Update
+		expected string
+	}{
+		{tgbotapi.Update{Message: &tgbotapi.Message{}}, "message"},
+		{tgbotapi.Update{EditedMessage: &tgbotapi.Message{}}, "edited_message"},
+		{tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{}}, "callback_query"},
+		{tgbotapi.Update{MyChatMember: &tgbotapi.ChatMemberUpdated{}}, "my_chat_member"},
+		{tgbotapi.Update{}, "other"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, updateType(tt.update))
+	}
+}
+
+// TestTagNameLogs tests that tag names typed by the user are logged only when
+// LOG_MESSAGE_TEXT is set
+func TestTagNameLogs(t *testing.T) {
+	bot, _ := newTestBotAPI(t)
+	db := setupTestDB(t)
+	// With the database gone, the lookup fails and the handler logs what it looked for
+	db.Close()
+	message := createTelegramMessage(20, 12345, "testuser", "my secret tag")
+
+	t.Run("Left out by default", func(t *testing.T) {
+		output := captureLogs(t)
+
+		handleDeleteTagReply(bot, message, db)
+
+		record := findLogRecord(parseLogRecords(t, output.String()), "Error finding tag to delete")
+		if !assert.NotNil(t, record) {
+			return
+		}
+		assert.Equal(t, "message", record["update_type"])
+		assert.Equal(t, float64(12345), record["user_id"])
+		assert.Equal(t, float64(20), record["message_id"])
+		assert.NotContains(t, record, "tag_name")
+		assert.NotContains(t, output.String(), "my secret tag")
+	})
+
+	t.Run("Logged when enabled", func(t *testing.T) {
+		t.Setenv("LOG_MESSAGE_TEXT", "true")
+		output := captureLogs(t)
+
+		handleDeleteTagReply(bot, message, db)
+
+		record := findLogRecord(parseLogRecords(t, output.String()), "Error finding tag to delete")
+		if !assert.NotNil(t, record) {
+			return
+		}
+		assert.Equal(t, "my secret tag", record["tag_name"])
+	})
+}
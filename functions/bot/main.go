@@ -4,8 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
+	"runtime/debug"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -14,60 +16,170 @@ import (
 
 var db *sql.DB
 
+// maxLoggedBodyLength caps how much of a malformed update body is logged
+const maxLoggedBodyLength = 1000
+
 func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	log.Printf("Handler started - RequestID from context")
-
-	// Initialize database connection if not already done
-	if db == nil {
-		log.Printf("Initializing database connection...")
-		var err error
-		db, err = initDB()
-		if err != nil {
-			log.Printf("Failed to connect to database: %v", err)
-			return events.APIGatewayProxyResponse{StatusCode: 500}, nil
+	// Parse incoming webhook. Retrying can't fix a malformed update, so answer 200
+	// to stop Telegram from redelivering it, before any DB or Telegram work.
+	var update tgbotapi.Update
+	if err := json.Unmarshal([]byte(request.Body), &update); err != nil {
+		attrs := []any{"error", err}
+		// The body holds the user's message, so it's only logged on request
+		if logMessageTextEnabled() {
+			attrs = append(attrs, "body", truncateText(request.Body, maxLoggedBodyLength))
 		}
-		log.Printf("Database connection established")
+		slog.Error("Error parsing update", attrs...)
+		countMetric("update_parse_errors")
+		return events.APIGatewayProxyResponse{StatusCode: 200}, nil
 	}
 
-	// Get bot token from environment
-	botToken := os.Getenv("TELEGRAM_BOT_TOKEN")
-	if botToken == "" {
-		log.Printf("TELEGRAM_BOT_TOKEN not set")
+	logger := updateLogger(update)
+	logger.Info("Handler started")
+
+	if err := ensureDB(logger); err != nil {
+		logger.Error("Failed to connect to database", "error", err)
 		return events.APIGatewayProxyResponse{StatusCode: 500}, nil
 	}
 
-	// Create bot instance
-	log.Printf("Creating bot instance...")
-	bot, err := tgbotapi.NewBotAPI(botToken)
+	logger.Info("Creating bot instance")
+	bot, err := newBot()
 	if err != nil {
-		log.Printf("Failed to create bot: %v", err)
+		logger.Error("Failed to create bot", "error", err)
 		return events.APIGatewayProxyResponse{StatusCode: 500}, nil
 	}
 
-	// Parse incoming webhook
-	log.Printf("Parsing webhook data...")
-	var update tgbotapi.Update
-	if err := json.Unmarshal([]byte(request.Body), &update); err != nil {
-		log.Printf("Error parsing update: %v", err)
-		return events.APIGatewayProxyResponse{StatusCode: 400}, err
+	// Archive media bytes as well as metadata when enabled
+	archive, err := mediaArchiveFromEnv(bot)
+	if err != nil {
+		logger.Warn("Media archiving disabled", "error", err)
+	}
+	mediaArchive = archive
+
+	// Keep the raw update around for debugging/replay when enabled
+	if ttl, enabled := rawUpdateTTL(); enabled {
+		if err := saveRawUpdate(db, update.UpdateID, updateSenderID(update), request.Body, ttl); err != nil {
+			logger.Error("Error saving raw update", "error", err)
+		}
+	}
+
+	// A panic must still answer 200, otherwise Telegram keeps retrying the update
+	stop := timeMetric("update_duration")
+	if processUpdateSafely(bot, update, []byte(request.Body), db) {
+		countMetric("update_panics")
+	}
+	stop()
+
+	logger.Info("Handler completed successfully")
+	return events.APIGatewayProxyResponse{StatusCode: 200}, nil
+}
+
+// ensureDB connects to the database unless a warm instance already has
+func ensureDB(logger *slog.Logger) error {
+	if db != nil {
+		return nil
+	}
+	logger.Info("Initializing database connection")
+	conn, err := initDB()
+	if err != nil {
+		return err
+	}
+	db = conn
+	logger.Info("Database connection established")
+	return nil
+}
+
+// newBot creates the Telegram client from TELEGRAM_BOT_TOKEN
+func newBot() (*tgbotapi.BotAPI, error) {
+	botToken := os.Getenv("TELEGRAM_BOT_TOKEN")
+	if botToken == "" {
+		return nil, fmt.Errorf("TELEGRAM_BOT_TOKEN not set")
 	}
+	return tgbotapi.NewBotAPIWithClient(botToken, tgbotapi.APIEndpoint, newMetricsHTTPClient())
+}
+
+// processUpdate dispatches a parsed update to the matching handler. body is the
+// raw update JSON, needed for fields tgbotapi doesn't decode.
+func processUpdate(bot *tgbotapi.BotAPI, update tgbotapi.Update, body []byte, db *sql.DB) {
+	logger := updateLogger(update)
 
 	// Handle the message
 	if update.Message != nil {
-		log.Printf("Processing message from user %d", update.Message.From.ID)
-		handleMessage(bot, update.Message, db)
+		logger.Info("Processing message")
+		handleMessage(bot, update.Message, db, update.UpdateID)
+
+		// Media spoilers, quotes and stories aren't decoded by tgbotapi, so read them from the raw body
+		if fields := parseRawMessageFields(body); fields.hasValues() && update.Message.From != nil {
+			if err := saveRawMessageFields(db, update.Message.From.ID, update.Message.MessageID, fields); err != nil {
+				logger.Error("Error saving raw message fields", "error", err)
+			}
+		}
+	}
+
+	// Keep stored previews in sync with edits
+	if update.EditedMessage != nil {
+		logger.Info("Processing edited message")
+		handleEditedMessage(update.EditedMessage, db)
 	}
 
 	// Handle callback queries (button clicks)
 	if update.CallbackQuery != nil {
-		log.Printf("Processing callback query from user %d", update.CallbackQuery.From.ID)
+		logger.Info("Processing callback query", "callback_query_id", update.CallbackQuery.ID)
 		handleCallbackQuery(bot, update.CallbackQuery, db)
 	}
 
-	log.Printf("Handler completed successfully")
-	return events.APIGatewayProxyResponse{StatusCode: 200}, nil
+	// Handle the bot being added to/removed from a chat or blocked by a user
+	if update.MyChatMember != nil {
+		logger.Info("Processing chat member update", "chat_id", update.MyChatMember.Chat.ID)
+		handleMyChatMember(bot, update.MyChatMember, db)
+	}
+}
+
+// processUpdateSafely runs processUpdate, recovering from panics the way
+// gin.Recovery does for the API. It reports whether a panic was recovered.
+func processUpdateSafely(bot *tgbotapi.BotAPI, update tgbotapi.Update, body []byte, db *sql.DB) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			updateLogger(update).Error("Recovered from panic while processing update", "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			notifyTransientError(bot, update)
+		}
+	}()
+
+	processUpdate(bot, update, body, db)
+	return false
+}
+
+// notifyTransientError tells the user something went wrong, if there's a chat to tell
+func notifyTransientError(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
+	chat := update.FromChat()
+	if bot == nil || chat == nil {
+		return
+	}
+
+	text := fmt.Sprintf("Sorry, something went wrong. Please try again.\nIf this keeps happening, mention reference #%d when reporting it.", update.UpdateID)
+	msg := tgbotapi.NewMessage(chat.ID, text)
+	if _, err := bot.Send(msg); err != nil {
+		updateLogger(update).Error("Error sending transient error message", "error", err)
+	}
+}
+
+// updateSenderID returns the Telegram ID of the user behind an update, or 0 if unknown
+func updateSenderID(update tgbotapi.Update) int64 {
+	if from := update.SentFrom(); from != nil {
+		return from.ID
+	}
+	if update.MyChatMember != nil {
+		return update.MyChatMember.From.ID
+	}
+	return 0
 }
 
 func main() {
+	// One build serves both functions: the webhook and the scheduled jobs
+	if os.Getenv("BOT_FUNCTION") == "maintenance" {
+		lambda.Start(MaintenanceHandler)
+		return
+	}
 	lambda.Start(Handler)
 }
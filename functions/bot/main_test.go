@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestProcessUpdateSafely tests that panics while handling an update are recovered
+func TestProcessUpdateSafely(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	t.Run("Panicking update is recovered", func(t *testing.T) {
+		// Replying through a nil bot panics
+		update := tgbotapi.Update{
+			UpdateID: 1001,
+			Message: &tgbotapi.Message{
+				MessageID: 1,
+				From:      &tgbotapi.User{ID: 123},
+				Chat:      &tgbotapi.Chat{ID: 123, Type: "private"},
+				Text:      "/help",
+				Entities:  []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: 5}},
+			},
+		}
+
+		var panicked bool
+		assert.NotPanics(t, func() {
+			panicked = processUpdateSafely(nil, update, nil, db)
+		})
+		assert.True(t, panicked)
+	})
+
+	t.Run("Message without a sender is skipped", func(t *testing.T) {
+		update := tgbotapi.Update{
+			UpdateID: 1003,
+			Message: &tgbotapi.Message{
+				MessageID: 1,
+				Chat:      &tgbotapi.Chat{ID: 123, Type: "private"},
+				Text:      "hello",
+			},
+		}
+		assert.False(t, processUpdateSafely(nil, update, []byte(`{"message":{"has_media_spoiler":true}}`), db))
+		assert.Equal(t, 0, countRows(t, db, "messages"))
+	})
+
+	t.Run("Update without handlers doesn't report a panic", func(t *testing.T) {
+		panicked := processUpdateSafely(nil, tgbotapi.Update{UpdateID: 1002}, nil, db)
+		assert.False(t, panicked)
+	})
+}
+
+// TestHandlerMalformedUpdate tests that an unparseable update is acknowledged
+// without retries or DB writes
+func TestHandlerMalformedUpdate(t *testing.T) {
+	testDB := setupTestDB(t)
+	defer testDB.Close()
+
+	previousDB := db
+	db = testDB
+	defer func() { db = previousDB }()
+
+	t.Setenv("STORE_RAW_UPDATES", "true")
+	output := captureMetrics(t)
+
+	response, err := Handler(context.Background(), events.APIGatewayProxyRequest{Body: `{"update_id": 1, "message": {`})
+	assert.NoError(t, err)
+	assert.Equal(t, 200, response.StatusCode)
+
+	for _, table := range []string{"users", "messages", "raw_updates"} {
+		var count int
+		assert.NoError(t, testDB.QueryRow(`SELECT COUNT(*) FROM `+table).Scan(&count))
+		assert.Equal(t, 0, count, table)
+	}
+
+	assert.NotNil(t, findMetric(parseMetricLines(t, output.String()), "update_parse_errors"))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// MaintenanceEvent is what a timer trigger sends the function: one message per
+// firing, whose payload names the job
+type MaintenanceEvent struct {
+	Messages []struct {
+		Details struct {
+			Payload string `json:"payload"`
+		} `json:"details"`
+	} `json:"messages"`
+}
+
+// MaintenanceHandler is the entry point for the bot's scheduled work. Deploy this
+// code as a second function with BOT_FUNCTION=maintenance and point timer
+// triggers at it, carrying these payloads:
+//
+//	daily, weekly     send that frequency's digests, e.g. cron 0 9 * * ? * and 0 9 ? * MON *
+//	cleanup (or "")   only the purges below
+//	replay:<id>       re-run stored update <id> through processUpdate, to reproduce a
+//	                  user-reported bug; invoke it by hand rather than on a timer
+//
+// Every job but replay also deletes expired raw updates and media group records,
+// and untagged messages past their owner's /autodelete setting.
+func MaintenanceHandler(ctx context.Context, event MaintenanceEvent) error {
+	logger := slog.Default().With("update_type", "maintenance")
+	if err := ensureDB(logger); err != nil {
+		logger.Error("Failed to connect to database", "error", err)
+		return err
+	}
+
+	var failed error
+	for _, message := range event.Messages {
+		if err := runMaintenanceJob(db, message.Details.Payload, newBot); err != nil {
+			logger.Error("Maintenance job failed", "job", message.Details.Payload, "error", err)
+			failed = err
+		}
+	}
+	return failed
+}
+
+// runMaintenanceJob runs the purges and then the job named by payload. The
+// Telegram client is only created for jobs that talk to Telegram.
+func runMaintenanceJob(db *sql.DB, payload string, newBot func() (*tgbotapi.BotAPI, error)) error {
+	job := strings.TrimSpace(payload)
+	logger := slog.Default().With("update_type", "maintenance", "job", job)
+
+	// Replays reproduce a bug, so they leave everything else as it is
+	if value, ok := strings.CutPrefix(job, "replay:"); ok {
+		updateID, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid update ID to replay: %s", value)
+		}
+		bot, err := newBot()
+		if err != nil {
+			return err
+		}
+		return replayRawUpdate(bot, db, updateID)
+	}
+
+	if job != "" && job != "cleanup" {
+		if _, ok := digestPeriod(job); !ok {
+			return fmt.Errorf("unknown maintenance job: %s", job)
+		}
+	}
+
+	expired, err := purgeExpired(db)
+	if err != nil {
+		return err
+	}
+	untagged, err := purgeOldUntagged(db)
+	if err != nil {
+		return err
+	}
+	logger.Info("Purged expired data", "expired_rows", expired, "untagged_messages", untagged)
+
+	if job == "" || job == "cleanup" {
+		return nil
+	}
+	bot, err := newBot()
+	if err != nil {
+		return err
+	}
+	sent, err := sendDigests(bot, db, job)
+	if err != nil {
+		return err
+	}
+	logger.Info("Sent digests", "frequency", job, "count", sent)
+	return nil
+}
+
+// replayRawUpdate re-runs a stored update through processUpdate. It's a
+// maintenance helper for reproducing user-reported bugs exactly.
+func replayRawUpdate(bot *tgbotapi.BotAPI, db *sql.DB, updateID int) error {
+	body, err := getRawUpdate(db, updateID)
+	if err != nil {
+		return err
+	}
+
+	var update tgbotapi.Update
+	if err := json.Unmarshal([]byte(body), &update); err != nil {
+		return fmt.Errorf("failed to parse stored update %d: %v", updateID, err)
+	}
+
+	updateLogger(update).Info("Replaying update")
+	processUpdate(bot, update, []byte(body), db)
+	return nil
+}
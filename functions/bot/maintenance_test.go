@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRunMaintenanceJob tests the jobs timer triggers run: purges on every run,
+// digests for their frequency and replays on request
+func TestRunMaintenanceJob(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	createTestUser(t, db, userID, "testuser")
+	assert.NoError(t, setUntaggedRetention(db, userID, 7))
+	digestResponse(db, userID, "daily")
+
+	createTestMessage(t, db, userID, 1)
+	_, err := db.Exec(`INSERT INTO messages (user_id, telegram_message_id, message_type, created_at) VALUES (?, 2, 'text', ?)`,
+		userID, time.Now().UTC().AddDate(0, 0, -30))
+	assert.NoError(t, err)
+
+	assert.NoError(t, saveRawUpdate(db, 1001, userID, `{"update_id": 1001}`, time.Hour))
+	assert.NoError(t, saveRawUpdate(db, 1002, userID, `{"update_id": 1002}`, -time.Minute))
+	_, err = db.Exec(`INSERT INTO media_groups (user_id, media_group_id, telegram_message_id, created_at, expires_at) VALUES (?, 'album', 1, ?, ?)`,
+		userID, time.Now().UTC().Add(-2*time.Hour), time.Now().UTC().Add(-time.Hour))
+	assert.NoError(t, err)
+
+	noBot := func() (*tgbotapi.BotAPI, error) {
+		t.Error("Job shouldn't need Telegram")
+		return nil, errors.New("no bot")
+	}
+
+	t.Run("Cleanup purges expired and old untagged rows", func(t *testing.T) {
+		assert.NoError(t, runMaintenanceJob(db, "cleanup", noBot))
+
+		assert.Equal(t, 1, countRows(t, db, "raw_updates"))
+		assert.Equal(t, 0, countRows(t, db, "media_groups"))
+		assert.Equal(t, 1, countRows(t, db, "messages"), "Only the message past the retention window goes")
+	})
+
+	t.Run("Digest frequencies send digests", func(t *testing.T) {
+		bot, called := newTestBotAPI(t)
+		newBot := func() (*tgbotapi.BotAPI, error) { return bot, nil }
+
+		assert.NoError(t, runMaintenanceJob(db, "weekly", newBot))
+		assert.Equal(t, 0, countMethod(called(), "sendMessage"), "The user gets daily digests")
+
+		assert.NoError(t, runMaintenanceJob(db, "daily", newBot))
+		requests := called()
+		if assert.Equal(t, 1, countMethod(requests, "sendMessage")) {
+			assert.Equal(t, "123", requests[0].Params.Get("chat_id"))
+		}
+	})
+
+	t.Run("Replay", func(t *testing.T) {
+		bot, _ := newTestBotAPI(t)
+		newBot := func() (*tgbotapi.BotAPI, error) { return bot, nil }
+
+		assert.NoError(t, runMaintenanceJob(db, "replay:1001", newBot))
+		assert.Error(t, runMaintenanceJob(db, "replay:9999", newBot))
+		assert.Error(t, runMaintenanceJob(db, "replay:abc", noBot))
+	})
+
+	t.Run("Unknown job", func(t *testing.T) {
+		assert.Error(t, runMaintenanceJob(db, "yearly", noBot))
+	})
+}
+
+// TestClaimMediaGroupExpired tests that an expired album record not yet purged
+// is claimed like a new one
+func TestClaimMediaGroupExpired(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	createTestUser(t, db, userID, "testuser")
+	_, err := db.Exec(`INSERT INTO media_groups (user_id, media_group_id, telegram_message_id, created_at, expires_at) VALUES (?, 'album', 1, ?, ?)`,
+		userID, time.Now().UTC().Add(-2*time.Hour), time.Now().UTC().Add(-time.Hour))
+	assert.NoError(t, err)
+
+	first, err := claimMediaGroup(db, userID, "album", 5)
+	assert.NoError(t, err)
+	assert.True(t, first)
+
+	first, err = claimMediaGroup(db, userID, "album", 6)
+	assert.NoError(t, err)
+	assert.False(t, first, "The fresh claim holds")
+	assert.Equal(t, 1, countRows(t, db, "media_groups"))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"telegram-content-organizer-shared/storage"
+)
+
+// maxMediaDownloadSize is the largest file the Bot API lets bots download
+const maxMediaDownloadSize = 20 * 1024 * 1024
+
+// mediaDownloadTimeout bounds a single media download
+const mediaDownloadTimeout = 30 * time.Second
+
+// ObjectStore keeps archived media bytes. Put stores data under key, replacing
+// any existing object. Delete removes the object; a missing one isn't an error.
+type ObjectStore interface {
+	Put(key string, data []byte, contentType string) error
+	Delete(key string) error
+}
+
+// MediaArchive copies media into an ObjectStore so it survives Telegram purging
+// the file. Fetch downloads a file's bytes by its file_id.
+type MediaArchive struct {
+	Store ObjectStore
+	Fetch func(fileID string) ([]byte, error)
+}
+
+// mediaArchive is used by saveMessage. It's nil unless STORE_MEDIA is enabled,
+// in which case only metadata is stored.
+var mediaArchive *MediaArchive
+
+// archive stores the message's file and returns its storage key. Failures are
+// logged and return an invalid key, so the metadata is still saved.
+func (a *MediaArchive) archive(userID int64, metadata FileMetadata) sql.NullString {
+	if a == nil || !metadata.FileID.Valid {
+		return sql.NullString{}
+	}
+	if metadata.FileSize.Valid && metadata.FileSize.Int64 > maxMediaDownloadSize {
+		userLogger(userID).Info("Not archiving file too large to download", "file_size", metadata.FileSize.Int64)
+		return sql.NullString{}
+	}
+
+	data, err := a.Fetch(metadata.FileID.String)
+	if err != nil {
+		userLogger(userID).Error("Error downloading media", "error", err)
+		countMetric("media_archive_errors", "stage", "download")
+		return sql.NullString{}
+	}
+
+	key := mediaKey(userID, metadata.FileID.String)
+	contentType := "application/octet-stream"
+	if metadata.MimeType.Valid {
+		contentType = metadata.MimeType.String
+	}
+	if err := a.Store.Put(key, data, contentType); err != nil {
+		userLogger(userID).Error("Error storing media", "error", err)
+		countMetric("media_archive_errors", "stage", "store")
+		return sql.NullString{}
+	}
+
+	countMetric("media_archived")
+	return sql.NullString{String: key, Valid: true}
+}
+
+// remove deletes archived objects whose messages were deleted. Failures are
+// logged: the rows are already gone, so the deletion can't be undone.
+func (a *MediaArchive) remove(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	if a == nil {
+		slog.Warn("Not deleting archived media: STORE_MEDIA is disabled", "count", len(keys))
+		return
+	}
+	for _, key := range keys {
+		if err := a.Store.Delete(key); err != nil {
+			slog.Error("Error deleting archived media", "media_key", key, "error", err)
+			countMetric("media_archive_errors", "stage", "delete")
+		}
+	}
+}
+
+// mediaKey is where a user's file is stored
+func mediaKey(userID int64, fileID string) string {
+	return fmt.Sprintf("media/%d/%s", userID, fileID)
+}
+
+// mediaArchiveFromEnv returns the archive configured by the environment, or nil
+// when STORE_MEDIA isn't enabled:
+//
+//	STORE_MEDIA      "true" to archive media bytes
+//	STORE_MEDIA_DIR  directory objects are written to, e.g. a mounted bucket
+func mediaArchiveFromEnv(bot *tgbotapi.BotAPI) (*MediaArchive, error) {
+	enabled, err := strconv.ParseBool(os.Getenv("STORE_MEDIA"))
+	if err != nil || !enabled {
+		return nil, nil
+	}
+
+	dir := os.Getenv("STORE_MEDIA_DIR")
+	if dir == "" {
+		return nil, fmt.Errorf("STORE_MEDIA is enabled but STORE_MEDIA_DIR is not set")
+	}
+	return &MediaArchive{Store: storage.DirObjectStore{Root: dir}, Fetch: telegramFileFetcher(bot)}, nil
+}
+
+// telegramFileFetcher downloads files through the Bot API
+func telegramFileFetcher(bot *tgbotapi.BotAPI) func(fileID string) ([]byte, error) {
+	client := &http.Client{Timeout: mediaDownloadTimeout}
+	return func(fileID string) ([]byte, error) {
+		url, err := bot.GetFileDirectURL(fileID)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, maxMediaDownloadSize+1))
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+
+	"telegram-content-organizer-shared/storage"
+)
+
+// mockObjectStore records what was Put, or fails with err
+type mockObjectStore struct {
+	objects      map[string][]byte
+	contentTypes map[string]string
+	err          error
+}
+
+func newMockObjectStore() *mockObjectStore {
+	return &mockObjectStore{objects: map[string][]byte{}, contentTypes: map[string]string{}}
+}
+
+func (s *mockObjectStore) Put(key string, data []byte, contentType string) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.objects[key] = data
+	s.contentTypes[key] = contentType
+	return nil
+}
+
+func (s *mockObjectStore) Delete(key string) error {
+	if s.err != nil {
+		return s.err
+	}
+	delete(s.objects, key)
+	delete(s.contentTypes, key)
+	return nil
+}
+
+// useMediaArchive swaps in archive for the duration of the test
+func useMediaArchive(t *testing.T, archive *MediaArchive) {
+	original := mediaArchive
+	mediaArchive = archive
+	t.Cleanup(func() { mediaArchive = original })
+}
+
+func TestSaveMessageArchivesMedia(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+
+	getMediaKey := func(telegramMessageID int) sql.NullString {
+		var key sql.NullString
+		query := `SELECT media_key FROM messages WHERE user_id = ? AND telegram_message_id = ?`
+		assert.NoError(t, db.QueryRow(query, user.ID, telegramMessageID).Scan(&key))
+		return key
+	}
+
+	store := newMockObjectStore()
+	var fetched []string
+	var fetchErr error
+	useMediaArchive(t, &MediaArchive{
+		Store: store,
+		Fetch: func(fileID string) ([]byte, error) {
+			fetched = append(fetched, fileID)
+			return []byte("bytes of " + fileID), fetchErr
+		},
+	})
+
+	// Media is downloaded and its key recorded
+	document := &tgbotapi.Message{
+		MessageID: 1,
+		From:      user,
+		Chat:      &tgbotapi.Chat{ID: user.ID},
+		Document:  &tgbotapi.Document{FileID: "doc1", MimeType: "application/pdf"},
+	}
+	assert.NoError(t, saveMessage(db, document))
+	key := getMediaKey(1)
+	assert.Equal(t, sql.NullString{String: "media/123/doc1", Valid: true}, key)
+	assert.Equal(t, []byte("bytes of doc1"), store.objects[key.String])
+	assert.Equal(t, "application/pdf", store.contentTypes[key.String])
+
+	// Text has nothing to archive
+	fetched = nil
+	assert.NoError(t, saveMessage(db, createTestMessageStruct(2, user, "just text")))
+	assert.Empty(t, fetched)
+	assert.False(t, getMediaKey(2).Valid)
+
+	// Files over the download limit are skipped without trying
+	large := createTestPhotoMessage(3, user, "", tgbotapi.PhotoSize{FileID: "large", FileSize: maxMediaDownloadSize + 1})
+	assert.NoError(t, saveMessage(db, large))
+	assert.Empty(t, fetched)
+	assert.False(t, getMediaKey(3).Valid)
+
+	// A failed download still saves the metadata
+	fetchErr = errors.New("file is gone")
+	assert.NoError(t, saveMessage(db, createTestPhotoMessage(4, user, "", tgbotapi.PhotoSize{FileID: "gone"})))
+	assert.Equal(t, []string{"gone"}, fetched)
+	assert.False(t, getMediaKey(4).Valid)
+	var fileID string
+	assert.NoError(t, db.QueryRow(`SELECT file_id FROM messages WHERE telegram_message_id = 4`).Scan(&fileID))
+	assert.Equal(t, "gone", fileID)
+
+	// A failed re-download keeps the key from the first save
+	assert.NoError(t, saveMessage(db, document))
+	assert.Equal(t, key, getMediaKey(1))
+
+	// A failed upload also still saves the metadata
+	fetchErr = nil
+	store.err = errors.New("bucket unavailable")
+	assert.NoError(t, saveMessage(db, createTestPhotoMessage(5, user, "", tgbotapi.PhotoSize{FileID: "photo5"})))
+	assert.False(t, getMediaKey(5).Valid)
+}
+
+func TestSaveMessageWithoutMediaArchive(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	useMediaArchive(t, nil)
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+
+	assert.NoError(t, saveMessage(db, createTestPhotoMessage(1, user, "", tgbotapi.PhotoSize{FileID: "photo1"})))
+	var key sql.NullString
+	assert.NoError(t, db.QueryRow(`SELECT media_key FROM messages WHERE telegram_message_id = 1`).Scan(&key))
+	assert.False(t, key.Valid)
+}
+
+func TestMediaArchiveFromEnv(t *testing.T) {
+	t.Run("disabled by default", func(t *testing.T) {
+		t.Setenv("STORE_MEDIA", "")
+		archive, err := mediaArchiveFromEnv(nil)
+		assert.NoError(t, err)
+		assert.Nil(t, archive)
+	})
+
+	t.Run("enabled without a directory", func(t *testing.T) {
+		t.Setenv("STORE_MEDIA", "true")
+		t.Setenv("STORE_MEDIA_DIR", "")
+		archive, err := mediaArchiveFromEnv(nil)
+		assert.Error(t, err)
+		assert.Nil(t, archive)
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		dir := t.TempDir()
+		t.Setenv("STORE_MEDIA", "true")
+		t.Setenv("STORE_MEDIA_DIR", dir)
+		archive, err := mediaArchiveFromEnv(nil)
+		assert.NoError(t, err)
+		if assert.NotNil(t, archive) {
+			assert.Equal(t, storage.DirObjectStore{Root: dir}, archive.Store)
+		}
+	})
+}
+
+// TestDeletingMessagesRemovesMedia tests that the wipe and the untagged purge
+// don't leave archived media behind
+func TestDeletingMessagesRemovesMedia(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	store := newMockObjectStore()
+	useMediaArchive(t, &MediaArchive{
+		Store: store,
+		Fetch: func(fileID string) ([]byte, error) { return []byte(fileID), nil },
+	})
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	other := createTestUserStruct(456, "other", "Other", "User")
+	assert.NoError(t, saveUser(db, user))
+	assert.NoError(t, saveUser(db, other))
+
+	t.Run("Wipe", func(t *testing.T) {
+		assert.NoError(t, saveMessage(db, createTestPhotoMessage(1, user, "", tgbotapi.PhotoSize{FileID: "mine"})))
+		assert.NoError(t, saveMessage(db, createTestPhotoMessage(1, other, "", tgbotapi.PhotoSize{FileID: "theirs"})))
+
+		_, err := deleteAllUserData(db, user.ID, false)
+		assert.NoError(t, err)
+		assert.NotContains(t, store.objects, "media/123/mine")
+		assert.Contains(t, store.objects, "media/456/theirs")
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		assert.NoError(t, setUntaggedRetention(db, user.ID, 30))
+		assert.NoError(t, saveMessage(db, createTestPhotoMessage(2, user, "", tgbotapi.PhotoSize{FileID: "old"})))
+		assert.NoError(t, saveMessage(db, createTestPhotoMessage(3, user, "", tgbotapi.PhotoSize{FileID: "shared"})))
+		assert.NoError(t, saveMessage(db, createTestPhotoMessage(4, user, "", tgbotapi.PhotoSize{FileID: "shared"})))
+
+		// Messages 2 and 3 are old and untagged; 4 is recent and keeps the shared file
+		_, err := db.Exec(`UPDATE messages SET created_at = ? WHERE user_id = ? AND telegram_message_id IN (2, 3)`,
+			time.Now().UTC().AddDate(0, 0, -40), user.ID)
+		assert.NoError(t, err)
+
+		deleted, err := purgeOldUntagged(db)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), deleted)
+		assert.NotContains(t, store.objects, "media/123/old")
+		assert.Contains(t, store.objects, "media/123/shared", "Objects still used by a message are kept")
+	})
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"os"
 	"regexp"
 	"strings"
 
@@ -20,15 +22,44 @@ const (
 	MessageTypeVoice     MessageType = "voice"
 	MessageTypeVideoNote MessageType = "video_note"
 	MessageTypeSticker   MessageType = "sticker"
+	MessageTypeStory     MessageType = "story"
+	MessageTypeAnimation MessageType = "animation"
+	MessageTypeLocation  MessageType = "location"
+	// MessageTypeUnknown marks messages with no text and no media we recognize,
+	// e.g. a message kind added to Telegram after this bot was written
+	MessageTypeUnknown MessageType = "unknown"
 )
 
+// knownMessageTypes lists every MessageType, e.g. to validate user settings
+var knownMessageTypes = []MessageType{
+	MessageTypeText, MessageTypePhoto, MessageTypeVideo, MessageTypeDocument, MessageTypeAudio,
+	MessageTypeVoice, MessageTypeVideoNote, MessageTypeSticker, MessageTypeStory, MessageTypeAnimation,
+	MessageTypeLocation, MessageTypeUnknown,
+}
+
+// parseMessageType returns the MessageType with this name, ignoring case
+func parseMessageType(name string) (MessageType, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, messageType := range knownMessageTypes {
+		if string(messageType) == name {
+			return messageType, true
+		}
+	}
+	return "", false
+}
+
 // FileMetadata contains file information extracted from a Telegram message
 type FileMetadata struct {
-	FileID   sql.NullString
-	FileName sql.NullString
-	MimeType sql.NullString
-	FileSize sql.NullInt64
-	Duration sql.NullInt32
+	FileID      sql.NullString
+	FileName    sql.NullString
+	MimeType    sql.NullString
+	FileSize    sql.NullInt64
+	Duration    sql.NullInt32
+	Width       sql.NullInt32
+	Height      sql.NullInt32
+	ThumbFileID sql.NullString
+	ThumbWidth  sql.NullInt32
+	ThumbHeight sql.NullInt32
 }
 
 func extractURLs(text, caption string) []string {
@@ -40,9 +71,34 @@ func extractURLs(text, caption string) []string {
 	if caption != "" {
 		urls = append(urls, urlRegex.FindAllString(caption, -1)...)
 	}
+	for i, url := range urls {
+		urls[i] = trimURLPunctuation(url)
+	}
 	return urls
 }
 
+// trimURLPunctuation strips punctuation that ends the surrounding sentence
+// rather than the URL, e.g. "https://example.com." or "(https://example.com)".
+// Closing brackets are kept when the URL opened them, as in
+// "https://en.wikipedia.org/wiki/Go_(programming_language)".
+func trimURLPunctuation(url string) string {
+	for url != "" {
+		last := url[len(url)-1]
+		switch last {
+		case '.', ',', ';', ':', '!', '?', '\'', '"':
+		case ')', ']', '}':
+			open := map[byte]string{')': "(", ']': "[", '}': "{"}[last]
+			if strings.Count(url, open) >= strings.Count(url, string(last)) {
+				return url
+			}
+		default:
+			return url
+		}
+		url = url[:len(url)-1]
+	}
+	return url
+}
+
 func extractHashtags(text, caption string) []string {
 	hashtagRegex := regexp.MustCompile(`#\w+`)
 	var hashtags []string
@@ -55,22 +111,184 @@ func extractHashtags(text, caption string) []string {
 	for i, tag := range hashtags {
 		hashtags[i] = strings.TrimPrefix(tag, "#")
 	}
-	return hashtags
+	return uniqueFold(removeIgnored(hashtags, ignoredValues("IGNORED_HASHTAGS", "#")))
 }
 
+// extractMentions finds @usernames. A mention must start the text or follow
+// whitespace, so the domain of user@example.com isn't one. Adjacent mentions
+// like "@a@b" count as one run starting at the first "@" and yield both.
 func extractMentions(text, caption string) []string {
-	mentionRegex := regexp.MustCompile(`@\w+`)
+	mentionRegex := regexp.MustCompile(`(?:^|\s)((?:@\w+)+)`)
 	var mentions []string
-	if text != "" {
-		mentions = append(mentions, mentionRegex.FindAllString(text, -1)...)
+	for _, s := range []string{text, caption} {
+		for _, match := range mentionRegex.FindAllStringSubmatch(s, -1) {
+			mentions = append(mentions, strings.Split(strings.TrimPrefix(match[1], "@"), "@")...)
+		}
 	}
-	if caption != "" {
-		mentions = append(mentions, mentionRegex.FindAllString(caption, -1)...)
+	return uniqueFold(removeIgnored(mentions, ignoredValues("IGNORED_MENTIONS", "@")))
+}
+
+// ignoredValues reads a comma-separated ignore-list from env, e.g.
+// IGNORED_HASHTAGS="#sentfrommyphone, ad". Entries are lowercased and the
+// optional prefix is stripped. An unset variable ignores nothing.
+func ignoredValues(envKey, prefix string) map[string]bool {
+	ignored := make(map[string]bool)
+	for _, value := range strings.Split(os.Getenv(envKey), ",") {
+		value = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(value), prefix))
+		if value != "" {
+			ignored[value] = true
+		}
+	}
+	return ignored
+}
+
+// removeIgnored drops values found in ignored, matching case-insensitively
+func removeIgnored(values []string, ignored map[string]bool) []string {
+	if len(ignored) == 0 {
+		return values
+	}
+	var kept []string
+	for _, value := range values {
+		if !ignored[strings.ToLower(value)] {
+			kept = append(kept, value)
+		}
+	}
+	return kept
+}
+
+// uniqueFold drops repeated values, keeping the first one's spelling and
+// position. Repeats match case-insensitively: Telegram treats hashtags and
+// usernames that way, so "#Work #work" is one hashtag, like tag names here.
+func uniqueFold(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	var unique []string
+	for _, value := range values {
+		if key := strings.ToLower(value); !seen[key] {
+			seen[key] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// hasSpoilerEntity reports whether any part of the text or caption is marked as a spoiler
+func hasSpoilerEntity(message *tgbotapi.Message) bool {
+	for _, entity := range message.Entities {
+		if entity.Type == "spoiler" {
+			return true
+		}
+	}
+	for _, entity := range message.CaptionEntities {
+		if entity.Type == "spoiler" {
+			return true
+		}
+	}
+	return false
+}
+
+// RawMessageFields holds message fields added to the Bot API after tgbotapi v5.5.1,
+// which drops them when decoding updates
+type RawMessageFields struct {
+	HasMediaSpoiler bool `json:"has_media_spoiler"`
+	Quote           *struct {
+		Text string `json:"text"`
+	} `json:"quote"`
+	Story *RawStory `json:"story"`
+}
+
+// RawStory references a forwarded story. The Bot API only exposes the posting
+// chat and story ID, not the story content.
+type RawStory struct {
+	ID   int `json:"id"`
+	Chat struct {
+		ID       int64  `json:"id"`
+		Username string `json:"username"`
+	} `json:"chat"`
+}
+
+// hasValues reports whether any field needs saveRawMessageFields
+func (f RawMessageFields) hasValues() bool {
+	return f.HasMediaSpoiler || f.Quote != nil || f.Story != nil
+}
+
+// messageType refines the type detected by getMessageType with fields tgbotapi
+// doesn't decode. Stories arrive without text, so they'd otherwise look unknown.
+func (f RawMessageFields) messageType(detected MessageType) MessageType {
+	if detected == MessageTypeUnknown && f.Story != nil {
+		return MessageTypeStory
+	}
+	return detected
+}
+
+// parseRawMessageFields reads RawMessageFields of update.message from the raw update body
+func parseRawMessageFields(body []byte) RawMessageFields {
+	var update struct {
+		Message *RawMessageFields `json:"message"`
+	}
+	if err := json.Unmarshal(body, &update); err != nil || update.Message == nil {
+		return RawMessageFields{}
+	}
+	return *update.Message
+}
+
+// typeEmoji returns an icon for the message type, matching the mini-app's icons
+func typeEmoji(messageType MessageType) string {
+	switch messageType {
+	case MessageTypePhoto:
+		return "📷"
+	case MessageTypeVideo:
+		return "🎥"
+	case MessageTypeDocument:
+		return "📄"
+	case MessageTypeAudio:
+		return "🎵"
+	case MessageTypeVoice:
+		return "🎤"
+	case MessageTypeVideoNote:
+		return "📹"
+	case MessageTypeSticker:
+		return "🏷️"
+	case MessageTypeStory:
+		return "📖"
+	case MessageTypeAnimation:
+		return "🎬"
+	case MessageTypeLocation:
+		return "📍"
+	case MessageTypeUnknown:
+		return "❓"
+	default:
+		return "💬"
 	}
-	for i, mention := range mentions {
-		mentions[i] = strings.TrimPrefix(mention, "@")
+}
+
+// typeLabel returns a human-readable name for the message type
+func typeLabel(messageType MessageType) string {
+	switch messageType {
+	case MessageTypePhoto:
+		return "Photo"
+	case MessageTypeVideo:
+		return "Video"
+	case MessageTypeDocument:
+		return "Document"
+	case MessageTypeAudio:
+		return "Audio"
+	case MessageTypeVoice:
+		return "Voice message"
+	case MessageTypeVideoNote:
+		return "Video note"
+	case MessageTypeSticker:
+		return "Sticker"
+	case MessageTypeStory:
+		return "Story"
+	case MessageTypeAnimation:
+		return "GIF"
+	case MessageTypeLocation:
+		return "Location"
+	case MessageTypeUnknown:
+		return "Unsupported message"
+	default:
+		return "Message"
 	}
-	return mentions
 }
 
 func getMessageType(message *tgbotapi.Message) MessageType {
@@ -80,6 +298,10 @@ func getMessageType(message *tgbotapi.Message) MessageType {
 	if message.Video != nil {
 		return MessageTypeVideo
 	}
+	// Telegram also sets Document on animations for older clients
+	if message.Animation != nil {
+		return MessageTypeAnimation
+	}
 	if message.Document != nil {
 		return MessageTypeDocument
 	}
@@ -95,6 +317,13 @@ func getMessageType(message *tgbotapi.Message) MessageType {
 	if message.Sticker != nil {
 		return MessageTypeSticker
 	}
+	// Venues come with their Location set too
+	if message.Venue != nil || message.Location != nil {
+		return MessageTypeLocation
+	}
+	if message.Text == "" {
+		return MessageTypeUnknown
+	}
 	return MessageTypeText
 }
 
@@ -104,11 +333,17 @@ func extractFileMetadata(message *tgbotapi.Message, messageType MessageType) Fil
 	switch messageType {
 	case MessageTypePhoto:
 		if len(message.Photo) > 0 {
-			photo := message.Photo[0] // Get the smallest photo (thumbnail)
+			// Keep the full-size photo as the file and the smallest as the thumbnail for grids
+			thumb, photo := photoSizeRange(message.Photo)
 			metadata.FileID = sql.NullString{String: photo.FileID, Valid: true}
 			if photo.FileSize != 0 {
 				metadata.FileSize = sql.NullInt64{Int64: int64(photo.FileSize), Valid: true}
 			}
+			metadata.Width = sql.NullInt32{Int32: int32(photo.Width), Valid: true}
+			metadata.Height = sql.NullInt32{Int32: int32(photo.Height), Valid: true}
+			metadata.ThumbFileID = sql.NullString{String: thumb.FileID, Valid: true}
+			metadata.ThumbWidth = sql.NullInt32{Int32: int32(thumb.Width), Valid: true}
+			metadata.ThumbHeight = sql.NullInt32{Int32: int32(thumb.Height), Valid: true}
 		}
 	case MessageTypeVideo:
 		if message.Video != nil {
@@ -139,6 +374,22 @@ func extractFileMetadata(message *tgbotapi.Message, messageType MessageType) Fil
 				metadata.FileSize = sql.NullInt64{Int64: int64(message.Document.FileSize), Valid: true}
 			}
 		}
+	case MessageTypeAnimation:
+		if message.Animation != nil {
+			metadata.FileID = sql.NullString{String: message.Animation.FileID, Valid: true}
+			if message.Animation.FileName != "" {
+				metadata.FileName = sql.NullString{String: message.Animation.FileName, Valid: true}
+			}
+			if message.Animation.MimeType != "" {
+				metadata.MimeType = sql.NullString{String: message.Animation.MimeType, Valid: true}
+			}
+			if message.Animation.FileSize != 0 {
+				metadata.FileSize = sql.NullInt64{Int64: int64(message.Animation.FileSize), Valid: true}
+			}
+			if message.Animation.Duration != 0 {
+				metadata.Duration = sql.NullInt32{Int32: int32(message.Animation.Duration), Valid: true}
+			}
+		}
 	case MessageTypeAudio:
 		if message.Audio != nil {
 			metadata.FileID = sql.NullString{String: message.Audio.FileID, Valid: true}
@@ -172,3 +423,48 @@ func extractFileMetadata(message *tgbotapi.Message, messageType MessageType) Fil
 
 	return metadata
 }
+
+// LocationData is where a location message points to; venues add the place's
+// title and address
+type LocationData struct {
+	Latitude     sql.NullFloat64
+	Longitude    sql.NullFloat64
+	VenueTitle   sql.NullString
+	VenueAddress sql.NullString
+}
+
+func extractLocation(message *tgbotapi.Message) LocationData {
+	var data LocationData
+
+	location := message.Location
+	if message.Venue != nil {
+		location = &message.Venue.Location
+		if message.Venue.Title != "" {
+			data.VenueTitle = sql.NullString{String: message.Venue.Title, Valid: true}
+		}
+		if message.Venue.Address != "" {
+			data.VenueAddress = sql.NullString{String: message.Venue.Address, Valid: true}
+		}
+	}
+	if location != nil {
+		data.Latitude = sql.NullFloat64{Float64: location.Latitude, Valid: true}
+		data.Longitude = sql.NullFloat64{Float64: location.Longitude, Valid: true}
+	}
+
+	return data
+}
+
+// photoSizeRange returns the smallest and largest of a photo's sizes by pixel
+// count. Telegram usually lists them in ascending order, but doesn't promise it.
+func photoSizeRange(sizes []tgbotapi.PhotoSize) (smallest, largest tgbotapi.PhotoSize) {
+	smallest, largest = sizes[0], sizes[0]
+	for _, size := range sizes[1:] {
+		if size.Width*size.Height < smallest.Width*smallest.Height {
+			smallest = size
+		}
+		if size.Width*size.Height > largest.Width*largest.Height {
+			largest = size
+		}
+	}
+	return smallest, largest
+}
@@ -64,6 +64,15 @@ func createVideoNoteMessage(videoNote *tgbotapi.VideoNote) *tgbotapi.Message {
 	}
 }
 
+func createAnimationMessage(caption string, animation *tgbotapi.Animation, document *tgbotapi.Document) *tgbotapi.Message {
+	return &tgbotapi.Message{
+		MessageID: 1,
+		Animation: animation,
+		Document:  document,
+		Caption:   caption,
+	}
+}
+
 func createStickerMessage(sticker *tgbotapi.Sticker) *tgbotapi.Message {
 	return &tgbotapi.Message{
 		MessageID: 1,
@@ -157,6 +166,32 @@ func TestExtractURLs(t *testing.T) {
 			expected: []string{"https://site1.com", "https://site2.org", "https://site3.net"},
 		},
 		
+		// Trailing punctuation
+		{
+			name:     "URL ending a sentence",
+			text:     "See https://example.com. Or https://example.org/docs/, https://example.net!",
+			caption:  "",
+			expected: []string{"https://example.com", "https://example.org/docs/", "https://example.net"},
+		},
+		{
+			name:     "URL in parentheses",
+			text:     "The site (https://x.com) and [https://y.com/path]; also \"https://z.com\"",
+			caption:  "",
+			expected: []string{"https://x.com", "https://y.com/path", "https://z.com"},
+		},
+		{
+			name:     "URL with a trailing query",
+			text:     "Search https://example.com/search?q=1 now, or ask https://example.com?",
+			caption:  "",
+			expected: []string{"https://example.com/search?q=1", "https://example.com"},
+		},
+		{
+			name:     "URL with its own parentheses",
+			text:     "Read https://en.wikipedia.org/wiki/Go_(programming_language). It's (https://en.wikipedia.org/wiki/Go_(programming_language))",
+			caption:  "",
+			expected: []string{"https://en.wikipedia.org/wiki/Go_(programming_language)", "https://en.wikipedia.org/wiki/Go_(programming_language)"},
+		},
+
 		// Invalid cases that should not match
 		{
 			name:     "Invalid protocols",
@@ -241,6 +276,18 @@ func TestExtractHashtags(t *testing.T) {
 			caption:  "",
 			expected: []string{"JavaScript", "HTML5", "css3", "NodeJS"},
 		},
+		{
+			name:     "Repeated hashtags are kept once",
+			text:     "#work #todo #work",
+			caption:  "",
+			expected: []string{"work", "todo"},
+		},
+		{
+			name:     "Repeats differing in case keep the first spelling",
+			text:     "#Work and #work",
+			caption:  "also #WORK",
+			expected: []string{"Work"},
+		},
 		
 		// Position tests
 		{
@@ -309,6 +356,39 @@ func TestExtractHashtags(t *testing.T) {
 	}
 }
 
+// TestExtractIgnoredHashtagsAndMentions tests that env ignore-lists filter noise before storage
+func TestExtractIgnoredHashtagsAndMentions(t *testing.T) {
+	t.Run("Empty ignore-list keeps everything", func(t *testing.T) {
+		t.Setenv("IGNORED_HASHTAGS", "")
+		t.Setenv("IGNORED_MENTIONS", "")
+
+		assert.Equal(t, []string{"work", "SentFromMyPhone"}, extractHashtags("#work #SentFromMyPhone", ""))
+		assert.Equal(t, []string{"alice", "bot"}, extractMentions("@alice @bot", ""))
+	})
+
+	t.Run("Ignored hashtags are excluded case-insensitively", func(t *testing.T) {
+		t.Setenv("IGNORED_HASHTAGS", "#sentfrommyphone, AD")
+
+		assert.Equal(t, []string{"work", "important"},
+			extractHashtags("#work #SentFromMyPhone #ad", "#important #SENTFROMMYPHONE"))
+		assert.Nil(t, extractHashtags("#sentfrommyphone", ""))
+	})
+
+	t.Run("Ignored mentions are excluded case-insensitively", func(t *testing.T) {
+		t.Setenv("IGNORED_MENTIONS", "@SomeBot,spam")
+
+		assert.Equal(t, []string{"alice"}, extractMentions("@alice @somebot", "@Spam"))
+	})
+
+	t.Run("Hashtag ignore-list does not affect mentions", func(t *testing.T) {
+		t.Setenv("IGNORED_HASHTAGS", "alice")
+		t.Setenv("IGNORED_MENTIONS", "")
+
+		assert.Equal(t, []string{"alice"}, extractMentions("@alice", ""))
+		assert.Nil(t, extractHashtags("#alice", ""))
+	})
+}
+
 // TestExtractMentions tests mention extraction from text and captions
 func TestExtractMentions(t *testing.T) {
 	tests := []struct {
@@ -370,6 +450,12 @@ func TestExtractMentions(t *testing.T) {
 			caption:  "",
 			expected: []string{"AdminUser", "testBot", "DevTeam"},
 		},
+		{
+			name:     "Repeated mentions are kept once",
+			text:     "@alice @bob @alice@bob",
+			caption:  "cc @Alice",
+			expected: []string{"alice", "bob"},
+		},
 		
 		// Position tests
 		{
@@ -426,7 +512,13 @@ func TestExtractMentions(t *testing.T) {
 			name:     "Email addresses should not match",
 			text:     "Contact me at user@example.com",
 			caption:  "",
-			expected: []string{"example"}, // Current regex will match @example part
+			expected: nil,
+		},
+		{
+			name:     "Email next to a mention",
+			text:     "Ask @support or write to help@example.com",
+			caption:  "",
+			expected: []string{"support"},
 		},
 	}
 
@@ -438,6 +530,94 @@ func TestExtractMentions(t *testing.T) {
 	}
 }
 
+// TestHasSpoilerEntity tests spoiler entity detection in text and captions
+func TestHasSpoilerEntity(t *testing.T) {
+	spoilerPhoto := createPhotoMessage("secret ending", tgbotapi.PhotoSize{FileID: "photo123"})
+	spoilerPhoto.CaptionEntities = []tgbotapi.MessageEntity{{Type: "spoiler", Offset: 0, Length: 6}}
+
+	spoilerText := createTextMessage("the butler did it", "")
+	spoilerText.Entities = []tgbotapi.MessageEntity{{Type: "bold", Offset: 0, Length: 3}, {Type: "spoiler", Offset: 4, Length: 6}}
+
+	boldText := createTextMessage("just bold", "")
+	boldText.Entities = []tgbotapi.MessageEntity{{Type: "bold", Offset: 0, Length: 4}}
+
+	assert.True(t, hasSpoilerEntity(spoilerPhoto))
+	assert.True(t, hasSpoilerEntity(spoilerText))
+	assert.False(t, hasSpoilerEntity(boldText))
+	assert.False(t, hasSpoilerEntity(createTextMessage("plain", "")))
+}
+
+// TestParseRawMessageFields tests reading fields tgbotapi doesn't decode from the raw update
+func TestParseRawMessageFields(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		expectSpoiler bool
+		expectQuote   string
+	}{
+		{
+			name:          "Spoiler photo",
+			body:          `{"update_id":1,"message":{"message_id":5,"photo":[{"file_id":"p"}],"has_media_spoiler":true}}`,
+			expectSpoiler: true,
+		},
+		{
+			name: "Photo without spoiler",
+			body: `{"update_id":1,"message":{"message_id":5,"photo":[{"file_id":"p"}]}}`,
+		},
+		{
+			name:        "Quoted reply",
+			body:        `{"update_id":1,"message":{"message_id":6,"text":"agreed","reply_to_message":{"message_id":5},"quote":{"text":"part of it","position":3}}}`,
+			expectQuote: "part of it",
+		},
+		{
+			name: "Callback update",
+			body: `{"update_id":1,"callback_query":{"id":"1","data":"tag:1:2"}}`,
+		},
+		{
+			name: "Invalid JSON",
+			body: `{`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := parseRawMessageFields([]byte(tt.body))
+			assert.Equal(t, tt.expectSpoiler, fields.HasMediaSpoiler)
+			if tt.expectQuote == "" {
+				assert.Nil(t, fields.Quote)
+			} else {
+				assert.NotNil(t, fields.Quote)
+				assert.Equal(t, tt.expectQuote, fields.Quote.Text)
+			}
+		})
+	}
+}
+
+// TestStoryMessageType tests that forwarded stories are detected from the raw update
+func TestStoryMessageType(t *testing.T) {
+	body := `{"update_id":1,"message":{"message_id":7,"forward_from_chat":{"id":-100123,"type":"channel"},"story":{"chat":{"id":-100123,"username":"somechannel","type":"channel"},"id":42}}}`
+
+	fields := parseRawMessageFields([]byte(body))
+	assert.NotNil(t, fields.Story)
+	assert.Equal(t, 42, fields.Story.ID)
+	assert.Equal(t, int64(-100123), fields.Story.Chat.ID)
+	assert.Equal(t, "somechannel", fields.Story.Chat.Username)
+	assert.True(t, fields.hasValues())
+
+	// tgbotapi sees a story as an empty message
+	message := &tgbotapi.Message{MessageID: 7}
+	assert.Equal(t, MessageTypeUnknown, getMessageType(message))
+	assert.Equal(t, MessageTypeStory, fields.messageType(getMessageType(message)))
+
+	// Messages without a story keep their detected type
+	plain := parseRawMessageFields([]byte(`{"update_id":1,"message":{"message_id":8,"text":"hi"}}`))
+	assert.Nil(t, plain.Story)
+	assert.False(t, plain.hasValues())
+	assert.Equal(t, MessageTypeText, plain.messageType(MessageTypeText))
+	assert.Equal(t, MessageTypeUnknown, plain.messageType(MessageTypeUnknown))
+	assert.Equal(t, MessageTypePhoto, fields.messageType(MessageTypePhoto))
+}
+
 // TestGetMessageType tests message type detection
 func TestGetMessageType(t *testing.T) {
 	tests := []struct {
@@ -531,6 +711,44 @@ func TestGetMessageType(t *testing.T) {
 			}),
 			expected: MessageTypeSticker,
 		},
+
+		// Location messages
+		{
+			name: "Location message",
+			message: &tgbotapi.Message{
+				MessageID: 1,
+				Location:  &tgbotapi.Location{Latitude: 52.52, Longitude: 13.40},
+			},
+			expected: MessageTypeLocation,
+		},
+		{
+			name: "Venue message",
+			message: &tgbotapi.Message{
+				MessageID: 1,
+				Location:  &tgbotapi.Location{Latitude: 52.52, Longitude: 13.40},
+				Venue: &tgbotapi.Venue{
+					Location: tgbotapi.Location{Latitude: 52.52, Longitude: 13.40},
+					Title:    "Brandenburg Gate",
+				},
+			},
+			expected: MessageTypeLocation,
+		},
+
+		// Animation messages
+		{
+			name: "Animation message",
+			message: createAnimationMessage("", &tgbotapi.Animation{
+				FileID:   "gif123",
+				Duration: 3,
+			}, nil),
+			expected: MessageTypeAnimation,
+		},
+		{
+			name: "Animation message with document",
+			message: createAnimationMessage("", &tgbotapi.Animation{FileID: "gif123"},
+				&tgbotapi.Document{FileID: "gif123", FileName: "funny.gif.mp4"}),
+			expected: MessageTypeAnimation,
+		},
 		
 		// Text messages (default case)
 		{
@@ -539,9 +757,17 @@ func TestGetMessageType(t *testing.T) {
 			expected: MessageTypeText,
 		},
 		{
-			name:     "Empty message defaults to text",
+			name:     "Empty message is unknown",
 			message:  createTextMessage("", ""),
-			expected: MessageTypeText,
+			expected: MessageTypeUnknown,
+		},
+		{
+			name: "Message with no known fields is unknown",
+			message: &tgbotapi.Message{
+				MessageID: 1,
+				Dice:      &tgbotapi.Dice{Emoji: "🎲", Value: 4},
+			},
+			expected: MessageTypeUnknown,
 		},
 		
 		// Priority testing - photo should take precedence over text
@@ -596,11 +822,16 @@ func TestExtractFileMetadata(t *testing.T) {
 			}),
 			messageType: MessageTypePhoto,
 			expected: FileMetadata{
-				FileID:   sqlNullString("photo123", true),
-				FileName: sqlNullString("", false),
-				MimeType: sqlNullString("", false),
-				FileSize: sqlNullInt64(150000, true),
-				Duration: sqlNullInt32(0, false),
+				FileID:      sqlNullString("photo123", true),
+				FileName:    sqlNullString("", false),
+				MimeType:    sqlNullString("", false),
+				FileSize:    sqlNullInt64(150000, true),
+				Duration:    sqlNullInt32(0, false),
+				Width:       sqlNullInt32(800, true),
+				Height:      sqlNullInt32(600, true),
+				ThumbFileID: sqlNullString("photo123", true),
+				ThumbWidth:  sqlNullInt32(800, true),
+				ThumbHeight: sqlNullInt32(600, true),
 			},
 		},
 		{
@@ -612,11 +843,37 @@ func TestExtractFileMetadata(t *testing.T) {
 			}),
 			messageType: MessageTypePhoto,
 			expected: FileMetadata{
-				FileID:   sqlNullString("photo456", true),
-				FileName: sqlNullString("", false),
-				MimeType: sqlNullString("", false),
-				FileSize: sqlNullInt64(0, false),
-				Duration: sqlNullInt32(0, false),
+				FileID:      sqlNullString("photo456", true),
+				FileName:    sqlNullString("", false),
+				MimeType:    sqlNullString("", false),
+				FileSize:    sqlNullInt64(0, false),
+				Duration:    sqlNullInt32(0, false),
+				Width:       sqlNullInt32(400, true),
+				Height:      sqlNullInt32(300, true),
+				ThumbFileID: sqlNullString("photo456", true),
+				ThumbWidth:  sqlNullInt32(400, true),
+				ThumbHeight: sqlNullInt32(300, true),
+			},
+		},
+		{
+			name: "Photo with three sizes",
+			message: createPhotoMessage("",
+				tgbotapi.PhotoSize{FileID: "photo_m", Width: 320, Height: 240, FileSize: 20000},
+				tgbotapi.PhotoSize{FileID: "photo_s", Width: 90, Height: 67, FileSize: 1500},
+				tgbotapi.PhotoSize{FileID: "photo_l", Width: 1280, Height: 960, FileSize: 180000},
+			),
+			messageType: MessageTypePhoto,
+			expected: FileMetadata{
+				FileID:      sqlNullString("photo_l", true),
+				FileName:    sqlNullString("", false),
+				MimeType:    sqlNullString("", false),
+				FileSize:    sqlNullInt64(180000, true),
+				Duration:    sqlNullInt32(0, false),
+				Width:       sqlNullInt32(1280, true),
+				Height:      sqlNullInt32(960, true),
+				ThumbFileID: sqlNullString("photo_s", true),
+				ThumbWidth:  sqlNullInt32(90, true),
+				ThumbHeight: sqlNullInt32(67, true),
 			},
 		},
 		{
@@ -689,6 +946,48 @@ func TestExtractFileMetadata(t *testing.T) {
 			},
 		},
 		
+		// Animation metadata
+		{
+			name: "Complete animation metadata",
+			message: createAnimationMessage("", &tgbotapi.Animation{
+				FileID:   "gif123",
+				Width:    480,
+				Height:   270,
+				Duration: 4,
+				FileName: "funny.gif.mp4",
+				MimeType: "video/mp4",
+				FileSize: 300000,
+			}, nil),
+			messageType: MessageTypeAnimation,
+			expected: FileMetadata{
+				FileID:   sqlNullString("gif123", true),
+				FileName: sqlNullString("funny.gif.mp4", true),
+				MimeType: sqlNullString("video/mp4", true),
+				FileSize: sqlNullInt64(300000, true),
+				Duration: sqlNullInt32(4, true),
+			},
+		},
+		{
+			name: "Animation with document uses the animation",
+			message: createAnimationMessage("", &tgbotapi.Animation{
+				FileID:   "gif456",
+				MimeType: "video/mp4",
+			}, &tgbotapi.Document{
+				FileID:   "doc456",
+				FileName: "animation.gif.mp4",
+				MimeType: "video/mp4",
+				FileSize: 250000,
+			}),
+			messageType: MessageTypeAnimation,
+			expected: FileMetadata{
+				FileID:   sqlNullString("gif456", true),
+				FileName: sqlNullString("", false),
+				MimeType: sqlNullString("video/mp4", true),
+				FileSize: sqlNullInt64(0, false),
+				Duration: sqlNullInt32(0, false),
+			},
+		},
+
 		// Audio metadata
 		{
 			name: "Complete audio metadata",
@@ -770,6 +1069,68 @@ func TestExtractFileMetadata(t *testing.T) {
 	}
 }
 
+// TestExtractLocation tests coordinate extraction from locations and venues
+func TestExtractLocation(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  *tgbotapi.Message
+		expected LocationData
+	}{
+		{
+			name: "Location",
+			message: &tgbotapi.Message{
+				Location: &tgbotapi.Location{Latitude: 52.52, Longitude: 13.405},
+			},
+			expected: LocationData{
+				Latitude:  sql.NullFloat64{Float64: 52.52, Valid: true},
+				Longitude: sql.NullFloat64{Float64: 13.405, Valid: true},
+			},
+		},
+		{
+			name: "Venue",
+			message: &tgbotapi.Message{
+				Location: &tgbotapi.Location{Latitude: 52.52, Longitude: 13.405},
+				Venue: &tgbotapi.Venue{
+					Location: tgbotapi.Location{Latitude: 52.5163, Longitude: 13.3777},
+					Title:    "Brandenburg Gate",
+					Address:  "Pariser Platz, Berlin",
+				},
+			},
+			expected: LocationData{
+				Latitude:     sql.NullFloat64{Float64: 52.5163, Valid: true},
+				Longitude:    sql.NullFloat64{Float64: 13.3777, Valid: true},
+				VenueTitle:   sqlNullString("Brandenburg Gate", true),
+				VenueAddress: sqlNullString("Pariser Platz, Berlin", true),
+			},
+		},
+		{
+			name: "Venue without address",
+			message: &tgbotapi.Message{
+				Venue: &tgbotapi.Venue{
+					Location: tgbotapi.Location{Latitude: 52.5163, Longitude: 13.3777},
+					Title:    "Brandenburg Gate",
+				},
+			},
+			expected: LocationData{
+				Latitude:   sql.NullFloat64{Float64: 52.5163, Valid: true},
+				Longitude:  sql.NullFloat64{Float64: 13.3777, Valid: true},
+				VenueTitle: sqlNullString("Brandenburg Gate", true),
+			},
+		},
+		{
+			name:     "Text message",
+			message:  createTextMessage("Hello", ""),
+			expected: LocationData{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, extractLocation(tt.message))
+		})
+	}
+}
+
 // Helper functions to create sql.Null* types for testing
 func sqlNullString(s string, valid bool) sql.NullString {
 	return sql.NullString{String: s, Valid: valid}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// Metrics are written to stdout as one JSON object per line, next to the regular
+// logs, so dashboards can be built from the log stream without another service:
+//
+//	{"metric":"messages_saved","value":1,"unit":"count","labels":{"message_type":"photo"}}
+
+var (
+	metricsMu     sync.Mutex
+	metricsOutput io.Writer = os.Stdout
+)
+
+type metricLine struct {
+	Metric string            `json:"metric"`
+	Value  float64           `json:"value"`
+	Unit   string            `json:"unit"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// emitMetric writes one metric line. labels are key/value pairs.
+func emitMetric(name string, value float64, unit string, labels ...string) {
+	line := metricLine{Metric: name, Value: value, Unit: unit}
+	if len(labels) > 1 {
+		line.Labels = make(map[string]string, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			line.Labels[labels[i]] = labels[i+1]
+		}
+	}
+
+	data, err := json.Marshal(line)
+	if err != nil {
+		slog.Error("Error encoding metric", "metric", name, "error", err)
+		return
+	}
+
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metricsOutput.Write(append(data, '\n'))
+}
+
+// countMetric increments a counter by one
+func countMetric(name string, labels ...string) {
+	emitMetric(name, 1, "count", labels...)
+}
+
+// timeMetric starts a timer; call the returned func when the operation is done
+func timeMetric(name string, labels ...string) func() {
+	start := time.Now()
+	return func() {
+		emitMetric(name, float64(time.Since(start).Microseconds())/1000, "ms", labels...)
+	}
+}
+
+// metricsTransport times every Bot API request, labeled with the API method
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+func (t metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The path is "/bot<token>/<method>"; only the method is safe to log
+	method := path.Base(req.URL.Path)
+
+	stop := timeMetric("telegram_request_duration", "method", method)
+	resp, err := t.next.RoundTrip(req)
+	stop()
+
+	if err != nil {
+		countMetric("telegram_request_errors", "method", method)
+	}
+	return resp, err
+}
+
+// newMetricsHTTPClient returns the HTTP client the bot uses to talk to Telegram
+func newMetricsHTTPClient() *http.Client {
+	return &http.Client{Transport: metricsTransport{next: http.DefaultTransport}}
+}
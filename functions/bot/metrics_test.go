@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// captureMetrics collects metric lines emitted for the rest of the test
+func captureMetrics(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := metricsOutput
+	metricsOutput = &buf
+	t.Cleanup(func() { metricsOutput = previous })
+	return &buf
+}
+
+func parseMetricLines(t *testing.T, output string) []metricLine {
+	var lines []metricLine
+	for _, raw := range strings.Split(strings.TrimSpace(output), "\n") {
+		if raw == "" {
+			continue
+		}
+		var line metricLine
+		assert.NoError(t, json.Unmarshal([]byte(raw), &line))
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func findMetric(lines []metricLine, name string) *metricLine {
+	for i := range lines {
+		if lines[i].Metric == name {
+			return &lines[i]
+		}
+	}
+	return nil
+}
+
+// TestEmitMetric tests the metric line format
+func TestEmitMetric(t *testing.T) {
+	output := captureMetrics(t)
+
+	countMetric("tags_created")
+	emitMetric("db_query_duration", 12.5, "ms", "query", "save_message")
+
+	lines := parseMetricLines(t, output.String())
+	assert.Equal(t, []metricLine{
+		{Metric: "tags_created", Value: 1, Unit: "count"},
+		{Metric: "db_query_duration", Value: 12.5, Unit: "ms", Labels: map[string]string{"query": "save_message"}},
+	}, lines)
+}
+
+// TestSaveMessageEmitsMetrics tests that a successful save is counted and timed
+func TestSaveMessageEmitsMetrics(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+
+	output := captureMetrics(t)
+	photo := createTestPhotoMessage(1, user, "caption", tgbotapi.PhotoSize{FileID: "photo"})
+	assert.NoError(t, saveMessage(db, photo))
+
+	lines := parseMetricLines(t, output.String())
+	saved := findMetric(lines, "messages_saved")
+	if assert.NotNil(t, saved) {
+		assert.Equal(t, float64(1), saved.Value)
+		assert.Equal(t, "photo", saved.Labels["message_type"])
+	}
+	timer := findMetric(lines, "db_query_duration")
+	if assert.NotNil(t, timer) {
+		assert.Equal(t, "ms", timer.Unit)
+		assert.Equal(t, "save_message", timer.Labels["query"])
+	}
+
+	// A failed save is not counted
+	closedDB := setupTestDB(t)
+	closedDB.Close()
+	output.Reset()
+	assert.Error(t, saveMessage(closedDB, photo))
+	assert.Nil(t, findMetric(parseMetricLines(t, output.String()), "messages_saved"))
+}
+
+// TestMetricsTransport tests that Bot API requests are timed without leaking the token
+func TestMetricsTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer server.Close()
+
+	output := captureMetrics(t)
+	resp, err := newMetricsHTTPClient().Get(server.URL + "/botsecret-token/sendMessage")
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.NotContains(t, output.String(), "secret-token")
+	timer := findMetric(parseMetricLines(t, output.String()), "telegram_request_duration")
+	if assert.NotNil(t, timer) {
+		assert.Equal(t, "sendMessage", timer.Labels["method"])
+	}
+}
@@ -2,13 +2,18 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"os"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"telegram-content-organizer-shared/storage"
 )
 
 type Tag struct {
@@ -19,7 +24,14 @@ type Tag struct {
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 }
 
+// maxSafeCallbackDataLength is the callback_data size above which tag buttons
+// switch to a compact encoding. Telegram allows 64 bytes, but some older clients
+// silently drop callbacks that get close to that limit.
+const maxSafeCallbackDataLength = 32
+
 func getUserTags(db *sql.DB, userID int64) ([]Tag, error) {
+	defer timeMetric("db_query_duration", "query", "get_user_tags")()
+
 	query := `SELECT id, name, color FROM tags WHERE user_id = $1 ORDER BY name`
 	rows, err := db.Query(query, userID)
 	if err != nil {
@@ -43,46 +55,274 @@ func getUserTags(db *sql.DB, userID int64) ([]Tag, error) {
 	return tags, nil
 }
 
-func getOrCreateTag(db *sql.DB, userID int64, tagName string) (int64, error) {
-	var tagID int64
+// TagCount is a tag with the number of messages carrying it
+type TagCount struct {
+	Name         string
+	MessageCount int
+}
 
-	// Try to get existing tag
-	query := `SELECT id FROM tags WHERE user_id = $1 AND name = $2`
-	err := db.QueryRow(query, userID, tagName).Scan(&tagID)
+// getUserTagCounts returns the user's tags with their message counts, in the
+// same order as getUserTags so the numbers match the tag selection list
+func getUserTagCounts(db *sql.DB, userID int64) ([]TagCount, error) {
+	query := `
+		SELECT t.name, COUNT(mt.message_id) FROM tags t
+		LEFT JOIN message_tags mt ON mt.tag_id = t.id
+		WHERE t.user_id = $1
+		GROUP BY t.id, t.name
+		ORDER BY t.name`
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	if err == sql.ErrNoRows {
-		// Create new tag
-		insertQuery := `INSERT INTO tags (user_id, name, created_at) VALUES ($1, $2, CURRENT_TIMESTAMP) RETURNING id`
-		err = db.QueryRow(insertQuery, userID, tagName).Scan(&tagID)
+	var tags []TagCount
+	for rows.Next() {
+		var tag TagCount
+		if err := rows.Scan(&tag.Name, &tag.MessageCount); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
 	}
+	return tags, rows.Err()
+}
 
+// getOrCreateTag returns the ID of the user's tag with this name, ignoring case,
+// creating it if needed. An existing tag keeps the casing it was created with.
+func getOrCreateTag(db *sql.DB, userID int64, tagName string) (int64, error) {
+	tagID, created, err := storage.GetOrCreateTag(db, userID, tagName)
+	if created {
+		countMetric("tags_created")
+	}
 	return tagID, err
 }
 
-func tagMessage(db *sql.DB, messageID int64, tagID int64) error {
-	query := `INSERT INTO message_tags (message_id, tag_id, created_at) VALUES ($1, $2, CURRENT_TIMESTAMP) ON CONFLICT (message_id, tag_id) DO NOTHING`
-	_, err := db.Exec(query, messageID, tagID)
+// tagMessage links a message to a tag, together with the other items of its album
+// if it has one. It reports false when they all already had the tag, e.g. when a
+// stale keyboard button is tapped again.
+func tagMessage(db *sql.DB, messageID int64, tagID int64) (bool, error) {
+	defer timeMetric("db_query_duration", "query", "tag_message")()
+
+	query := `
+		INSERT INTO message_tags (message_id, tag_id, created_at)
+		SELECT m.id, $2, CURRENT_TIMESTAMP FROM messages m
+		JOIN messages target ON target.id = $1
+		WHERE m.id = target.id
+		   OR (m.user_id = target.user_id AND m.media_group_id = target.media_group_id)
+		ON CONFLICT (message_id, tag_id) DO NOTHING`
+	result, err := db.Exec(query, messageID, tagID)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// isLaterAlbumItem reports whether the message is an album item whose album
+// already got a tag prompt. Such an item takes the tags applied to the album so
+// far; tags applied later reach it through tagMessage.
+func isLaterAlbumItem(db *sql.DB, message *tgbotapi.Message) bool {
+	if message.MediaGroupID == "" {
+		return false
+	}
+
+	logger := messageLogger(message).With("media_group_id", message.MediaGroupID)
+	first, err := claimMediaGroup(db, message.From.ID, message.MediaGroupID, message.MessageID)
+	if err != nil {
+		logger.Error("Error claiming media group", "error", err)
+		return false
+	}
+	if first {
+		return false
+	}
+
+	messageID, err := getMessageByTelegramID(db, message.From.ID, int64(message.MessageID))
+	if err != nil {
+		logger.Error("Error finding album item", "error", err)
+		return true
+	}
+	query := `
+		INSERT INTO message_tags (message_id, tag_id, created_at)
+		SELECT DISTINCT $1, mt.tag_id, CURRENT_TIMESTAMP FROM message_tags mt
+		JOIN messages m ON m.id = mt.message_id
+		WHERE m.user_id = $2 AND m.media_group_id = $3 AND m.id <> $1
+		ON CONFLICT (message_id, tag_id) DO NOTHING`
+	if _, err := db.Exec(query, messageID, message.From.ID, message.MediaGroupID); err != nil {
+		logger.Error("Error copying album tags", "error", err)
+	}
+	return true
+}
+
+// untagMessage removes a tag from a message, together with the other items of
+// its album like tagMessage adds it. It reports false when the message didn't
+// have the tag, e.g. when a stale button is tapped again.
+func untagMessage(db *sql.DB, messageID int64, tagID int64) (bool, error) {
+	query := `
+		DELETE FROM message_tags
+		WHERE tag_id = $2 AND message_id IN (
+			SELECT m.id FROM messages m
+			JOIN messages target ON target.id = $1
+			WHERE m.id = target.id
+			   OR (m.user_id = target.user_id AND m.media_group_id = target.media_group_id))`
+	result, err := db.Exec(query, messageID, tagID)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// getRepliedMessageID returns the ID of the saved message the given message
+// replies to, or sql.ErrNoRows if it isn't a reply to one
+func getRepliedMessageID(db *sql.DB, messageID int64) (int64, error) {
+	var repliedID int64
+	query := `
+		SELECT src.id FROM messages m
+		JOIN messages src ON src.user_id = m.user_id AND src.source_chat_id = m.source_chat_id
+			AND src.telegram_message_id = m.reply_to_message_id
+		WHERE m.id = $1`
+	err := db.QueryRow(query, messageID).Scan(&repliedID)
+	return repliedID, err
+}
+
+// copyMessageTags adds every tag of the source message to the target message,
+// keeping tags the target already has
+func copyMessageTags(db *sql.DB, sourceID int64, targetID int64) error {
+	query := `
+		INSERT INTO message_tags (message_id, tag_id, created_at)
+		SELECT $2, tag_id, CURRENT_TIMESTAMP FROM message_tags WHERE message_id = $1
+		ON CONFLICT (message_id, tag_id) DO NOTHING`
+	_, err := db.Exec(query, sourceID, targetID)
 	return err
 }
 
+// getMessageTagIDs returns the IDs of a message's tags as a set
+func getMessageTagIDs(db *sql.DB, messageID int64) (map[int64]bool, error) {
+	rows, err := db.Query(`SELECT tag_id FROM message_tags WHERE message_id = $1`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := map[int64]bool{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// getMessageTags returns a message's tags, alphabetically
+func getMessageTags(db *sql.DB, messageID int64) ([]Tag, error) {
+	query := `
+		SELECT t.id, t.user_id, t.name, t.color FROM message_tags mt
+		JOIN tags t ON t.id = mt.tag_id
+		WHERE mt.message_id = $1
+		ORDER BY t.name`
+	rows, err := db.Query(query, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []Tag
+	for rows.Next() {
+		var tag Tag
+		var color sql.NullString
+		if err := rows.Scan(&tag.ID, &tag.UserID, &tag.Name, &color); err != nil {
+			return nil, err
+		}
+		if color.Valid {
+			tag.Color = &color.String
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// getMessageTagNames returns the names of a message's tags, alphabetically
+func getMessageTagNames(db *sql.DB, messageID int64) ([]string, error) {
+	query := `
+		SELECT t.name FROM message_tags mt
+		JOIN tags t ON t.id = mt.tag_id
+		WHERE mt.message_id = $1
+		ORDER BY t.name`
+	rows, err := db.Query(query, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
 func getMessageByTelegramID(db *sql.DB, userID int64, telegramMessageID int64) (int64, error) {
 	var messageID int64
-	query := `SELECT id FROM messages WHERE user_id = $1 AND telegram_message_id = $2`
+	query := `SELECT id FROM messages WHERE user_id = $1 AND source_chat_id = 0 AND telegram_message_id = $2`
 	err := db.QueryRow(query, userID, telegramMessageID).Scan(&messageID)
 	return messageID, err
 }
 
+// getStoredMessageType returns the message_type saved for a message
+func getStoredMessageType(db *sql.DB, messageID int64) (MessageType, error) {
+	var messageType string
+	err := db.QueryRow(`SELECT message_type FROM messages WHERE id = $1`, messageID).Scan(&messageType)
+	return MessageType(messageType), err
+}
+
+// taggedConfirmationText describes a tagged message by its type, e.g. "📷 Photo tagged with 'x'"
+func taggedConfirmationText(db *sql.DB, messageID int64, tagName string) string {
+	messageType, err := getStoredMessageType(db, messageID)
+	if err != nil {
+		slog.Error("Error getting message type", "stored_message_id", messageID, "error", err)
+		messageType = MessageTypeText
+	}
+	return fmt.Sprintf("%s %s tagged with '%s'", typeEmoji(messageType), typeLabel(messageType), tagName)
+}
+
+// defaultTagButtonThreshold is the most tags shown as buttons unless
+// TAG_BUTTON_THRESHOLD says otherwise
+const defaultTagButtonThreshold = 20
+
+// tagButtonThreshold reads TAG_BUTTON_THRESHOLD, the most tags the tag prompt
+// shows as buttons before switching to a numbered text list
+func tagButtonThreshold() int {
+	threshold, err := strconv.Atoi(os.Getenv("TAG_BUTTON_THRESHOLD"))
+	if err != nil || threshold <= 0 {
+		return defaultTagButtonThreshold
+	}
+	return threshold
+}
+
 func showTagSelection(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB) {
 	// Get user's existing tags
 	tags, err := getUserTags(db, message.From.ID)
 	if err != nil {
-		log.Printf("Error getting user tags: %v", err)
-		sendErrorMessage(bot, message, "Could not load your tags.")
+		messageLogger(message).Error("Error getting user tags", "error", err)
+		// The message is already saved; don't let the user think otherwise
+		sendErrorMessage(bot, message, "Your message is saved, but I couldn't load your tags to tag it. Please try again later.")
 		return
 	}
 
-	// Use buttons for ≤20 tags, text for >20 tags
-	if len(tags) <= 20 {
+	// Use buttons up to TAG_BUTTON_THRESHOLD tags, text beyond
+	if len(tags) <= tagButtonThreshold() {
 		showTagSelectionWithButtons(bot, message, tags)
 	} else {
 		showTagSelectionWithText(bot, message, tags)
@@ -90,115 +330,166 @@ func showTagSelection(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.D
 }
 
 func showTagSelectionWithButtons(bot *tgbotapi.BotAPI, message *tgbotapi.Message, tags []Tag) {
-	var responseText string
-	var keyboard tgbotapi.InlineKeyboardMarkup
+	msg := tgbotapi.NewMessage(message.Chat.ID, buttonPromptText(tags, message.MessageID))
+	msg.ReplyToMessageID = message.MessageID
+	msg.ReplyMarkup = tagSelectionKeyboard(tags, message.MessageID, len(tags) > 0)
+
+	if _, err := bot.Send(msg); err != nil {
+		messageLogger(message).Error("Error sending tag selection with buttons", "error", err)
+	}
+}
 
+// buttonPromptText is the text above the tag buttons. It numbers the tags and
+// carries the [MSG_ID:...] marker, so replying with a tag name or number works
+// like in the text UI, e.g. when the buttons don't render.
+func buttonPromptText(tags []Tag, messageID int) string {
 	if len(tags) == 0 {
-		responseText = "You don't have any tags yet. Click the button below to create your first tag:"
-		// Single "Create New Tag" button
-		keyboard = tgbotapi.NewInlineKeyboardMarkup(
-			tgbotapi.NewInlineKeyboardRow(
-				tgbotapi.NewInlineKeyboardButtonData("➕ Create New Tag", fmt.Sprintf("new_tag:%d", message.MessageID)),
-			),
-		)
-	} else {
-		responseText = "Choose a tag or create a new one:"
-		
-		// Create button rows (2 buttons per row for better layout)
-		var rows [][]tgbotapi.InlineKeyboardButton
-		for i := 0; i < len(tags); i += 2 {
-			var row []tgbotapi.InlineKeyboardButton
-			
-			// First button in row
+		return fmt.Sprintf("You don't have any tags yet. Click the button below to create your first tag, or reply with its name.\n\n[MSG_ID:%d]", messageID)
+	}
+
+	numbered := make([]string, len(tags))
+	for i, tag := range tags {
+		numbered[i] = fmt.Sprintf("%d. %s", i+1, tag.Name)
+	}
+	return fmt.Sprintf("Choose a tag or create a new one:\n\n%s\n\nTap a button or reply with a tag name or number.\n\n[MSG_ID:%d]",
+		strings.Join(numbered, " · "), messageID)
+}
+
+// tagSelectionKeyboard lays out tag buttons two per row, followed by an optional
+// "Search" row and the "Create New Tag" row. Every button carries messageID so the
+// tap tags the original message.
+func tagSelectionKeyboard(tags []Tag, messageID int, withSearch bool) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i := 0; i < len(tags); i += 2 {
+		var row []tgbotapi.InlineKeyboardButton
+
+		// First button in row
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(
+			tags[i].Name,
+			tagCallbackData(tags[i].ID, messageID),
+		))
+
+		// Second button in row (if exists)
+		if i+1 < len(tags) {
 			row = append(row, tgbotapi.NewInlineKeyboardButtonData(
-				tags[i].Name,
-				fmt.Sprintf("tag:%d:%d", tags[i].ID, message.MessageID),
+				tags[i+1].Name,
+				tagCallbackData(tags[i+1].ID, messageID),
 			))
-			
-			// Second button in row (if exists)
-			if i+1 < len(tags) {
-				row = append(row, tgbotapi.NewInlineKeyboardButtonData(
-					tags[i+1].Name,
-					fmt.Sprintf("tag:%d:%d", tags[i+1].ID, message.MessageID),
-				))
-			}
-			
-			rows = append(rows, row)
 		}
-		
-		// Add "Create New Tag" button at the end
+
+		rows = append(rows, row)
+	}
+
+	if withSearch {
 		rows = append(rows, []tgbotapi.InlineKeyboardButton{
-			tgbotapi.NewInlineKeyboardButtonData("➕ Create New Tag", fmt.Sprintf("new_tag:%d", message.MessageID)),
+			tgbotapi.NewInlineKeyboardButtonData("🔍 Search", fmt.Sprintf("tag_search:%d", messageID)),
 		})
-		
-		keyboard = tgbotapi.InlineKeyboardMarkup{InlineKeyboard: rows}
 	}
 
-	msg := tgbotapi.NewMessage(message.Chat.ID, responseText)
-	msg.ReplyToMessageID = message.MessageID
-	msg.ReplyMarkup = keyboard
+	// Add "Create New Tag" button at the end
+	rows = append(rows, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("➕ Create New Tag", fmt.Sprintf("new_tag:%d", messageID)),
+	})
 
-	if _, err := bot.Send(msg); err != nil {
-		log.Printf("Error sending tag selection with buttons: %v", err)
-	}
+	return tgbotapi.InlineKeyboardMarkup{InlineKeyboard: rows}
 }
 
 func showTagSelectionWithText(bot *tgbotapi.BotAPI, message *tgbotapi.Message, tags []Tag) {
-	responseText := fmt.Sprintf("You have many tags (%d). Choose by typing its name or number, or create a new one:\n\n", len(tags))
-	
+	chunks := buildTagSelectionTextChunks(tags, message.MessageID)
+
+	for i, chunk := range chunks {
+		msg := tgbotapi.NewMessage(message.Chat.ID, chunk)
+		if i == 0 {
+			msg.ReplyToMessageID = message.MessageID
+		}
+		if i == len(chunks)-1 {
+			msg.ReplyMarkup = tgbotapi.ForceReply{ForceReply: true, Selective: true}
+		}
+
+		if _, err := bot.Send(msg); err != nil {
+			messageLogger(message).Error("Error sending tag selection with text", "part", i+1, "parts", len(chunks), "error", err)
+			return
+		}
+	}
+}
+
+// maxMessageLength is Telegram's limit for a single text message
+const maxMessageLength = 4096
+
+// maxListedTagNameLength caps tag names in the text list so every line fits in a chunk
+const maxListedTagNameLength = 100
+
+// buildTagSelectionTextChunks numbers the tags and splits the list into messages
+// under maxMessageLength. Every chunk carries the [MSG_ID:...] marker so replying
+// to any of them tags the original message, and numbering continues across chunks.
+func buildTagSelectionTextChunks(tags []Tag, messageID int) []string {
+	header := fmt.Sprintf("You have many tags (%d). Choose by typing its name or number, or create a new one:\n\n", len(tags))
+	footer := fmt.Sprintf("\nType a tag name/number or create a new tag.\n\n[MSG_ID:%d]", messageID)
+	continuedHeader := "More tags:\n\n"
+	continuedFooter := fmt.Sprintf("\n[MSG_ID:%d]", messageID)
+
+	var chunks []string
+	var current strings.Builder
+	current.WriteString(header)
+
 	for i, tag := range tags {
-		responseText += fmt.Sprintf("%d. %s\n", i+1, tag.Name)
+		line := fmt.Sprintf("%d. %s\n", i+1, truncateText(tag.Name, maxListedTagNameLength))
+		// Leave room for the longest footer on whichever chunk ends up last
+		if current.Len()+len(line)+len(footer) > maxMessageLength {
+			current.WriteString(continuedFooter)
+			chunks = append(chunks, current.String())
+			current.Reset()
+			current.WriteString(continuedHeader)
+		}
+		current.WriteString(line)
 	}
-	responseText += fmt.Sprintf("\nType a tag name/number or create a new tag.\n\n[MSG_ID:%d]", message.MessageID)
 
-	msg := tgbotapi.NewMessage(message.Chat.ID, responseText)
-	msg.ReplyToMessageID = message.MessageID
-	msg.ReplyMarkup = tgbotapi.ForceReply{ForceReply: true, Selective: true}
+	current.WriteString(footer)
+	return append(chunks, current.String())
+}
 
-	if _, err := bot.Send(msg); err != nil {
-		log.Printf("Error sending tag selection with text: %v", err)
+// extractMsgID parses the original message ID from a "[MSG_ID:123]" marker
+func extractMsgID(text string) (int, error) {
+	msgIDStart := strings.Index(text, "[MSG_ID:")
+	if msgIDStart == -1 {
+		return 0, fmt.Errorf("no MSG_ID marker")
 	}
+
+	msgIDEnd := strings.Index(text[msgIDStart:], "]")
+	if msgIDEnd == -1 {
+		return 0, fmt.Errorf("no closing bracket for MSG_ID")
+	}
+
+	msgIDStr := text[msgIDStart+8 : msgIDStart+msgIDEnd] // +8 to skip "[MSG_ID:"
+	return strconv.Atoi(msgIDStr)
 }
 
 func handleTagSelection(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB) {
+	logger := messageLogger(message)
+
 	// Extract original message ID from the bot's tag selection message
 	if message.ReplyToMessage == nil {
-		log.Printf("No ReplyToMessage found")
+		logger.Warn("No ReplyToMessage found")
 		sendErrorMessage(bot, message, "This doesn't appear to be a reply.")
 		return
 	}
 	
 	// Parse the original message ID from the tag selection message text
 	botMessageText := message.ReplyToMessage.Text
-	msgIDStart := strings.Index(botMessageText, "[MSG_ID:")
-	if msgIDStart == -1 {
-		log.Printf("Could not find MSG_ID in bot message: %s", botMessageText)
-		sendErrorMessage(bot, message, "Could not find the original message to tag.")
-		return
-	}
-	
-	msgIDEnd := strings.Index(botMessageText[msgIDStart:], "]")
-	if msgIDEnd == -1 {
-		log.Printf("Could not find closing bracket for MSG_ID")
-		sendErrorMessage(bot, message, "Could not find the original message to tag.")
-		return
-	}
-	
-	msgIDStr := botMessageText[msgIDStart+8 : msgIDStart+msgIDEnd] // +8 to skip "[MSG_ID:"
-	
-	originalMessageID, err := strconv.Atoi(msgIDStr)
+	originalMessageID, err := extractMsgID(botMessageText)
 	if err != nil {
-		log.Printf("Could not parse message ID: %s", msgIDStr)
+		withText(logger, "bot_text", botMessageText).Warn("Could not extract MSG_ID from bot message", "error", err)
 		sendErrorMessage(bot, message, "Could not find the original message to tag.")
 		return
 	}
 	
-	log.Printf("Extracted original message ID: %d", originalMessageID)
+	logger = logger.With("original_message_id", originalMessageID)
+	logger.Info("Extracted original message ID")
 
 	// Get the database message ID
 	dbMessageID, err := getMessageByTelegramID(db, message.From.ID, int64(originalMessageID))
 	if err != nil {
-		log.Printf("Error finding original message: %v", err)
+		logger.Error("Error finding original message", "error", err)
 		sendErrorMessage(bot, message, "Could not find the original message to tag.")
 		return
 	}
@@ -210,6 +501,12 @@ func handleTagSelection(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql
 		return
 	}
 
+	// Replies to the search prompt are a filter, not a tag name
+	if strings.HasPrefix(botMessageText, tagSearchPromptText) {
+		showTagSearchResults(bot, message, db, tagName, originalMessageID)
+		return
+	}
+
 	// Check if it's a number (selecting from list)
 	if num, err := strconv.Atoi(tagName); err == nil {
 		// User selected by number
@@ -221,56 +518,72 @@ func handleTagSelection(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql
 		tagName = tags[num-1].Name
 	}
 
+	// A typo of an existing tag means that tag. Names that match no tag even
+	// loosely are confirmed before they're created.
+	if !strings.HasPrefix(botMessageText, newTagPromptText) {
+		matched, err := matchUserTag(db, message.From.ID, tagName)
+		if err != nil {
+			withText(logger, "tag_name", tagName).Error("Error checking tag", "error", err)
+			sendErrorMessage(bot, message, "Could not create or find the tag.")
+			return
+		}
+		if matched == "" {
+			sendNewTagConfirmation(bot, message.Chat.ID, tagName, originalMessageID)
+			return
+		}
+		tagName = matched
+	}
+
 	// Get or create the tag
 	tagID, err := getOrCreateTag(db, message.From.ID, tagName)
 	if err != nil {
-		log.Printf("Error creating/getting tag: %v", err)
+		logger.Error("Error creating/getting tag", "error", err)
 		sendErrorMessage(bot, message, "Could not create or find the tag.")
 		return
 	}
 
 	// Tag the message
-	if err := tagMessage(db, dbMessageID, tagID); err != nil {
-		log.Printf("Error tagging message: %v", err)
+	created, err := tagMessage(db, dbMessageID, tagID)
+	if err != nil {
+		logger.Error("Error tagging message", "error", err)
 		sendErrorMessage(bot, message, "Could not tag the message.")
 		return
 	}
 
 	// Send confirmation
-	responseText := fmt.Sprintf("✅ Message tagged with '%s'", tagName)
+	responseText := taggedConfirmationText(db, dbMessageID, tagName)
+	if !created {
+		responseText = fmt.Sprintf("Already tagged with '%s'", tagName)
+	}
 	msg := tgbotapi.NewMessage(message.Chat.ID, responseText)
 
 	if _, err := bot.Send(msg); err != nil {
-		log.Printf("Error sending confirmation: %v", err)
+		logger.Error("Error sending confirmation", "error", err)
 	}
 }
 
 func handleTagCallback(bot *tgbotapi.BotAPI, callbackQuery *tgbotapi.CallbackQuery, db *sql.DB) {
-	// Parse callback data: "tag:tagID:messageID"
-	parts := strings.Split(callbackQuery.Data, ":")
-	if len(parts) != 3 {
-		log.Printf("Invalid tag callback data: %s", callbackQuery.Data)
-		return
-	}
-	
-	tagID, err := strconv.ParseInt(parts[1], 10, 64)
-	if err != nil {
-		log.Printf("Invalid tag ID in callback data: %s", parts[1])
-		return
-	}
-	
-	originalMessageID, err := strconv.Atoi(parts[2])
+	logger := callbackLogger(callbackQuery)
+
+	// Parse callback data: "tag:tagID:messageID" or "tagb:tagID:messageID"
+	tagID, originalMessageID, err := parseTagCallbackData(callbackQuery.Data)
 	if err != nil {
-		log.Printf("Invalid message ID in callback data: %s", parts[2])
+		logger.Warn("Invalid tag callback data", "data", callbackQuery.Data, "error", err)
+		if strings.HasPrefix(callbackQuery.Data, "tagt:") {
+			// Buttons from before tags were encoded in the button pointed at
+			// tokens held in memory, which are gone
+			sendErrorMessageToCallback(bot, callbackQuery, "This button has expired. Please send the message again.")
+		}
 		return
 	}
 	
-	log.Printf("Processing tag callback - tagID: %d, originalMsgID: %d", tagID, originalMessageID)
+	logger = logger.With("tag_id", tagID, "original_message_id", originalMessageID)
+	logger.Info("Processing tag callback")
 	
 	// Get the database message ID
 	dbMessageID, err := getMessageByTelegramID(db, callbackQuery.From.ID, int64(originalMessageID))
 	if err != nil {
-		log.Printf("Error finding original message: %v", err)
+		logger.Error("Error finding original message", "error", err)
 		sendErrorMessageToCallback(bot, callbackQuery, "Could not find the original message to tag.")
 		return
 	}
@@ -280,75 +593,971 @@ func handleTagCallback(bot *tgbotapi.BotAPI, callbackQuery *tgbotapi.CallbackQue
 	query := `SELECT name FROM tags WHERE id = $1 AND user_id = $2`
 	err = db.QueryRow(query, tagID, callbackQuery.From.ID).Scan(&tagName)
 	if err != nil {
-		log.Printf("Error getting tag name: %v", err)
+		logger.Error("Error getting tag name", "error", err)
 		sendErrorMessageToCallback(bot, callbackQuery, "Could not find the tag.")
 		return
 	}
 	
 	// Tag the message
-	if err := tagMessage(db, dbMessageID, tagID); err != nil {
-		log.Printf("Error tagging message: %v", err)
+	created, err := tagMessage(db, dbMessageID, tagID)
+	if err != nil {
+		logger.Error("Error tagging message", "error", err)
 		sendErrorMessageToCallback(bot, callbackQuery, "Could not tag the message.")
 		return
 	}
-	
-	// Send confirmation
-	responseText := fmt.Sprintf("✅ Message tagged with '%s'", tagName)
-	msg := tgbotapi.NewMessage(callbackQuery.Message.Chat.ID, responseText)
-	
-	if _, err := bot.Send(msg); err != nil {
-		log.Printf("Error sending confirmation: %v", err)
+
+	// Keep the buttons so more tags can be applied, marking the ones already on the message
+	appliedTagIDs, err := getMessageTagIDs(db, dbMessageID)
+	if err != nil {
+		logger.Error("Error getting applied tags", "error", err)
+		appliedTagIDs = map[int64]bool{tagID: true}
 	}
-	
-	// Edit the original message to remove buttons
-	editMsg := tgbotapi.NewEditMessageText(callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID, 
-		fmt.Sprintf("✅ Tagged with '%s'", tagName))
-	if _, err := bot.Send(editMsg); err != nil {
-		log.Printf("Error editing message: %v", err)
+	markup := callbackQuery.Message.ReplyMarkup
+	if markup == nil {
+		tags, err := getUserTags(db, callbackQuery.From.ID)
+		if err != nil {
+			logger.Error("Error getting user tags", "error", err)
+			tags = []Tag{{ID: tagID, Name: tagName}}
+		}
+		keyboard := tagSelectionKeyboard(tags, originalMessageID, len(tags) > 0)
+		markup = &keyboard
+	}
+	keyboard := appliedTagsKeyboard(*markup, appliedTagIDs, originalMessageID)
+
+	_, err = bot.Send(tgbotapi.NewEditMessageReplyMarkup(callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID, keyboard))
+	if err == nil {
+		return
+	}
+	if !messageNotEditable(err) {
+		// Includes "message is not modified" when a repeat tap changes nothing
+		logger.Error("Error updating tag buttons", "error", err)
+		return
+	}
+
+	// Typically the message is older than 48h; the buttons stay tappable but
+	// repeat taps are idempotent, so confirm with a new message instead
+	logger.Info("Message can't be edited anymore, sending a confirmation", "error", err)
+	responseText := fmt.Sprintf("✅ Tagged with '%s'", tagName)
+	if created {
+		responseText = taggedConfirmationText(db, dbMessageID, tagName)
+	}
+	if _, err := bot.Send(tgbotapi.NewMessage(callbackQuery.Message.Chat.ID, responseText)); err != nil {
+		logger.Error("Error sending confirmation", "error", err)
 	}
 }
 
-func handleNewTagCallback(bot *tgbotapi.BotAPI, callbackQuery *tgbotapi.CallbackQuery, db *sql.DB) {
-	// Parse callback data: "new_tag:messageID"
-	parts := strings.Split(callbackQuery.Data, ":")
-	if len(parts) != 2 {
-		log.Printf("Invalid new_tag callback data: %s", callbackQuery.Data)
+// appliedTagPrefix marks tag buttons whose tag is already on the message
+const appliedTagPrefix = "✓ "
+
+// appliedTagsKeyboard copies a tag selection keyboard, prefixing the buttons of
+// applied tags with appliedTagPrefix, and makes sure it ends with a "Done" row
+func appliedTagsKeyboard(markup tgbotapi.InlineKeyboardMarkup, applied map[int64]bool, messageID int) tgbotapi.InlineKeyboardMarkup {
+	doneData := fmt.Sprintf("tag_done:%d", messageID)
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, row := range markup.InlineKeyboard {
+		var newRow []tgbotapi.InlineKeyboardButton
+		for _, button := range row {
+			if button.CallbackData != nil && *button.CallbackData == doneData {
+				continue
+			}
+			if button.CallbackData != nil {
+				if tagID, _, err := parseTagCallbackData(*button.CallbackData); err == nil {
+					name := strings.TrimPrefix(button.Text, appliedTagPrefix)
+					if applied[tagID] {
+						name = appliedTagPrefix + name
+					}
+					button = tgbotapi.NewInlineKeyboardButtonData(name, *button.CallbackData)
+				}
+			}
+			newRow = append(newRow, button)
+		}
+		if len(newRow) > 0 {
+			rows = append(rows, newRow)
+		}
+	}
+
+	rows = append(rows, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("✅ Done", doneData),
+	})
+	return tgbotapi.InlineKeyboardMarkup{InlineKeyboard: rows}
+}
+
+// handleTagDoneCallback closes the tag keyboard, replacing it with a summary of
+// the message's tags
+func handleTagDoneCallback(bot *tgbotapi.BotAPI, callbackQuery *tgbotapi.CallbackQuery, db *sql.DB) {
+	logger := callbackLogger(callbackQuery)
+
+	// Parse callback data: "tag_done:messageID"
+	_, idText, _ := strings.Cut(callbackQuery.Data, ":")
+	originalMessageID, err := strconv.Atoi(idText)
+	if err != nil {
+		logger.Warn("Invalid tag_done callback data", "data", callbackQuery.Data)
 		return
 	}
-	
-	originalMessageID, err := strconv.Atoi(parts[1])
+
+	dbMessageID, err := getMessageByTelegramID(db, callbackQuery.From.ID, int64(originalMessageID))
 	if err != nil {
-		log.Printf("Invalid message ID in new_tag callback data: %s", parts[1])
+		logger.Error("Error finding original message", "error", err)
+		sendErrorMessageToCallback(bot, callbackQuery, "Could not find the original message.")
 		return
 	}
-	
-	// Send a message asking for the new tag name
-	responseText := fmt.Sprintf("Please reply with the name for your new tag:\n\n[MSG_ID:%d]", originalMessageID)
-	msg := tgbotapi.NewMessage(callbackQuery.Message.Chat.ID, responseText)
-	msg.ReplyMarkup = tgbotapi.ForceReply{ForceReply: true, Selective: true}
-	
+
+	names, err := getMessageTagNames(db, dbMessageID)
+	if err != nil {
+		logger.Error("Error getting message tags", "error", err)
+		sendErrorMessageToCallback(bot, callbackQuery, "Could not load the message's tags.")
+		return
+	}
+
+	editOrSend(bot, callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID, tagDoneText(names))
+}
+
+// tagDoneText summarizes the tags applied from the keyboard
+func tagDoneText(names []string) string {
+	if len(names) == 0 {
+		return "No tags added."
+	}
+	return "✅ Tagged with " + strings.Join(names, ", ")
+}
+
+// untagPromptText is shown above the buttons of /untag
+const untagPromptText = "Tap a tag to remove it from the message:"
+
+// untagKeyboard has one "untag:tagID:messageID" button per tag, two per row
+func untagKeyboard(tags []Tag, messageID int) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i := 0; i < len(tags); i += 2 {
+		var row []tgbotapi.InlineKeyboardButton
+		for _, tag := range tags[i:min(i+2, len(tags))] {
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData("✖️ "+tag.Name, fmt.Sprintf("untag:%d:%d", tag.ID, messageID)))
+		}
+		rows = append(rows, row)
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// sendUntagPrompt answers /untag, sent as a reply to a saved message, with a
+// button for each of the message's tags
+func sendUntagPrompt(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB) {
+	if message.ReplyToMessage == nil {
+		sendErrorMessage(bot, message, "Reply /untag to one of your saved messages to remove its tags.")
+		return
+	}
+
+	logger := messageLogger(message)
+	originalMessageID := message.ReplyToMessage.MessageID
+	dbMessageID, err := getMessageByTelegramID(db, message.From.ID, int64(originalMessageID))
+	if err != nil {
+		logger.Error("Error finding message to untag", "error", err)
+		sendErrorMessage(bot, message, "Could not find that message. Tags can only be removed from messages you've saved.")
+		return
+	}
+
+	tags, err := getMessageTags(db, dbMessageID)
+	if err != nil {
+		logger.Error("Error getting message tags", "error", err)
+		sendErrorMessage(bot, message, "Could not load the message's tags.")
+		return
+	}
+	if len(tags) == 0 {
+		sendErrorMessage(bot, message, "That message has no tags.")
+		return
+	}
+
+	msg := tgbotapi.NewMessage(message.Chat.ID, untagPromptText)
+	msg.ReplyToMessageID = originalMessageID
+	msg.ReplyMarkup = untagKeyboard(tags, originalMessageID)
 	if _, err := bot.Send(msg); err != nil {
-		log.Printf("Error sending new tag prompt: %v", err)
+		logger.Error("Error sending untag prompt", "error", err)
 	}
-	
-	// Edit the original message to show we're waiting for input
-	editMsg := tgbotapi.NewEditMessageText(callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID, 
+}
+
+// handleUntagCallback handles "untag:tagID:messageID" by removing the tag and
+// leaving buttons for the message's remaining tags
+func handleUntagCallback(bot *tgbotapi.BotAPI, callbackQuery *tgbotapi.CallbackQuery, db *sql.DB) {
+	logger := callbackLogger(callbackQuery)
+	parts := strings.Split(callbackQuery.Data, ":")
+	if len(parts) != 3 {
+		logger.Warn("Invalid untag callback data", "data", callbackQuery.Data)
+		return
+	}
+	tagID, tagErr := strconv.ParseInt(parts[1], 10, 64)
+	originalMessageID, messageErr := strconv.Atoi(parts[2])
+	if tagErr != nil || messageErr != nil {
+		logger.Warn("Invalid untag callback data", "data", callbackQuery.Data)
+		return
+	}
+
+	dbMessageID, err := getMessageByTelegramID(db, callbackQuery.From.ID, int64(originalMessageID))
+	if err != nil {
+		logger.Error("Error finding original message", "error", err)
+		sendErrorMessageToCallback(bot, callbackQuery, "Could not find the original message.")
+		return
+	}
+
+	if _, err := untagMessage(db, dbMessageID, tagID); err != nil {
+		logger.Error("Error untagging message", "error", err)
+		sendErrorMessageToCallback(bot, callbackQuery, "Could not remove the tag.")
+		return
+	}
+
+	tags, err := getMessageTags(db, dbMessageID)
+	if err != nil {
+		logger.Error("Error getting message tags", "error", err)
+		sendErrorMessageToCallback(bot, callbackQuery, "Could not load the message's tags.")
+		return
+	}
+
+	chatID, promptID := callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID
+	if len(tags) == 0 {
+		editOrSend(bot, chatID, promptID, "🏷 The message has no tags left.")
+		return
+	}
+	edit := tgbotapi.NewEditMessageTextAndMarkup(chatID, promptID, untagPromptText, untagKeyboard(tags, originalMessageID))
+	if _, err := bot.Send(edit); err != nil {
+		logger.Error("Error updating untag prompt", "error", err)
+	}
+}
+
+func handleNewTagCallback(bot *tgbotapi.BotAPI, callbackQuery *tgbotapi.CallbackQuery, db *sql.DB) {
+	logger := callbackLogger(callbackQuery)
+
+	// Parse callback data: "new_tag:messageID"
+	parts := strings.Split(callbackQuery.Data, ":")
+	if len(parts) != 2 {
+		logger.Warn("Invalid new_tag callback data", "data", callbackQuery.Data)
+		return
+	}
+	
+	originalMessageID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		logger.Warn("Invalid message ID in new_tag callback data", "data", callbackQuery.Data)
+		return
+	}
+	
+	// Send a message asking for the new tag name
+	responseText := fmt.Sprintf("%s\n\n[MSG_ID:%d]", newTagPromptText, originalMessageID)
+	msg := tgbotapi.NewMessage(callbackQuery.Message.Chat.ID, responseText)
+	msg.ReplyMarkup = tgbotapi.ForceReply{ForceReply: true, Selective: true}
+	
+	if _, err := bot.Send(msg); err != nil {
+		logger.Error("Error sending new tag prompt", "error", err)
+	}
+	
+	// Edit the original message to show we're waiting for input. The prompt
+	// above is the feedback, so a message too old to edit needs no fallback.
+	editMsg := tgbotapi.NewEditMessageText(callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID, 
 		"Please reply with your new tag name...")
 	if _, err := bot.Send(editMsg); err != nil {
-		log.Printf("Error editing message: %v", err)
+		logger.Error("Error editing message", "error", err)
+	}
+}
+
+// tagSearchPromptText starts the prompt sent by the "Search" button. Text typed in
+// reply to it filters the user's tags instead of naming one.
+const tagSearchPromptText = "Type a few letters of the tag you're looking for:"
+
+// maxTagSearchResults caps the buttons shown for a search, matching the button UI limit
+const maxTagSearchResults = 20
+
+func handleTagSearchCallback(bot *tgbotapi.BotAPI, callbackQuery *tgbotapi.CallbackQuery, db *sql.DB) {
+	logger := callbackLogger(callbackQuery)
+
+	// Parse callback data: "tag_search:messageID"
+	parts := strings.Split(callbackQuery.Data, ":")
+	if len(parts) != 2 {
+		logger.Warn("Invalid tag_search callback data", "data", callbackQuery.Data)
+		return
+	}
+
+	originalMessageID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		logger.Warn("Invalid message ID in tag_search callback data", "data", callbackQuery.Data)
+		return
+	}
+
+	responseText := fmt.Sprintf("%s\n\n[MSG_ID:%d]", tagSearchPromptText, originalMessageID)
+	msg := tgbotapi.NewMessage(callbackQuery.Message.Chat.ID, responseText)
+	msg.ReplyMarkup = tgbotapi.ForceReply{ForceReply: true, Selective: true}
+
+	if _, err := bot.Send(msg); err != nil {
+		logger.Error("Error sending tag search prompt", "error", err)
+	}
+
+	// The results come as a new message, so retire the full list
+	editMsg := tgbotapi.NewEditMessageText(callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID,
+		"Please reply with part of the tag name...")
+	if _, err := bot.Send(editMsg); err != nil {
+		logger.Error("Error editing message", "error", err)
+	}
+}
+
+// filterTags returns the tags whose names contain query, ignoring case, in their
+// original order
+func filterTags(tags []Tag, query string) []Tag {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return nil
+	}
+
+	var matches []Tag
+	for _, tag := range tags {
+		if strings.Contains(strings.ToLower(tag.Name), query) {
+			matches = append(matches, tag)
+		}
+	}
+	return matches
+}
+
+// tagSearchResultsText describes the matches shown for a search
+func tagSearchResultsText(query string, total int) string {
+	switch {
+	case total == 0:
+		return fmt.Sprintf("No tags match '%s'. Search again or create a new tag:", query)
+	case total > maxTagSearchResults:
+		return fmt.Sprintf("Tags matching '%s' (first %d of %d):", query, maxTagSearchResults, total)
+	default:
+		return fmt.Sprintf("Tags matching '%s':", query)
+	}
+}
+
+// showTagSearchResults re-renders the tag buttons for only the tags matching query
+func showTagSearchResults(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB, query string, originalMessageID int) {
+	tags, err := getUserTags(db, message.From.ID)
+	if err != nil {
+		messageLogger(message).Error("Error getting user tags", "error", err)
+		sendErrorMessage(bot, message, "Could not load your tags.")
+		return
+	}
+
+	matches := filterTags(tags, query)
+	responseText := tagSearchResultsText(query, len(matches))
+	if len(matches) > maxTagSearchResults {
+		matches = matches[:maxTagSearchResults]
+	}
+
+	msg := tgbotapi.NewMessage(message.Chat.ID, responseText)
+	msg.ReplyToMessageID = message.MessageID
+	msg.ReplyMarkup = tagSelectionKeyboard(matches, originalMessageID, true)
+
+	if _, err := bot.Send(msg); err != nil {
+		messageLogger(message).Error("Error sending tag search results", "error", err)
+	}
+}
+
+// newTagPromptText starts the prompt sent by the "Create New Tag" button. Names
+// typed in reply to it are created without asking for confirmation.
+const newTagPromptText = "Please reply with the name for your new tag:"
+
+// matchUserTag returns the name of the user's tag that name refers to: the tag
+// with this name ignoring case, or else the closest one within
+// maxTagNameTypos(name) edits. It returns "" when no tag is that close.
+func matchUserTag(db *sql.DB, userID int64, name string) (string, error) {
+	tags, err := getUserTags(db, userID)
+	if err != nil {
+		return "", err
+	}
+
+	name = strings.ToLower(name)
+	matched, best := "", maxTagNameTypos(name)+1
+	for _, tag := range tags {
+		distance := levenshtein(name, strings.ToLower(tag.Name))
+		if distance < best {
+			matched, best = tag.Name, distance
+		}
+	}
+	return matched, nil
+}
+
+// maxTagNameTypos is how many edits a typed tag name may be from an existing
+// tag and still mean it. Short names must match exactly, since "ai" and "go"
+// are one edit apart but clearly different tags.
+func maxTagNameTypos(name string) int {
+	switch length := utf8.RuneCountInString(name); {
+	case length < 4:
+		return 0
+	case length < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// levenshtein returns the number of single-character insertions, deletions and
+// substitutions that turn a into b
+func levenshtein(a, b string) int {
+	source, target := []rune(a), []rune(b)
+	previous := make([]int, len(target)+1)
+	current := make([]int, len(target)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(source); i++ {
+		current[0] = i
+		for j := 1; j <= len(target); j++ {
+			cost := 1
+			if source[i-1] == target[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(target)]
+}
+
+// newTagConfirmationText asks whether to create tagName. The name and message ID
+// are read back from this text when a button is pressed, so the Lambda stays stateless.
+func newTagConfirmationText(tagName string, messageID int) string {
+	return fmt.Sprintf("Create new tag '%s'?\n\n[MSG_ID:%d]", tagName, messageID)
+}
+
+// parseNewTagConfirmation extracts the tag name and original message ID from a
+// message built by newTagConfirmationText
+func parseNewTagConfirmation(text string) (string, int, error) {
+	messageID, err := extractMsgID(text)
+	if err != nil {
+		return "", 0, err
+	}
+
+	const prefix = "Create new tag '"
+	end := strings.LastIndex(text, "'?\n\n[MSG_ID:")
+	if !strings.HasPrefix(text, prefix) || end < len(prefix) {
+		return "", 0, fmt.Errorf("not a new tag confirmation")
+	}
+	return text[len(prefix):end], messageID, nil
+}
+
+func sendNewTagConfirmation(bot *tgbotapi.BotAPI, chatID int64, tagName string, messageID int) {
+	msg := tgbotapi.NewMessage(chatID, newTagConfirmationText(tagName, messageID))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Yes", fmt.Sprintf("new_tag_yes:%d", messageID)),
+			tgbotapi.NewInlineKeyboardButtonData("❌ No", fmt.Sprintf("new_tag_no:%d", messageID)),
+		),
+	)
+
+	if _, err := bot.Send(msg); err != nil {
+		slog.Error("Error sending new tag confirmation", "chat_id", chatID, "error", err)
+	}
+}
+
+// confirmNewTag creates the tag named in a confirmation message and tags the
+// original message with it, returning the tag name and the tagged message's ID
+func confirmNewTag(db *sql.DB, userID int64, confirmationText string) (string, int64, error) {
+	tagName, originalMessageID, err := parseNewTagConfirmation(confirmationText)
+	if err != nil {
+		return "", 0, err
+	}
+
+	dbMessageID, err := getMessageByTelegramID(db, userID, int64(originalMessageID))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to find original message: %v", err)
+	}
+
+	tagID, err := getOrCreateTag(db, userID, tagName)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create tag: %v", err)
+	}
+
+	if _, err := tagMessage(db, dbMessageID, tagID); err != nil {
+		return "", 0, fmt.Errorf("failed to tag message: %v", err)
+	}
+	return tagName, dbMessageID, nil
+}
+
+// handleNewTagConfirmCallback handles the Yes/No buttons of a new tag
+// confirmation: "new_tag_yes:messageID" or "new_tag_no:messageID"
+func handleNewTagConfirmCallback(bot *tgbotapi.BotAPI, callbackQuery *tgbotapi.CallbackQuery, db *sql.DB) {
+	chatID := callbackQuery.Message.Chat.ID
+	confirmationID := callbackQuery.Message.MessageID
+
+	if strings.HasPrefix(callbackQuery.Data, "new_tag_yes:") {
+		tagName, dbMessageID, err := confirmNewTag(db, callbackQuery.From.ID, callbackQuery.Message.Text)
+		if err != nil {
+			callbackLogger(callbackQuery).Error("Error confirming new tag", "error", err)
+			sendErrorMessageToCallback(bot, callbackQuery, "Could not create the tag.")
+			return
+		}
+
+		editOrSend(bot, chatID, confirmationID, taggedConfirmationText(db, dbMessageID, tagName))
+		return
+	}
+
+	// Declined: drop the confirmation and let the user pick again
+	_, originalMessageID, err := parseNewTagConfirmation(callbackQuery.Message.Text)
+	if err != nil {
+		callbackLogger(callbackQuery).Warn("Invalid new tag confirmation", "error", err)
+		return
+	}
+
+	editOrSend(bot, chatID, confirmationID, "Tag not created.")
+
+	original := &tgbotapi.Message{
+		MessageID: originalMessageID,
+		From:      callbackQuery.From,
+		Chat:      callbackQuery.Message.Chat,
+	}
+	showTagSelection(bot, original, db)
+}
+
+var (
+	errEmptyTagName = errors.New("tag name is empty")
+	errTagNameTaken = errors.New("you already have a tag with that name")
+	errTagNotFound  = errors.New("tag not found")
+)
+
+// getUserTagByName returns the ID and stored name of the user's tag with this
+// name, ignoring case
+func getUserTagByName(db *sql.DB, userID int64, name string) (int64, string, error) {
+	var tagID int64
+	var storedName string
+	query := `SELECT id, name FROM tags WHERE user_id = $1 AND lower(name) = lower($2) ORDER BY id LIMIT 1`
+	err := db.QueryRow(query, userID, name).Scan(&tagID, &storedName)
+	if err == sql.ErrNoRows {
+		return 0, "", errTagNotFound
+	}
+	return tagID, storedName, err
+}
+
+// getUserTagName returns the name of the user's tag tagID
+func getUserTagName(db *sql.DB, userID, tagID int64) (string, error) {
+	var name string
+	err := db.QueryRow(`SELECT name FROM tags WHERE id = $1 AND user_id = $2`, tagID, userID).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", errTagNotFound
+	}
+	return name, err
+}
+
+// renameTag changes the name of the user's tag; its message_tags stay as they are.
+// idx_tags_user_lower_name rejects a name already taken, even by a concurrent rename.
+func renameTag(db *sql.DB, userID, tagID int64, newName string) error {
+	newName = strings.TrimSpace(newName)
+	if newName == "" {
+		return errEmptyTagName
+	}
+
+	result, err := db.Exec(`UPDATE tags SET name = $3 WHERE id = $1 AND user_id = $2`, tagID, userID, newName)
+	if isUniqueViolation(err) {
+		return errTagNameTaken
+	}
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return errTagNotFound
+	}
+	return nil
+}
+
+// renameTagPromptText starts the prompt sent by the "Rename" button
+const renameTagPromptText = "Please reply with the new name for the tag"
+
+// renameTagPrompt asks for a new name for tagName. The tag ID is read back from
+// this text when the user replies, like [MSG_ID:n] in tag prompts.
+func renameTagPrompt(tagName string, tagID int64) string {
+	return fmt.Sprintf("%s '%s':\n\n[TAG_ID:%d]", renameTagPromptText, tagName, tagID)
+}
+
+// extractTagID parses the tag ID from a renameTagPrompt text
+func extractTagID(text string) (int64, error) {
+	const marker = "[TAG_ID:"
+	start := strings.Index(text, marker)
+	if start == -1 {
+		return 0, fmt.Errorf("no TAG_ID found in text")
+	}
+	end := strings.Index(text[start:], "]")
+	if end == -1 {
+		return 0, fmt.Errorf("no closing bracket for TAG_ID")
+	}
+	return strconv.ParseInt(text[start+len(marker):start+end], 10, 64)
+}
+
+// countTagMessages returns how many messages carry the tag
+func countTagMessages(db *sql.DB, tagID int64) (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM message_tags WHERE tag_id = $1`, tagID).Scan(&count)
+	return count, err
+}
+
+// deleteTag deletes the user's tag and removes it from every message, in one
+// transaction so no message_tags rows are left pointing at a missing tag. It
+// returns how many messages the tag was removed from.
+func deleteTag(db *sql.DB, userID, tagID int64) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var ownerID int64
+	err = tx.QueryRow(`SELECT user_id FROM tags WHERE id = $1`, tagID).Scan(&ownerID)
+	if err == sql.ErrNoRows || (err == nil && ownerID != userID) {
+		return 0, errTagNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec(`DELETE FROM message_tags WHERE tag_id = $1`, tagID)
+	if err != nil {
+		return 0, err
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM tags WHERE id = $1 AND user_id = $2`, tagID, userID); err != nil {
+		return 0, err
+	}
+	return removed, tx.Commit()
+}
+
+// deleteTagPromptMarker identifies replies to the /deletetag prompt
+const deleteTagPromptMarker = "[DELETE_TAG]"
+
+func sendDeleteTagPrompt(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
+	msg := tgbotapi.NewMessage(message.Chat.ID, "Which tag should I delete? Reply with its name or its number from /tags.\n\n"+deleteTagPromptMarker)
+	msg.ReplyToMessageID = message.MessageID
+	msg.ReplyMarkup = tgbotapi.ForceReply{ForceReply: true, Selective: true}
+
+	if _, err := bot.Send(msg); err != nil {
+		messageLogger(message).Error("Error sending delete tag prompt", "error", err)
+	}
+}
+
+// resolveTagReply finds the tag a user typed, by name ignoring case or by its
+// number in the /tags list. A tag named like a number wins over the number.
+func resolveTagReply(db *sql.DB, userID int64, text string) (int64, string, error) {
+	tagID, tagName, err := getUserTagByName(db, userID, text)
+	if err != errTagNotFound {
+		return tagID, tagName, err
+	}
+
+	num, convErr := strconv.Atoi(text)
+	if convErr != nil {
+		return 0, "", errTagNotFound
+	}
+	tags, err := getUserTags(db, userID)
+	if err != nil {
+		return 0, "", err
+	}
+	if num < 1 || num > len(tags) {
+		return 0, "", errTagNotFound
+	}
+	return tags[num-1].ID, tags[num-1].Name, nil
+}
+
+// handleDeleteTagReply deletes the tag named in a reply to the /deletetag prompt
+func handleDeleteTagReply(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB) {
+	text := strings.TrimSpace(message.Text)
+	if text == "" {
+		sendErrorMessage(bot, message, "Please enter a tag name or number.")
+		return
+	}
+
+	logger := messageLogger(message)
+	tagID, tagName, err := resolveTagReply(db, message.From.ID, text)
+	if err == errTagNotFound {
+		sendErrorMessage(bot, message, fmt.Sprintf("You don't have a tag '%s'. Use /tags to see your tags.", text))
+		return
+	}
+	if err != nil {
+		withText(logger, "tag_name", text).Error("Error finding tag to delete", "error", err)
+		sendErrorMessage(bot, message, "Could not delete the tag.")
+		return
+	}
+
+	logger = logger.With("tag_id", tagID)
+	count, err := deleteTag(db, message.From.ID, tagID)
+	if err != nil {
+		logger.Error("Error deleting tag", "error", err)
+		sendErrorMessage(bot, message, "Could not delete the tag.")
+		return
+	}
+
+	msg := tgbotapi.NewMessage(message.Chat.ID, fmt.Sprintf("🗑️ Deleted tag '%s' and removed it from %d messages.", tagName, count))
+	if _, err := bot.Send(msg); err != nil {
+		logger.Error("Error sending delete tag result", "error", err)
+	}
+}
+
+// maxTagsPerListMessage is how many tags /tags lists per message
+const maxTagsPerListMessage = 50
+
+// buildTagListChunks numbers the tags with their message counts and splits the
+// list into messages of at most maxTagsPerListMessage tags and maxMessageLength
+func buildTagListChunks(tags []TagCount) []string {
+	var chunks []string
+	var current strings.Builder
+	current.WriteString(fmt.Sprintf("🏷️ Your tags (%d):\n\n", len(tags)))
+	listed := 0
+
+	for i, tag := range tags {
+		line := fmt.Sprintf("%d. %s — %d messages\n", i+1, truncateText(tag.Name, maxListedTagNameLength), tag.MessageCount)
+		if listed == maxTagsPerListMessage || current.Len()+len(line) > maxMessageLength {
+			chunks = append(chunks, current.String())
+			current.Reset()
+			current.WriteString("More tags:\n\n")
+			listed = 0
+		}
+		current.WriteString(line)
+		listed++
+	}
+
+	return append(chunks, current.String())
+}
+
+// sendTagList answers "/tags" with every tag and how many messages carry it
+func sendTagList(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB) {
+	tags, err := getUserTagCounts(db, message.From.ID)
+	if err != nil {
+		messageLogger(message).Error("Error getting tag counts", "error", err)
+		sendErrorMessage(bot, message, "Sorry, I couldn't load your tags. Please try again later.")
+		return
+	}
+	if len(tags) == 0 {
+		sendErrorMessage(bot, message, "You don't have any tags yet. Send me a message to tag it.")
+		return
+	}
+
+	chunks := buildTagListChunks(tags)
+	for i, chunk := range chunks {
+		if _, err := bot.Send(tgbotapi.NewMessage(message.Chat.ID, chunk)); err != nil {
+			messageLogger(message).Error("Error sending tag list", "part", i+1, "parts", len(chunks), "error", err)
+			return
+		}
+	}
+}
+
+// sendTagOverview answers "/show <tag>" with the tag's message count and a
+// button to rename it
+func sendTagOverview(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB) {
+	tagName := strings.TrimSpace(message.CommandArguments())
+	if tagName == "" {
+		sendErrorMessage(bot, message, "Usage: /show <tag name>")
+		return
+	}
+
+	logger := messageLogger(message)
+	tagID, storedName, err := getUserTagByName(db, message.From.ID, tagName)
+	if err == errTagNotFound {
+		sendErrorMessage(bot, message, fmt.Sprintf("You don't have a tag named '%s'.", tagName))
+		return
+	}
+	if err != nil {
+		withText(logger, "tag_name", tagName).Error("Error finding tag", "error", err)
+		sendErrorMessage(bot, message, "Could not find the tag.")
+		return
+	}
+
+	logger = logger.With("tag_id", tagID)
+	count, err := countTagMessages(db, tagID)
+	if err != nil {
+		logger.Error("Error counting messages for tag", "error", err)
+		sendErrorMessage(bot, message, "Could not find the tag.")
+		return
+	}
+
+	msg := tgbotapi.NewMessage(message.Chat.ID, fmt.Sprintf("🏷️ %s\n%d messages", storedName, count))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✏️ Rename", fmt.Sprintf("rename_tag:%d", tagID)),
+		),
+	)
+	if _, err := bot.Send(msg); err != nil {
+		logger.Error("Error sending tag overview", "error", err)
+	}
+}
+
+// handleRenameTagCallback handles the "rename_tag:tagID" button by asking for the new name
+func handleRenameTagCallback(bot *tgbotapi.BotAPI, callbackQuery *tgbotapi.CallbackQuery, db *sql.DB) {
+	logger := callbackLogger(callbackQuery)
+	_, idText, _ := strings.Cut(callbackQuery.Data, ":")
+	tagID, err := strconv.ParseInt(idText, 10, 64)
+	if err != nil {
+		logger.Warn("Invalid rename_tag callback data", "data", callbackQuery.Data)
+		return
+	}
+
+	logger = logger.With("tag_id", tagID)
+	tagName, err := getUserTagName(db, callbackQuery.From.ID, tagID)
+	if err != nil {
+		logger.Error("Error finding tag to rename", "error", err)
+		sendErrorMessageToCallback(bot, callbackQuery, "Could not find the tag.")
+		return
+	}
+
+	msg := tgbotapi.NewMessage(callbackQuery.Message.Chat.ID, renameTagPrompt(tagName, tagID))
+	msg.ReplyMarkup = tgbotapi.ForceReply{ForceReply: true, Selective: true}
+	if _, err := bot.Send(msg); err != nil {
+		logger.Error("Error sending rename prompt", "error", err)
+	}
+}
+
+// handleRenameTagReply renames the tag named in the prompt the message replies to
+func handleRenameTagReply(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB) {
+	logger := messageLogger(message)
+	tagID, err := extractTagID(message.ReplyToMessage.Text)
+	if err != nil {
+		withText(logger, "bot_text", message.ReplyToMessage.Text).Warn("Could not extract TAG_ID from bot message", "error", err)
+		sendErrorMessage(bot, message, "Could not find the tag to rename.")
+		return
+	}
+
+	newName := strings.TrimSpace(message.Text)
+	var responseText string
+	switch err := renameTag(db, message.From.ID, tagID, newName); err {
+	case nil:
+		responseText = fmt.Sprintf("✏️ Tag renamed to '%s'", newName)
+	case errEmptyTagName:
+		responseText = "Please enter a tag name."
+	case errTagNameTaken:
+		responseText = "You already have a tag with that name."
+	case errTagNotFound:
+		responseText = "Could not find the tag to rename."
+	default:
+		logger.Error("Error renaming tag", "tag_id", tagID, "error", err)
+		responseText = "Could not rename the tag."
+	}
+
+	msg := tgbotapi.NewMessage(message.Chat.ID, responseText)
+	if _, err := bot.Send(msg); err != nil {
+		logger.Error("Error sending rename result", "error", err)
+	}
+}
+
+// renameTagCommandMarker identifies replies to the /renametag prompt
+const renameTagCommandMarker = "[RENAME_TAG]"
+
+func sendRenameTagCommandPrompt(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
+	msg := tgbotapi.NewMessage(message.Chat.ID, "Which tag should I rename? Reply with its name or its number from /tags.\n\n"+renameTagCommandMarker)
+	msg.ReplyToMessageID = message.MessageID
+	msg.ReplyMarkup = tgbotapi.ForceReply{ForceReply: true, Selective: true}
+
+	if _, err := bot.Send(msg); err != nil {
+		messageLogger(message).Error("Error sending rename tag prompt", "error", err)
+	}
+}
+
+// handleRenameTagCommandReply finds the tag named in a reply to the /renametag
+// prompt and asks for its new name, which handleRenameTagReply then applies
+func handleRenameTagCommandReply(bot *tgbotapi.BotAPI, message *tgbotapi.Message, db *sql.DB) {
+	text := strings.TrimSpace(message.Text)
+	if text == "" {
+		sendErrorMessage(bot, message, "Please enter a tag name or number.")
+		return
+	}
+
+	logger := messageLogger(message)
+	tagID, tagName, err := resolveTagReply(db, message.From.ID, text)
+	if err == errTagNotFound {
+		sendErrorMessage(bot, message, fmt.Sprintf("You don't have a tag '%s'. Use /tags to see your tags.", text))
+		return
+	}
+	if err != nil {
+		withText(logger, "tag_name", text).Error("Error finding tag to rename", "error", err)
+		sendErrorMessage(bot, message, "Could not find the tag to rename.")
+		return
+	}
+
+	msg := tgbotapi.NewMessage(message.Chat.ID, renameTagPrompt(tagName, tagID))
+	msg.ReplyToMessageID = message.MessageID
+	msg.ReplyMarkup = tgbotapi.ForceReply{ForceReply: true, Selective: true}
+	if _, err := bot.Send(msg); err != nil {
+		logger.Error("Error sending rename prompt", "error", err)
+	}
+}
+
+// tagCallbackData builds the callback data for a tag button. When the plain
+// "tag:tagID:messageID" form would exceed maxSafeCallbackDataLength, both IDs
+// are written in base 36 as "tagb:tagID:messageID", which fits any int64 tag ID
+// in 25 bytes. Everything the tap needs stays in the button.
+func tagCallbackData(tagID int64, messageID int) string {
+	data := fmt.Sprintf("tag:%d:%d", tagID, messageID)
+	if len(data) <= maxSafeCallbackDataLength {
+		return data
+	}
+	return "tagb:" + strconv.FormatInt(tagID, 36) + ":" + strconv.FormatInt(int64(messageID), 36)
+}
+
+// parseTagCallbackData extracts the tag ID and original message ID from tag
+// button callback data built by tagCallbackData
+func parseTagCallbackData(data string) (int64, int, error) {
+	parts := strings.Split(data, ":")
+	if len(parts) != 3 {
+		return 0, 0, fmt.Errorf("expected 3 parts, got %d", len(parts))
+	}
+
+	var base int
+	switch parts[0] {
+	case "tag":
+		base = 10
+	case "tagb":
+		base = 36
+	default:
+		return 0, 0, fmt.Errorf("unknown prefix: %s", parts[0])
+	}
+
+	tagID, err := strconv.ParseInt(parts[1], base, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid tag ID: %s", parts[1])
+	}
+	messageID, err := strconv.ParseInt(parts[2], base, 0)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid message ID: %s", parts[2])
+	}
+	return tagID, int(messageID), nil
+}
+
+// messageNotEditable reports whether Telegram refused an edit because the message
+// can't be edited anymore, typically because it's older than 48 hours
+func messageNotEditable(err error) bool {
+	var apiErr *tgbotapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	description := strings.ToLower(apiErr.Message)
+	return strings.Contains(description, "message can't be edited") ||
+		strings.Contains(description, "message to edit not found")
+}
+
+// editOrSend replaces the text (and buttons) of one of the bot's messages. When
+// Telegram no longer allows the edit, the text is sent as a new message instead
+// so the user still gets feedback.
+func editOrSend(bot *tgbotapi.BotAPI, chatID int64, messageID int, text string) {
+	_, err := bot.Send(tgbotapi.NewEditMessageText(chatID, messageID, text))
+	if err == nil {
+		return
+	}
+	logger := slog.Default().With("chat_id", chatID, "message_id", messageID)
+	if !messageNotEditable(err) {
+		logger.Error("Error editing message", "error", err)
+		return
+	}
+
+	logger.Info("Message can't be edited anymore, sending a new one", "error", err)
+	if _, err := bot.Send(tgbotapi.NewMessage(chatID, text)); err != nil {
+		logger.Error("Error sending message", "error", err)
 	}
 }
 
 func sendErrorMessage(bot *tgbotapi.BotAPI, message *tgbotapi.Message, text string) {
 	msg := tgbotapi.NewMessage(message.Chat.ID, text)
 	if _, err := bot.Send(msg); err != nil {
-		log.Printf("Error sending error message: %v", err)
+		messageLogger(message).Error("Error sending error message", "error", err)
 	}
 }
 
 func sendErrorMessageToCallback(bot *tgbotapi.BotAPI, callbackQuery *tgbotapi.CallbackQuery, text string) {
 	msg := tgbotapi.NewMessage(callbackQuery.Message.Chat.ID, text)
 	if _, err := bot.Send(msg); err != nil {
-		log.Printf("Error sending error message: %v", err)
+		callbackLogger(callbackQuery).Error("Error sending error message", "error", err)
 	}
 }
@@ -2,7 +2,9 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"testing"
@@ -239,91 +241,52 @@ func TestGetUserTags(t *testing.T) {
 	}
 }
 
-// TestGetOrCreateTag tests the getOrCreateTag function
-func TestGetOrCreateTag(t *testing.T) {
-	tests := []struct {
-		name         string
-		userID       int64
-		tagName      string
-		existingTags []string
-		expectCreate bool
-		expectError  bool
-	}{
-		{
-			name:         "Create new tag",
-			userID:       123,
-			tagName:      "newtag",
-			existingTags: nil,
-			expectCreate: true,
-			expectError:  false,
-		},
-		{
-			name:         "Get existing tag",
-			userID:       123,
-			tagName:      "existingtag",
-			existingTags: []string{"existingtag"},
-			expectCreate: false,
-			expectError:  false,
-		},
-		{
-			name:         "Create tag when others exist",
-			userID:       123,
-			tagName:      "newtag",
-			existingTags: []string{"othertag1", "othertag2"},
-			expectCreate: true,
-			expectError:  false,
-		},
-		{
-			name:         "Get existing tag among many",
-			userID:       123,
-			tagName:      "middletag",
-			existingTags: []string{"atag", "middletag", "ztag"},
-			expectCreate: false,
-			expectError:  false,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			db := setupTestDB(t)
-			defer db.Close()
-
-			// Create test user
-			createTestUser(t, db, tt.userID, "testuser")
-
-			// Setup existing tags
-			var existingTagID int64
-			for _, tagName := range tt.existingTags {
-				tagID := createTestTag(t, db, tt.userID, tagName, "")
-				if tagName == tt.tagName {
-					existingTagID = tagID
-				}
-			}
+// TestGetOrCreateTagIgnoresCase tests that tag names differing only in case
+// resolve to the tag created first, keeping its casing
+func TestGetOrCreateTagIgnoresCase(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
 
-			// Test getOrCreateTag
-			tagID, err := getOrCreateTag(db, tt.userID, tt.tagName)
+	userID, otherID := int64(123), int64(456)
+	createTestUser(t, db, userID, "testuser")
+	createTestUser(t, db, otherID, "other")
 
-			if tt.expectError {
-				assert.Error(t, err)
-				return
-			}
-
-			assert.NoError(t, err)
-			assert.Greater(t, tagID, int64(0))
-
-			if !tt.expectCreate {
-				// Should return existing tag ID
-				assert.Equal(t, existingTagID, tagID)
-			}
-
-			// Verify tag exists in database
-			var retrievedName string
-			query := `SELECT name FROM tags WHERE id = ? AND user_id = ?`
-			err = db.QueryRow(query, tagID, tt.userID).Scan(&retrievedName)
-			assert.NoError(t, err)
-			assert.Equal(t, tt.tagName, retrievedName)
-		})
+	workID, err := getOrCreateTag(db, userID, "Work")
+	assert.NoError(t, err)
+	for _, name := range []string{"work", "WORK", "Work"} {
+		tagID, err := getOrCreateTag(db, userID, name)
+		assert.NoError(t, err)
+		assert.Equal(t, workID, tagID, name)
 	}
+
+	name, err := getUserTagName(db, userID, workID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Work", name)
+	assert.Equal(t, 1, countRows(t, db, "tags"))
+
+	matched, err := matchUserTag(db, userID, "wORk")
+	assert.NoError(t, err)
+	assert.Equal(t, "Work", matched)
+
+	tagID, tagName, err := resolveTagReply(db, userID, "work")
+	assert.NoError(t, err)
+	assert.Equal(t, workID, tagID)
+	assert.Equal(t, "Work", tagName)
+
+	// Other users' tags don't count
+	otherWorkID, err := getOrCreateTag(db, otherID, "work")
+	assert.NoError(t, err)
+	assert.NotEqual(t, workID, otherWorkID)
+
+	// The unique index rejects case variants added behind getOrCreateTag's back
+	_, err = db.Exec(`INSERT INTO tags (user_id, name) VALUES (?, 'WORK')`, userID)
+	assert.Error(t, err)
+
+	// Renaming can change a tag's own casing, but not take another tag's name
+	musicID, err := getOrCreateTag(db, userID, "music")
+	assert.NoError(t, err)
+	assert.NoError(t, renameTag(db, userID, workID, "work"))
+	assert.Equal(t, errTagNameTaken, renameTag(db, userID, musicID, "WORK"))
 }
 
 // TestTagMessage tests the tagMessage function
@@ -334,6 +297,7 @@ func TestTagMessage(t *testing.T) {
 		tagID            int64
 		existingRelation bool
 		expectError      bool
+		expectCreated    bool
 	}{
 		{
 			name:             "Tag new message",
@@ -341,6 +305,7 @@ func TestTagMessage(t *testing.T) {
 			tagID:            1,
 			existingRelation: false,
 			expectError:      false,
+			expectCreated:    true,
 		},
 		{
 			name:             "Tag already tagged message (should not error)",
@@ -348,6 +313,7 @@ func TestTagMessage(t *testing.T) {
 			tagID:            1,
 			existingRelation: true,
 			expectError:      false,
+			expectCreated:    false,
 		},
 	}
 
@@ -369,7 +335,7 @@ func TestTagMessage(t *testing.T) {
 			}
 
 			// Test tagMessage
-			err := tagMessage(db, messageID, tagID)
+			created, err := tagMessage(db, messageID, tagID)
 
 			if tt.expectError {
 				assert.Error(t, err)
@@ -377,6 +343,7 @@ func TestTagMessage(t *testing.T) {
 			}
 
 			assert.NoError(t, err)
+			assert.Equal(t, tt.expectCreated, created)
 
 			// Verify relationship exists
 			var count int
@@ -508,6 +475,43 @@ func TestShowTagSelection(t *testing.T) {
 	}
 }
 
+// TestTagButtonThreshold tests that TAG_BUTTON_THRESHOLD moves the switch from
+// buttons to the text list
+func TestTagButtonThreshold(t *testing.T) {
+	for _, invalid := range []string{"", "0", "-3", "many"} {
+		t.Setenv("TAG_BUTTON_THRESHOLD", invalid)
+		assert.Equal(t, defaultTagButtonThreshold, tagButtonThreshold(), invalid)
+	}
+
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	createTestUser(t, db, userID, "testuser")
+	for i := 0; i < 25; i++ {
+		createTestTag(t, db, userID, fmt.Sprintf("tag%d", i), "")
+	}
+
+	usesButtons := func() bool {
+		bot, called := newTestBotAPI(t)
+		showTagSelection(bot, createTelegramMessage(456, userID, "testuser", "test message"), db)
+		requests := called()
+		if !assert.Len(t, requests, 1) {
+			return false
+		}
+		return strings.Contains(requests[0].Params.Get("reply_markup"), "inline_keyboard")
+	}
+
+	t.Setenv("TAG_BUTTON_THRESHOLD", "")
+	assert.False(t, usesButtons(), "25 tags are over the default of 20")
+
+	t.Setenv("TAG_BUTTON_THRESHOLD", "40")
+	assert.True(t, usesButtons())
+
+	t.Setenv("TAG_BUTTON_THRESHOLD", "5")
+	assert.False(t, usesButtons())
+}
+
 // TestShowTagSelectionWithButtons tests the button UI generation
 func TestShowTagSelectionWithButtons(t *testing.T) {
 	tests := []struct {
@@ -813,6 +817,141 @@ func TestCallbackDataParsing(t *testing.T) {
 	}
 }
 
+// TestTagCallbackDataCompact tests the compact encoding for oversized callback data
+func TestTagCallbackDataCompact(t *testing.T) {
+	t.Run("Small IDs use plain format", func(t *testing.T) {
+		data := tagCallbackData(42, 456)
+		assert.Equal(t, "tag:42:456", data)
+
+		tagID, messageID, err := parseTagCallbackData(data)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(42), tagID)
+		assert.Equal(t, 456, messageID)
+	})
+
+	t.Run("Large tag ID switches to base 36", func(t *testing.T) {
+		largeTagID := int64(math.MaxInt64)
+		messageID := math.MaxInt32
+
+		data := tagCallbackData(largeTagID, messageID)
+		assert.True(t, strings.HasPrefix(data, "tagb:"), "Expected compact format, got %s", data)
+		assert.LessOrEqual(t, len(data), maxSafeCallbackDataLength)
+
+		tagID, parsedMessageID, err := parseTagCallbackData(data)
+		assert.NoError(t, err)
+		assert.Equal(t, largeTagID, tagID)
+		assert.Equal(t, messageID, parsedMessageID)
+
+		// Nothing is kept between building and parsing, so any instance can
+		// resolve a button, even after a cold start
+		otherTagID := int64(math.MaxInt64 - 1)
+		tagID, _, err = parseTagCallbackData(tagCallbackData(otherTagID, messageID))
+		assert.NoError(t, err)
+		assert.Equal(t, otherTagID, tagID)
+	})
+
+	t.Run("Old token buttons no longer resolve", func(t *testing.T) {
+		_, _, err := parseTagCallbackData("tagt:1:456")
+		assert.Error(t, err)
+	})
+
+	t.Run("Malformed data", func(t *testing.T) {
+		for _, data := range []string{"tag:invalid", "tag:abc:123", "tag:1:abc", "tagb:1:!", "other:1:2"} {
+			_, _, err := parseTagCallbackData(data)
+			assert.Error(t, err, "Expected error for %s", data)
+		}
+	})
+}
+
+// TestBuildTagSelectionTextChunks tests that very large tag lists are split under Telegram's limit
+func TestBuildTagSelectionTextChunks(t *testing.T) {
+	t.Run("Few tags fit in one message", func(t *testing.T) {
+		tags := []Tag{{ID: 1, Name: "work"}, {ID: 2, Name: "personal"}}
+		chunks := buildTagSelectionTextChunks(tags, 456)
+
+		assert.Len(t, chunks, 1)
+		assert.Contains(t, chunks[0], "1. work\n2. personal\n")
+		assert.Contains(t, chunks[0], "[MSG_ID:456]")
+	})
+
+	t.Run("Very long tag names are truncated", func(t *testing.T) {
+		tags := []Tag{{ID: 1, Name: strings.Repeat("x", 5000)}}
+		chunks := buildTagSelectionTextChunks(tags, 456)
+
+		assert.Len(t, chunks, 1)
+		assert.LessOrEqual(t, len(chunks[0]), maxMessageLength)
+	})
+
+	t.Run("500 tags are chunked and still taggable", func(t *testing.T) {
+		db := setupTestDB(t)
+		defer db.Close()
+
+		userID := int64(123)
+		createTestUser(t, db, userID, "testuser")
+		messageID := createTestMessage(t, db, userID, 456)
+
+		for i := 0; i < 500; i++ {
+			createTestTag(t, db, userID, fmt.Sprintf("a-fairly-descriptive-tag-name-%03d", i), "")
+		}
+
+		tags, err := getUserTags(db, userID)
+		assert.NoError(t, err)
+		assert.Len(t, tags, 500)
+
+		chunks := buildTagSelectionTextChunks(tags, 456)
+		assert.Greater(t, len(chunks), 1, "500 tags should not fit in one message")
+
+		listed := 0
+		for _, chunk := range chunks {
+			assert.LessOrEqual(t, len(chunk), maxMessageLength)
+			assert.True(t, containsTagSelectionPattern(chunk))
+
+			// Every chunk correlates back to the original message
+			msgID, err := extractMsgID(chunk)
+			assert.NoError(t, err)
+			assert.Equal(t, 456, msgID)
+
+			listed += strings.Count(chunk, ". a-fairly-descriptive-tag-name-")
+		}
+		assert.Equal(t, 500, listed, "Every tag should be listed exactly once")
+
+		// Numbering continues across chunks
+		lastChunk := chunks[len(chunks)-1]
+		assert.Contains(t, lastChunk, "500. a-fairly-descriptive-tag-name-499")
+
+		// Select the last tag by number, as handleTagSelection does
+		msgID, err := extractMsgID(lastChunk)
+		assert.NoError(t, err)
+		dbMessageID, err := getMessageByTelegramID(db, userID, int64(msgID))
+		assert.NoError(t, err)
+		assert.Equal(t, messageID, dbMessageID)
+
+		num, err := strconv.Atoi("500")
+		assert.NoError(t, err)
+		tagID, err := getOrCreateTag(db, userID, tags[num-1].Name)
+		assert.NoError(t, err)
+		_, err = tagMessage(db, dbMessageID, tagID)
+		assert.NoError(t, err)
+
+		var taggedName string
+		err = db.QueryRow(`SELECT t.name FROM message_tags mt JOIN tags t ON t.id = mt.tag_id WHERE mt.message_id = ?`, dbMessageID).Scan(&taggedName)
+		assert.NoError(t, err)
+		assert.Equal(t, "a-fairly-descriptive-tag-name-499", taggedName)
+	})
+}
+
+// TestExtractMsgID tests parsing the MSG_ID marker from bot prompts
+func TestExtractMsgID(t *testing.T) {
+	msgID, err := extractMsgID("Choose a tag:\n\n[MSG_ID:456]")
+	assert.NoError(t, err)
+	assert.Equal(t, 456, msgID)
+
+	for _, text := range []string{"No marker", "[MSG_ID:", "[MSG_ID:abc]", "[MSG_ID:]"} {
+		_, err := extractMsgID(text)
+		assert.Error(t, err, "Expected error for %q", text)
+	}
+}
+
 // TestNewTagWorkflow tests the new tag creation workflow logic
 func TestNewTagWorkflow(t *testing.T) {
 	t.Run("New tag prompt message format", func(t *testing.T) {
@@ -835,6 +974,223 @@ func TestNewTagWorkflow(t *testing.T) {
 	})
 }
 
+// TestNewTagConfirmation tests the confirm/deny step before creating a typed tag
+func TestNewTagConfirmation(t *testing.T) {
+	t.Run("Confirmation text round-trips", func(t *testing.T) {
+		for _, name := range []string{"worrk", "it's 'quoted'", "🏷️ emoji tag"} {
+			text := newTagConfirmationText(name, 456)
+			assert.Contains(t, text, "[MSG_ID:456]")
+
+			parsedName, msgID, err := parseNewTagConfirmation(text)
+			assert.NoError(t, err)
+			assert.Equal(t, name, parsedName)
+			assert.Equal(t, 456, msgID)
+		}
+	})
+
+	t.Run("Other prompts are rejected", func(t *testing.T) {
+		for _, text := range []string{
+			"Choose a tag or create a new one:",
+			"Please reply with the name for your new tag:\n\n[MSG_ID:456]",
+			"Create new tag 'x'?",
+		} {
+			_, _, err := parseNewTagConfirmation(text)
+			assert.Error(t, err, "Expected error for %q", text)
+		}
+	})
+
+	t.Run("Unknown names need confirmation", func(t *testing.T) {
+		db := setupTestDB(t)
+		defer db.Close()
+
+		userID := int64(123)
+		createTestUser(t, db, userID, "testuser")
+		createTestTag(t, db, userID, "work", "")
+		createTestTag(t, db, userID, "recipes", "")
+		createTestTag(t, db, userID, "go", "")
+		createTestTag(t, db, userID, "photography", "")
+
+		tests := []struct {
+			typed    string
+			expected string
+		}{
+			{"work", "work"},
+			{"WORK", "work"},
+			{"worrk", "work"},
+			{"wrk", ""}, // Too short for a typo to count
+			{"wokr", ""},
+			{"recipe", "recipes"},
+			{"Recpies", ""},
+			{"photograhpy", "photography"},
+			{"fotography", "photography"},
+			{"go", "go"},
+			{"ai", ""},
+			{"gp", ""},
+			{"holiday", ""},
+		}
+		for _, tt := range tests {
+			matched, err := matchUserTag(db, userID, tt.typed)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, matched, tt.typed)
+		}
+
+		matched, err := matchUserTag(db, int64(999), "work")
+		assert.NoError(t, err)
+		assert.Empty(t, matched, "Other users' tags don't count")
+	})
+
+	t.Run("Closest tag wins", func(t *testing.T) {
+		db := setupTestDB(t)
+		defer db.Close()
+
+		userID := int64(123)
+		createTestUser(t, db, userID, "testuser")
+		createTestTag(t, db, userID, "reading", "")
+		createTestTag(t, db, userID, "readings", "")
+
+		matched, err := matchUserTag(db, userID, "readingss")
+		assert.NoError(t, err)
+		assert.Equal(t, "readings", matched)
+	})
+
+	t.Run("Confirm creates the tag and tags the message", func(t *testing.T) {
+		db := setupTestDB(t)
+		defer db.Close()
+
+		userID := int64(123)
+		createTestUser(t, db, userID, "testuser")
+		messageID := createTestMessage(t, db, userID, 456)
+
+		tagName, taggedID, err := confirmNewTag(db, userID, newTagConfirmationText("worrk", 456))
+		assert.NoError(t, err)
+		assert.Equal(t, "worrk", tagName)
+		assert.Equal(t, messageID, taggedID)
+
+		var taggedName string
+		err = db.QueryRow(`SELECT t.name FROM message_tags mt JOIN tags t ON t.id = mt.tag_id WHERE mt.message_id = ?`, messageID).Scan(&taggedName)
+		assert.NoError(t, err)
+		assert.Equal(t, "worrk", taggedName)
+	})
+
+	t.Run("Confirm fails without creating a tag for unknown messages", func(t *testing.T) {
+		db := setupTestDB(t)
+		defer db.Close()
+
+		userID := int64(123)
+		createTestUser(t, db, userID, "testuser")
+
+		_, _, err := confirmNewTag(db, userID, newTagConfirmationText("worrk", 999))
+		assert.Error(t, err)
+
+		matched, err := matchUserTag(db, userID, "worrk")
+		assert.NoError(t, err)
+		assert.Empty(t, matched)
+	})
+
+	t.Run("Deny leaves tags untouched", func(t *testing.T) {
+		db := setupTestDB(t)
+		defer db.Close()
+
+		userID := int64(123)
+		createTestUser(t, db, userID, "testuser")
+		createTestMessage(t, db, userID, 456)
+
+		// Declining only needs the original message ID to re-show the selection
+		_, msgID, err := parseNewTagConfirmation(newTagConfirmationText("worrk", 456))
+		assert.NoError(t, err)
+		assert.Equal(t, 456, msgID)
+
+		tags, err := getUserTags(db, userID)
+		assert.NoError(t, err)
+		assert.Empty(t, tags)
+	})
+}
+
+// TestTaggedConfirmationText tests that confirmations name the tagged content type
+func TestTaggedConfirmationText(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	user := createTestUserStruct(123, "user", "Test", "User")
+	assert.NoError(t, saveUser(db, user))
+
+	photo := createTestPhotoMessage(1, user, "", tgbotapi.PhotoSize{FileID: "photo"})
+	assert.NoError(t, saveMessage(db, photo))
+	photoID, err := getMessageByTelegramID(db, user.ID, 1)
+	assert.NoError(t, err)
+
+	text := taggedConfirmationText(db, photoID, "trips")
+	assert.Equal(t, "📷 Photo tagged with 'trips'", text)
+	assert.Contains(t, text, typeEmoji(MessageTypePhoto))
+
+	note := createTestMessageStruct(2, user, "hello")
+	assert.NoError(t, saveMessage(db, note))
+	noteID, err := getMessageByTelegramID(db, user.ID, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, "💬 Message tagged with 'work'", taggedConfirmationText(db, noteID, "work"))
+
+	// Unknown messages fall back to the generic label
+	assert.Equal(t, "💬 Message tagged with 'work'", taggedConfirmationText(db, 999, "work"))
+}
+
+// handleTagCallbackWithBotAPI mirrors handleTagCallback against the BotAPI interface
+func handleTagCallbackWithBotAPI(bot BotAPI, callbackQuery *tgbotapi.CallbackQuery, db *sql.DB) {
+	tagID, originalMessageID, err := parseTagCallbackData(callbackQuery.Data)
+	if err != nil {
+		return
+	}
+
+	dbMessageID, err := getMessageByTelegramID(db, callbackQuery.From.ID, int64(originalMessageID))
+	if err != nil {
+		return
+	}
+
+	var tagName string
+	if err := db.QueryRow(`SELECT name FROM tags WHERE id = $1 AND user_id = $2`, tagID, callbackQuery.From.ID).Scan(&tagName); err != nil {
+		return
+	}
+
+	created, err := tagMessage(db, dbMessageID, tagID)
+	if err != nil {
+		return
+	}
+	if created {
+		bot.Send(tgbotapi.NewMessage(callbackQuery.Message.Chat.ID, taggedConfirmationText(db, dbMessageID, tagName)))
+	}
+
+	editMsg := tgbotapi.NewEditMessageText(callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID,
+		fmt.Sprintf("✅ Tagged with '%s'", tagName))
+	bot.Send(editMsg)
+}
+
+// TestTagCallbackEditFailureIsIdempotent tests repeat taps on buttons that couldn't be removed
+func TestTagCallbackEditFailureIsIdempotent(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(12345)
+	createTestUser(t, db, userID, "testuser")
+	messageID := createTestMessage(t, db, userID, 456)
+	tagID := createTestTag(t, db, userID, "work", "")
+
+	mockBot := &MockBotAPI{}
+	// The confirmation is sent once; removing the buttons fails every time
+	mockBot.On("Send", mock.AnythingOfType("tgbotapi.MessageConfig")).Return(tgbotapi.Message{}, nil).Once()
+	mockBot.On("Send", mock.AnythingOfType("tgbotapi.EditMessageTextConfig")).
+		Return(tgbotapi.Message{}, fmt.Errorf("Bad Request: message can't be edited")).Twice()
+
+	callbackQuery := createCallbackQuery("callback123", userID, "testuser", fmt.Sprintf("tag:%d:456", tagID))
+	handleTagCallbackWithBotAPI(mockBot, callbackQuery, db)
+	handleTagCallbackWithBotAPI(mockBot, callbackQuery, db)
+
+	mockBot.AssertExpectations(t)
+
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM message_tags WHERE message_id = ? AND tag_id = ?`, messageID, tagID).Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
 // TestTagsEdgeCases tests comprehensive edge cases
 func TestTagsEdgeCases(t *testing.T) {
 	t.Run("Tag name with special characters", func(t *testing.T) {
@@ -889,7 +1245,7 @@ func TestTagsEdgeCases(t *testing.T) {
 		_, err = getOrCreateTag(db, userID, "testtag")
 		assert.Error(t, err, "Should handle database connection errors")
 
-		err = tagMessage(db, 1, 1)
+		_, err = tagMessage(db, 1, 1)
 		assert.Error(t, err, "Should handle database connection errors")
 
 		_, err = getMessageByTelegramID(db, userID, 456)
@@ -953,3 +1309,724 @@ func TestTagsEdgeCases(t *testing.T) {
 		}
 	})
 }
+
+// TestFilterTags tests that a search keeps only matching tags
+func TestFilterTags(t *testing.T) {
+	tags := []Tag{
+		{ID: 1, Name: "work"},
+		{ID: 2, Name: "Homework"},
+		{ID: 3, Name: "recipes"},
+		{ID: 4, Name: "WORKOUT"},
+		{ID: 5, Name: "travel"},
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		expected []int64
+	}{
+		{name: "Substring matches keep their order", query: "work", expected: []int64{1, 2, 4}},
+		{name: "Case insensitive", query: "Rec", expected: []int64{3}},
+		{name: "Surrounding spaces ignored", query: "  travel ", expected: []int64{5}},
+		{name: "No matches", query: "music", expected: nil},
+		{name: "Empty query matches nothing", query: "   ", expected: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ids []int64
+			for _, tag := range filterTags(tags, tt.query) {
+				ids = append(ids, tag.ID)
+			}
+			assert.Equal(t, tt.expected, ids)
+		})
+	}
+}
+
+// TestTagSearchResultsText tests the header shown above search results
+func TestTagSearchResultsText(t *testing.T) {
+	assert.Equal(t, "Tags matching 'wo':", tagSearchResultsText("wo", 3))
+	assert.Equal(t, "No tags match 'zz'. Search again or create a new tag:", tagSearchResultsText("zz", 0))
+	assert.Equal(t, "Tags matching 'a' (first 20 of 45):", tagSearchResultsText("a", 45))
+}
+
+// TestTagSelectionKeyboard tests that filtered keyboards still tag the original message
+func TestTagSelectionKeyboard(t *testing.T) {
+	matches := filterTags([]Tag{{ID: 1, Name: "work"}, {ID: 2, Name: "music"}, {ID: 3, Name: "homework"}}, "work")
+
+	keyboard := tagSelectionKeyboard(matches, 456, true)
+	rows := keyboard.InlineKeyboard
+	assert.Len(t, rows, 3)
+
+	assert.Len(t, rows[0], 2)
+	for i, button := range rows[0] {
+		assert.Equal(t, matches[i].Name, button.Text)
+		tagID, messageID, err := parseTagCallbackData(*button.CallbackData)
+		assert.NoError(t, err)
+		assert.Equal(t, matches[i].ID, tagID)
+		assert.Equal(t, 456, messageID)
+	}
+
+	assert.Equal(t, "🔍 Search", rows[1][0].Text)
+	assert.Equal(t, "tag_search:456", *rows[1][0].CallbackData)
+	assert.Equal(t, "new_tag:456", *rows[2][0].CallbackData)
+
+	t.Run("Without search", func(t *testing.T) {
+		keyboard := tagSelectionKeyboard(nil, 456, false)
+		assert.Len(t, keyboard.InlineKeyboard, 1)
+		assert.Equal(t, "new_tag:456", *keyboard.InlineKeyboard[0][0].CallbackData)
+	})
+}
+
+// TestRenameTag tests renaming, name conflicts and ownership
+func TestRenameTag(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID, otherID := int64(123), int64(456)
+	createTestUser(t, db, userID, "owner")
+	createTestUser(t, db, otherID, "other")
+
+	workID, err := getOrCreateTag(db, userID, "wrok")
+	assert.NoError(t, err)
+	_, err = getOrCreateTag(db, userID, "music")
+	assert.NoError(t, err)
+	messageID := createTestMessage(t, db, userID, 1)
+	_, err = tagMessage(db, messageID, workID)
+	assert.NoError(t, err)
+
+	assert.NoError(t, renameTag(db, userID, workID, "  work "))
+	name, err := getUserTagName(db, userID, workID)
+	assert.NoError(t, err)
+	assert.Equal(t, "work", name)
+
+	// Associations survive the rename
+	var count int
+	assert.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM message_tags WHERE tag_id = ?`, workID).Scan(&count))
+	assert.Equal(t, 1, count)
+
+	// Renaming to its own name is a no-op, not a conflict
+	assert.NoError(t, renameTag(db, userID, workID, "work"))
+
+	assert.Equal(t, errTagNameTaken, renameTag(db, userID, workID, "music"))
+	assert.Equal(t, errEmptyTagName, renameTag(db, userID, workID, "   "))
+	assert.Equal(t, errTagNotFound, renameTag(db, otherID, workID, "stolen"))
+}
+
+// TestExtractTagID tests reading the tag ID back from a rename prompt
+func TestExtractTagID(t *testing.T) {
+	tagID, err := extractTagID(renameTagPrompt("work", 42))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), tagID)
+
+	_, err = extractTagID("no marker here")
+	assert.Error(t, err)
+}
+
+// TestHandleRenameTagCallback tests that the rename button prompts for a name with the tag ID encoded
+func TestHandleRenameTagCallback(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	createTestUser(t, db, userID, "owner")
+	tagID, err := getOrCreateTag(db, userID, "work")
+	assert.NoError(t, err)
+
+	bot, called := newTestBotAPI(t)
+	handleRenameTagCallback(bot, createCallbackQuery("callback123", userID, "owner", fmt.Sprintf("rename_tag:%d", tagID)), db)
+
+	requests := called()
+	if assert.Len(t, requests, 1) {
+		assert.Equal(t, "sendMessage", requests[0].Method)
+		text := requests[0].Params.Get("text")
+		assert.Equal(t, renameTagPrompt("work", tagID), text)
+		assert.Contains(t, requests[0].Params.Get("reply_markup"), `"force_reply":true`)
+
+		promptTagID, err := extractTagID(text)
+		assert.NoError(t, err)
+		assert.Equal(t, tagID, promptTagID)
+	}
+
+	t.Run("Another user's tag", func(t *testing.T) {
+		bot, called := newTestBotAPI(t)
+		handleRenameTagCallback(bot, createCallbackQuery("callback123", 999, "other", fmt.Sprintf("rename_tag:%d", tagID)), db)
+
+		requests := called()
+		if assert.Len(t, requests, 1) {
+			assert.Equal(t, "Could not find the tag.", requests[0].Params.Get("text"))
+		}
+	})
+}
+
+// TestEditOrSend tests the fallback to a new message when an edit isn't allowed
+func TestEditOrSend(t *testing.T) {
+	t.Run("Edit succeeds", func(t *testing.T) {
+		bot, called := newTestBotAPI(t)
+		editOrSend(bot, 123, 7, "Tag not created.")
+
+		requests := called()
+		if assert.Len(t, requests, 1) {
+			assert.Equal(t, "editMessageText", requests[0].Method)
+		}
+	})
+
+	t.Run("Message too old to edit", func(t *testing.T) {
+		bot, called := newFailingTestBotAPI(t, map[string]string{"editMessageText": "Bad Request: message can't be edited"})
+		editOrSend(bot, 123, 7, "Tag not created.")
+
+		requests := called()
+		if assert.Len(t, requests, 2) {
+			assert.Equal(t, "editMessageText", requests[0].Method)
+			assert.Equal(t, "sendMessage", requests[1].Method)
+			assert.Equal(t, "Tag not created.", requests[1].Params.Get("text"))
+			assert.Equal(t, "123", requests[1].Params.Get("chat_id"))
+		}
+	})
+
+	t.Run("Other errors are only logged", func(t *testing.T) {
+		bot, called := newFailingTestBotAPI(t, map[string]string{"editMessageText": "Bad Request: message is not modified"})
+		editOrSend(bot, 123, 7, "Tag not created.")
+
+		assert.Equal(t, 0, countMethod(called(), "sendMessage"))
+	})
+}
+
+// TestHandleTagCallbackRepeatTapOnOldMessage tests that a repeat tap on buttons
+// that can't be removed anymore still gets a reply
+func TestHandleTagCallbackRepeatTapOnOldMessage(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	createTestUser(t, db, userID, "testuser")
+	messageID := createTestMessage(t, db, userID, 456)
+	tagID := createTestTag(t, db, userID, "work", "")
+	_, err := tagMessage(db, messageID, tagID)
+	assert.NoError(t, err)
+
+	bot, called := newFailingTestBotAPI(t, map[string]string{"editMessageReplyMarkup": "Bad Request: message can't be edited"})
+	handleTagCallback(bot, createCallbackQuery("callback123", userID, "testuser", fmt.Sprintf("tag:%d:456", tagID)), db)
+
+	requests := called()
+	assert.Equal(t, 1, countMethod(requests, "sendMessage"))
+	if assert.NotEmpty(t, requests) {
+		assert.Equal(t, "✅ Tagged with 'work'", requests[len(requests)-1].Params.Get("text"))
+	}
+}
+
+// TestHandleTagCallbackKeepsKeyboard tests that tagging re-sends the keyboard
+// with applied tags checked, so several tags can be added in one go
+func TestHandleTagCallbackKeepsKeyboard(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	createTestUser(t, db, userID, "testuser")
+	messageID := createTestMessage(t, db, userID, 456)
+	workID := createTestTag(t, db, userID, "work", "")
+	musicID := createTestTag(t, db, userID, "music", "")
+
+	// Tap "work" on the keyboard as it was first sent
+	callbackQuery := createCallbackQuery("callback123", userID, "testuser", fmt.Sprintf("tag:%d:456", workID))
+	keyboard := tagSelectionKeyboard([]Tag{{ID: workID, Name: "work"}, {ID: musicID, Name: "music"}}, 456, true)
+	callbackQuery.Message.ReplyMarkup = &keyboard
+
+	bot, called := newTestBotAPI(t)
+	handleTagCallback(bot, callbackQuery, db)
+
+	requests := called()
+	assert.Equal(t, 0, countMethod(requests, "sendMessage"))
+	if assert.Equal(t, 1, countMethod(requests, "editMessageReplyMarkup")) {
+		var markup tgbotapi.InlineKeyboardMarkup
+		assert.NoError(t, json.Unmarshal([]byte(requests[0].Params.Get("reply_markup")), &markup))
+		assert.Equal(t, appliedTagPrefix+"work", markup.InlineKeyboard[0][0].Text)
+		assert.Equal(t, "music", markup.InlineKeyboard[0][1].Text)
+		assert.Equal(t, "🔍 Search", markup.InlineKeyboard[1][0].Text)
+		assert.Equal(t, "➕ Create New Tag", markup.InlineKeyboard[2][0].Text)
+		assert.Equal(t, "tag_done:456", *markup.InlineKeyboard[3][0].CallbackData)
+
+		// Tapping "music" on the updated keyboard checks it too, without a second Done row
+		callbackQuery.Data = fmt.Sprintf("tag:%d:456", musicID)
+		callbackQuery.Message.ReplyMarkup = &markup
+		bot, called = newTestBotAPI(t)
+		handleTagCallback(bot, callbackQuery, db)
+
+		requests = called()
+		if assert.Len(t, requests, 1) {
+			var updated tgbotapi.InlineKeyboardMarkup
+			assert.NoError(t, json.Unmarshal([]byte(requests[0].Params.Get("reply_markup")), &updated))
+			assert.Equal(t, appliedTagPrefix+"work", updated.InlineKeyboard[0][0].Text)
+			assert.Equal(t, appliedTagPrefix+"music", updated.InlineKeyboard[0][1].Text)
+			assert.Len(t, updated.InlineKeyboard, 4)
+		}
+	}
+
+	names, err := getMessageTagNames(db, messageID)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"music", "work"}, names)
+}
+
+// TestHandleTagDoneCallback tests that Done replaces the keyboard with a summary
+func TestHandleTagDoneCallback(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	createTestUser(t, db, userID, "testuser")
+	messageID := createTestMessage(t, db, userID, 456)
+
+	bot, called := newTestBotAPI(t)
+	handleTagDoneCallback(bot, createCallbackQuery("callback123", userID, "testuser", "tag_done:456"), db)
+	requests := called()
+	if assert.Len(t, requests, 1) {
+		assert.Equal(t, "editMessageText", requests[0].Method)
+		assert.Equal(t, "No tags added.", requests[0].Params.Get("text"))
+	}
+
+	createTestMessageTag(t, db, messageID, createTestTag(t, db, userID, "work", ""))
+	createTestMessageTag(t, db, messageID, createTestTag(t, db, userID, "music", ""))
+
+	bot, called = newTestBotAPI(t)
+	handleTagDoneCallback(bot, createCallbackQuery("callback123", userID, "testuser", "tag_done:456"), db)
+	requests = called()
+	if assert.Len(t, requests, 1) {
+		assert.Equal(t, "editMessageText", requests[0].Method)
+		assert.Equal(t, "✅ Tagged with music, work", requests[0].Params.Get("text"))
+		assert.Empty(t, requests[0].Params.Get("reply_markup"))
+	}
+}
+
+// TestButtonPromptText tests that the button prompt supports typed replies
+func TestButtonPromptText(t *testing.T) {
+	text := buttonPromptText([]Tag{{ID: 1, Name: "work"}, {ID: 2, Name: "music"}}, 456)
+	assert.Equal(t, "Choose a tag or create a new one:\n\n1. work · 2. music\n\nTap a button or reply with a tag name or number.\n\n[MSG_ID:456]", text)
+
+	empty := buttonPromptText(nil, 456)
+	assert.Contains(t, empty, "You don't have any tags yet")
+
+	for _, prompt := range []string{text, empty} {
+		msgID, err := extractMsgID(prompt)
+		assert.NoError(t, err)
+		assert.Equal(t, 456, msgID)
+	}
+}
+
+// TestReplyToButtonPrompt tests typing a tag number or name in reply to the button prompt
+func TestReplyToButtonPrompt(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	createTestUser(t, db, userID, "testuser")
+	messageID := createTestMessage(t, db, userID, 456)
+	createTestTag(t, db, userID, "music", "")
+	createTestTag(t, db, userID, "work", "")
+
+	// Capture the prompt the bot shows after saving message 456
+	bot, called := newTestBotAPI(t)
+	showTagSelection(bot, createTelegramMessage(456, userID, "testuser", "test message"), db)
+	requests := called()
+	if !assert.Len(t, requests, 1) {
+		return
+	}
+	assert.Contains(t, requests[0].Params.Get("reply_markup"), "inline_keyboard", "The prompt uses buttons")
+	prompt := &tgbotapi.Message{
+		MessageID: 2,
+		From:      &tgbotapi.User{ID: 999999, IsBot: true},
+		Text:      requests[0].Params.Get("text"),
+	}
+
+	tagNames := func() []string {
+		rows, err := db.Query(`SELECT t.name FROM message_tags mt JOIN tags t ON t.id = mt.tag_id WHERE mt.message_id = ? ORDER BY t.name`, messageID)
+		assert.NoError(t, err)
+		defer rows.Close()
+		var names []string
+		for rows.Next() {
+			var name string
+			assert.NoError(t, rows.Scan(&name))
+			names = append(names, name)
+		}
+		return names
+	}
+
+	reply := func(text string) []testBotRequest {
+		message := createTelegramMessage(3, userID, "testuser", text)
+		message.Chat.Type = "private"
+		message.ReplyToMessage = prompt
+
+		bot, called := newTestBotAPI(t)
+		handleMessage(bot, message, db, 1)
+		return called()
+	}
+
+	// Tags are numbered in the prompt in the same order as in the text UI
+	tags, err := getUserTags(db, userID)
+	assert.NoError(t, err)
+	requests = reply("2")
+	assert.Equal(t, []string{tags[1].Name}, tagNames())
+	assert.Equal(t, 1, countRows(t, db, "messages"), "The reply isn't saved as a new message")
+
+	requests = reply(tags[0].Name)
+	assert.ElementsMatch(t, []string{"music", "work"}, tagNames())
+	if assert.NotEmpty(t, requests) {
+		assert.Contains(t, requests[len(requests)-1].Params.Get("text"), tags[0].Name)
+	}
+}
+
+// TestSendTagList tests that /tags lists every tag with its message count
+func TestSendTagList(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	createTestUser(t, db, userID, "testuser")
+	message := createTelegramMessage(1, userID, "testuser", "/tags")
+
+	bot, called := newTestBotAPI(t)
+	sendTagList(bot, message, db)
+	requests := called()
+	if assert.Len(t, requests, 1) {
+		assert.Contains(t, requests[0].Params.Get("text"), "You don't have any tags yet")
+	}
+
+	work := createTestTag(t, db, userID, "work", "")
+	music := createTestTag(t, db, userID, "music", "")
+	createTestTag(t, db, userID, "empty", "")
+	createTestTag(t, db, 456, "someone else's", "")
+	for i := int64(1); i <= 3; i++ {
+		messageID := createTestMessage(t, db, userID, 100+i)
+		createTestMessageTag(t, db, messageID, work)
+		if i == 1 {
+			createTestMessageTag(t, db, messageID, music)
+		}
+	}
+
+	bot, called = newTestBotAPI(t)
+	sendTagList(bot, message, db)
+	requests = called()
+	if assert.Len(t, requests, 1) {
+		assert.Equal(t, "🏷️ Your tags (3):\n\n1. empty — 0 messages\n2. music — 1 messages\n3. work — 3 messages\n", requests[0].Params.Get("text"))
+	}
+}
+
+// TestBuildTagListChunks tests that long tag lists are split across messages
+func TestBuildTagListChunks(t *testing.T) {
+	var tags []TagCount
+	for i := 1; i <= 120; i++ {
+		tags = append(tags, TagCount{Name: fmt.Sprintf("tag%03d", i), MessageCount: i})
+	}
+
+	chunks := buildTagListChunks(tags)
+	assert.Len(t, chunks, 3, "50 tags per message")
+	assert.True(t, strings.HasPrefix(chunks[0], "🏷️ Your tags (120):"))
+	assert.True(t, strings.HasPrefix(chunks[1], "More tags:"))
+
+	all := strings.Join(chunks, "")
+	for i, tag := range tags {
+		assert.Contains(t, all, fmt.Sprintf("%d. %s — %d messages\n", i+1, tag.Name, tag.MessageCount))
+	}
+
+	// Long names are split by length as well
+	var long []TagCount
+	for i := 0; i < 50; i++ {
+		long = append(long, TagCount{Name: strings.Repeat("x", 200), MessageCount: 1})
+	}
+	for _, chunk := range buildTagListChunks(long) {
+		assert.LessOrEqual(t, len(chunk), maxMessageLength)
+	}
+}
+
+// TestDeleteTag tests that deleting a tag checks ownership and removes its links
+func TestDeleteTag(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID, otherID := int64(123), int64(456)
+	createTestUser(t, db, userID, "testuser")
+	createTestUser(t, db, otherID, "otheruser")
+	work := createTestTag(t, db, userID, "work", "")
+	music := createTestTag(t, db, userID, "music", "")
+	for i := int64(1); i <= 3; i++ {
+		messageID := createTestMessage(t, db, userID, i)
+		createTestMessageTag(t, db, messageID, work)
+		createTestMessageTag(t, db, messageID, music)
+	}
+
+	// Someone else's tag is reported as missing and left alone
+	_, err := deleteTag(db, otherID, work)
+	assert.Equal(t, errTagNotFound, err)
+	assert.Equal(t, 2, countRows(t, db, "tags"))
+	assert.Equal(t, 6, countRows(t, db, "message_tags"))
+
+	removed, err := deleteTag(db, userID, work)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), removed)
+	tags, err := getUserTags(db, userID)
+	assert.NoError(t, err)
+	if assert.Len(t, tags, 1) {
+		assert.Equal(t, "music", tags[0].Name)
+	}
+	count, err := countTagMessages(db, work)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count, "No message_tags rows point at the deleted tag")
+	assert.Equal(t, 3, countRows(t, db, "message_tags"), "Other tags keep their messages")
+	assert.Equal(t, 3, countRows(t, db, "messages"), "Messages aren't deleted")
+
+	_, err = deleteTag(db, userID, work)
+	assert.Equal(t, errTagNotFound, err)
+}
+
+// TestDeleteTagCommand tests /deletetag followed by a reply with a name or number
+func TestDeleteTagCommand(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	createTestUser(t, db, userID, "testuser")
+	work := createTestTag(t, db, userID, "work", "")
+	createTestTag(t, db, userID, "music", "")
+	createTestTag(t, db, userID, "books", "")
+	messageID := createTestMessage(t, db, userID, 1)
+	createTestMessageTag(t, db, messageID, work)
+
+	command := createTelegramMessage(2, userID, "testuser", "/deletetag")
+	command.Chat.Type = "private"
+	command.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: 10}}
+	bot, called := newTestBotAPI(t)
+	handleMessage(bot, command, db, 1)
+	requests := called()
+	var prompt string
+	for _, r := range requests {
+		if r.Method == "sendMessage" {
+			prompt = r.Params.Get("text")
+			assert.Contains(t, r.Params.Get("reply_markup"), "force_reply")
+		}
+	}
+	assert.Contains(t, prompt, deleteTagPromptMarker)
+
+	reply := func(text string) string {
+		message := createTelegramMessage(3, userID, "testuser", text)
+		message.Chat.Type = "private"
+		message.ReplyToMessage = &tgbotapi.Message{MessageID: 4, From: &tgbotapi.User{ID: 999999, IsBot: true}, Text: prompt}
+
+		bot, called := newTestBotAPI(t)
+		handleMessage(bot, message, db, 1)
+		requests := called()
+		if !assert.NotEmpty(t, requests) {
+			return ""
+		}
+		return requests[len(requests)-1].Params.Get("text")
+	}
+
+	assert.Equal(t, "🗑️ Deleted tag 'work' and removed it from 1 messages.", reply("work"))
+	assert.Contains(t, reply("work"), "You don't have a tag 'work'")
+
+	// Numbers follow the /tags order: books, music
+	assert.Equal(t, "🗑️ Deleted tag 'music' and removed it from 0 messages.", reply("2"))
+	assert.Contains(t, reply("5"), "You don't have a tag '5'")
+
+	tags, err := getUserTags(db, userID)
+	assert.NoError(t, err)
+	assert.Len(t, tags, 1)
+	assert.Equal(t, 1, countRows(t, db, "messages"), "Replies to the prompt aren't saved")
+}
+
+// TestRenameTagCommand tests /renametag: a reply with the tag, then one with the new name
+func TestRenameTagCommand(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	createTestUser(t, db, userID, "testuser")
+	work := createTestTag(t, db, userID, "wrok", "")
+	createTestTag(t, db, userID, "music", "")
+	messageID := createTestMessage(t, db, userID, 1)
+	createTestMessageTag(t, db, messageID, work)
+
+	command := createTelegramMessage(2, userID, "testuser", "/renametag")
+	command.Chat.Type = "private"
+	command.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: 10}}
+	bot, called := newTestBotAPI(t)
+	handleMessage(bot, command, db, 1)
+	var prompt string
+	for _, r := range called() {
+		if r.Method == "sendMessage" {
+			prompt = r.Params.Get("text")
+			assert.Contains(t, r.Params.Get("reply_markup"), "force_reply")
+		}
+	}
+	assert.Contains(t, prompt, renameTagCommandMarker)
+
+	reply := func(text, to string) string {
+		message := createTelegramMessage(3, userID, "testuser", text)
+		message.Chat.Type = "private"
+		message.ReplyToMessage = &tgbotapi.Message{MessageID: 4, From: &tgbotapi.User{ID: 999999, IsBot: true}, Text: to}
+
+		bot, called := newTestBotAPI(t)
+		handleMessage(bot, message, db, 1)
+		requests := called()
+		if !assert.NotEmpty(t, requests) {
+			return ""
+		}
+		return requests[len(requests)-1].Params.Get("text")
+	}
+
+	assert.Contains(t, reply("books", prompt), "You don't have a tag 'books'")
+
+	namePrompt := reply("wrok", prompt)
+	assert.Equal(t, renameTagPrompt("wrok", work), namePrompt)
+
+	t.Run("Duplicate name", func(t *testing.T) {
+		assert.Equal(t, "You already have a tag with that name.", reply("music", namePrompt))
+		name, err := getUserTagName(db, userID, work)
+		assert.NoError(t, err)
+		assert.Equal(t, "wrok", name)
+	})
+
+	assert.Equal(t, "✏️ Tag renamed to 'work'", reply("work", namePrompt))
+	name, err := getUserTagName(db, userID, work)
+	assert.NoError(t, err)
+	assert.Equal(t, "work", name)
+
+	count, err := countTagMessages(db, work)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count, "The renamed tag keeps its messages")
+	assert.Equal(t, 1, countRows(t, db, "messages"), "Replies to the prompts aren't saved")
+}
+
+// TestUntagMessage tests listing a message's tags and removing one without
+// affecting the others
+func TestUntagMessage(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	createTestUser(t, db, userID, "testuser")
+	work := createTestTag(t, db, userID, "work", "")
+	music := createTestTag(t, db, userID, "music", "")
+	messageID := createTestMessage(t, db, userID, 1)
+	otherMessageID := createTestMessage(t, db, userID, 2)
+	createTestMessageTag(t, db, messageID, work)
+	createTestMessageTag(t, db, messageID, music)
+	createTestMessageTag(t, db, otherMessageID, work)
+
+	tags, err := getMessageTags(db, messageID)
+	assert.NoError(t, err)
+	if assert.Len(t, tags, 2) {
+		assert.Equal(t, "music", tags[0].Name)
+		assert.Equal(t, music, tags[0].ID)
+		assert.Equal(t, "work", tags[1].Name)
+	}
+
+	removed, err := untagMessage(db, messageID, work)
+	assert.NoError(t, err)
+	assert.True(t, removed)
+
+	tags, err = getMessageTags(db, messageID)
+	assert.NoError(t, err)
+	if assert.Len(t, tags, 1) {
+		assert.Equal(t, "music", tags[0].Name)
+	}
+	count, err := countTagMessages(db, work)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count, "The other message keeps the tag")
+
+	removed, err = untagMessage(db, messageID, work)
+	assert.NoError(t, err)
+	assert.False(t, removed, "Removing it again is a no-op")
+}
+
+// TestUntagCommand tests /untag as a reply to a saved message and tapping its buttons
+func TestUntagCommand(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	userID := int64(123)
+	createTestUser(t, db, userID, "testuser")
+	work := createTestTag(t, db, userID, "work", "")
+	music := createTestTag(t, db, userID, "music", "")
+	messageID := createTestMessage(t, db, userID, 10)
+	createTestMessageTag(t, db, messageID, work)
+	createTestMessageTag(t, db, messageID, music)
+
+	untag := func(replyTo *tgbotapi.Message) []testBotRequest {
+		command := createTelegramMessage(20, userID, "testuser", "/untag")
+		command.Chat.Type = "private"
+		command.ReplyToMessage = replyTo
+		bot, called := newTestBotAPI(t)
+		handleMessage(bot, command, db, 1)
+		return called()
+	}
+
+	requests := untag(nil)
+	if assert.Len(t, requests, 1) {
+		assert.Contains(t, requests[0].Params.Get("text"), "Reply /untag to one of your saved messages")
+	}
+
+	requests = untag(&tgbotapi.Message{MessageID: 99})
+	if assert.Len(t, requests, 1) {
+		assert.Contains(t, requests[0].Params.Get("text"), "Could not find that message")
+	}
+
+	requests = untag(&tgbotapi.Message{MessageID: 10})
+	if assert.Len(t, requests, 1) {
+		assert.Equal(t, untagPromptText, requests[0].Params.Get("text"))
+		markup := requests[0].Params.Get("reply_markup")
+		assert.Contains(t, markup, fmt.Sprintf(`"callback_data":"untag:%d:10"`, music))
+		assert.Contains(t, markup, fmt.Sprintf(`"callback_data":"untag:%d:10"`, work))
+	}
+
+	// Tapping a tag removes it and leaves the other button
+	bot, called := newTestBotAPI(t)
+	handleCallbackQuery(bot, createCallbackQuery("callback1", userID, "testuser", fmt.Sprintf("untag:%d:10", work)), db)
+	requests = called()
+	assert.Equal(t, 1, countMethod(requests, "editMessageText"))
+	for _, r := range requests {
+		if r.Method == "editMessageText" {
+			assert.Contains(t, r.Params.Get("reply_markup"), fmt.Sprintf("untag:%d:10", music))
+			assert.NotContains(t, r.Params.Get("reply_markup"), fmt.Sprintf("untag:%d:10", work))
+		}
+	}
+	names, err := getMessageTagNames(db, messageID)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"music"}, names)
+
+	// Removing the last tag says so
+	bot, called = newTestBotAPI(t)
+	handleCallbackQuery(bot, createCallbackQuery("callback2", userID, "testuser", fmt.Sprintf("untag:%d:10", music)), db)
+	requests = called()
+	for _, r := range requests {
+		if r.Method == "editMessageText" {
+			assert.Equal(t, "🏷 The message has no tags left.", r.Params.Get("text"))
+		}
+	}
+	assert.Equal(t, 0, countRows(t, db, "message_tags"))
+
+	requests = untag(&tgbotapi.Message{MessageID: 10})
+	if assert.Len(t, requests, 1) {
+		assert.Equal(t, "That message has no tags.", requests[0].Params.Get("text"))
+	}
+	assert.Equal(t, 2, countRows(t, db, "tags"), "Untagging keeps the tags")
+}
+
+// TestLevenshtein tests the edit distance used to match typed tag names
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"", "", 0},
+		{"work", "work", 0},
+		{"work", "", 4},
+		{"work", "worrk", 1},
+		{"work", "wokr", 2},
+		{"kitten", "sitting", 3},
+		{"café", "cafe", 1},
+		{"🏷️tag", "tag", 2},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, levenshtein(tt.a, tt.b), "%q -> %q", tt.a, tt.b)
+		assert.Equal(t, tt.expected, levenshtein(tt.b, tt.a), "%q -> %q", tt.b, tt.a)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	telegramparser "github.com/kd3n1z/go-telegram-parser"
 )
@@ -26,12 +27,37 @@ func validateTelegramWebApp(initData string, p ParserInterface) (int64, error) {
 		return 0, fmt.Errorf("invalid initData: %v", err)
 	}
 
+	// initData signed before the user's last /revoke is no longer accepted
+	minAuthDate, err := minAuthDateLookup(validatedData.User.Id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check revoked sessions: %v", err)
+	}
+	if isAuthDateRevoked(validatedData.AuthDate, minAuthDate) {
+		log.Printf("[WARN] Telegram WebApp session revoked for user %d", validatedData.User.Id)
+		return 0, fmt.Errorf("initData issued at %d was revoked", validatedData.AuthDate)
+	}
+
 	log.Printf("[INFO] Telegram WebApp validation successful")
 	log.Printf("[INFO] User ID: %d, FirstName: %s", validatedData.User.Id, validatedData.User.FirstName)
 
 	return validatedData.User.Id, nil
 }
 
+// minAuthDateLookup returns the oldest auth_date still accepted for a user. The
+// database is opened before routing, so it's only nil in tests that don't use one.
+var minAuthDateLookup = func(userID int64) (time.Time, error) {
+	if db == nil {
+		return time.Time{}, nil
+	}
+	return getMinAuthDate(db, userID)
+}
+
+// isAuthDateRevoked reports whether initData signed at authDate (unix seconds)
+// predates minAuthDate. A zero minAuthDate means nothing was revoked.
+func isAuthDateRevoked(authDate int64, minAuthDate time.Time) bool {
+	return !minAuthDate.IsZero() && time.Unix(authDate, 0).Before(minAuthDate)
+}
+
 func extractUserIDFromAuth(authHeader string, envProvider EnvProvider, parserFactory ParserFactory) (int64, error) {
 	if authHeader == "" {
 		return 0, fmt.Errorf("authorization header is required")
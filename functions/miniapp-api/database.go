@@ -2,12 +2,23 @@ package main
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/url"
 	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
-	_ "github.com/lib/pq"
+
+	"telegram-content-organizer-shared/storage"
+	"telegram-content-organizer-shared/textcrypt"
 )
 
 type User struct {
@@ -31,52 +42,319 @@ type Tag struct {
 }
 
 type MessageResponse struct {
-	ID                int64     `json:"id" db:"id"`
-	TelegramMessageID int64     `json:"telegram_message_id" db:"telegram_message_id"`
-	MessageType       string    `json:"message_type" db:"message_type"`
-	TextContent       *string   `json:"text_content" db:"text_content"`
-	Caption           *string   `json:"caption" db:"caption"`
-	FileName          *string   `json:"file_name" db:"file_name"`
-	FileSize          *int64    `json:"file_size" db:"file_size"`
-	CreatedAt         time.Time `json:"created_at" db:"created_at"`
-	ForwardedFrom     *string   `json:"forwarded_from" db:"forwarded_from"`
-	URLs              []string  `json:"urls"`
-	Hashtags          []string  `json:"hashtags"`
+	ID                int64      `json:"id" db:"id"`
+	TelegramMessageID int64      `json:"telegram_message_id" db:"telegram_message_id"`
+	MessageType       string     `json:"message_type" db:"message_type"`
+	TextContent       *string    `json:"text_content" db:"text_content"`
+	Caption           *string    `json:"caption" db:"caption"`
+	FileName          *string    `json:"file_name" db:"file_name"`
+	FileSize          *int64     `json:"file_size" db:"file_size"`
+	CreatedAt         time.Time  `json:"created_at" db:"created_at"`
+	ForwardedFrom     *string    `json:"forwarded_from" db:"forwarded_from"`
+	URLs              []string   `json:"urls"`
+	Hashtags          []string   `json:"hashtags"`
+	HasSpoiler        bool       `json:"has_spoiler" db:"has_spoiler"`
+	ReplyToMessageID  *int64     `json:"reply_to_message_id" db:"reply_to_message_id"`
+	QuoteText         *string    `json:"quote_text" db:"quote_text"`
+	StoryChatID       *int64     `json:"story_chat_id" db:"story_chat_id"`
+	StoryID           *int64     `json:"story_id" db:"story_id"`
+	UserNote          *string    `json:"user_note" db:"user_note"`
+	Preview           string     `json:"preview"`
+	Width             *int       `json:"width,omitempty" db:"width"`
+	Height            *int       `json:"height,omitempty" db:"height"`
+	HasThumbnail      bool       `json:"has_thumbnail"`
+	SeenAt            *time.Time `json:"seen_at"`
+	Latitude          *float64   `json:"latitude,omitempty" db:"latitude"`
+	Longitude         *float64   `json:"longitude,omitempty" db:"longitude"`
+	VenueTitle        *string    `json:"venue_title,omitempty" db:"venue_title"`
+	VenueAddress      *string    `json:"venue_address,omitempty" db:"venue_address"`
+}
+
+type TimelinePoint struct {
+	BucketStart  time.Time `json:"bucket_start"`
+	MessageCount int       `json:"message_count"`
+}
+
+// TypeCount is how many of a tag's messages have one message type
+type TypeCount struct {
+	MessageType  string `json:"message_type"`
+	MessageCount int    `json:"message_count"`
+}
+
+// MessageFilters narrow the messages endpoints; zero values disable a filter
+type MessageFilters struct {
+	HasURL  bool
+	HasFile bool
+	// Seen keeps only seen (true) or unseen (false) messages; nil keeps both
+	Seen *bool
+	// UnseenFirst lists unseen messages before seen ones
+	UnseenFirst bool
+}
+
+// sqlConditions renders the enabled filters as extra WHERE conditions on m
+func (f MessageFilters) sqlConditions() string {
+	var conditions strings.Builder
+	if f.HasURL {
+		conditions.WriteString(" AND array_length(m.urls, 1) > 0")
+	}
+	if f.HasFile {
+		conditions.WriteString(" AND m.file_id IS NOT NULL")
+	}
+	if f.Seen != nil {
+		if *f.Seen {
+			conditions.WriteString(" AND m.seen_at IS NOT NULL")
+		} else {
+			conditions.WriteString(" AND m.seen_at IS NULL")
+		}
+	}
+	return conditions.String()
+}
+
+// orderBy renders the ORDER BY clause on m: newest first, unseen first if asked.
+// Messages saved in the same second (albums, bulk forwards) fall back to id so
+// the order is total and stable across pages.
+func (f MessageFilters) orderBy() string {
+	if f.UnseenFirst {
+		return "m.seen_at IS NOT NULL, m.created_at DESC, m.id DESC"
+	}
+	return "m.created_at DESC, m.id DESC"
+}
+
+// SearchFields selects which message columns a text search matches
+type SearchFields string
+
+const (
+	SearchFieldsAll     SearchFields = "all"
+	SearchFieldsText    SearchFields = "text"
+	SearchFieldsCaption SearchFields = "caption"
+)
+
+// parseSearchFields reads a fields=text|caption|all value. Empty means all.
+func parseSearchFields(value string) (SearchFields, bool) {
+	switch fields := SearchFields(strings.ToLower(value)); fields {
+	case "":
+		return SearchFieldsAll, true
+	case SearchFieldsAll, SearchFieldsText, SearchFieldsCaption:
+		return fields, true
+	}
+	return "", false
+}
+
+// ilikeCondition renders a WHERE condition on m matching the pattern parameter
+// against the selected columns. text_content and caption are 150-character
+// previews, so the whole text in full_text is matched, falling back to the
+// preview for messages saved before full_text.
+func (f SearchFields) ilikeCondition(param string) string {
+	text := fmt.Sprintf("(m.text_content IS NOT NULL AND COALESCE(m.full_text, m.text_content) ILIKE %s)", param)
+	caption := fmt.Sprintf("(m.caption IS NOT NULL AND COALESCE(m.full_text, m.caption) ILIKE %s)", param)
+	switch f {
+	case SearchFieldsText:
+		return text
+	case SearchFieldsCaption:
+		return caption
+	}
+	return fmt.Sprintf("(%s OR %s)", text, caption)
+}
+
+// matches is ilikeCondition for decoded values, for text encrypted at rest that
+// SQL can't match. query is lowercase.
+func (f SearchFields) matches(query string, textContent, caption, fullText sql.NullString) bool {
+	contains := func(preview sql.NullString) bool {
+		if !preview.Valid {
+			return false
+		}
+		text := preview.String
+		if fullText.Valid {
+			text = fullText.String
+		}
+		return strings.Contains(strings.ToLower(text), query)
+	}
+	switch f {
+	case SearchFieldsText:
+		return contains(textContent)
+	case SearchFieldsCaption:
+		return contains(caption)
+	}
+	return contains(textContent) || contains(caption)
+}
+
+// knownMessageTypes are the message_type values the bot stores. Keep in sync
+// with MessageType in the bot.
+var knownMessageTypes = map[string]bool{
+	"text": true, "photo": true, "video": true, "document": true, "audio": true,
+	"voice": true, "video_note": true, "sticker": true, "story": true, "animation": true,
+	"location": true, "unknown": true,
+}
+
+// likePattern matches value anywhere in a column with LIKE/ILIKE, escaping the
+// wildcards it contains
+func likePattern(value string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+	return "%" + escaped + "%"
+}
+
+// timelineBuckets are the date_trunc units accepted by getTagTimeline
+var timelineBuckets = map[string]bool{"day": true, "week": true, "month": true}
+
+// maxTimelineBuckets caps the points in one timeline, a little under three
+// years of days. Longer ranges need a coarser bucket.
+const maxTimelineBuckets = 1000
+
+// errTimelineTooLong is returned by getTagTimeline when the range, given or
+// spanned by the data, needs more than maxTimelineBuckets points
+var errTimelineTooLong = fmt.Errorf("timeline needs more than %d buckets", maxTimelineBuckets)
+
+type DomainCount struct {
+	Host         string `json:"host"`
+	MessageCount int    `json:"message_count"`
+}
+
+// Retry defaults for queries hitting a database that isn't reachable yet, e.g.
+// the first query after a cold start: 3 attempts, 100ms then 200ms apart
+const (
+	defaultDBRetryAttempts  = 3
+	defaultDBRetryBaseDelay = 100 * time.Millisecond
+)
+
+// DBRetryConfig bounds how withDBRetry retries a query
+type DBRetryConfig struct {
+	Attempts  int
+	BaseDelay time.Duration
+}
+
+// dbRetryConfig reads DB_RETRY_ATTEMPTS and DB_RETRY_BASE_DELAY (a duration
+// like "250ms"), keeping the default for unset or invalid values
+func dbRetryConfig() DBRetryConfig {
+	config := DBRetryConfig{
+		Attempts:  defaultDBRetryAttempts,
+		BaseDelay: defaultDBRetryBaseDelay,
+	}
+	if n, err := strconv.Atoi(os.Getenv("DB_RETRY_ATTEMPTS")); err == nil && n > 0 {
+		config.Attempts = n
+	}
+	// Zero retries immediately
+	if d, err := time.ParseDuration(os.Getenv("DB_RETRY_BASE_DELAY")); err == nil && d >= 0 {
+		config.BaseDelay = d
+	}
+	return config
+}
+
+// withDBRetry runs fn until it succeeds or fails with an error that isn't a
+// connection error, doubling the delay after each attempt
+func withDBRetry(fn func() error) error {
+	config := dbRetryConfig()
+	delay := config.BaseDelay
+	var err error
+	for attempt := 1; attempt <= config.Attempts; attempt++ {
+		if err = fn(); err == nil || !isConnectionError(err) {
+			return err
+		}
+		if attempt < config.Attempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return err
+}
+
+// isConnectionError reports whether err means the database couldn't be reached
+// or dropped the connection, as opposed to the query itself failing
+func isConnectionError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	// Class 08 is connection exceptions; 57P03 is returned while the server starts
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code.Class() == "08" || pqErr.Code == "57P03"
+	}
+	return false
 }
 
 func initDB() (*sql.DB, error) {
 	dbURL := os.Getenv("DATABASE_URL")
 	if dbURL == "" {
-		return nil, fmt.Errorf("DATABASE_URL  environment variable not set")
+		return nil, fmt.Errorf("DATABASE_URL environment variable not set")
 	}
 
 	db, err := sql.Open("postgres", dbURL)
 	if err != nil {
 		return nil, err
 	}
+	storage.ConfigurePool(db, storage.LoadPoolConfig())
 
 	if err = db.Ping(); err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	return db, nil
 }
 
-func getUserTagsWithCounts(db *sql.DB, userID int64) ([]Tag, error) {
+// TagSort selects the order of getUserTagsWithCounts
+type TagSort string
+
+const (
+	TagSortCount  TagSort = "count"
+	TagSortName   TagSort = "name"
+	TagSortRecent TagSort = "recent"
+)
+
+// parseTagSort reads a sort=count|name|recent value. Empty means count.
+func parseTagSort(value string) (TagSort, bool) {
+	switch order := TagSort(strings.ToLower(value)); order {
+	case "":
+		return TagSortCount, true
+	case TagSortCount, TagSortName, TagSortRecent:
+		return order, true
+	}
+	return "", false
+}
+
+// orderBy renders the ORDER BY clause of the tag list: most messages first,
+// alphabetically ignoring case, or most recently applied first (unused tags
+// last, newest first)
+func (s TagSort) orderBy() string {
+	switch s {
+	case TagSortName:
+		return "lower(t.name) ASC, t.id ASC"
+	case TagSortRecent:
+		return "MAX(mt.created_at) DESC NULLS LAST, t.created_at DESC, t.id DESC"
+	}
+	return "message_count DESC, t.name ASC"
+}
+
+// getUserTagsWithCounts returns the user's tags in the given order. Connection
+// errors are retried with withDBRetry.
+func getUserTagsWithCounts(db *sql.DB, userID int64, order TagSort) ([]Tag, error) {
 	query := `
 		SELECT t.id, t.user_id, t.name, t.color, t.created_at, COUNT(mt.message_id) as message_count
 		FROM tags t
 		LEFT JOIN message_tags mt ON t.id = mt.tag_id
 		WHERE t.user_id = $1
 		GROUP BY t.id, t.user_id, t.name, t.color, t.created_at
-		ORDER BY message_count DESC, t.name ASC`
+		ORDER BY ` + order.orderBy()
 
-	rows, err := db.Query(query, userID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+	var tags []Tag
+	err := withDBRetry(func() error {
+		rows, err := db.Query(query, userID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		tags, err = scanTagRows(rows)
+		return err
+	})
+	return tags, err
+}
 
+// scanTagRows reads rows of id, user_id, name, color, created_at, message_count
+func scanTagRows(rows *sql.Rows) ([]Tag, error) {
 	var tags []Tag
 	for rows.Next() {
 		var tag Tag
@@ -96,48 +374,333 @@ func getUserTagsWithCounts(db *sql.DB, userID int64) ([]Tag, error) {
 	return tags, rows.Err()
 }
 
-func getTagMessages(db *sql.DB, userID int64, tagID int64) ([]MessageResponse, error) {
-	// First verify that the tag belongs to the user
-	var tagExists bool
-	tagQuery := "SELECT EXISTS(SELECT 1 FROM tags WHERE id = $1 AND user_id = $2)"
-	err := db.QueryRow(tagQuery, tagID, userID).Scan(&tagExists)
+// getAvailableTags returns the user's tags that aren't on the message yet, in
+// the same order as getUserTagsWithCounts
+func getAvailableTags(db *sql.DB, userID int64, messageID int64) ([]Tag, error) {
+	// First verify that the message belongs to the user
+	if err := assertOwnership(db, userID, ResourceMessage, messageID); err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT t.id, t.user_id, t.name, t.color, t.created_at, COUNT(mt.message_id) as message_count
+		FROM tags t
+		LEFT JOIN message_tags mt ON t.id = mt.tag_id
+		WHERE t.user_id = $1
+			AND NOT EXISTS (SELECT 1 FROM message_tags applied WHERE applied.tag_id = t.id AND applied.message_id = $2)
+		GROUP BY t.id, t.user_id, t.name, t.color, t.created_at
+		ORDER BY message_count DESC, t.name ASC`
+
+	rows, err := db.Query(query, userID, messageID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to verify tag ownership: %v", err)
+		return nil, fmt.Errorf("failed to query available tags: %v", err)
 	}
-	if !tagExists {
-		return nil, fmt.Errorf("tag not found or access denied")
+	defer rows.Close()
+
+	return scanTagRows(rows)
+}
+
+// getMessageTags returns the tags on one of the user's messages, by name
+func getMessageTags(db *sql.DB, userID int64, messageID int64) ([]Tag, error) {
+	query := `
+		SELECT t.id, t.user_id, t.name, t.color, t.created_at, COUNT(all_mt.message_id) as message_count
+		FROM message_tags mt
+		INNER JOIN tags t ON t.id = mt.tag_id
+		LEFT JOIN message_tags all_mt ON all_mt.tag_id = t.id
+		WHERE mt.message_id = $1 AND t.user_id = $2
+		GROUP BY t.id, t.user_id, t.name, t.color, t.created_at
+		ORDER BY t.name ASC`
+
+	rows, err := db.Query(query, messageID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query message tags: %v", err)
+	}
+	defer rows.Close()
+
+	return scanTagRows(rows)
+}
+
+// copyMessageTags adds every tag of the source message to the target message,
+// keeping tags the target already has, and returns the target's tags
+func copyMessageTags(db *sql.DB, userID int64, targetID int64, sourceID int64) ([]Tag, error) {
+	// Both messages must belong to the user
+	for _, messageID := range []int64{targetID, sourceID} {
+		if err := assertOwnership(db, userID, ResourceMessage, messageID); err != nil {
+			return nil, err
+		}
 	}
 
-	// Query messages for the specified tag
 	query := `
-		SELECT 
-			m.id, 
-			m.telegram_message_id, 
-			m.message_type, 
-			m.text_content, 
-			m.caption, 
-			m.file_name, 
-			m.file_size, 
-			m.created_at, 
-			m.forwarded_from, 
-			m.urls, 
-			m.hashtags
+		INSERT INTO message_tags (message_id, tag_id)
+		SELECT $1, tag_id FROM message_tags WHERE message_id = $2
+		ON CONFLICT (message_id, tag_id) DO NOTHING`
+	if _, err := db.Exec(query, targetID, sourceID); err != nil {
+		return nil, fmt.Errorf("failed to copy tags: %v", err)
+	}
+
+	return getMessageTags(db, userID, targetID)
+}
+
+// Ownership policy: a resource that doesn't exist and one that belongs to another
+// user are reported the same way, as *NotFoundError, which handlers map to 404.
+// Responses never reveal whether another user's tag or message ID exists.
+
+// ResourceType names a kind of user-owned row
+type ResourceType string
+
+const (
+	ResourceTag     ResourceType = "tag"
+	ResourceMessage ResourceType = "message"
+	ResourceUser    ResourceType = "user"
+)
+
+// ownedTables maps each resource to its table; all are keyed by id and user_id.
+// Users own themselves and aren't checked through assertOwnership.
+var ownedTables = map[ResourceType]string{
+	ResourceTag:     "tags",
+	ResourceMessage: "messages",
+}
+
+// NotFoundError reports a resource that doesn't exist or isn't the user's
+type NotFoundError struct {
+	Resource ResourceType
+	ID       int64
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %d not found or access denied", e.Resource, e.ID)
+}
+
+// assertOwnership returns *NotFoundError unless the resource exists and belongs to userID
+func assertOwnership(db *sql.DB, userID int64, resource ResourceType, id int64) error {
+	table, ok := ownedTables[resource]
+	if !ok {
+		return fmt.Errorf("unknown resource type: %s", resource)
+	}
+
+	var exists bool
+	query := "SELECT EXISTS(SELECT 1 FROM " + table + " WHERE id = $1 AND user_id = $2)"
+	if err := db.QueryRow(query, id, userID).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to verify %s ownership: %w", resource, err)
+	}
+	if !exists {
+		return &NotFoundError{Resource: resource, ID: id}
+	}
+	return nil
+}
+
+// Page selects a window of a message list
+type Page struct {
+	Limit  int
+	Offset int
+}
+
+// Pagination is returned with a page of messages; Total counts every match
+type Pagination struct {
+	Total  int `json:"total"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+}
+
+// getTagMessages returns one page of the tag's messages and how many there are
+// in total. A non-empty messageType keeps only messages of that type. Connection
+// errors are retried with withDBRetry.
+func getTagMessages(db *sql.DB, userID int64, tagID int64, filters MessageFilters, messageType string, page Page) ([]MessageResponse, int, error) {
+	var messages []MessageResponse
+	var total int
+	err := withDBRetry(func() error {
+		var err error
+		messages, total, err = queryTagMessages(db, userID, tagID, filters, messageType, page)
+		return err
+	})
+	return messages, total, err
+}
+
+// queryTagMessages does the work of getTagMessages, once
+func queryTagMessages(db *sql.DB, userID int64, tagID int64, filters MessageFilters, messageType string, page Page) ([]MessageResponse, int, error) {
+	// First verify that the tag belongs to the user
+	if err := assertOwnership(db, userID, ResourceTag, tagID); err != nil {
+		return nil, 0, err
+	}
+
+	args := []interface{}{tagID, userID}
+	from := `
 		FROM messages m
 		INNER JOIN message_tags mt ON m.id = mt.message_id
-		WHERE mt.tag_id = $1 AND m.user_id = $2
-		ORDER BY m.created_at DESC`
+		WHERE mt.tag_id = $1 AND m.user_id = $2` + filters.sqlConditions()
+	if messageType != "" {
+		args = append(args, messageType)
+		from += fmt.Sprintf(" AND m.message_type = $%d", len(args))
+	}
 
-	rows, err := db.Query(query, tagID, userID)
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*)`+from, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count messages: %w", err)
+	}
+
+	// Query messages for the specified tag
+	args = append(args, page.Limit, page.Offset)
+	query := `
+		SELECT ` + messageResponseColumns + from + `
+		ORDER BY ` + filters.orderBy() + `
+		` + fmt.Sprintf("LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query messages: %v", err)
+		return nil, 0, fmt.Errorf("failed to query messages: %w", err)
 	}
 	defer rows.Close()
 
+	messages, err := scanMessageRows(rows)
+	return messages, total, err
+}
+
+// deleteTag deletes one of the user's tags together with its message_tags rows.
+// The messages themselves are kept.
+func deleteTag(db *sql.DB, userID int64, tagID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the tag so it can't be applied to a message while it's being deleted
+	var id int64
+	err = tx.QueryRow(`SELECT id FROM tags WHERE id = $1 AND user_id = $2 FOR UPDATE`, tagID, userID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return &NotFoundError{Resource: ResourceTag, ID: tagID}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to verify tag ownership: %v", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM message_tags WHERE tag_id = $1`, tagID); err != nil {
+		return fmt.Errorf("failed to untag messages: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM tags WHERE id = $1`, tagID); err != nil {
+		return fmt.Errorf("failed to delete tag: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+// mergeTags moves every message of the source tag to the destination tag and
+// deletes the source tag, in one transaction, and returns the destination tag.
+// The move itself is storage.MergeTags, which the shared tests cover without
+// Postgres.
+func mergeTags(db *sql.DB, userID int64, sourceID int64, destID int64) (*Tag, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock both tags so neither is applied or deleted while they're merged
+	for _, tagID := range []int64{sourceID, destID} {
+		var id int64
+		err := tx.QueryRow(`SELECT id FROM tags WHERE id = $1 AND user_id = $2 FOR UPDATE`, tagID, userID).Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil, &NotFoundError{Resource: ResourceTag, ID: tagID}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify tag ownership: %v", err)
+		}
+	}
+
+	if err := storage.MergeTags(tx, userID, sourceID, destID); err != nil {
+		return nil, fmt.Errorf("failed to merge tags: %v", err)
+	}
+
+	var tag Tag
+	var color sql.NullString
+	query := `SELECT id, user_id, name, color, created_at,
+			(SELECT COUNT(*) FROM message_tags mt WHERE mt.tag_id = tags.id)
+		FROM tags WHERE id = $1`
+	if err := tx.QueryRow(query, destID).Scan(&tag.ID, &tag.UserID, &tag.Name, &color, &tag.CreatedAt, &tag.MessageCount); err != nil {
+		return nil, fmt.Errorf("failed to load merged tag: %v", err)
+	}
+	tag.Color = storage.NullStringPtr(color)
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &tag, nil
+}
+
+// getUserProfile returns the user's stored profile
+func getUserProfile(db *sql.DB, userID int64) (*User, error) {
+	var user User
+	var username, firstName, lastName sql.NullString
+	query := `
+		SELECT id, telegram_id, username, first_name, last_name, created_at, updated_at, is_active
+		FROM users WHERE telegram_id = $1`
+	err := db.QueryRow(query, userID).Scan(&user.ID, &user.TelegramID, &username, &firstName, &lastName,
+		&user.CreatedAt, &user.UpdatedAt, &user.IsActive)
+	if err == sql.ErrNoRows {
+		return nil, &NotFoundError{Resource: ResourceUser, ID: userID}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load user: %v", err)
+	}
+
+	user.Username = storage.NullStringPtr(username)
+	user.FirstName = storage.NullStringPtr(firstName)
+	user.LastName = storage.NullStringPtr(lastName)
+	return &user, nil
+}
+
+// getMinAuthDate returns when the user last revoked their mini-app sessions with
+// the bot's /revoke command, or the zero time if they never did
+func getMinAuthDate(db *sql.DB, userID int64) (time.Time, error) {
+	var minAuthDate sql.NullTime
+	err := db.QueryRow(`SELECT min_auth_date FROM users WHERE telegram_id = $1`, userID).Scan(&minAuthDate)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to load min_auth_date: %v", err)
+	}
+	return minAuthDate.Time, nil
+}
+
+// messageResponseColumns selects the columns of messages m read by scanMessageRows
+const messageResponseColumns = `
+			m.id,
+			m.telegram_message_id,
+			m.message_type,
+			m.text_content,
+			m.caption,
+			m.file_name,
+			m.file_size,
+			m.created_at,
+			m.forwarded_from,
+			m.urls,
+			m.hashtags,
+			m.has_spoiler,
+			m.reply_to_message_id,
+			m.quote_text,
+			m.story_chat_id,
+			m.story_id,
+			m.user_note,
+			m.width,
+			m.height,
+			m.thumb_file_id IS NOT NULL,
+			m.seen_at,
+			m.latitude,
+			m.longitude,
+			m.venue_title,
+			m.venue_address`
+
+// scanMessageRows reads rows selected with messageResponseColumns
+func scanMessageRows(rows *sql.Rows) ([]MessageResponse, error) {
 	var messages []MessageResponse
 	for rows.Next() {
 		var msg MessageResponse
-		var textContent, caption, fileName, forwardedFrom sql.NullString
-		var fileSize sql.NullInt64
+		var textContent, caption, fileName, forwardedFrom, quoteText, userNote, venueTitle, venueAddress sql.NullString
+		var fileSize, replyToMessageID, storyChatID, storyID sql.NullInt64
+		var width, height sql.NullInt32
+		var latitude, longitude sql.NullFloat64
+		var seenAt sql.NullTime
 		var urls, hashtags pq.StringArray
 
 		err := rows.Scan(
@@ -152,11 +715,44 @@ func getTagMessages(db *sql.DB, userID int64, tagID int64) ([]MessageResponse, e
 			&forwardedFrom,
 			&urls,
 			&hashtags,
+			&msg.HasSpoiler,
+			&replyToMessageID,
+			&quoteText,
+			&storyChatID,
+			&storyID,
+			&userNote,
+			&width,
+			&height,
+			&msg.HasThumbnail,
+			&seenAt,
+			&latitude,
+			&longitude,
+			&venueTitle,
+			&venueAddress,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan message row: %v", err)
 		}
 
+		if textContent, err = textcrypt.Decode(textContent); err != nil {
+			return nil, fmt.Errorf("failed to decode text of message %d: %v", msg.ID, err)
+		}
+		if caption, err = textcrypt.Decode(caption); err != nil {
+			return nil, fmt.Errorf("failed to decode caption of message %d: %v", msg.ID, err)
+		}
+		if userNote, err = textcrypt.Decode(userNote); err != nil {
+			return nil, fmt.Errorf("failed to decode note of message %d: %v", msg.ID, err)
+		}
+		if quoteText, err = textcrypt.Decode(quoteText); err != nil {
+			return nil, fmt.Errorf("failed to decode quote of message %d: %v", msg.ID, err)
+		}
+		if msg.URLs, err = textcrypt.DecodeList(urls); err != nil {
+			return nil, fmt.Errorf("failed to decode urls of message %d: %v", msg.ID, err)
+		}
+		if msg.Hashtags, err = textcrypt.DecodeList(hashtags); err != nil {
+			return nil, fmt.Errorf("failed to decode hashtags of message %d: %v", msg.ID, err)
+		}
+
 		// Handle nullable fields
 		if textContent.Valid {
 			msg.TextContent = &textContent.String
@@ -173,10 +769,37 @@ func getTagMessages(db *sql.DB, userID int64, tagID int64) ([]MessageResponse, e
 		if forwardedFrom.Valid {
 			msg.ForwardedFrom = &forwardedFrom.String
 		}
-
-		// Handle arrays (they might be nil, that's fine)
-		msg.URLs = []string(urls)
-		msg.Hashtags = []string(hashtags)
+		if replyToMessageID.Valid {
+			msg.ReplyToMessageID = &replyToMessageID.Int64
+		}
+		if quoteText.Valid {
+			msg.QuoteText = &quoteText.String
+		}
+		if storyChatID.Valid {
+			msg.StoryChatID = &storyChatID.Int64
+		}
+		if storyID.Valid {
+			msg.StoryID = &storyID.Int64
+		}
+		if width.Valid && height.Valid {
+			w, h := int(width.Int32), int(height.Int32)
+			msg.Width, msg.Height = &w, &h
+		}
+		if userNote.Valid {
+			msg.UserNote = &userNote.String
+		}
+		if seenAt.Valid {
+			msg.SeenAt = &seenAt.Time
+		}
+		if latitude.Valid && longitude.Valid {
+			msg.Latitude, msg.Longitude = &latitude.Float64, &longitude.Float64
+		}
+		if venueTitle.Valid {
+			msg.VenueTitle = &venueTitle.String
+		}
+		if venueAddress.Valid {
+			msg.VenueAddress = &venueAddress.String
+		}
 
 		// Ensure arrays are not nil for JSON serialization
 		if msg.URLs == nil {
@@ -186,8 +809,736 @@ func getTagMessages(db *sql.DB, userID int64, tagID int64) ([]MessageResponse, e
 			msg.Hashtags = []string{}
 		}
 
+		msg.Preview = derivePreview(msg)
+
 		messages = append(messages, msg)
 	}
 
 	return messages, rows.Err()
 }
+
+// MessageDetail is one message with its whole text; list views only get the
+// 150-character text_content and caption previews
+type MessageDetail struct {
+	MessageResponse
+	FullText      *string `json:"full_text"`
+	TextTruncated bool    `json:"text_truncated"`
+}
+
+// getMessage returns one of the user's messages with its full text. Messages
+// saved before full_text was added have none, so FullText is nil for them.
+func getMessage(db *sql.DB, userID int64, messageID int64) (*MessageDetail, error) {
+	query := `SELECT ` + messageResponseColumns + `
+		FROM messages m
+		WHERE m.id = $1 AND m.user_id = $2`
+	rows, err := db.Query(query, messageID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query message: %v", err)
+	}
+	defer rows.Close()
+
+	messages, err := scanMessageRows(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, &NotFoundError{Resource: ResourceMessage, ID: messageID}
+	}
+
+	detail := MessageDetail{MessageResponse: messages[0]}
+	var fullText sql.NullString
+	err = db.QueryRow(`SELECT full_text, COALESCE(text_truncated, FALSE) FROM messages WHERE id = $1`, messageID).
+		Scan(&fullText, &detail.TextTruncated)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query full text: %v", err)
+	}
+	if fullText, err = textcrypt.Decode(fullText); err != nil {
+		return nil, fmt.Errorf("failed to decode full text of message %d: %v", messageID, err)
+	}
+	detail.FullText = storage.NullStringPtr(fullText)
+	return &detail, nil
+}
+
+// setMessageNote stores the user's own note on one of their messages. An empty
+// note clears it. Notes are encrypted like message text.
+func setMessageNote(db *sql.DB, userID int64, messageID int64, note string) error {
+	var value sql.NullString
+	if note != "" {
+		value = sql.NullString{String: note, Valid: true}
+	}
+
+	value, err := textcrypt.Encode(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode note: %v", err)
+	}
+
+	result, err := db.Exec(`UPDATE messages SET user_note = $1 WHERE id = $2 AND user_id = $3`, value, messageID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update note: %v", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return &NotFoundError{Resource: ResourceMessage, ID: messageID}
+	}
+	return nil
+}
+
+// TagUpdate changes one tag; nil fields are left as they are and an empty
+// color clears it
+type TagUpdate struct {
+	ID    int64   `json:"id"`
+	Name  *string `json:"name"`
+	Color *string `json:"color"`
+}
+
+// TagConflictError reports a rename to a name another of the user's tags has
+type TagConflictError struct {
+	Name string
+}
+
+func (e *TagConflictError) Error() string {
+	return fmt.Sprintf("tag name %q is already taken", e.Name)
+}
+
+// uniqueViolation is the Postgres error code for a unique constraint violation
+const uniqueViolation = "23505"
+
+// updateTags applies all updates in one transaction and returns the updated tags
+// in request order. A tag that isn't the user's (*NotFoundError) or a name that's
+// already taken (*TagConflictError) rolls back the whole batch.
+func updateTags(db *sql.DB, userID int64, updates []TagUpdate) ([]Tag, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	tags := make([]Tag, 0, len(updates))
+	for _, update := range updates {
+		sets := []string{}
+		args := []interface{}{update.ID, userID}
+		if update.Name != nil {
+			args = append(args, *update.Name)
+			sets = append(sets, fmt.Sprintf("name = $%d", len(args)))
+		}
+		if update.Color != nil {
+			args = append(args, sql.NullString{String: *update.Color, Valid: *update.Color != ""})
+			sets = append(sets, fmt.Sprintf("color = $%d", len(args)))
+		}
+		if len(sets) == 0 {
+			// Nothing to change, but the tag must still be the user's
+			sets = append(sets, "name = name")
+		}
+
+		query := `UPDATE tags SET ` + strings.Join(sets, ", ") + `
+			WHERE id = $1 AND user_id = $2
+			RETURNING id, user_id, name, color, created_at,
+				(SELECT COUNT(*) FROM message_tags mt WHERE mt.tag_id = tags.id)`
+
+		var tag Tag
+		var color sql.NullString
+		err := tx.QueryRow(query, args...).Scan(&tag.ID, &tag.UserID, &tag.Name, &color, &tag.CreatedAt, &tag.MessageCount)
+		if err == sql.ErrNoRows {
+			return nil, &NotFoundError{Resource: ResourceTag, ID: update.ID}
+		}
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+			return nil, &TagConflictError{Name: *update.Name}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to update tag %d: %v", update.ID, err)
+		}
+		tag.Color = storage.NullStringPtr(color)
+		tags = append(tags, tag)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit tag updates: %v", err)
+	}
+	return tags, nil
+}
+
+// markMessageSeen marks one of the user's messages as seen and returns when it
+// was first seen. Marking it again keeps the original time.
+func markMessageSeen(db *sql.DB, userID int64, messageID int64) (time.Time, error) {
+	var seenAt time.Time
+	query := `UPDATE messages SET seen_at = COALESCE(seen_at, CURRENT_TIMESTAMP)
+		WHERE id = $1 AND user_id = $2
+		RETURNING seen_at`
+	err := db.QueryRow(query, messageID, userID).Scan(&seenAt)
+	if err == sql.ErrNoRows {
+		return time.Time{}, &NotFoundError{Resource: ResourceMessage, ID: messageID}
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to mark message seen: %v", err)
+	}
+	return seenAt, nil
+}
+
+// errMessageHasNoFile is returned by getMessageFile for messages without media
+var errMessageHasNoFile = errors.New("message has no file")
+
+// MessageFile is the Telegram file attached to a message
+type MessageFile struct {
+	FileID   string
+	FileName string
+	MimeType string
+}
+
+// getMessageFile returns the file of one of the user's messages. With thumbnail
+// set it returns the small photo size instead, when the message has one.
+func getMessageFile(db *sql.DB, userID int64, messageID int64, thumbnail bool) (*MessageFile, error) {
+	var fileID, thumbFileID, fileName, mimeType sql.NullString
+	query := `SELECT file_id, thumb_file_id, file_name, mime_type FROM messages WHERE id = $1 AND user_id = $2`
+	err := db.QueryRow(query, messageID, userID).Scan(&fileID, &thumbFileID, &fileName, &mimeType)
+	if err == sql.ErrNoRows {
+		return nil, &NotFoundError{Resource: ResourceMessage, ID: messageID}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query message file: %v", err)
+	}
+	if thumbnail && thumbFileID.Valid && thumbFileID.String != "" {
+		fileID = thumbFileID
+	}
+	if !fileID.Valid || fileID.String == "" {
+		return nil, errMessageHasNoFile
+	}
+
+	return &MessageFile{FileID: fileID.String, FileName: fileName.String, MimeType: mimeType.String}, nil
+}
+
+// derivePreview picks the string clients show for a message in lists: the text
+// for text messages, the file name for documents (it says more than a caption),
+// the caption for other media, the venue for locations, and a "[type]" placeholder
+// when there's nothing else
+func derivePreview(msg MessageResponse) string {
+	candidates := []*string{msg.Caption, msg.FileName}
+	switch msg.MessageType {
+	case "text":
+		candidates = []*string{msg.TextContent}
+	case "document":
+		candidates = []*string{msg.FileName, msg.Caption}
+	case "location":
+		candidates = []*string{msg.VenueTitle, msg.VenueAddress}
+	}
+
+	for _, candidate := range candidates {
+		if candidate != nil && strings.TrimSpace(*candidate) != "" {
+			return *candidate
+		}
+	}
+
+	messageType := msg.MessageType
+	if messageType == "" {
+		messageType = "message"
+	}
+	return "[" + strings.ReplaceAll(messageType, "_", " ") + "]"
+}
+
+// extractHost returns the lowercased host of a URL without port or "www." prefix,
+// or an empty string if the URL has no host
+func extractHost(rawURL string) string {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+	return strings.TrimPrefix(host, "www.")
+}
+
+// tagColorPalette is the fixed set of colors suggested for new tags
+var tagColorPalette = []string{
+	"#FF6B6B", "#4ECDC4", "#45B7D1", "#96CEB4", "#FFEAA7",
+	"#DDA0DD", "#F4A261", "#6C5CE7", "#00B894", "#E17055",
+}
+
+// suggestTagColor picks the palette color least used by usedColors, preferring
+// colors not used at all. Ties go to the earliest palette entry.
+func suggestTagColor(usedColors []string) string {
+	usage := make(map[string]int)
+	for _, color := range usedColors {
+		usage[strings.ToUpper(strings.TrimSpace(color))]++
+	}
+
+	best := tagColorPalette[0]
+	for _, color := range tagColorPalette[1:] {
+		if usage[color] < usage[best] {
+			best = color
+		}
+	}
+	return best
+}
+
+// countDomains counts, for each host, the number of messages linking to it.
+// Each inner slice holds the URLs of a single message.
+func countDomains(messageURLs [][]string) []DomainCount {
+	counts := make(map[string]int)
+	for _, urls := range messageURLs {
+		seen := make(map[string]bool)
+		for _, rawURL := range urls {
+			host := extractHost(rawURL)
+			if host == "" || seen[host] {
+				continue
+			}
+			seen[host] = true
+			counts[host]++
+		}
+	}
+
+	domains := make([]DomainCount, 0, len(counts))
+	for host, count := range counts {
+		domains = append(domains, DomainCount{Host: host, MessageCount: count})
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		if domains[i].MessageCount != domains[j].MessageCount {
+			return domains[i].MessageCount > domains[j].MessageCount
+		}
+		return domains[i].Host < domains[j].Host
+	})
+	return domains
+}
+
+func getUserDomains(db *sql.DB, userID int64) ([]DomainCount, error) {
+	query := `SELECT urls FROM messages WHERE user_id = $1 AND cardinality(urls) > 0`
+
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query urls: %v", err)
+	}
+	defer rows.Close()
+
+	var messageURLs [][]string
+	for rows.Next() {
+		var stored pq.StringArray
+		if err := rows.Scan(&stored); err != nil {
+			return nil, fmt.Errorf("failed to scan urls: %v", err)
+		}
+		urls, err := textcrypt.DecodeList(stored)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode urls: %v", err)
+		}
+		messageURLs = append(messageURLs, urls)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return countDomains(messageURLs), nil
+}
+
+// tagFilterModes are the accepted modes of getMessagesByTags: "all" requires
+// every tag, "any" at least one
+var tagFilterModes = map[string]bool{"all": true, "any": true}
+
+// getMessagesByTags returns the user's messages tagged with all or any of tagIDs.
+// Every tag must belong to the user.
+func getMessagesByTags(db *sql.DB, userID int64, tagIDs []int64, mode string, filters MessageFilters) ([]MessageResponse, error) {
+	if !tagFilterModes[mode] {
+		return nil, fmt.Errorf("invalid mode: %s", mode)
+	}
+	if len(tagIDs) == 0 {
+		return []MessageResponse{}, nil
+	}
+
+	for _, tagID := range tagIDs {
+		if err := assertOwnership(db, userID, ResourceTag, tagID); err != nil {
+			return nil, err
+		}
+	}
+
+	taggedMessages := `SELECT message_id FROM message_tags WHERE tag_id = ANY($2)`
+	args := []interface{}{userID, pq.Array(tagIDs)}
+	if mode == "all" {
+		taggedMessages += ` GROUP BY message_id HAVING COUNT(DISTINCT tag_id) = $3`
+		args = append(args, len(tagIDs))
+	}
+
+	query := `
+		SELECT ` + messageResponseColumns + `
+		FROM messages m
+		WHERE m.user_id = $1 AND m.id IN (` + taggedMessages + `)` + filters.sqlConditions() + `
+		ORDER BY ` + filters.orderBy()
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %v", err)
+	}
+	defer rows.Close()
+
+	return scanMessageRows(rows)
+}
+
+func getDomainMessages(db *sql.DB, userID int64, host string, filters MessageFilters) ([]MessageResponse, error) {
+	query := `
+		SELECT ` + messageResponseColumns + `
+		FROM messages m
+		WHERE m.user_id = $1 AND cardinality(m.urls) > 0` + filters.sqlConditions() + `
+		ORDER BY ` + filters.orderBy()
+
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %v", err)
+	}
+	defer rows.Close()
+
+	messages, err := scanMessageRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hosts are normalized in Go, so filter here rather than in SQL
+	host = extractHost("https://" + host)
+	matching := []MessageResponse{}
+	for _, msg := range messages {
+		for _, rawURL := range msg.URLs {
+			if extractHost(rawURL) == host {
+				matching = append(matching, msg)
+				break
+			}
+		}
+	}
+	return matching, nil
+}
+
+// SearchParams are the query parameters of GET /api/user/messages/search
+type SearchParams struct {
+	Query  string
+	Fields SearchFields
+	// MessageType keeps only messages of this type; empty keeps all
+	MessageType string
+}
+
+// searchMessages returns one page of the user's messages whose text or caption
+// contains params.Query, ignoring case, and how many match in total. When all
+// fields are searched, hashtags match too, with or without a leading "#". Like
+// the bot's /search, the database does the matching unless text is encrypted at
+// rest; then searchEncryptedMessages decodes and matches every message.
+func searchMessages(db *sql.DB, userID int64, params SearchParams, page Page) ([]MessageResponse, int, error) {
+	if textcrypt.Enabled() {
+		return searchEncryptedMessages(db, userID, params, page)
+	}
+
+	args := []interface{}{userID, likePattern(params.Query)}
+	condition := params.Fields.ilikeCondition("$2")
+	if params.Fields == SearchFieldsAll {
+		args = append(args, likePattern(strings.TrimPrefix(params.Query, "#")))
+		condition = fmt.Sprintf("(%s OR EXISTS (SELECT 1 FROM unnest(m.hashtags) AS h WHERE h ILIKE $%d))", condition, len(args))
+	}
+	if params.MessageType != "" {
+		args = append(args, params.MessageType)
+		condition += fmt.Sprintf(" AND m.message_type = $%d", len(args))
+	}
+
+	from := `
+		FROM messages m
+		WHERE m.user_id = $1 AND ` + condition
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*)`+from, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count matching messages: %v", err)
+	}
+
+	args = append(args, page.Limit, page.Offset)
+	query := `
+		SELECT ` + messageResponseColumns + from + `
+		ORDER BY m.created_at DESC, m.id DESC
+		` + fmt.Sprintf("LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to search messages: %v", err)
+	}
+	defer rows.Close()
+
+	messages, err := scanMessageRows(rows)
+	return messages, total, err
+}
+
+// searchEncryptedMessages is searchMessages for text encrypted at rest. It
+// decodes the user's messages to find the matching IDs, then loads the page.
+func searchEncryptedMessages(db *sql.DB, userID int64, params SearchParams, page Page) ([]MessageResponse, int, error) {
+	args := []interface{}{userID}
+	typeFilter := ""
+	if params.MessageType != "" {
+		args = append(args, params.MessageType)
+		typeFilter = " AND message_type = $2"
+	}
+
+	rows, err := db.Query(`
+		SELECT id, text_content, caption, full_text, hashtags
+		FROM messages
+		WHERE user_id = $1`+typeFilter+`
+		ORDER BY created_at DESC, id DESC`, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to search messages: %v", err)
+	}
+	defer rows.Close()
+
+	query := strings.ToLower(params.Query)
+	hashtag := strings.TrimPrefix(query, "#")
+	var matching []int64
+	for rows.Next() {
+		var id int64
+		var textContent, caption, fullText sql.NullString
+		var hashtags pq.StringArray
+		if err := rows.Scan(&id, &textContent, &caption, &fullText, &hashtags); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan message row: %v", err)
+		}
+		if textContent, err = textcrypt.Decode(textContent); err != nil {
+			return nil, 0, fmt.Errorf("failed to decode text of message %d: %v", id, err)
+		}
+		if caption, err = textcrypt.Decode(caption); err != nil {
+			return nil, 0, fmt.Errorf("failed to decode caption of message %d: %v", id, err)
+		}
+		if fullText, err = textcrypt.Decode(fullText); err != nil {
+			return nil, 0, fmt.Errorf("failed to decode full text of message %d: %v", id, err)
+		}
+		decodedHashtags, err := textcrypt.DecodeList(hashtags)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to decode hashtags of message %d: %v", id, err)
+		}
+
+		match := params.Fields.matches(query, textContent, caption, fullText)
+		if !match && params.Fields == SearchFieldsAll {
+			match = slices.ContainsFunc(decodedHashtags, func(h string) bool {
+				return strings.Contains(strings.ToLower(h), hashtag)
+			})
+		}
+		if match {
+			matching = append(matching, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to search messages: %v", err)
+	}
+
+	total := len(matching)
+	if page.Offset >= total {
+		return []MessageResponse{}, total, nil
+	}
+	ids := matching[page.Offset:min(page.Offset+page.Limit, total)]
+
+	pageRows, err := db.Query(`
+		SELECT `+messageResponseColumns+`
+		FROM messages m
+		WHERE m.user_id = $1 AND m.id = ANY($2)
+		ORDER BY m.created_at DESC, m.id DESC`, userID, pq.Array(ids))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to search messages: %v", err)
+	}
+	defer pageRows.Close()
+
+	messages, err := scanMessageRows(pageRows)
+	return messages, total, err
+}
+
+// maxRelatedMessages caps the list returned by getRelatedMessages
+const maxRelatedMessages = 20
+
+// getRelatedMessages returns the user's other messages that share tags or
+// hashtags with messageID, ranked by how many they share. Ties go to newer
+// messages; messages sharing nothing are left out. Hashtags encrypted at rest
+// never compare equal, so only tags count for those messages.
+func getRelatedMessages(db *sql.DB, userID int64, messageID int64) ([]MessageResponse, error) {
+	// First verify that the message belongs to the user
+	if err := assertOwnership(db, userID, ResourceMessage, messageID); err != nil {
+		return nil, err
+	}
+
+	query := `
+		WITH overlaps AS (
+			SELECT other.id,
+				(SELECT COUNT(*) FROM message_tags a
+					INNER JOIN message_tags b ON b.tag_id = a.tag_id
+					WHERE a.message_id = src.id AND b.message_id = other.id)
+				+ (SELECT COUNT(DISTINCT h) FROM unnest(other.hashtags) AS h
+					WHERE h = ANY(src.hashtags)) AS overlap
+			FROM messages src
+			INNER JOIN messages other ON other.user_id = src.user_id AND other.id <> src.id
+			WHERE src.id = $1 AND src.user_id = $2
+		)
+		SELECT ` + messageResponseColumns + `
+		FROM messages m
+		INNER JOIN overlaps o ON o.id = m.id
+		WHERE o.overlap > 0
+		ORDER BY o.overlap DESC, m.created_at DESC, m.id DESC
+		LIMIT $3`
+
+	rows, err := db.Query(query, messageID, userID, maxRelatedMessages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query related messages: %v", err)
+	}
+	defer rows.Close()
+
+	messages, err := scanMessageRows(rows)
+	if err != nil {
+		return nil, err
+	}
+	if messages == nil {
+		messages = []MessageResponse{}
+	}
+	return messages, nil
+}
+
+// getTagTimeline counts messages tagged with tagID per bucket (day, week or month)
+// based on when the tag was applied. from and to are optional; to is exclusive.
+func getTagTimeline(db *sql.DB, userID int64, tagID int64, bucket string, from, to *time.Time) ([]TimelinePoint, error) {
+	if !timelineBuckets[bucket] {
+		return nil, fmt.Errorf("invalid bucket: %s", bucket)
+	}
+
+	if from != nil && to != nil && timelineBucketCount(*from, *to, bucket) > maxTimelineBuckets {
+		return nil, errTimelineTooLong
+	}
+
+	// First verify that the tag belongs to the user
+	if err := assertOwnership(db, userID, ResourceTag, tagID); err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT date_trunc($3, mt.created_at) AS bucket_start, COUNT(*)
+		FROM message_tags mt
+		INNER JOIN tags t ON t.id = mt.tag_id
+		WHERE mt.tag_id = $1 AND t.user_id = $2
+			AND ($4::timestamp IS NULL OR mt.created_at >= $4)
+			AND ($5::timestamp IS NULL OR mt.created_at < $5)
+		GROUP BY bucket_start
+		ORDER BY bucket_start`
+
+	rows, err := db.Query(query, tagID, userID, bucket, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query timeline: %v", err)
+	}
+	defer rows.Close()
+
+	var points []TimelinePoint
+	for rows.Next() {
+		var point TimelinePoint
+		if err := rows.Scan(&point.BucketStart, &point.MessageCount); err != nil {
+			return nil, fmt.Errorf("failed to scan timeline row: %v", err)
+		}
+		point.BucketStart = point.BucketStart.UTC()
+		points = append(points, point)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return fillTimelineGaps(points, bucket, from, to)
+}
+
+// getTagBreakdown counts the messages tagged with tagID per message type, most
+// common first
+func getTagBreakdown(db *sql.DB, userID int64, tagID int64) ([]TypeCount, error) {
+	// First verify that the tag belongs to the user
+	if err := assertOwnership(db, userID, ResourceTag, tagID); err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT m.message_type, COUNT(*)
+		FROM message_tags mt
+		INNER JOIN messages m ON m.id = mt.message_id
+		WHERE mt.tag_id = $1 AND m.user_id = $2
+		GROUP BY m.message_type
+		ORDER BY COUNT(*) DESC, m.message_type`
+
+	rows, err := db.Query(query, tagID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tag breakdown: %v", err)
+	}
+	defer rows.Close()
+
+	counts := []TypeCount{}
+	for rows.Next() {
+		var count TypeCount
+		if err := rows.Scan(&count.MessageType, &count.MessageCount); err != nil {
+			return nil, fmt.Errorf("failed to scan tag breakdown row: %v", err)
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+// truncateToBucket mirrors PostgreSQL's date_trunc for day, week (ISO, Monday) and month
+func truncateToBucket(t time.Time, bucket string) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch bucket {
+	case "week":
+		offset := (int(day.Weekday()) + 6) % 7 // days since Monday
+		return day.AddDate(0, 0, -offset)
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return day
+	}
+}
+
+func nextBucket(t time.Time, bucket string) time.Time {
+	switch bucket {
+	case "week":
+		return t.AddDate(0, 0, 7)
+	case "month":
+		return t.AddDate(0, 1, 0)
+	default:
+		return t.AddDate(0, 0, 1)
+	}
+}
+
+// timelineBucketCount returns how many buckets the range from..to (exclusive)
+// spans, counting the partial buckets at either end
+func timelineBucketCount(from, to time.Time, bucket string) int {
+	start := truncateToBucket(from, bucket)
+	end := truncateToBucket(to.Add(-time.Nanosecond), bucket)
+	if end.Before(start) {
+		return 0
+	}
+	switch bucket {
+	case "week":
+		return int(end.Sub(start).Hours()/24/7) + 1
+	case "month":
+		return (end.Year()-start.Year())*12 + int(end.Month()-start.Month()) + 1
+	default:
+		return int(end.Sub(start).Hours()/24) + 1
+	}
+}
+
+// fillTimelineGaps adds zero-count buckets so a sparkline has evenly spaced points.
+// The range spans from..to when given, otherwise the first..last point. It
+// returns errTimelineTooLong rather than more than maxTimelineBuckets points.
+func fillTimelineGaps(points []TimelinePoint, bucket string, from, to *time.Time) ([]TimelinePoint, error) {
+	counts := make(map[time.Time]int)
+	for _, point := range points {
+		counts[truncateToBucket(point.BucketStart, bucket)] += point.MessageCount
+	}
+
+	var start, end time.Time
+	if from != nil {
+		start = truncateToBucket(*from, bucket)
+	} else if len(points) > 0 {
+		start = truncateToBucket(points[0].BucketStart, bucket)
+	}
+	if to != nil {
+		// to is exclusive, so the last bucket is the one containing the instant before it
+		end = truncateToBucket(to.Add(-time.Nanosecond), bucket)
+	} else if len(points) > 0 {
+		end = truncateToBucket(points[len(points)-1].BucketStart, bucket)
+	}
+
+	filled := []TimelinePoint{}
+	if start.IsZero() || end.IsZero() {
+		return filled, nil
+	}
+	if timelineBucketCount(start, nextBucket(end, bucket), bucket) > maxTimelineBuckets {
+		return nil, errTimelineTooLong
+	}
+	for t := start; !t.After(end); t = nextBucket(t, bucket) {
+		filled = append(filled, TimelinePoint{BucketStart: t, MessageCount: counts[t]})
+	}
+	return filled, nil
+}
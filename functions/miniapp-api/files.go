@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// telegramAPIURL is the Bot API base URL; tests point it at a fake server
+var telegramAPIURL = "https://api.telegram.org"
+
+// maxProxiedFileSize keeps proxied files within one function response: Cloud
+// Functions return at most 3.5 MB, and binary bodies grow by a third when
+// base64 encoded. Files this small are buffered, so serveFile answers Range
+// requests by slicing, and each Range request downloads the file again.
+const maxProxiedFileSize = 2 << 20
+
+// errFileTooLarge is returned for files over maxProxiedFileSize
+var errFileTooLarge = fmt.Errorf("file is larger than %d bytes", maxProxiedFileSize)
+
+var telegramFileClient = &http.Client{Timeout: 30 * time.Second}
+
+// downloadTelegramFile resolves fileID with getFile and downloads the whole
+// file. Files over maxProxiedFileSize return errFileTooLarge.
+func downloadTelegramFile(ctx context.Context, botToken, fileID string) ([]byte, error) {
+	getFileURL := fmt.Sprintf("%s/bot%s/getFile?file_id=%s", telegramAPIURL, botToken, url.QueryEscape(fileID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, getFileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := telegramFileClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("getFile request failed: %v", withoutURL(err))
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+		Result      struct {
+			FilePath string `json:"file_path"`
+			FileSize int64  `json:"file_size"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid getFile response: %v", err)
+	}
+	if !result.OK || result.Result.FilePath == "" {
+		return nil, fmt.Errorf("getFile failed: %s", result.Description)
+	}
+	// Don't download what can't be returned
+	if result.Result.FileSize > maxProxiedFileSize {
+		return nil, errFileTooLarge
+	}
+
+	downloadURL := fmt.Sprintf("%s/file/bot%s/%s", telegramAPIURL, botToken, result.Result.FilePath)
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, downloadURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	fileResp, err := telegramFileClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("file download failed: %v", withoutURL(err))
+	}
+	defer fileResp.Body.Close()
+
+	if fileResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("file download failed with status %d", fileResp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(fileResp.Body, maxProxiedFileSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("file download failed: %v", withoutURL(err))
+	}
+	if len(data) > maxProxiedFileSize {
+		return nil, errFileTooLarge
+	}
+	return data, nil
+}
+
+// withoutURL drops the request URL from an HTTP client error. Bot API URLs
+// carry the bot token, and these errors end up in the logs.
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
+
+// serveFile writes a buffered file. http.ServeContent honors Range headers, so
+// video seeking gets 206 Partial Content with Content-Range, and requests
+// without a Range get the whole file with 200.
+func serveFile(c *gin.Context, data []byte, fileName, mimeType string) {
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	c.Header("Content-Type", mimeType)
+	c.Header("Cache-Control", "private, max-age=3600")
+	if fileName != "" {
+		c.Header("Content-Disposition", fmt.Sprintf("inline; filename=%q", fileName))
+	}
+
+	http.ServeContent(c.Writer, c.Request, fileName, time.Time{}, bytes.NewReader(data))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeFileRange(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	data := []byte("0123456789")
+
+	tests := []struct {
+		name                 string
+		rangeHeader          string
+		expectedStatus       int
+		expectedBody         string
+		expectedContentRange string
+	}{
+		{name: "No range returns the whole file", expectedStatus: http.StatusOK, expectedBody: "0123456789"},
+		{name: "Byte range", rangeHeader: "bytes=2-5", expectedStatus: http.StatusPartialContent, expectedBody: "2345", expectedContentRange: "bytes 2-5/10"},
+		{name: "Open-ended range", rangeHeader: "bytes=7-", expectedStatus: http.StatusPartialContent, expectedBody: "789", expectedContentRange: "bytes 7-9/10"},
+		{name: "Suffix range", rangeHeader: "bytes=-3", expectedStatus: http.StatusPartialContent, expectedBody: "789", expectedContentRange: "bytes 7-9/10"},
+		{name: "Unsatisfiable range", rangeHeader: "bytes=20-30", expectedStatus: http.StatusRequestedRangeNotSatisfiable, expectedContentRange: "bytes */10"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			req, _ := http.NewRequest("GET", "/api/user/messages/1/file", nil)
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			c.Request = req
+
+			serveFile(c, data, "clip.mp4", "video/mp4")
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Equal(t, tt.expectedContentRange, w.Header().Get("Content-Range"))
+			if tt.expectedBody != "" {
+				assert.Equal(t, tt.expectedBody, w.Body.String())
+				assert.Equal(t, "video/mp4", w.Header().Get("Content-Type"))
+				assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+			}
+		})
+	}
+}
+
+func TestDownloadTelegramFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/bottoken/getFile" && r.URL.Query().Get("file_id") == "large":
+			w.Write([]byte(`{"ok": true, "result": {"file_id": "large", "file_path": "videos/file_2.mp4", "file_size": 10485760}}`))
+		case r.URL.Path == "/file/bottoken/videos/file_2.mp4":
+			t.Error("A file over the limit shouldn't be downloaded")
+		case r.URL.Path == "/bottoken/getFile" && r.URL.Query().Get("file_id") == "known":
+			w.Write([]byte(`{"ok": true, "result": {"file_id": "known", "file_path": "videos/file_1.mp4"}}`))
+		case r.URL.Path == "/bottoken/getFile":
+			w.Write([]byte(`{"ok": false, "description": "Bad Request: invalid file_id"}`))
+		case r.URL.Path == "/file/bottoken/videos/file_1.mp4":
+			w.Write([]byte("video bytes"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	previousURL := telegramAPIURL
+	telegramAPIURL = server.URL
+	defer func() { telegramAPIURL = previousURL }()
+
+	data, err := downloadTelegramFile(context.Background(), "token", "known")
+	assert.NoError(t, err)
+	assert.Equal(t, "video bytes", string(data))
+
+	_, err = downloadTelegramFile(context.Background(), "token", "unknown")
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "invalid file_id"))
+
+	_, err = downloadTelegramFile(context.Background(), "token", "large")
+	assert.ErrorIs(t, err, errFileTooLarge)
+}
+
+func TestDownloadTelegramFileHidesToken(t *testing.T) {
+	// A closed server fails every request before any response
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	previousURL := telegramAPIURL
+	telegramAPIURL = server.URL
+	defer func() { telegramAPIURL = previousURL }()
+
+	_, err := downloadTelegramFile(context.Background(), "123:secret-token", "known")
+	if assert.Error(t, err) {
+		assert.NotContains(t, err.Error(), "secret-token")
+		assert.Contains(t, err.Error(), "getFile request failed")
+	}
+}
@@ -7,7 +7,8 @@ require (
 	github.com/gin-gonic/gin v1.10.0
 	github.com/kd3n1z/go-telegram-parser v1.0.2
 	github.com/lib/pq v1.10.9
-	github.com/stretchr/testify v1.9.0
+	github.com/stretchr/testify v1.11.1
+	telegram-content-organizer-shared v0.0.0
 )
 
 require (
@@ -35,8 +36,10 @@ require (
 	golang.org/x/arch v0.8.0 // indirect
 	golang.org/x/crypto v0.23.0 // indirect
 	golang.org/x/net v0.25.0 // indirect
-	golang.org/x/sys v0.20.0 // indirect
+	golang.org/x/sys v0.34.0 // indirect
 	golang.org/x/text v0.15.0 // indirect
 	google.golang.org/protobuf v1.34.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace telegram-content-organizer-shared => ../shared
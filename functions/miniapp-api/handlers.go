@@ -1,19 +1,73 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"os"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"log/slog"
 
 	"github.com/gin-gonic/gin"
+
+	"telegram-content-organizer-shared/storage"
 )
 
 type APIResponse struct {
-	Success bool        `json:"success"`
-	Data    interface{} `json:"data,omitempty"`
-	Error   string      `json:"error,omitempty"`
+	Success    bool        `json:"success"`
+	Data       interface{} `json:"data,omitempty"`
+	Pagination *Pagination `json:"pagination,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	RequestID  string      `json:"request_id,omitempty"`
+}
+
+// requestIDHeader echoes the API Gateway request ID back to the client
+const requestIDHeader = "X-Request-Id"
+
+const requestIDKey = "request_id"
+
+// requestIDContextKey holds the API Gateway request ID in the request context
+type requestIDContextKey struct{}
+
+// withRequestID attaches the API Gateway request ID to req for the router
+func withRequestID(req *http.Request, id string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), requestIDContextKey{}, id))
+}
+
+// requestIDMiddleware exposes the request ID to handlers and echoes it back so
+// users can quote it when reporting errors. It only trusts the ID Handler took
+// from the gateway; a client's X-Request-Id header could forge log entries.
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if id, _ := c.Request.Context().Value(requestIDContextKey{}).(string); id != "" {
+			c.Set(requestIDKey, id)
+			c.Header(requestIDHeader, id)
+		}
+		c.Next()
+	}
+}
+
+// requestID returns the current request's ID, or "" outside API Gateway
+func requestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// requestLogger returns the default logger tagged with the request ID
+func requestLogger(c *gin.Context) *slog.Logger {
+	if id := requestID(c); id != "" {
+		return slog.Default().With(requestIDKey, id)
+	}
+	return slog.Default()
 }
 
 func setupRoutes(db *sql.DB) *gin.Engine {
@@ -25,6 +79,7 @@ func setupRoutes(db *sql.DB) *gin.Engine {
 	// Add logging middleware
 	r.Use(gin.Logger())
 	r.Use(gin.Recovery())
+	r.Use(requestIDMiddleware())
 
 	// Add CORS middleware
 	r.Use(corsMiddleware())
@@ -32,43 +87,166 @@ func setupRoutes(db *sql.DB) *gin.Engine {
 	// API routes
 	api := r.Group("/api")
 	{
-		// Health check endpoint (no auth required)
+		// Liveness endpoint for Lambda warmers (no auth, no DB)
+		api.GET("/ping", func(c *gin.Context) {
+			c.String(http.StatusOK, "pong")
+		})
+
+		// Readiness endpoint: verifies the database is reachable (no auth required)
 		api.GET("/health", func(c *gin.Context) {
+			timestamp := time.Now().UTC().Format(time.RFC3339)
+			if err := db.PingContext(c.Request.Context()); err != nil {
+				requestLogger(c).Error("Health check failed", "error", err)
+				c.JSON(http.StatusServiceUnavailable, APIResponse{
+					Success:   false,
+					Data:      map[string]string{"status": "unhealthy", "timestamp": timestamp},
+					Error:     "Database unavailable",
+					RequestID: requestID(c),
+				})
+				return
+			}
 			c.JSON(http.StatusOK, APIResponse{
 				Success: true,
-				Data:    map[string]string{"status": "healthy", "timestamp": "2025-01-15T12:00:00Z"},
+				Data:    map[string]string{"status": "healthy", "timestamp": timestamp},
 			})
 		})
 		api.OPTIONS("/health", optionsHandler)
 
+		api.GET("/user/profile", func(c *gin.Context) {
+			getUserProfileHandler(c, db)
+		})
+		api.OPTIONS("/user/profile", optionsHandler)
+
 		api.GET("/user/tags", func(c *gin.Context) {
 			getUserTagsHandler(c, db)
 		})
+		api.PATCH("/user/tags", func(c *gin.Context) {
+			updateTagsHandler(c, db)
+		})
 		api.OPTIONS("/user/tags", optionsHandler)
 
+		api.GET("/user/tags/suggest-color", func(c *gin.Context) {
+			suggestTagColorHandler(c, db)
+		})
+		api.OPTIONS("/user/tags/suggest-color", optionsHandler)
+
+		api.DELETE("/user/tags/:tagId", func(c *gin.Context) {
+			deleteTagHandler(c, db)
+		})
+		api.OPTIONS("/user/tags/:tagId", optionsHandler)
+
+		api.PUT("/user/tags/:tagId/color", func(c *gin.Context) {
+			setTagColorHandler(c, db)
+		})
+		api.OPTIONS("/user/tags/:tagId/color", optionsHandler)
+
+		api.POST("/user/tags/:tagId/merge", func(c *gin.Context) {
+			mergeTagsHandler(c, db)
+		})
+		api.OPTIONS("/user/tags/:tagId/merge", optionsHandler)
+
 		api.GET("/user/tags/:tagId/messages", func(c *gin.Context) {
 			getTagMessagesHandler(c, db)
 		})
 		api.OPTIONS("/user/tags/:tagId/messages", optionsHandler)
+
+		api.GET("/user/tags/:tagId/timeline", func(c *gin.Context) {
+			getTagTimelineHandler(c, db)
+		})
+		api.OPTIONS("/user/tags/:tagId/timeline", optionsHandler)
+
+		api.GET("/user/tags/:tagId/breakdown", func(c *gin.Context) {
+			getTagBreakdownHandler(c, db)
+		})
+		api.OPTIONS("/user/tags/:tagId/breakdown", optionsHandler)
+
+		api.GET("/user/export", func(c *gin.Context) {
+			exportUserDataHandler(c, db)
+		})
+		api.OPTIONS("/user/export", optionsHandler)
+
+		api.DELETE("/user", func(c *gin.Context) {
+			deleteUserDataHandler(c, db)
+		})
+		api.OPTIONS("/user", optionsHandler)
+
+		api.GET("/user/messages", func(c *gin.Context) {
+			getMessagesByTagsHandler(c, db)
+		})
+		api.OPTIONS("/user/messages", optionsHandler)
+
+		api.GET("/user/messages/search", func(c *gin.Context) {
+			searchMessagesHandler(c, db)
+		})
+		api.OPTIONS("/user/messages/search", optionsHandler)
+
+		api.GET("/user/messages/:messageId", func(c *gin.Context) {
+			getMessageHandler(c, db)
+		})
+		api.OPTIONS("/user/messages/:messageId", optionsHandler)
+
+		api.PUT("/user/messages/:messageId/note", func(c *gin.Context) {
+			setMessageNoteHandler(c, db)
+		})
+		api.OPTIONS("/user/messages/:messageId/note", optionsHandler)
+
+		api.POST("/user/messages/:messageId/seen", func(c *gin.Context) {
+			markMessageSeenHandler(c, db)
+		})
+		api.OPTIONS("/user/messages/:messageId/seen", optionsHandler)
+
+		api.GET("/user/messages/:messageId/related", func(c *gin.Context) {
+			getRelatedMessagesHandler(c, db)
+		})
+		api.OPTIONS("/user/messages/:messageId/related", optionsHandler)
+
+		api.GET("/user/messages/:messageId/available-tags", func(c *gin.Context) {
+			getAvailableTagsHandler(c, db)
+		})
+		api.OPTIONS("/user/messages/:messageId/available-tags", optionsHandler)
+
+		api.POST("/user/messages/:messageId/copy-tags-from/:sourceId", func(c *gin.Context) {
+			copyMessageTagsHandler(c, db)
+		})
+		api.OPTIONS("/user/messages/:messageId/copy-tags-from/:sourceId", optionsHandler)
+
+		api.GET("/user/messages/:messageId/file", func(c *gin.Context) {
+			getMessageFileHandler(c, db)
+		})
+		api.OPTIONS("/user/messages/:messageId/file", optionsHandler)
+
+		api.POST("/user/import", func(c *gin.Context) {
+			importMessagesHandler(c, db)
+		})
+		api.OPTIONS("/user/import", optionsHandler)
+
+		api.GET("/user/domains", func(c *gin.Context) {
+			getUserDomainsHandler(c, db)
+		})
+		api.OPTIONS("/user/domains", optionsHandler)
+
+		api.GET("/user/domains/:host/messages", func(c *gin.Context) {
+			getDomainMessagesHandler(c, db)
+		})
+		api.OPTIONS("/user/domains/:host/messages", optionsHandler)
 	}
 
 	return r
 }
 
+// exposedHeaders are readable by the mini-app; the range headers let it seek in proxied media
+const exposedHeaders = requestIDHeader + ", Content-Range, Accept-Ranges"
+
 func corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		origin := c.Request.Header.Get("Origin")
-
-		// Allow all yandexcloud.net and website.yandexcloud.net domains
-		if origin != "" && (containsYandexDomain(origin)) {
-			c.Header("Access-Control-Allow-Origin", origin)
-		} else {
-			c.Header("Access-Control-Allow-Origin", "*")
+		if allowOrigin := corsAllowOrigin(c.Request.Header.Get("Origin")); allowOrigin != "" {
+			c.Header("Access-Control-Allow-Origin", allowOrigin)
 		}
 
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization, X-Requested-With")
 		c.Header("Access-Control-Allow-Credentials", "false")
+		c.Header("Access-Control-Expose-Headers", exposedHeaders)
 		c.Header("Access-Control-Max-Age", "86400")
 
 		if c.Request.Method == "OPTIONS" {
@@ -80,15 +258,70 @@ func corsMiddleware() gin.HandlerFunc {
 	}
 }
 
+// corsAllowOrigin returns the Access-Control-Allow-Origin value for a request
+// from origin, or "" to leave the header out so browsers block the response.
+// ALLOWED_ORIGINS lists the allowed origins, comma-separated; "*" allows any.
+// Without it Yandex Cloud origins are echoed and any other origin gets "*".
+func corsAllowOrigin(origin string) string {
+	var patterns []string
+	for _, pattern := range strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	if len(patterns) == 0 {
+		if containsYandexDomain(origin) {
+			return origin
+		}
+		return "*"
+	}
+
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			return "*"
+		}
+		if originMatches(origin, pattern) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// originMatches reports whether origin matches an ALLOWED_ORIGINS entry: an
+// exact origin like "https://app.example.com", or a wildcard like
+// "*.example.com" or "https://*.example.com" matching any subdomain
+func originMatches(origin, pattern string) bool {
+	origin, pattern = strings.ToLower(origin), strings.ToLower(pattern)
+	if origin == "" {
+		return false
+	}
+	if origin == pattern {
+		return true
+	}
+
+	scheme, host, ok := strings.Cut(origin, "://")
+	if !ok {
+		return false
+	}
+	if patternScheme, rest, ok := strings.Cut(pattern, "://"); ok {
+		if patternScheme != scheme {
+			return false
+		}
+		pattern = rest
+	}
+
+	suffix, ok := strings.CutPrefix(pattern, "*")
+	return ok && strings.HasPrefix(suffix, ".") && len(host) > len(suffix) && strings.HasSuffix(host, suffix)
+}
+
 func containsYandexDomain(origin string) bool {
 	return origin != "" && (
 	// Allow both API gateway and Object Storage domains
 	origin == "https://d5di1npf8thkd9m534rv.8wihnuyr.apigw.yandexcloud.net" ||
 		origin == "https://tg-bot-storage-fjod.website.yandexcloud.net" ||
-		// Allow any yandexcloud.net subdomain for flexibility
-		(len(origin) > 16 && origin[:8] == "https://" &&
-			(origin[len(origin)-16:] == ".yandexcloud.net" ||
-				origin[len(origin)-24:] == ".website.yandexcloud.net")))
+		// Allow any yandexcloud.net subdomain (website.yandexcloud.net included) for flexibility
+		(strings.HasPrefix(origin, "https://") && strings.HasSuffix(origin, ".yandexcloud.net")))
 }
 
 func optionsHandler(c *gin.Context) {
@@ -104,15 +337,18 @@ func getUserTagsHandler(c *gin.Context, db *sql.DB) {
 		return
 	}
 
+	order, ok := parseTagSort(c.Query("sort"))
+	if !ok {
+		respondError(c, http.StatusBadRequest, "Invalid sort value, expected count, name or recent")
+		return
+	}
+
 	// Get user's tags with message counts
-	tags, err := getUserTagsWithCounts(db, *userID)
+	tags, err := getUserTagsWithCounts(db, *userID, order)
 	if err != nil {
-		slog.Error("Database error", "user_id", *userID, "error", err)
+		requestLogger(c).Error("Database error", "user_id", *userID, "error", err)
 
-		c.JSON(http.StatusInternalServerError, APIResponse{
-			Success: false,
-			Error:   "Failed to fetch user tags",
-		})
+		respondError(c, http.StatusInternalServerError, "Failed to fetch user tags")
 		return
 	}
 
@@ -137,40 +373,99 @@ var defaultEnvProvider = &prodEnvProvider{}
 func getUserID(c *gin.Context, p EnvProvider, factory ParserFactory) *int64 {
 	authHeader := c.GetHeader("Authorization")
 	if authHeader == "" {
-		c.JSON(http.StatusUnauthorized, APIResponse{
-			Success: false,
-			Error:   "Authorization header is required!",
-		})
+		respondError(c, http.StatusUnauthorized, "Authorization header is required!")
 		return nil
 	}
 
 	// Extract user ID from Telegram Web App data
 	userID, err := extractUserIDFromAuth(authHeader, p, factory)
 	if err != nil {
-		slog.Error("Authentication error", "error", err)
-		c.JSON(http.StatusUnauthorized, APIResponse{
-			Success: false,
-			Error:   "Invalid authentication data",
-		})
+		requestLogger(c).Error("Authentication error", "client_ip", clientIP(c), "error", err)
+		respondError(c, http.StatusUnauthorized, "Invalid authentication data")
 		return nil
 	}
 	return &userID
 }
 
+// defaultTrustedProxyCount assumes only API Gateway sits in front of the function
+const defaultTrustedProxyCount = 1
+
+// trustedProxyCount reads TRUSTED_PROXY_COUNT, the number of proxies in front of
+// the API that append to X-Forwarded-For. 0 ignores the header entirely.
+func trustedProxyCount() int {
+	count, err := strconv.Atoi(os.Getenv("TRUSTED_PROXY_COUNT"))
+	if err != nil || count < 0 {
+		return defaultTrustedProxyCount
+	}
+	return count
+}
+
+// clientIP returns the caller's IP for rate limiting and abuse detection. Entries
+// left of the trusted hops in X-Forwarded-For can be spoofed by the client, so
+// the address is taken trustedProxyCount entries from the right. A header with
+// fewer entries than that didn't pass through every trusted proxy, so none of
+// it is trusted and the connection's address is used.
+func clientIP(c *gin.Context) string {
+	remoteIP := c.RemoteIP()
+
+	trusted := trustedProxyCount()
+	if trusted == 0 {
+		return remoteIP
+	}
+
+	var hops []string
+	for _, hop := range strings.Split(c.GetHeader("X-Forwarded-For"), ",") {
+		if hop = strings.TrimSpace(hop); hop != "" {
+			hops = append(hops, hop)
+		}
+	}
+	if trusted > len(hops) {
+		return remoteIP
+	}
+	return hops[len(hops)-trusted]
+}
+
 func getTagID(c *gin.Context) *int64 {
 	tagIDStr := c.Param("tagId")
 	tagID, err := strconv.ParseInt(tagIDStr, 10, 64)
 	if err != nil {
-		slog.Error("Invalid tagId parameter", "tag_id_str", tagIDStr, "error", err)
-		c.JSON(http.StatusBadRequest, APIResponse{
-			Success: false,
-			Error:   "Invalid tag ID format",
-		})
+		requestLogger(c).Error("Invalid tagId parameter", "tag_id_str", tagIDStr, "error", err)
+		respondError(c, http.StatusBadRequest, "Invalid tag ID format")
 		return nil
 	}
 	return &tagID
 }
 
+// deleteTagHandler deletes one of the user's tags and removes it from its messages
+func deleteTagHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	tagID := getTagID(c)
+	if tagID == nil {
+		return
+	}
+
+	if err := deleteTag(db, *userID, *tagID); err != nil {
+		requestLogger(c).Error("Database error", "user_id", *userID, "tag_id", *tagID, "error", err)
+
+		if respondNotFound(c, err) {
+			return
+		}
+
+		respondError(c, http.StatusInternalServerError, "Failed to delete tag")
+		return
+	}
+
+	requestLogger(c).Info("Deleted tag", "user_id", *userID, "tag_id", *tagID)
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+	})
+}
+
 func getTagMessagesHandler(c *gin.Context, db *sql.DB) {
 	// Get authorization header
 	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
@@ -184,41 +479,1159 @@ func getTagMessagesHandler(c *gin.Context, db *sql.DB) {
 		return
 	}
 
+	filters := getMessageFilters(c)
+	if filters == nil {
+		return
+	}
+
+	messageType, ok := getMessageTypeParam(c)
+	if !ok {
+		return
+	}
+
+	page := getPage(c)
+	if page == nil {
+		return
+	}
+
 	// Get messages for the specified tag
-	messages, err := getTagMessages(db, *userID, *tagID)
+	messages, total, err := getTagMessages(db, *userID, *tagID, *filters, messageType, *page)
 	if err != nil {
 		printMessagesError(c, userID, tagID, err)
 		return
 	}
+	if messages == nil {
+		messages = []MessageResponse{}
+	}
 
-	slog.Info("Successfully retrieved messages",
+	requestLogger(c).Info("Successfully retrieved messages",
 		"message_count", len(messages),
+		"total", total,
 		"user_id", *userID,
 		"tag_id", *tagID)
 
 	// Return successful response
 	c.JSON(http.StatusOK, APIResponse{
-		Success: true,
-		Data:    messages,
+		Success:    true,
+		Data:       messages,
+		Pagination: &Pagination{Total: total, Limit: page.Limit, Offset: page.Offset},
+	})
+}
+
+// maxSearchQueryLength bounds the q parameter of a message search
+const maxSearchQueryLength = 200
+
+// getSearchParams parses q (required), fields=text|caption|all and type
+func getSearchParams(c *gin.Context) *SearchParams {
+	badRequest := func(message string) *SearchParams {
+		respondError(c, http.StatusBadRequest, message)
+		return nil
+	}
+
+	params := SearchParams{Query: strings.TrimSpace(c.Query("q"))}
+	if params.Query == "" || params.Query == "#" {
+		return badRequest("Missing search query: send ?q=...")
+	}
+	if utf8.RuneCountInString(params.Query) > maxSearchQueryLength {
+		return badRequest(fmt.Sprintf("Search query is too long (max %d characters)", maxSearchQueryLength))
+	}
+
+	fields, ok := parseSearchFields(c.Query("fields"))
+	if !ok {
+		return badRequest("Invalid fields value, expected text, caption or all")
+	}
+	params.Fields = fields
+
+	messageType, ok := getMessageTypeParam(c)
+	if !ok {
+		return nil
+	}
+	params.MessageType = messageType
+	return &params
+}
+
+// getMessageTypeParam reads the optional type query parameter, answering 400
+// for a type the bot never stores
+func getMessageTypeParam(c *gin.Context) (string, bool) {
+	messageType := strings.ToLower(c.Query("type"))
+	if messageType != "" && !knownMessageTypes[messageType] {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("Unknown message type %q", c.Query("type")))
+		return "", false
+	}
+	return messageType, true
+}
+
+// searchMessagesHandler finds the user's messages by text, caption or hashtag
+func searchMessagesHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	params := getSearchParams(c)
+	if params == nil {
+		return
+	}
+
+	page := getPage(c)
+	if page == nil {
+		return
+	}
+
+	messages, total, err := searchMessages(db, *userID, *params, *page)
+	if err != nil {
+		requestLogger(c).Error("Database error", "user_id", *userID, "error", err)
+
+		respondError(c, http.StatusInternalServerError, "Failed to search messages")
+		return
+	}
+	if messages == nil {
+		messages = []MessageResponse{}
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success:    true,
+		Data:       messages,
+		Pagination: &Pagination{Total: total, Limit: page.Limit, Offset: page.Offset},
+	})
+}
+
+// respondError answers status with message and the request ID
+func respondError(c *gin.Context, status int, message string) {
+	c.JSON(status, APIResponse{
+		Success:   false,
+		Error:     message,
+		RequestID: requestID(c),
 	})
 }
 
+// respondNotFound answers 404 when err is a *NotFoundError and reports whether it
+// did. Missing resources and other users' resources get the same response.
+func respondNotFound(c *gin.Context, err error) bool {
+	var notFound *NotFoundError
+	if !errors.As(err, &notFound) {
+		return false
+	}
+
+	resource := string(notFound.Resource)
+	respondError(c, http.StatusNotFound, strings.ToUpper(resource[:1])+resource[1:]+" not found or you don't have access to it")
+	return true
+}
+
 func printMessagesError(c *gin.Context, userID *int64, tagID *int64, err error) {
-	slog.Error("Database error", "user_id", *userID, "tag_id", *tagID, "error", err)
+	requestLogger(c).Error("Database error", "user_id", *userID, "tag_id", *tagID, "error", err)
 
 	// Check if it's a not found/access denied error
-	if err.Error() == "tag not found or access denied" {
-		c.JSON(http.StatusNotFound, APIResponse{
-			Success: false,
-			Error:   "Tag not found or you don't have access to it",
-		})
+	if respondNotFound(c, err) {
 		return
 	}
 
 	// General database error
-	c.JSON(http.StatusInternalServerError, APIResponse{
-		Success: false,
-		Error:   "Failed to fetch messages for tag",
-	})
+	respondError(c, http.StatusInternalServerError, "Failed to fetch messages for tag")
 	return
 }
+
+func getUserDomainsHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	domains, err := getUserDomains(db, *userID)
+	if err != nil {
+		requestLogger(c).Error("Database error", "user_id", *userID, "error", err)
+
+		respondError(c, http.StatusInternalServerError, "Failed to fetch domains")
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    domains,
+	})
+}
+
+func getDomainMessagesHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	host := c.Param("host")
+	if extractHost("https://"+host) == "" {
+		respondError(c, http.StatusBadRequest, "Invalid host")
+		return
+	}
+
+	filters := getMessageFilters(c)
+	if filters == nil {
+		return
+	}
+
+	messages, err := getDomainMessages(db, *userID, host, *filters)
+	if err != nil {
+		requestLogger(c).Error("Database error", "user_id", *userID, "host", host, "error", err)
+
+		respondError(c, http.StatusInternalServerError, "Failed to fetch messages for domain")
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    messages,
+	})
+}
+
+// parseBoolQuery reads an optional boolean query parameter, defaulting to false
+func parseBoolQuery(c *gin.Context, name string) (bool, error) {
+	value := c.Query(name)
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// defaultPageLimit and maxPageLimit bound the messages in one page
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+)
+
+// getPage parses the limit (1-200, default 50) and offset (default 0) query parameters
+func getPage(c *gin.Context) *Page {
+	page := Page{Limit: defaultPageLimit}
+	parse := func(name string, target *int, min, max int) bool {
+		value := c.Query(name)
+		if value == "" {
+			return true
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < min || n > max {
+			respondError(c, http.StatusBadRequest, fmt.Sprintf("Invalid %s value, expected an integer from %d to %d", name, min, max))
+			return false
+		}
+		*target = n
+		return true
+	}
+
+	if !parse("limit", &page.Limit, 1, maxPageLimit) || !parse("offset", &page.Offset, 0, math.MaxInt32) {
+		return nil
+	}
+	return &page
+}
+
+// getMessageFilters parses the has_url, has_file, seen and unseen_first query parameters
+func getMessageFilters(c *gin.Context) *MessageFilters {
+	var filters MessageFilters
+	var err error
+	if filters.HasURL, err = parseBoolQuery(c, "has_url"); err != nil {
+		respondError(c, http.StatusBadRequest, "Invalid has_url value, expected true or false")
+		return nil
+	}
+	if filters.HasFile, err = parseBoolQuery(c, "has_file"); err != nil {
+		respondError(c, http.StatusBadRequest, "Invalid has_file value, expected true or false")
+		return nil
+	}
+	if value := c.Query("seen"); value != "" {
+		seen, err := strconv.ParseBool(value)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "Invalid seen value, expected true or false")
+			return nil
+		}
+		filters.Seen = &seen
+	}
+	if filters.UnseenFirst, err = parseBoolQuery(c, "unseen_first"); err != nil {
+		respondError(c, http.StatusBadRequest, "Invalid unseen_first value, expected true or false")
+		return nil
+	}
+	return &filters
+}
+
+func suggestTagColorHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	tags, err := getUserTagsWithCounts(db, *userID, TagSortCount)
+	if err != nil {
+		requestLogger(c).Error("Database error", "user_id", *userID, "error", err)
+
+		respondError(c, http.StatusInternalServerError, "Failed to fetch tags")
+		return
+	}
+
+	var usedColors []string
+	for _, tag := range tags {
+		if tag.Color != nil {
+			usedColors = append(usedColors, *tag.Color)
+		}
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    map[string]string{"color": suggestTagColor(usedColors)},
+	})
+}
+
+// maxTagUpdates bounds the number of tags changed by one PATCH /api/user/tags
+const maxTagUpdates = 100
+
+// maxTagNameLength matches tags.name VARCHAR(100)
+const maxTagNameLength = 100
+
+// tagColorPattern is the hex form tags.color stores, e.g. #FF6B6B
+var tagColorPattern = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+
+// getTagUpdates reads the PATCH /api/user/tags body: an array of
+// {id, name?, color?}. Names are trimmed and colors uppercased.
+func getTagUpdates(c *gin.Context) []TagUpdate {
+	badRequest := func(message string) []TagUpdate {
+		respondError(c, http.StatusBadRequest, message)
+		return nil
+	}
+
+	var updates []TagUpdate
+	if err := c.ShouldBindJSON(&updates); err != nil {
+		return badRequest("Invalid request body: send [{\"id\": 1, \"name\": \"...\", \"color\": \"#RRGGBB\"}]")
+	}
+	if len(updates) == 0 {
+		return badRequest("No tag updates given")
+	}
+	if len(updates) > maxTagUpdates {
+		return badRequest(fmt.Sprintf("Too many tag updates (max %d)", maxTagUpdates))
+	}
+
+	seen := make(map[int64]bool, len(updates))
+	for i := range updates {
+		update := &updates[i]
+		if seen[update.ID] {
+			return badRequest(fmt.Sprintf("Tag %d is updated more than once", update.ID))
+		}
+		seen[update.ID] = true
+
+		if update.Name != nil {
+			name := strings.TrimSpace(*update.Name)
+			if name == "" {
+				return badRequest("Tag name can't be empty")
+			}
+			if utf8.RuneCountInString(name) > maxTagNameLength {
+				return badRequest(fmt.Sprintf("Tag name is too long (max %d characters)", maxTagNameLength))
+			}
+			update.Name = &name
+		}
+		if update.Color != nil && *update.Color != "" {
+			if !tagColorPattern.MatchString(*update.Color) {
+				return badRequest("Tag color must look like #RRGGBB")
+			}
+			color := strings.ToUpper(*update.Color)
+			update.Color = &color
+		}
+	}
+	return updates
+}
+
+// updateTagsHandler renames and recolors several tags at once. Either all
+// updates are applied or none.
+func updateTagsHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	updates := getTagUpdates(c)
+	if updates == nil {
+		return
+	}
+
+	tags, err := updateTags(db, *userID, updates)
+	if err != nil {
+		requestLogger(c).Error("Database error", "user_id", *userID, "error", err)
+
+		if respondNotFound(c, err) {
+			return
+		}
+
+		var conflict *TagConflictError
+		if errors.As(err, &conflict) {
+			respondError(c, http.StatusConflict, fmt.Sprintf("A tag named %q already exists", conflict.Name))
+			return
+		}
+
+		respondError(c, http.StatusInternalServerError, "Failed to update tags")
+		return
+	}
+
+	requestLogger(c).Info("Updated tags", "user_id", *userID, "count", len(tags))
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    tags,
+	})
+}
+
+// ColorRequest is the body of PUT /api/user/tags/:tagId/color
+type ColorRequest struct {
+	Color string `json:"color"`
+}
+
+// getColorRequest reads a #RRGGBB color, uppercased like getTagUpdates does
+func getColorRequest(c *gin.Context) *ColorRequest {
+	var req ColorRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !tagColorPattern.MatchString(req.Color) {
+		respondError(c, http.StatusBadRequest, "Invalid request body: send {\"color\": \"#RRGGBB\"}")
+		return nil
+	}
+
+	req.Color = strings.ToUpper(req.Color)
+	return &req
+}
+
+// setTagColorHandler sets the color of one of the user's tags and returns the tag
+func setTagColorHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	tagID := getTagID(c)
+	if tagID == nil {
+		return
+	}
+
+	req := getColorRequest(c)
+	if req == nil {
+		return
+	}
+
+	tags, err := updateTags(db, *userID, []TagUpdate{{ID: *tagID, Color: &req.Color}})
+	if err != nil {
+		requestLogger(c).Error("Database error", "user_id", *userID, "tag_id", *tagID, "error", err)
+
+		if respondNotFound(c, err) {
+			return
+		}
+
+		respondError(c, http.StatusInternalServerError, "Failed to update tag color")
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    tags[0],
+	})
+}
+
+// MergeRequest is the body of POST /api/user/tags/:tagId/merge
+type MergeRequest struct {
+	Into int64 `json:"into"`
+}
+
+// getMergeRequest reads the destination tag, which must differ from tagID
+func getMergeRequest(c *gin.Context, tagID int64) *MergeRequest {
+	var req MergeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Into <= 0 {
+		respondError(c, http.StatusBadRequest, "Invalid request body: send {\"into\": <tagId>}")
+		return nil
+	}
+	if req.Into == tagID {
+		respondError(c, http.StatusBadRequest, "Cannot merge a tag into itself")
+		return nil
+	}
+	return &req
+}
+
+// mergeTagsHandler merges one of the user's tags into another and returns the
+// combined tag
+func mergeTagsHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	tagID := getTagID(c)
+	if tagID == nil {
+		return
+	}
+
+	req := getMergeRequest(c, *tagID)
+	if req == nil {
+		return
+	}
+
+	tag, err := mergeTags(db, *userID, *tagID, req.Into)
+	if err != nil {
+		requestLogger(c).Error("Database error", "user_id", *userID, "tag_id", *tagID, "into", req.Into, "error", err)
+
+		if respondNotFound(c, err) {
+			return
+		}
+
+		respondError(c, http.StatusInternalServerError, "Failed to merge tags")
+		return
+	}
+
+	requestLogger(c).Info("Merged tags", "user_id", *userID, "tag_id", *tagID, "into", req.Into)
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    tag,
+	})
+}
+
+// TagFilterParams are the query parameters of GET /api/user/messages
+type TagFilterParams struct {
+	TagIDs []int64
+	Mode   string
+}
+
+// maxFilterTags bounds the number of tags in one multi-tag query
+const maxFilterTags = 20
+
+// getTagFilterParams parses "tags=1,2,3&mode=all|any"; mode defaults to "all"
+// and duplicate tag IDs are ignored
+func getTagFilterParams(c *gin.Context) *TagFilterParams {
+	params := TagFilterParams{Mode: c.DefaultQuery("mode", "all")}
+	if !tagFilterModes[params.Mode] {
+		respondError(c, http.StatusBadRequest, "Invalid mode, expected all or any")
+		return nil
+	}
+
+	seen := make(map[int64]bool)
+	for _, value := range strings.Split(c.Query("tags"), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		tagID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "Invalid tag ID format")
+			return nil
+		}
+		if !seen[tagID] {
+			seen[tagID] = true
+			params.TagIDs = append(params.TagIDs, tagID)
+		}
+	}
+
+	if len(params.TagIDs) == 0 || len(params.TagIDs) > maxFilterTags {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("Expected between 1 and %d tag IDs", maxFilterTags))
+		return nil
+	}
+	return &params
+}
+
+func getMessagesByTagsHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	params := getTagFilterParams(c)
+	if params == nil {
+		return
+	}
+
+	filters := getMessageFilters(c)
+	if filters == nil {
+		return
+	}
+
+	messages, err := getMessagesByTags(db, *userID, params.TagIDs, params.Mode, *filters)
+	if err != nil {
+		requestLogger(c).Error("Database error", "user_id", *userID, "tag_ids", params.TagIDs, "mode", params.Mode, "error", err)
+
+		if respondNotFound(c, err) {
+			return
+		}
+
+		respondError(c, http.StatusInternalServerError, "Failed to fetch messages for tags")
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    messages,
+	})
+}
+
+// ResetRequest is the body required by DELETE /api/user
+type ResetRequest struct {
+	Confirm       string `json:"confirm"`
+	RemoveAccount bool   `json:"remove_account"`
+}
+
+// resetConfirmToken must be sent in ResetRequest.Confirm to delete user data
+const resetConfirmToken = "DELETE"
+
+func getResetRequest(c *gin.Context) *ResetRequest {
+	var req ResetRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Confirm != resetConfirmToken {
+		respondError(c, http.StatusBadRequest, "Confirmation required: send {\"confirm\": \"DELETE\"}")
+		return nil
+	}
+	return &req
+}
+
+func getUserProfileHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	profile, err := getUserProfile(db, *userID)
+	if err != nil {
+		// Users get a row when they first message the bot
+		if respondNotFound(c, err) {
+			return
+		}
+		requestLogger(c).Error("Database error", "user_id", *userID, "error", err)
+
+		respondError(c, http.StatusInternalServerError, "Failed to fetch user profile")
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    profile,
+	})
+}
+
+func exportUserDataHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	export, err := storage.ExportUserData(db, *userID)
+	if err != nil {
+		requestLogger(c).Error("Database error", "user_id", *userID, "error", err)
+
+		respondError(c, http.StatusInternalServerError, "Failed to export user data")
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    export,
+	})
+}
+
+func deleteUserDataHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	req := getResetRequest(c)
+	if req == nil {
+		return
+	}
+
+	deleted, err := storage.DeleteUserData(db, *userID, req.RemoveAccount)
+	if err != nil {
+		requestLogger(c).Error("Database error", "user_id", *userID, "error", err)
+
+		respondError(c, http.StatusInternalServerError, "Failed to delete user data")
+		return
+	}
+
+	requestLogger(c).Info("Deleted all user data", "user_id", *userID, "remove_account", req.RemoveAccount)
+	removeArchivedMedia(requestLogger(c), deleted.MediaKeys)
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+	})
+}
+
+// removeArchivedMedia deletes media the bot archived for deleted messages from
+// STORE_MEDIA_DIR, the directory the bot stores it in. Without the directory
+// the objects can't be reached from here, so they're only logged.
+func removeArchivedMedia(logger *slog.Logger, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	dir := os.Getenv("STORE_MEDIA_DIR")
+	if dir == "" {
+		logger.Warn("Not deleting archived media: STORE_MEDIA_DIR is not set", "objects", len(keys))
+		return
+	}
+
+	store := storage.DirObjectStore{Root: dir}
+	for _, key := range keys {
+		if err := store.Delete(key); err != nil {
+			logger.Error("Failed to delete archived media", "key", key, "error", err)
+		}
+	}
+}
+
+// getMessageHandler returns one message with its full text
+func getMessageHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	messageID := getMessageID(c)
+	if messageID == nil {
+		return
+	}
+
+	message, err := getMessage(db, *userID, *messageID)
+	if err != nil {
+		requestLogger(c).Error("Database error", "user_id", *userID, "message_id", *messageID, "error", err)
+
+		if respondNotFound(c, err) {
+			return
+		}
+
+		respondError(c, http.StatusInternalServerError, "Failed to fetch message")
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    message,
+	})
+}
+
+// NoteRequest is the body of PUT /api/user/messages/:messageId/note
+type NoteRequest struct {
+	Note string `json:"note"`
+}
+
+// MessageNote is returned after a note is saved; UserNote is null once cleared
+type MessageNote struct {
+	ID       int64   `json:"id"`
+	UserNote *string `json:"user_note"`
+}
+
+// maxUserNoteLength caps notes, in characters
+const maxUserNoteLength = 2000
+
+func getMessageID(c *gin.Context) *int64 {
+	messageIDStr := c.Param("messageId")
+	messageID, err := strconv.ParseInt(messageIDStr, 10, 64)
+	if err != nil {
+		requestLogger(c).Error("Invalid messageId parameter", "message_id_str", messageIDStr, "error", err)
+		respondError(c, http.StatusBadRequest, "Invalid message ID format")
+		return nil
+	}
+	return &messageID
+}
+
+func getSourceMessageID(c *gin.Context) *int64 {
+	sourceIDStr := c.Param("sourceId")
+	sourceID, err := strconv.ParseInt(sourceIDStr, 10, 64)
+	if err != nil {
+		requestLogger(c).Error("Invalid sourceId parameter", "source_id_str", sourceIDStr, "error", err)
+		respondError(c, http.StatusBadRequest, "Invalid source message ID format")
+		return nil
+	}
+	return &sourceID
+}
+
+// getNoteRequest reads the note, trimmed. An empty note clears it.
+func getNoteRequest(c *gin.Context) *NoteRequest {
+	var req NoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "Invalid request body: send {\"note\": \"...\"}")
+		return nil
+	}
+
+	req.Note = strings.TrimSpace(req.Note)
+	if utf8.RuneCountInString(req.Note) > maxUserNoteLength {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("Note is too long (max %d characters)", maxUserNoteLength))
+		return nil
+	}
+	return &req
+}
+
+func setMessageNoteHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	messageID := getMessageID(c)
+	if messageID == nil {
+		return
+	}
+
+	req := getNoteRequest(c)
+	if req == nil {
+		return
+	}
+
+	if err := setMessageNote(db, *userID, *messageID, req.Note); err != nil {
+		requestLogger(c).Error("Database error", "user_id", *userID, "message_id", *messageID, "error", err)
+
+		if respondNotFound(c, err) {
+			return
+		}
+
+		respondError(c, http.StatusInternalServerError, "Failed to save note")
+		return
+	}
+
+	note := MessageNote{ID: *messageID}
+	if req.Note != "" {
+		note.UserNote = &req.Note
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    note,
+	})
+}
+
+// MessageSeen is returned after a message is marked seen
+type MessageSeen struct {
+	ID     int64     `json:"id"`
+	SeenAt time.Time `json:"seen_at"`
+}
+
+func markMessageSeenHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	messageID := getMessageID(c)
+	if messageID == nil {
+		return
+	}
+
+	seenAt, err := markMessageSeen(db, *userID, *messageID)
+	if err != nil {
+		requestLogger(c).Error("Database error", "user_id", *userID, "message_id", *messageID, "error", err)
+
+		if respondNotFound(c, err) {
+			return
+		}
+
+		respondError(c, http.StatusInternalServerError, "Failed to mark message as seen")
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    MessageSeen{ID: *messageID, SeenAt: seenAt},
+	})
+}
+
+// getRelatedMessagesHandler lists messages sharing the most tags or hashtags
+// with the given one
+func getRelatedMessagesHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	messageID := getMessageID(c)
+	if messageID == nil {
+		return
+	}
+
+	messages, err := getRelatedMessages(db, *userID, *messageID)
+	if err != nil {
+		requestLogger(c).Error("Database error", "user_id", *userID, "message_id", *messageID, "error", err)
+
+		if respondNotFound(c, err) {
+			return
+		}
+
+		respondError(c, http.StatusInternalServerError, "Failed to fetch related messages")
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    messages,
+	})
+}
+
+// getAvailableTagsHandler lists the user's tags not yet applied to a message,
+// for the mini-app's add-tag picker
+func getAvailableTagsHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	messageID := getMessageID(c)
+	if messageID == nil {
+		return
+	}
+
+	tags, err := getAvailableTags(db, *userID, *messageID)
+	if err != nil {
+		requestLogger(c).Error("Database error", "user_id", *userID, "message_id", *messageID, "error", err)
+
+		if respondNotFound(c, err) {
+			return
+		}
+
+		respondError(c, http.StatusInternalServerError, "Failed to fetch available tags")
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    tags,
+	})
+}
+
+// copyMessageTagsHandler gives a message all the tags of another one, e.g. a
+// follow-up the tags of what it follows up on
+func copyMessageTagsHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	messageID := getMessageID(c)
+	if messageID == nil {
+		return
+	}
+	sourceID := getSourceMessageID(c)
+	if sourceID == nil {
+		return
+	}
+
+	tags, err := copyMessageTags(db, *userID, *messageID, *sourceID)
+	if err != nil {
+		requestLogger(c).Error("Database error", "user_id", *userID, "message_id", *messageID, "source_id", *sourceID, "error", err)
+
+		if respondNotFound(c, err) {
+			return
+		}
+
+		respondError(c, http.StatusInternalServerError, "Failed to copy tags")
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    tags,
+	})
+}
+
+// getMessageFileHandler proxies a message's media from Telegram so the bot
+// token never reaches the browser
+func getMessageFileHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	messageID := getMessageID(c)
+	if messageID == nil {
+		return
+	}
+
+	// Grids ask for ?size=thumb to get the small photo size
+	file, err := getMessageFile(db, *userID, *messageID, c.Query("size") == "thumb")
+	if err != nil {
+		requestLogger(c).Error("Database error", "user_id", *userID, "message_id", *messageID, "error", err)
+
+		if respondNotFound(c, err) {
+			return
+		}
+
+		if errors.Is(err, errMessageHasNoFile) {
+			respondError(c, http.StatusNotFound, "Message has no file")
+			return
+		}
+
+		respondError(c, http.StatusInternalServerError, "Failed to fetch file")
+		return
+	}
+
+	data, err := downloadTelegramFile(c.Request.Context(), defaultEnvProvider.GetBotToken(), file.FileID)
+	if err != nil {
+		if errors.Is(err, errFileTooLarge) {
+			respondError(c, http.StatusRequestEntityTooLarge, "File is too large to show here")
+			return
+		}
+
+		requestLogger(c).Error("Telegram file download failed", "user_id", *userID, "message_id", *messageID, "error", err)
+		respondError(c, http.StatusBadGateway, "Failed to download file from Telegram")
+		return
+	}
+
+	serveFile(c, data, file.FileName, file.MimeType)
+}
+
+// TimelineParams are the query parameters of GET /api/user/tags/:tagId/timeline
+type TimelineParams struct {
+	Bucket string
+	From   *time.Time
+	To     *time.Time
+}
+
+// parseTimelineDate accepts RFC 3339 timestamps or plain YYYY-MM-DD dates
+func parseTimelineDate(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		t = t.UTC()
+		return &t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func getTimelineParams(c *gin.Context) *TimelineParams {
+	params := TimelineParams{Bucket: c.DefaultQuery("bucket", "day")}
+	if !timelineBuckets[params.Bucket] {
+		respondError(c, http.StatusBadRequest, "Invalid bucket, expected day, week or month")
+		return nil
+	}
+
+	var err error
+	if params.From, err = parseTimelineDate(c.Query("from")); err != nil {
+		respondError(c, http.StatusBadRequest, "Invalid from date")
+		return nil
+	}
+	if params.To, err = parseTimelineDate(c.Query("to")); err != nil {
+		respondError(c, http.StatusBadRequest, "Invalid to date")
+		return nil
+	}
+	if params.From != nil && params.To != nil && !params.From.Before(*params.To) {
+		respondError(c, http.StatusBadRequest, "from must be before to")
+		return nil
+	}
+	if params.From != nil && params.To != nil && timelineBucketCount(*params.From, *params.To, params.Bucket) > maxTimelineBuckets {
+		respondTimelineTooLong(c)
+		return nil
+	}
+
+	return &params
+}
+
+// respondTimelineTooLong rejects a timeline needing more than maxTimelineBuckets points
+func respondTimelineTooLong(c *gin.Context) {
+	respondError(c, http.StatusBadRequest, fmt.Sprintf("Date range is too long, at most %d buckets; use a shorter range or a larger bucket", maxTimelineBuckets))
+}
+
+func getTagTimelineHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	tagID := getTagID(c)
+	if tagID == nil {
+		return
+	}
+
+	params := getTimelineParams(c)
+	if params == nil {
+		return
+	}
+
+	timeline, err := getTagTimeline(db, *userID, *tagID, params.Bucket, params.From, params.To)
+	if errors.Is(err, errTimelineTooLong) {
+		// Without both from and to, the range is known only once the data is read
+		respondTimelineTooLong(c)
+		return
+	}
+	if err != nil {
+		requestLogger(c).Error("Database error", "user_id", *userID, "tag_id", *tagID, "error", err)
+
+		if respondNotFound(c, err) {
+			return
+		}
+
+		respondError(c, http.StatusInternalServerError, "Failed to fetch tag timeline")
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    timeline,
+	})
+}
+
+// getTagBreakdownHandler returns how many of a tag's messages are photos, links,
+// documents and so on
+func getTagBreakdownHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	tagID := getTagID(c)
+	if tagID == nil {
+		return
+	}
+
+	breakdown, err := getTagBreakdown(db, *userID, *tagID)
+	if err != nil {
+		requestLogger(c).Error("Database error", "user_id", *userID, "tag_id", *tagID, "error", err)
+
+		if respondNotFound(c, err) {
+			return
+		}
+
+		respondError(c, http.StatusInternalServerError, "Failed to fetch tag breakdown")
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    breakdown,
+	})
+}
+
+// maxImportTagLength matches tags.name VARCHAR(100)
+const maxImportTagLength = 100
+
+func importMessagesHandler(c *gin.Context, db *sql.DB) {
+	userID := getUserID(c, defaultEnvProvider, defaultParserFactory)
+	if userID == nil {
+		return
+	}
+
+	tagName := strings.TrimSpace(c.Query("tag"))
+	if utf8.RuneCountInString(tagName) > maxImportTagLength {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("Tag name is too long (max %d characters)", maxImportTagLength))
+		return
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize)
+	result, err := importMessages(db, *userID, body, tagName)
+	if err != nil {
+		requestLogger(c).Error("Import failed", "user_id", *userID, "error", err)
+
+		// Batches before the error are already saved; report them with the error
+		var syntaxErr *json.SyntaxError
+		var maxBytesErr *http.MaxBytesError
+		status, message := http.StatusInternalServerError, "Failed to import messages"
+		switch {
+		case errors.As(err, &maxBytesErr):
+			status, message = http.StatusRequestEntityTooLarge, fmt.Sprintf("Export is too large (max %d MB)", maxImportSize>>20)
+		case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, errNotChatExport):
+			status, message = http.StatusBadRequest, "Invalid export file: "+err.Error()
+		}
+		c.JSON(status, APIResponse{
+			Success:   false,
+			Data:      result,
+			Error:     message,
+			RequestID: requestID(c),
+		})
+		return
+	}
+
+	requestLogger(c).Info("Import finished", "user_id", *userID,
+		"imported", result.Imported, "duplicates", result.Duplicates, "skipped", result.Skipped)
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    result,
+	})
+}
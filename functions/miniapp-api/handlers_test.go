@@ -1,15 +1,24 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	telegramparser "github.com/kd3n1z/go-telegram-parser"
 	"github.com/stretchr/testify/assert"
+
+	"telegram-content-organizer-shared/storage"
 )
 
 type mockEnvProvider struct {
@@ -25,6 +34,7 @@ var testEnvProvider = &mockEnvProvider{token: "test"}
 type mockTelegramParser struct {
 	shouldSucceed bool
 	userID        int64
+	authDate      int64
 }
 
 func (m *mockTelegramParser) Parse(_ string) (telegramparser.WebAppInitData, error) {
@@ -32,7 +42,8 @@ func (m *mockTelegramParser) Parse(_ string) (telegramparser.WebAppInitData, err
 		return telegramparser.WebAppInitData{}, fmt.Errorf("mock validation failed")
 	}
 	return telegramparser.WebAppInitData{
-		User: telegramparser.WebAppUser{Id: m.userID},
+		User:     telegramparser.WebAppUser{Id: m.userID},
+		AuthDate: m.authDate,
 	}, nil
 }
 
@@ -128,6 +139,236 @@ func TestGetUserID_ValidTelegramData(t *testing.T) {
 	assert.NotNil(t, userID)
 }
 
+func TestIsAuthDateRevoked(t *testing.T) {
+	revokedAt := time.Unix(1700000000, 0)
+
+	assert.False(t, isAuthDateRevoked(1600000000, time.Time{}), "Nothing is revoked without a min_auth_date")
+	assert.True(t, isAuthDateRevoked(1699999999, revokedAt), "initData from before the revoke is rejected")
+	assert.False(t, isAuthDateRevoked(1700000000, revokedAt), "initData from the revoke second is accepted")
+	assert.False(t, isAuthDateRevoked(1700000001, revokedAt))
+	assert.True(t, isAuthDateRevoked(1700000000, revokedAt.Add(500*time.Millisecond)), "Sub-second revokes still reject that second's initData")
+}
+
+func TestValidateTelegramWebApp_MinAuthDate(t *testing.T) {
+	revokedAt := time.Unix(1700000000, 0)
+	var lookupErr error
+	original := minAuthDateLookup
+	minAuthDateLookup = func(userID int64) (time.Time, error) {
+		assert.Equal(t, int64(123456789), userID)
+		return revokedAt, lookupErr
+	}
+	defer func() { minAuthDateLookup = original }()
+
+	parser := &mockTelegramParser{shouldSucceed: true, userID: 123456789}
+
+	parser.authDate = revokedAt.Unix() - 1
+	_, err := validateTelegramWebApp("init_data", parser)
+	assert.Error(t, err, "initData signed before /revoke is rejected")
+
+	parser.authDate = revokedAt.Unix()
+	userID, err := validateTelegramWebApp("init_data", parser)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(123456789), userID)
+
+	parser.authDate = revokedAt.Unix() + 60
+	_, err = validateTelegramWebApp("init_data", parser)
+	assert.NoError(t, err)
+
+	lookupErr = errors.New("connection refused")
+	_, err = validateTelegramWebApp("init_data", parser)
+	assert.Error(t, err, "Sessions aren't accepted when revocation can't be checked")
+}
+
+// useMockParser makes the handlers authenticate every request as userID
+func useMockParser(t *testing.T, userID int64) {
+	t.Setenv("TELEGRAM_BOT_TOKEN", "test")
+	original := defaultParserFactory
+	defaultParserFactory = func(botToken string) ParserInterface {
+		return &mockTelegramParser{shouldSucceed: true, userID: userID}
+	}
+	t.Cleanup(func() { defaultParserFactory = original })
+}
+
+func TestDeleteTagHandlerValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := setupRoutes(nil)
+
+	// Without Authorization nothing is deleted
+	req := httptest.NewRequest(http.MethodDelete, "/api/user/tags/1", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	useMockParser(t, 123456789)
+
+	req = httptest.NewRequest(http.MethodDelete, "/api/user/tags/abc", nil)
+	req.Header.Set("Authorization", "Bearer init_data")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Preflight allows DELETE
+	req = httptest.NewRequest(http.MethodOptions, "/api/user/tags/1", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Methods"), "DELETE")
+}
+
+func TestSetTagColorHandlerValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := setupRoutes(nil)
+	useMockParser(t, 123456789)
+
+	// Malformed colors are rejected before the database is touched
+	for _, body := range []string{`{"color": "red"}`, `{"color": "#FFF"}`, `{"color": "#GG0000"}`, `{"color": ""}`, `{}`, `not json`} {
+		req := httptest.NewRequest(http.MethodPut, "/api/user/tags/1/color", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer init_data")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+
+	// Preflight allows PUT
+	req := httptest.NewRequest(http.MethodOptions, "/api/user/tags/1/color", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Methods"), "PUT")
+}
+
+func TestMergeTagsHandlerValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := setupRoutes(nil)
+	useMockParser(t, 123456789)
+
+	// A missing destination or a merge into itself is rejected before the database is touched
+	for _, body := range []string{`{}`, `{"into": 0}`, `{"into": -2}`, `{"into": "2"}`, `{"into": 1}`, `not json`} {
+		req := httptest.NewRequest(http.MethodPost, "/api/user/tags/1/merge", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer init_data")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+
+	// Preflight allows POST
+	req := httptest.NewRequest(http.MethodOptions, "/api/user/tags/1/merge", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Methods"), "POST")
+}
+
+func TestGetPage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		query    string
+		expected *Page
+	}{
+		{"", &Page{Limit: 50, Offset: 0}},
+		{"limit=10&offset=20", &Page{Limit: 10, Offset: 20}},
+		{"limit=200", &Page{Limit: 200, Offset: 0}},
+		{"limit=0", nil},
+		{"limit=201", nil},
+		{"limit=-1", nil},
+		{"offset=-1", nil},
+		{"limit=ten", nil},
+		{"offset=1.5", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/test?"+tt.query, nil)
+
+			page := getPage(c)
+			assert.Equal(t, tt.expected, page)
+			if tt.expected == nil {
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+			}
+		})
+	}
+}
+
+func TestGetTagMessagesHandlerRejectsBadPage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := setupRoutes(nil)
+	useMockParser(t, 123456789)
+
+	for _, query := range []string{"limit=500", "offset=-5"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/user/tags/1/messages?"+query, nil)
+		req.Header.Set("Authorization", "Bearer init_data")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestGetTagMessagesHandlerRejectsUnknownType(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := setupRoutes(nil)
+	useMockParser(t, 123456789)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/user/tags/1/messages?type=gif", nil)
+	req.Header.Set("Authorization", "Bearer init_data")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var response APIResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Contains(t, response.Error, `Unknown message type "gif"`)
+}
+
+func TestGetUserTagsHandlerRejectsUnknownSort(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := setupRoutes(nil)
+	useMockParser(t, 123456789)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/user/tags?sort=color", nil)
+	req.Header.Set("Authorization", "Bearer init_data")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var response APIResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "Invalid sort value, expected count, name or recent", response.Error)
+}
+
+func TestSearchMessagesHandlerValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := setupRoutes(nil)
+	useMockParser(t, 123456789)
+
+	tests := []struct {
+		query string
+		error string
+	}{
+		{"", "Missing search query"},
+		{"q=%20%20", "Missing search query"},
+		{"q=%23", "Missing search query"},
+		{"q=milk&fields=title", "Invalid fields value"},
+		{"q=milk&type=gif", "Unknown message type"},
+		{"q=milk&limit=0", "Invalid limit value"},
+		{"q=" + strings.Repeat("a", maxSearchQueryLength+1), "too long"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/user/messages/search?"+tt.query, nil)
+		req.Header.Set("Authorization", "Bearer init_data")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, tt.query)
+		var response APIResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Contains(t, response.Error, tt.error, tt.query)
+	}
+}
+
 func TestGetTag_ID_NoParam(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
@@ -161,3 +402,464 @@ func TestGetTag_ID_Param(t *testing.T) {
 	assert.Equal(t, randomTag, *tagID)
 	assert.Equal(t, http.StatusOK, w.Code)
 }
+
+func TestGetResetRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name          string
+		body          string
+		expectValid   bool
+		removeAccount bool
+	}{
+		{name: "No body", body: "", expectValid: false},
+		{name: "Invalid JSON", body: "{", expectValid: false},
+		{name: "Missing confirmation", body: `{"remove_account": true}`, expectValid: false},
+		{name: "Wrong confirmation", body: `{"confirm": "delete"}`, expectValid: false},
+		{name: "Valid confirmation", body: `{"confirm": "DELETE"}`, expectValid: true},
+		{name: "Valid confirmation with account removal", body: `{"confirm": "DELETE", "remove_account": true}`, expectValid: true, removeAccount: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			req, _ := http.NewRequest("DELETE", "/api/user", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			c.Request = req
+
+			resetReq := getResetRequest(c)
+
+			if !tt.expectValid {
+				assert.Nil(t, resetReq)
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+				return
+			}
+
+			assert.NotNil(t, resetReq)
+			assert.Equal(t, tt.removeAccount, resetReq.RemoveAccount)
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+	}
+}
+
+func TestGetNoteRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name         string
+		body         string
+		expectValid  bool
+		expectedNote string
+	}{
+		{name: "No body", body: "", expectValid: false},
+		{name: "Invalid JSON", body: "{", expectValid: false},
+		{name: "Note is trimmed", body: `{"note": "  read later  "}`, expectValid: true, expectedNote: "read later"},
+		{name: "Empty note clears", body: `{"note": ""}`, expectValid: true, expectedNote: ""},
+		{name: "Missing note clears", body: `{}`, expectValid: true, expectedNote: ""},
+		{name: "Note at the limit", body: `{"note": "` + strings.Repeat("я", maxUserNoteLength) + `"}`, expectValid: true, expectedNote: strings.Repeat("я", maxUserNoteLength)},
+		{name: "Note too long", body: `{"note": "` + strings.Repeat("a", maxUserNoteLength+1) + `"}`, expectValid: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			req, _ := http.NewRequest("PUT", "/api/user/messages/1/note", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			c.Request = req
+
+			noteReq := getNoteRequest(c)
+
+			if !tt.expectValid {
+				assert.Nil(t, noteReq)
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+				return
+			}
+
+			assert.NotNil(t, noteReq)
+			assert.Equal(t, tt.expectedNote, noteReq.Note)
+		})
+	}
+}
+
+func TestGetTagUpdates(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name        string
+		body        string
+		expectValid bool
+		expected    []TagUpdate
+	}{
+		{name: "No body", body: "", expectValid: false},
+		{name: "Not an array", body: `{"id": 1, "name": "work"}`, expectValid: false},
+		{name: "Empty array", body: `[]`, expectValid: false},
+		{name: "Empty name", body: `[{"id": 1, "name": "  "}]`, expectValid: false},
+		{name: "Name too long", body: `[{"id": 1, "name": "` + strings.Repeat("a", maxTagNameLength+1) + `"}]`, expectValid: false},
+		{name: "Invalid color", body: `[{"id": 1, "color": "red"}]`, expectValid: false},
+		{name: "Duplicate ID", body: `[{"id": 1, "name": "a"}, {"id": 1, "color": "#FFFFFF"}]`, expectValid: false},
+		{name: "Too many updates", body: "[" + strings.Repeat(`{"id": 1},`, maxTagUpdates) + `{"id": 2}]`, expectValid: false},
+		{
+			name:        "Mixed batch",
+			body:        `[{"id": 1, "name": " job "}, {"id": 2, "color": "#4ecdc4"}, {"id": 3, "name": "reading", "color": ""}]`,
+			expectValid: true,
+			expected: []TagUpdate{
+				{ID: 1, Name: stringPtr("job")},
+				{ID: 2, Color: stringPtr("#4ECDC4")},
+				{ID: 3, Name: stringPtr("reading"), Color: stringPtr("")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			req, _ := http.NewRequest("PATCH", "/api/user/tags", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			c.Request = req
+
+			updates := getTagUpdates(c)
+
+			if !tt.expectValid {
+				assert.Nil(t, updates)
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+				return
+			}
+
+			assert.Equal(t, tt.expected, updates)
+		})
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestGetMessageHandlerValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := setupRoutes(nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/user/messages/1", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	useMockParser(t, 123456789)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/user/messages/abc", nil)
+	req.Header.Set("Authorization", "Bearer init_data")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestGetMessageID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Params = gin.Params{{Key: "messageId", Value: "abc"}}
+	assert.Nil(t, getMessageID(c))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Params = gin.Params{{Key: "messageId", Value: "42"}}
+	messageID := getMessageID(c)
+	assert.NotNil(t, messageID)
+	assert.Equal(t, int64(42), *messageID)
+}
+
+func TestGetTimelineParams(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name         string
+		query        string
+		expectValid  bool
+		expectBucket string
+	}{
+		{name: "Defaults to day", query: "", expectValid: true, expectBucket: "day"},
+		{name: "Week bucket", query: "bucket=week", expectValid: true, expectBucket: "week"},
+		{name: "Month bucket with date range", query: "bucket=month&from=2025-01-01&to=2025-06-01", expectValid: true, expectBucket: "month"},
+		{name: "RFC 3339 range", query: "from=2025-01-01T00:00:00Z&to=2025-01-02T00:00:00Z", expectValid: true, expectBucket: "day"},
+		{name: "Invalid bucket", query: "bucket=year", expectValid: false},
+		{name: "Invalid from", query: "from=yesterday", expectValid: false},
+		{name: "Invalid to", query: "to=2025-13-01", expectValid: false},
+		{name: "From after to", query: "from=2025-02-01&to=2025-01-01", expectValid: false},
+		{name: "Too many days", query: "from=2000-01-01&to=2025-01-01", expectValid: false},
+		{name: "Same range in months", query: "bucket=month&from=2000-01-01&to=2025-01-01", expectValid: true, expectBucket: "month"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			req, _ := http.NewRequest("GET", "/test?"+tt.query, nil)
+			c.Request = req
+
+			params := getTimelineParams(c)
+
+			if !tt.expectValid {
+				assert.Nil(t, params)
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+				return
+			}
+
+			assert.NotNil(t, params)
+			assert.Equal(t, tt.expectBucket, params.Bucket)
+		})
+	}
+}
+
+func TestGetMessageFilters(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name        string
+		query       string
+		expectValid bool
+		expected    MessageFilters
+	}{
+		{name: "No filters", query: "", expectValid: true, expected: MessageFilters{}},
+		{name: "URLs only", query: "has_url=true", expectValid: true, expected: MessageFilters{HasURL: true}},
+		{name: "Files only", query: "has_file=true", expectValid: true, expected: MessageFilters{HasFile: true}},
+		{name: "URLs and files", query: "has_url=true&has_file=1", expectValid: true, expected: MessageFilters{HasURL: true, HasFile: true}},
+		{name: "Explicit false", query: "has_url=false&has_file=false", expectValid: true, expected: MessageFilters{}},
+		{name: "Invalid has_url", query: "has_url=yes", expectValid: false},
+		{name: "Invalid has_file", query: "has_file=maybe", expectValid: false},
+		{name: "Unseen only", query: "seen=false", expectValid: true, expected: MessageFilters{Seen: boolPtr(false)}},
+		{name: "Seen, unseen first", query: "seen=true&unseen_first=true", expectValid: true, expected: MessageFilters{Seen: boolPtr(true), UnseenFirst: true}},
+		{name: "Invalid seen", query: "seen=later", expectValid: false},
+		{name: "Invalid unseen_first", query: "unseen_first=please", expectValid: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			req, _ := http.NewRequest("GET", "/test?"+tt.query, nil)
+			c.Request = req
+
+			filters := getMessageFilters(c)
+
+			if !tt.expectValid {
+				assert.Nil(t, filters)
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+				return
+			}
+
+			assert.NotNil(t, filters)
+			assert.Equal(t, tt.expected, *filters)
+		})
+	}
+}
+
+func TestGetTagFilterParams(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name         string
+		query        string
+		expectValid  bool
+		expectTagIDs []int64
+		expectMode   string
+	}{
+		{name: "Defaults to all", query: "tags=1,2,3", expectValid: true, expectTagIDs: []int64{1, 2, 3}, expectMode: "all"},
+		{name: "Any mode", query: "tags=1,2&mode=any", expectValid: true, expectTagIDs: []int64{1, 2}, expectMode: "any"},
+		{name: "Duplicates and spaces", query: "tags=2,%201,2,&mode=all", expectValid: true, expectTagIDs: []int64{2, 1}, expectMode: "all"},
+		{name: "Missing tags", query: "mode=any", expectValid: false},
+		{name: "Invalid tag ID", query: "tags=1,abc", expectValid: false},
+		{name: "Invalid mode", query: "tags=1&mode=none", expectValid: false},
+		{name: "Too many tags", query: "tags=1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20,21", expectValid: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			req, _ := http.NewRequest("GET", "/test?"+tt.query, nil)
+			c.Request = req
+
+			params := getTagFilterParams(c)
+
+			if !tt.expectValid {
+				assert.Nil(t, params)
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+				return
+			}
+
+			assert.NotNil(t, params)
+			assert.Equal(t, tt.expectTagIDs, params.TagIDs)
+			assert.Equal(t, tt.expectMode, params.Mode)
+		})
+	}
+}
+
+func TestSuggestColorRouteDoesNotConflict(t *testing.T) {
+	router := setupRoutes(nil)
+
+	// Without auth both routes stop at authentication, proving they resolve
+	for _, path := range []string{"/api/user/tags/suggest-color", "/api/user/tags/1/messages"} {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, path)
+	}
+}
+
+func TestCorsAllowOrigin(t *testing.T) {
+	tests := []struct {
+		name           string
+		allowedOrigins string
+		origin         string
+		expected       string
+	}{
+		{name: "Unset echoes Yandex Cloud origins", origin: "https://tg-bot-storage-fjod.website.yandexcloud.net", expected: "https://tg-bot-storage-fjod.website.yandexcloud.net"},
+		{name: "Unset allows other origins", origin: "https://example.com", expected: "*"},
+		{name: "Unset without origin", expected: "*"},
+		{name: "Exact match", allowedOrigins: "https://app.example.com, https://admin.example.com", origin: "https://admin.example.com", expected: "https://admin.example.com"},
+		{name: "Exact match ignores case", allowedOrigins: "https://App.Example.com", origin: "https://app.example.com", expected: "https://app.example.com"},
+		{name: "Wildcard match", allowedOrigins: "*.example.com", origin: "https://app.example.com", expected: "https://app.example.com"},
+		{name: "Wildcard match with port", allowedOrigins: "*.example.com:8443", origin: "https://app.example.com:8443", expected: "https://app.example.com:8443"},
+		{name: "Wildcard with scheme", allowedOrigins: "https://*.example.com", origin: "https://app.example.com", expected: "https://app.example.com"},
+		{name: "Wildcard with other scheme", allowedOrigins: "https://*.example.com", origin: "http://app.example.com", expected: ""},
+		{name: "Wildcard doesn't match the bare domain", allowedOrigins: "*.example.com", origin: "https://example.com", expected: ""},
+		{name: "Wildcard doesn't match a lookalike domain", allowedOrigins: "*.example.com", origin: "https://app.example.com.evil.net", expected: ""},
+		{name: "No match", allowedOrigins: "https://app.example.com", origin: "https://evil.net", expected: ""},
+		{name: "No match for Yandex Cloud once configured", allowedOrigins: "https://app.example.com", origin: "https://tg-bot-storage-fjod.website.yandexcloud.net", expected: ""},
+		{name: "No origin once configured", allowedOrigins: "https://app.example.com", expected: ""},
+		{name: "Star allows any origin", allowedOrigins: "*", origin: "https://evil.net", expected: "*"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ALLOWED_ORIGINS", tt.allowedOrigins)
+			assert.Equal(t, tt.expected, corsAllowOrigin(tt.origin))
+		})
+	}
+}
+
+func TestCorsMiddlewareAllowedOrigins(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("ALLOWED_ORIGINS", "*.example.com")
+	router := setupRoutes(nil)
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/api/user/tags", nil)
+		req.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := preflight("https://app.example.com")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = preflight("https://evil.net")
+	assert.Empty(t, w.Header().Values("Access-Control-Allow-Origin"))
+}
+
+func TestClientIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name         string
+		trustedCount string
+		remoteAddr   string
+		xff          string
+		expected     string
+	}{
+		{name: "No header uses the remote address", remoteAddr: "203.0.113.7:443", expected: "203.0.113.7"},
+		{name: "Single hop", remoteAddr: "10.0.0.1:443", xff: "198.51.100.4", expected: "198.51.100.4"},
+		{name: "Chained hops default to the gateway's entry", remoteAddr: "10.0.0.1:443", xff: "1.2.3.4, 198.51.100.4", expected: "198.51.100.4"},
+		{name: "Chained hops with two trusted proxies", trustedCount: "2", remoteAddr: "10.0.0.1:443", xff: "1.2.3.4, 198.51.100.4, 10.0.0.9", expected: "198.51.100.4"},
+		{name: "More trusted proxies than hops uses the remote address", trustedCount: "5", remoteAddr: "10.0.0.1:443", xff: "198.51.100.4, 10.0.0.9", expected: "10.0.0.1"},
+		{name: "Exactly as many hops as trusted proxies", trustedCount: "2", remoteAddr: "10.0.0.1:443", xff: "198.51.100.4, 10.0.0.9", expected: "198.51.100.4"},
+		{name: "Zero trusted proxies ignores the header", trustedCount: "0", remoteAddr: "203.0.113.7:443", xff: "1.2.3.4", expected: "203.0.113.7"},
+		{name: "Invalid count falls back to the default", trustedCount: "abc", remoteAddr: "10.0.0.1:443", xff: "1.2.3.4, 198.51.100.4", expected: "198.51.100.4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TRUSTED_PROXY_COUNT", tt.trustedCount)
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			req, _ := http.NewRequest("GET", "/test", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			c.Request = req
+
+			assert.Equal(t, tt.expected, clientIP(c))
+		})
+	}
+}
+
+func TestRespondNotFound(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name          string
+		err           error
+		expectHandled bool
+		expectedError string
+	}{
+		{name: "Tag", err: &NotFoundError{Resource: ResourceTag, ID: 1}, expectHandled: true, expectedError: "Tag not found or you don't have access to it"},
+		{name: "Message", err: &NotFoundError{Resource: ResourceMessage, ID: 2}, expectHandled: true, expectedError: "Message not found or you don't have access to it"},
+		{name: "Wrapped", err: fmt.Errorf("lookup failed: %w", &NotFoundError{Resource: ResourceTag, ID: 3}), expectHandled: true, expectedError: "Tag not found or you don't have access to it"},
+		{name: "Other errors are left to the caller", err: errors.New("connection refused"), expectHandled: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request, _ = http.NewRequest("GET", "/test", nil)
+
+			assert.Equal(t, tt.expectHandled, respondNotFound(c, tt.err))
+			if !tt.expectHandled {
+				assert.Equal(t, 0, w.Body.Len())
+				return
+			}
+
+			var response APIResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, http.StatusNotFound, w.Code)
+			assert.Equal(t, tt.expectedError, response.Error)
+		})
+	}
+}
+
+// TestRemoveArchivedMedia tests that deleted messages' media is removed from
+// the bot's media directory
+func TestRemoveArchivedMedia(t *testing.T) {
+	dir := t.TempDir()
+	store := storage.DirObjectStore{Root: dir}
+	assert.NoError(t, store.Put("media/123/mine", []byte("photo"), "image/jpeg"))
+	assert.NoError(t, store.Put("media/456/theirs", []byte("photo"), "image/jpeg"))
+
+	t.Setenv("STORE_MEDIA_DIR", dir)
+	removeArchivedMedia(slog.Default(), []string{"media/123/mine", "media/123/missing"})
+
+	_, err := os.Stat(filepath.Join(dir, "media", "123", "mine"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "media", "456", "theirs"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"telegram-content-organizer-shared/storage"
+	"telegram-content-organizer-shared/textcrypt"
+)
+
+// maxImportSize bounds POST /api/user/import bodies
+const maxImportSize = 32 << 20
+
+// importBatchSize is how many messages are inserted per transaction
+const importBatchSize = 500
+
+// importedTextLength matches the previews the bot stores for text and captions
+const importedTextLength = 150
+
+// unknownExportChatID is the source_chat_id of messages from an export without
+// a chat "id". Like every imported message, they never match the bot's own
+// messages, which have source_chat_id 0.
+const unknownExportChatID = -1
+
+// ImportResult counts what happened to the messages of an import
+type ImportResult struct {
+	Imported   int `json:"imported"`
+	Duplicates int `json:"duplicates"`
+	Skipped    int `json:"skipped"`
+}
+
+// exportMessage is the part of a message in a Telegram Desktop chat export
+// (Export chat history → JSON, result.json) that's imported
+type exportMessage struct {
+	ID               int64           `json:"id"`
+	Type             string          `json:"type"`
+	Date             string          `json:"date"`
+	DateUnixtime     string          `json:"date_unixtime"`
+	Text             json.RawMessage `json:"text"`
+	TextEntities     []exportEntity  `json:"text_entities"`
+	Photo            string          `json:"photo"`
+	File             string          `json:"file"`
+	FileName         string          `json:"file_name"`
+	MediaType        string          `json:"media_type"`
+	MimeType         string          `json:"mime_type"`
+	DurationSeconds  int             `json:"duration_seconds"`
+	ForwardedFrom    string          `json:"forwarded_from"`
+	ReplyToMessageID int64           `json:"reply_to_message_id"`
+}
+
+// exportEntity is a formatted part of an exported message's text
+type exportEntity struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+	Href string `json:"href"`
+}
+
+// importedMessage is an export message mapped onto the messages table
+type importedMessage struct {
+	SourceChatID      int64
+	TelegramMessageID int64
+	MessageType       string
+	Text              string
+	Caption           string
+	FileName          string
+	MimeType          string
+	Duration          int
+	CreatedAt         time.Time
+	ForwardedFrom     string
+	ReplyToMessageID  int64
+	URLs              []string
+	Hashtags          []string
+	Mentions          []string
+}
+
+// exportMediaTypes maps export media_type values to message types
+var exportMediaTypes = map[string]string{
+	"video_file":    "video",
+	"video_message": "video_note",
+	"voice_message": "voice",
+	"audio_file":    "audio",
+	"sticker":       "sticker",
+	"animation":     "animation",
+}
+
+// parseExportText flattens an export "text" field, which is either a string or
+// a list of strings and entity objects, and returns the entities it contains
+func parseExportText(raw json.RawMessage) (string, []exportEntity, error) {
+	if len(raw) == 0 {
+		return "", nil, nil
+	}
+
+	var plain string
+	if err := json.Unmarshal(raw, &plain); err == nil {
+		return plain, nil, nil
+	}
+
+	var parts []json.RawMessage
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", nil, fmt.Errorf("invalid text: %v", err)
+	}
+
+	var b strings.Builder
+	var entities []exportEntity
+	for _, part := range parts {
+		if err := json.Unmarshal(part, &plain); err == nil {
+			b.WriteString(plain)
+			continue
+		}
+		var entity exportEntity
+		if err := json.Unmarshal(part, &entity); err != nil {
+			return "", nil, fmt.Errorf("invalid text part: %v", err)
+		}
+		b.WriteString(entity.Text)
+		entities = append(entities, entity)
+	}
+	return b.String(), entities, nil
+}
+
+// parseExportDate reads the message date, preferring the unambiguous date_unixtime
+// that newer exports include over the local-time date
+func parseExportDate(m exportMessage) (time.Time, error) {
+	if m.DateUnixtime != "" {
+		seconds, err := strconv.ParseInt(m.DateUnixtime, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid date_unixtime %q", m.DateUnixtime)
+		}
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	date, err := time.Parse("2006-01-02T15:04:05", m.Date)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q", m.Date)
+	}
+	return date, nil
+}
+
+// normalizeExportMessage validates an export message and maps it onto the
+// messages table. Service messages (joins, pins, calls) are rejected.
+func normalizeExportMessage(m exportMessage) (*importedMessage, error) {
+	if m.Type != "message" {
+		return nil, fmt.Errorf("message %d: not a regular message (%q)", m.ID, m.Type)
+	}
+	if m.ID <= 0 {
+		return nil, fmt.Errorf("invalid message id %d", m.ID)
+	}
+
+	createdAt, err := parseExportDate(m)
+	if err != nil {
+		return nil, fmt.Errorf("message %d: %v", m.ID, err)
+	}
+
+	text, entities, err := parseExportText(m.Text)
+	if err != nil {
+		return nil, fmt.Errorf("message %d: %v", m.ID, err)
+	}
+	if m.TextEntities != nil {
+		entities = m.TextEntities
+	}
+
+	msg := &importedMessage{
+		TelegramMessageID: m.ID,
+		FileName:          m.FileName,
+		MimeType:          m.MimeType,
+		Duration:          m.DurationSeconds,
+		CreatedAt:         createdAt,
+		ForwardedFrom:     m.ForwardedFrom,
+		ReplyToMessageID:  m.ReplyToMessageID,
+	}
+
+	switch {
+	case m.Photo != "":
+		msg.MessageType = "photo"
+	case m.MediaType != "":
+		msg.MessageType = exportMediaTypes[m.MediaType]
+		if msg.MessageType == "" {
+			msg.MessageType = "document"
+		}
+	case m.File != "":
+		msg.MessageType = "document"
+	case text != "":
+		msg.MessageType = "text"
+	default:
+		// Polls, contacts, locations and the like
+		msg.MessageType = "unknown"
+	}
+
+	// Exports keep media captions in "text"
+	if msg.MessageType == "text" {
+		msg.Text = text
+	} else {
+		msg.Caption = text
+	}
+
+	for _, entity := range entities {
+		switch entity.Type {
+		case "link":
+			msg.URLs = append(msg.URLs, entity.Text)
+		case "text_link":
+			msg.URLs = append(msg.URLs, entity.Href)
+		case "hashtag":
+			msg.Hashtags = append(msg.Hashtags, strings.TrimPrefix(entity.Text, "#"))
+		case "mention":
+			msg.Mentions = append(msg.Mentions, strings.TrimPrefix(entity.Text, "@"))
+		}
+	}
+
+	return msg, nil
+}
+
+var errNotChatExport = errors.New(`no "messages" array found; upload the result.json of a chat export`)
+
+// readExportMessages streams the "messages" array of a chat export, calling fn
+// for each element so large exports are never held in memory at once, along
+// with the export's chat "id" (Telegram Desktop writes it before the messages)
+// or unknownExportChatID. Elements with fields of the wrong type are passed to
+// fn with their error; a syntax error aborts the whole read.
+func readExportMessages(r io.Reader, fn func(chatID int64, m exportMessage, err error) error) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+
+	found := false
+	chatID := int64(unknownExportChatID)
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := token.(string)
+		if key == "id" {
+			// A chat ID of the wrong type is ignored rather than failing the import
+			var id int64
+			if err := dec.Decode(&id); err == nil && id > 0 {
+				chatID = id
+			}
+			continue
+		}
+		if key != "messages" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+
+		found = true
+		if err := expectDelim(dec, '['); err != nil {
+			return err
+		}
+		for dec.More() {
+			var m exportMessage
+			err := dec.Decode(&m)
+			var typeErr *json.UnmarshalTypeError
+			if err != nil && !errors.As(err, &typeErr) {
+				return err
+			}
+			if err := fn(chatID, m, err); err != nil {
+				return err
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return err
+		}
+	}
+
+	if !found {
+		return errNotChatExport
+	}
+	return expectDelim(dec, '}')
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return errNotChatExport
+	}
+	return nil
+}
+
+// importMessages reads a chat export and saves its messages for the user in
+// batches of importBatchSize per transaction. Messages the user already
+// imported from the same chat are counted as duplicates; invalid ones are
+// skipped. Message IDs are numbered per chat, so they're keyed by the export's
+// chat ID and never collide with messages the bot saved.
+// When tagName is set, every imported message gets that tag.
+func importMessages(db *sql.DB, userID int64, r io.Reader, tagName string) (*ImportResult, error) {
+	// Users who never messaged the bot have no row yet
+	if _, err := db.Exec(`INSERT INTO users (telegram_id) VALUES ($1) ON CONFLICT (telegram_id) DO NOTHING`, userID); err != nil {
+		return nil, fmt.Errorf("failed to create user: %v", err)
+	}
+
+	var tagID sql.NullInt64
+	if tagName != "" {
+		id, _, err := storage.GetOrCreateTag(db, userID, tagName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create tag: %v", err)
+		}
+		tagID = sql.NullInt64{Int64: id, Valid: true}
+	}
+
+	result := &ImportResult{}
+	var batch []*importedMessage
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := insertImportBatch(db, userID, batch, tagID, result)
+		batch = batch[:0]
+		return err
+	}
+
+	err := readExportMessages(r, func(chatID int64, m exportMessage, decodeErr error) error {
+		if decodeErr != nil {
+			result.Skipped++
+			return nil
+		}
+		msg, err := normalizeExportMessage(m)
+		if err != nil {
+			result.Skipped++
+			return nil
+		}
+		msg.SourceChatID = chatID
+		batch = append(batch, msg)
+		if len(batch) == importBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	return result, flush()
+}
+
+// insertImportBatch saves a batch of messages in one transaction
+func insertImportBatch(db *sql.DB, userID int64, batch []*importedMessage, tagID sql.NullInt64, result *ImportResult) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insertMessage, err := tx.Prepare(`
+		INSERT INTO messages (
+			user_id, telegram_message_id, message_type, text_content, caption, full_text, text_truncated,
+			file_name, mime_type, duration, forwarded_from, reply_to_message_id,
+			urls, hashtags, mentions, created_at, source_chat_id
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+		ON CONFLICT (user_id, source_chat_id, telegram_message_id) DO NOTHING
+		RETURNING id`)
+	if err != nil {
+		return err
+	}
+	defer insertMessage.Close()
+
+	maxStoredText := storage.MaxStoredText()
+	imported, duplicates := 0, 0
+	for _, msg := range batch {
+		text, err := textcrypt.Encode(previewText(msg.Text))
+		if err != nil {
+			return fmt.Errorf("failed to encode text: %v", err)
+		}
+		caption, err := textcrypt.Encode(previewText(msg.Caption))
+		if err != nil {
+			return fmt.Errorf("failed to encode caption: %v", err)
+		}
+		// Keep the whole text or caption too, up to MAX_STORED_TEXT, like the bot
+		var fullText sql.NullString
+		var truncated bool
+		if whole := msg.Text + msg.Caption; whole != "" {
+			fullText.String, truncated = storage.LimitStoredText(whole, maxStoredText)
+			fullText.Valid = true
+		}
+		if fullText, err = textcrypt.Encode(fullText); err != nil {
+			return fmt.Errorf("failed to encode full text: %v", err)
+		}
+		urls, err := textcrypt.EncodeList(emptyIfNil(msg.URLs))
+		if err != nil {
+			return fmt.Errorf("failed to encode urls: %v", err)
+		}
+		hashtags, err := textcrypt.EncodeList(emptyIfNil(msg.Hashtags))
+		if err != nil {
+			return fmt.Errorf("failed to encode hashtags: %v", err)
+		}
+		mentions, err := textcrypt.EncodeList(emptyIfNil(msg.Mentions))
+		if err != nil {
+			return fmt.Errorf("failed to encode mentions: %v", err)
+		}
+
+		var messageID int64
+		err = insertMessage.QueryRow(userID, msg.TelegramMessageID, msg.MessageType, text, caption, fullText, truncated,
+			nullString(msg.FileName), nullString(msg.MimeType), sql.NullInt64{Int64: int64(msg.Duration), Valid: msg.Duration > 0},
+			nullString(msg.ForwardedFrom), sql.NullInt64{Int64: msg.ReplyToMessageID, Valid: msg.ReplyToMessageID > 0},
+			pq.Array(urls), pq.Array(hashtags), pq.Array(mentions),
+			msg.CreatedAt, msg.SourceChatID).Scan(&messageID)
+		if err == sql.ErrNoRows {
+			duplicates++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to insert message %d: %v", msg.TelegramMessageID, err)
+		}
+		imported++
+
+		if tagID.Valid {
+			_, err := tx.Exec(`INSERT INTO message_tags (message_id, tag_id) VALUES ($1, $2) ON CONFLICT (message_id, tag_id) DO NOTHING`,
+				messageID, tagID.Int64)
+			if err != nil {
+				return fmt.Errorf("failed to tag message %d: %v", msg.TelegramMessageID, err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	result.Imported += imported
+	result.Duplicates += duplicates
+	return nil
+}
+
+// previewText shortens text like the bot's stored previews
+func previewText(text string) sql.NullString {
+	if text == "" {
+		return sql.NullString{}
+	}
+	if runes := []rune(text); len(runes) > importedTextLength {
+		text = string(runes[:importedTextLength]) + "..."
+	}
+	return sql.NullString{String: text, Valid: true}
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func emptyIfNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"telegram-content-organizer-shared/storage"
+)
+
+// sampleExport is a trimmed Telegram Desktop chat export
+const sampleExport = `{
+ "name": "Saved Messages",
+ "type": "saved_messages",
+ "id": 123456,
+ "messages": [
+  {
+   "id": 1,
+   "type": "service",
+   "date": "2024-03-01T09:00:00",
+   "date_unixtime": "1709283600",
+   "action": "pin_message",
+   "text": ""
+  },
+  {
+   "id": 2,
+   "type": "message",
+   "date": "2024-03-01T10:00:00",
+   "date_unixtime": "1709287200",
+   "from": "Ada",
+   "text": "Buy milk",
+   "text_entities": [{"type": "plain", "text": "Buy milk"}]
+  },
+  {
+   "id": 3,
+   "type": "message",
+   "date": "2024-03-02T11:30:00",
+   "date_unixtime": "1709379000",
+   "forwarded_from": "Go News",
+   "text": ["Read ", {"type": "link", "text": "https://go.dev/blog"}, " ", {"type": "hashtag", "text": "#golang"}, " via ", {"type": "mention", "text": "@gopher"}],
+   "text_entities": [
+    {"type": "plain", "text": "Read "},
+    {"type": "link", "text": "https://go.dev/blog"},
+    {"type": "plain", "text": " "},
+    {"type": "hashtag", "text": "#golang"},
+    {"type": "plain", "text": " via "},
+    {"type": "mention", "text": "@gopher"}
+   ]
+  },
+  {
+   "id": 4,
+   "type": "message",
+   "date": "2024-03-03T08:15:00",
+   "photo": "photos/photo_1@03-03-2024_08-15-00.jpg",
+   "width": 1280,
+   "height": 960,
+   "text": ["Sunset ", {"type": "text_link", "text": "here", "href": "https://example.com/map"}]
+  },
+  {
+   "id": 5,
+   "type": "message",
+   "date": "2024-03-04T20:00:00",
+   "date_unixtime": "1709582400",
+   "file": "video_files/clip.mp4",
+   "file_name": "clip.mp4",
+   "media_type": "video_file",
+   "mime_type": "video/mp4",
+   "duration_seconds": 42,
+   "text": ""
+  },
+  {
+   "id": 6,
+   "type": "message",
+   "date": "yesterday",
+   "text": "Broken date"
+  },
+  {
+   "id": "seven",
+   "type": "message",
+   "date": "2024-03-05T08:00:00",
+   "text": "Broken id"
+  },
+  {
+   "id": 8,
+   "type": "message",
+   "date": "2024-03-05T09:00:00",
+   "date_unixtime": "1709629200",
+   "poll": {"question": "Lunch?"},
+   "text": ""
+  }
+ ]
+}`
+
+func readSampleExport(t *testing.T, export string) ([]*importedMessage, int) {
+	var messages []*importedMessage
+	skipped := 0
+	err := readExportMessages(strings.NewReader(export), func(chatID int64, m exportMessage, decodeErr error) error {
+		if decodeErr != nil {
+			skipped++
+			return nil
+		}
+		msg, err := normalizeExportMessage(m)
+		if err != nil {
+			skipped++
+			return nil
+		}
+		msg.SourceChatID = chatID
+		messages = append(messages, msg)
+		return nil
+	})
+	assert.NoError(t, err)
+	return messages, skipped
+}
+
+func TestReadExportMessages(t *testing.T) {
+	messages, skipped := readSampleExport(t, sampleExport)
+
+	// The service message, the broken date and the broken id are skipped
+	assert.Equal(t, 3, skipped)
+	if !assert.Len(t, messages, 5) {
+		return
+	}
+
+	text := messages[0]
+	assert.Equal(t, int64(2), text.TelegramMessageID)
+	assert.Equal(t, int64(123456), text.SourceChatID, "Messages are keyed by the export's chat")
+	assert.Equal(t, "text", text.MessageType)
+	assert.Equal(t, "Buy milk", text.Text)
+	assert.Equal(t, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), text.CreatedAt)
+
+	link := messages[1]
+	assert.Equal(t, "Read https://go.dev/blog #golang via @gopher", link.Text)
+	assert.Equal(t, []string{"https://go.dev/blog"}, link.URLs)
+	assert.Equal(t, []string{"golang"}, link.Hashtags)
+	assert.Equal(t, []string{"gopher"}, link.Mentions)
+	assert.Equal(t, "Go News", link.ForwardedFrom)
+
+	photo := messages[2]
+	assert.Equal(t, "photo", photo.MessageType)
+	assert.Equal(t, "", photo.Text)
+	assert.Equal(t, "Sunset here", photo.Caption, "Media captions come from the text field")
+	assert.Equal(t, []string{"https://example.com/map"}, photo.URLs)
+	assert.Equal(t, time.Date(2024, 3, 3, 8, 15, 0, 0, time.UTC), photo.CreatedAt, "Falls back to date without date_unixtime")
+
+	video := messages[3]
+	assert.Equal(t, "video", video.MessageType)
+	assert.Equal(t, "clip.mp4", video.FileName)
+	assert.Equal(t, "video/mp4", video.MimeType)
+	assert.Equal(t, 42, video.Duration)
+
+	assert.Equal(t, "unknown", messages[4].MessageType)
+}
+
+func TestReadExportMessagesInvalid(t *testing.T) {
+	noop := func(int64, exportMessage, error) error { return nil }
+
+	err := readExportMessages(strings.NewReader(`{"name": "chat", "type": "personal_chat"}`), noop)
+	assert.ErrorIs(t, err, errNotChatExport)
+
+	err = readExportMessages(strings.NewReader(`[1, 2, 3]`), noop)
+	assert.ErrorIs(t, err, errNotChatExport)
+
+	err = readExportMessages(strings.NewReader(`{"messages": [{"id": 1,}]}`), noop)
+	var syntaxErr *json.SyntaxError
+	assert.True(t, errors.As(err, &syntaxErr), "Syntax errors abort the import, got %v", err)
+
+	var chatID int64
+	err = readExportMessages(strings.NewReader(`{"messages": [{"id": 1, "type": "message"}]}`), func(id int64, m exportMessage, err error) error {
+		chatID = id
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(unknownExportChatID), chatID, "Exports without a chat id are still kept apart from the bot's messages")
+}
+
+func TestPreviewText(t *testing.T) {
+	assert.False(t, previewText("").Valid)
+	assert.Equal(t, "short", previewText("short").String)
+
+	long := strings.Repeat("я", importedTextLength+10)
+	preview := previewText(long).String
+	assert.Equal(t, strings.Repeat("я", importedTextLength)+"...", preview, "Long text is cut on a rune boundary")
+}
+
+func TestImportMessages(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID := int64(999992)
+	storage.DeleteUserData(testDB, userID, true)
+	defer storage.DeleteUserData(testDB, userID, true)
+
+	result, err := importMessages(testDB, userID, strings.NewReader(sampleExport), "imported")
+	assert.NoError(t, err)
+	assert.Equal(t, ImportResult{Imported: 5, Duplicates: 0, Skipped: 3}, *result)
+
+	tags, err := getUserTagsWithCounts(testDB, userID, TagSortCount)
+	assert.NoError(t, err)
+	if assert.Len(t, tags, 1) {
+		assert.Equal(t, "imported", tags[0].Name)
+		assert.Equal(t, 5, tags[0].MessageCount)
+	}
+
+	// Importing the same export again only finds duplicates
+	result, err = importMessages(testDB, userID, strings.NewReader(sampleExport), "")
+	assert.NoError(t, err)
+	assert.Equal(t, ImportResult{Imported: 0, Duplicates: 5, Skipped: 3}, *result)
+}
+
+// TestImportMessagesKeepsBotMessages tests that exported message IDs, numbered
+// per chat, don't collide with the messages the bot saved
+func TestImportMessagesKeepsBotMessages(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID := int64(999965)
+	storage.DeleteUserData(testDB, userID, true)
+	defer storage.DeleteUserData(testDB, userID, true)
+
+	_, err = testDB.Exec(`INSERT INTO users (telegram_id) VALUES ($1)`, userID)
+	assert.NoError(t, err)
+	// The bot saved its own message 2, as sampleExport has a message 2
+	_, err = testDB.Exec(`INSERT INTO messages (user_id, telegram_message_id, message_type, text_content) VALUES ($1, 2, 'text', 'from the bot')`, userID)
+	assert.NoError(t, err)
+
+	result, err := importMessages(testDB, userID, strings.NewReader(sampleExport), "")
+	assert.NoError(t, err)
+	assert.Equal(t, ImportResult{Imported: 5, Duplicates: 0, Skipped: 3}, *result)
+
+	var count int
+	assert.NoError(t, testDB.QueryRow(`SELECT COUNT(*) FROM messages WHERE user_id = $1 AND telegram_message_id = 2`, userID).Scan(&count))
+	assert.Equal(t, 2, count)
+}
+
+// TestImportMessagesFullText tests that imported text longer than the previews
+// is kept whole in full_text, up to MAX_STORED_TEXT
+func TestImportMessagesFullText(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID := int64(999961)
+	storage.DeleteUserData(testDB, userID, true)
+	defer storage.DeleteUserData(testDB, userID, true)
+
+	long := strings.Repeat("long text ", 30)
+	export := func(id int, text string) string {
+		encoded, _ := json.Marshal(text)
+		return `{"id": 42, "messages": [{"id": ` + strconv.Itoa(id) + `, "type": "message", "date_unixtime": "1709287200", "text": ` + string(encoded) + `}]}`
+	}
+	detail := func(telegramMessageID int) *MessageDetail {
+		var messageID int64
+		err := testDB.QueryRow(`SELECT id FROM messages WHERE user_id = $1 AND telegram_message_id = $2`, userID, telegramMessageID).Scan(&messageID)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		message, err := getMessage(testDB, userID, messageID)
+		assert.NoError(t, err)
+		return message
+	}
+
+	result, err := importMessages(testDB, userID, strings.NewReader(export(1, long)), "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Imported)
+	if message := detail(1); message != nil && assert.NotNil(t, message.FullText) {
+		assert.Equal(t, long, *message.FullText)
+		assert.False(t, message.TextTruncated)
+		assert.Less(t, len(*message.TextContent), len(long))
+	}
+
+	t.Setenv("MAX_STORED_TEXT", "200")
+	_, err = importMessages(testDB, userID, strings.NewReader(export(2, long)), "")
+	assert.NoError(t, err)
+	if message := detail(2); message != nil && assert.NotNil(t, message.FullText) {
+		assert.Equal(t, long[:200], *message.FullText)
+		assert.True(t, message.TextTruncated)
+	}
+}
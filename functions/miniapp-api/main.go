@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -27,36 +34,93 @@ func getBotToken() string {
 	return os.Getenv("TELEGRAM_BOT_TOKEN")
 }
 
-func containsPattern(origin, pattern string) bool {
-	return strings.Contains(origin, pattern)
+// isPingRequest reports whether the request is a warmer ping. Pings are
+// answered before any logging or database work so they stay cheap.
+func isPingRequest(request events.APIGatewayProxyRequest) bool {
+	if request.HTTPMethod != http.MethodGet {
+		return false
+	}
+	for _, path := range []string{
+		request.Headers["X-Envoy-Original-Path"],
+		request.Headers["x-envoy-original-path"],
+		request.Path,
+		request.Resource,
+	} {
+		if path != "" {
+			return strings.TrimSuffix(path, "/") == "/api/ping"
+		}
+	}
+	return false
+}
+
+func pingResponse(origin, requestID string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "pong",
+		Headers:    responseHeaders("text/plain", origin, requestID),
+	}
+}
+
+// requestOrigin returns the request's Origin header, whichever case it came in
+func requestOrigin(request events.APIGatewayProxyRequest) string {
+	if origin := request.Headers["origin"]; origin != "" {
+		return origin
+	}
+	return request.Headers["Origin"]
+}
+
+// responseHeaders are the headers of responses built outside the Gin router,
+// with CORS decided by corsAllowOrigin like everywhere else
+func responseHeaders(contentType, origin, requestID string) map[string]string {
+	headers := map[string]string{
+		"Content-Type": contentType,
+	}
+	if allowOrigin := corsAllowOrigin(origin); allowOrigin != "" {
+		headers["Access-Control-Allow-Origin"] = allowOrigin
+	}
+	if requestID != "" {
+		headers[requestIDHeader] = requestID
+	}
+	return headers
+}
+
+// errorResponse builds an APIResponse error for failures outside the Gin router
+func errorResponse(statusCode int, message, origin, requestID string) events.APIGatewayProxyResponse {
+	body, _ := json.Marshal(APIResponse{Success: false, Error: message, RequestID: requestID})
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       string(body),
+		Headers:    responseHeaders("application/json", origin, requestID),
+	}
 }
 
 func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	// Log incoming request details
-	log.Printf("=== LAMBDA REQUEST RECEIVED ===")
-	log.Printf("HTTP Method: %s", request.HTTPMethod)
-	log.Printf("Path: %s", request.Path)
-	log.Printf("Resource: %s", request.Resource)
-	log.Printf("Stage: %s", request.RequestContext.Stage)
-	log.Printf("Headers: %+v", request.Headers)
-	log.Printf("Query Params: %+v", request.QueryStringParameters)
-	log.Printf("Body: %s", request.Body)
-	log.Printf("==============================")
+	// The API Gateway request ID correlates user reports with logs
+	requestID := request.RequestContext.RequestID
+	origin := requestOrigin(request)
+
+	// Lambda warmers hit /api/ping; answer without logging or touching the DB
+	if isPingRequest(request) {
+		return pingResponse(origin, requestID), nil
+	}
+
+	logger := slog.Default().With("request_id", requestID)
+
+	// Headers, query strings and bodies stay out of the logs: they carry the
+	// initData credentials, search text, notes and whole chat imports
+	logger.Info("Request received",
+		"method", request.HTTPMethod,
+		"path", request.Path,
+		"resource", request.Resource,
+		"stage", request.RequestContext.Stage)
 
 	// Initialize database connection if not already done
 	if db == nil {
 		var err error
 		db, err = initDB()
 		if err != nil {
-			log.Printf("Failed to connect to database: %v", err)
-			return events.APIGatewayProxyResponse{
-				StatusCode: 500,
-				Body:       `{"success": false, "error": "Database connection failed"}`,
-				Headers: map[string]string{
-					"Content-Type":                "application/json",
-					"Access-Control-Allow-Origin": "*",
-				},
-			}, nil
+			logger.Error("Failed to connect to database", "error", err)
+			return errorResponse(500, "Database connection failed", origin, requestID), nil
 		}
 	}
 
@@ -66,15 +130,11 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 	// Convert Lambda request to HTTP request
 	req, err := convertLambdaRequest(request)
 	if err != nil {
-		log.Printf("Failed to convert Lambda request : %v", err)
-		return events.APIGatewayProxyResponse{
-			StatusCode: 400,
-			Body:       `{"success": false, "error": " Invalid request format"}`,
-			Headers: map[string]string{
-				"Content-Type":                "application/json",
-				"Access-Control-Allow-Origin": "*",
-			},
-		}, nil
+		logger.Error("Failed to convert Lambda request", "error", err)
+		return errorResponse(400, "Invalid request format", origin, requestID), nil
+	}
+	if requestID != "" {
+		req = withRequestID(req, requestID)
 	}
 
 	// Create response recorder
@@ -95,32 +155,36 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 		recorder.headers = make(map[string]string)
 	}
 
-	// Set CORS headers to allow both domain patterns
-	origin := request.Headers["origin"]
-	if origin == "" {
-		origin = request.Headers["Origin"]
+	// Keep headers set by handlers, e.g. Content-Type and Content-Range from the
+	// file proxy; the CORS headers below take precedence
+	for key := range recorder.header {
+		recorder.headers[key] = recorder.header.Get(key)
 	}
 
-	// Allow both yandexcloud.net and website.yandexcloud.net domains
-	if origin != "" && (containsPattern(origin, "yandexcloud.net") ||
-		containsPattern(origin, "website.yandexcloud.net")) {
-		recorder.headers["Access-Control-Allow-Origin"] = origin
+	// Set CORS headers for the request's origin, like corsMiddleware
+	if allowOrigin := corsAllowOrigin(origin); allowOrigin != "" {
+		recorder.headers["Access-Control-Allow-Origin"] = allowOrigin
 	} else {
-		recorder.headers["Access-Control-Allow-Origin"] = "*"
+		delete(recorder.headers, "Access-Control-Allow-Origin")
 	}
 
-	recorder.headers["Access-Control-Allow-Methods"] = "GET, POST, PUT, DELETE, OPTIONS"
+	recorder.headers["Access-Control-Allow-Methods"] = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
 	recorder.headers["Access-Control-Allow-Headers"] = "Origin, Content-Type, Authorization"
 	recorder.headers["Access-Control-Allow-Credentials"] = "false"
+	recorder.headers["Access-Control-Expose-Headers"] = exposedHeaders
+	if requestID != "" {
+		recorder.headers[requestIDHeader] = requestID
+	}
 
-	log.Printf("Returning response - Status: %d, Body length: %d, Headers: %+v",
-		recorder.statusCode, len(recorder.body), recorder.headers)
+	logger.Info("Returning response", "status", recorder.statusCode, "body_length", len(recorder.body))
 
 	// Convert to Lambda response
+	body, isBase64 := recorder.lambdaBody()
 	return events.APIGatewayProxyResponse{
-		StatusCode: recorder.statusCode,
-		Body:       recorder.body,
-		Headers:    recorder.headers,
+		StatusCode:      recorder.statusCode,
+		Body:            body,
+		Headers:         recorder.headers,
+		IsBase64Encoded: isBase64,
 	}, nil
 }
 
@@ -147,18 +211,40 @@ func convertLambdaRequest(request events.APIGatewayProxyRequest) (*http.Request,
 		}
 	}
 
-	// Create HTTP request from Lambda request
-	req, err := http.NewRequest(request.HTTPMethod, path, nil)
+	// Create HTTP request from Lambda request. API Gateway base64-encodes
+	// bodies it treats as binary.
+	var body io.Reader
+	if request.Body != "" {
+		if request.IsBase64Encoded {
+			decoded, err := base64.StdEncoding.DecodeString(request.Body)
+			if err != nil {
+				log.Printf("Failed to decode base64 request body: %v", err)
+				return nil, fmt.Errorf("invalid base64 body: %v", err)
+			}
+			body = bytes.NewReader(decoded)
+		} else {
+			body = strings.NewReader(request.Body)
+		}
+	}
+	req, err := http.NewRequest(request.HTTPMethod, path, body)
 	if err != nil {
 		log.Printf("Failed to create HTTP request: %v", err)
 		return nil, err
 	}
+	if sourceIP := request.RequestContext.Identity.SourceIP; sourceIP != "" {
+		req.RemoteAddr = net.JoinHostPort(sourceIP, "0")
+	}
 
 	// Add headers
 	for key, value := range request.Headers {
 		req.Header.Set(key, value)
 	}
 
+	// The gateway's Content-Length describes the encoded body, not the decoded one
+	if body != nil {
+		req.Header.Set("Content-Length", strconv.FormatInt(req.ContentLength, 10))
+	}
+
 	log.Printf("Added %d headers to request", len(request.Headers))
 
 	// Add query parameters
@@ -168,27 +254,26 @@ func convertLambdaRequest(request events.APIGatewayProxyRequest) (*http.Request,
 	}
 	req.URL.RawQuery = q.Encode()
 
-	log.Printf("Final request URL: %s", req.URL.String())
-
 	return req, nil
 }
 
 type ResponseRecorder struct {
 	statusCode int
-	body       string
+	body       []byte
+	header     http.Header
 	headers    map[string]string
 }
 
 func (r *ResponseRecorder) Header() http.Header {
-	h := make(http.Header)
-	for key, value := range r.headers {
-		h.Set(key, value)
+	if r.header == nil {
+		r.header = make(http.Header)
 	}
-	return h
+	return r.header
 }
 
 func (r *ResponseRecorder) Write(data []byte) (int, error) {
-	r.body = string(data)
+	// Streamed responses such as proxied files arrive in several writes
+	r.body = append(r.body, data...)
 	return len(data), nil
 }
 
@@ -196,6 +281,26 @@ func (r *ResponseRecorder) WriteHeader(statusCode int) {
 	r.statusCode = statusCode
 }
 
+// lambdaBody returns the body for the Lambda response. API Gateway only passes
+// text through, so binary content such as proxied media is base64 encoded.
+func (r *ResponseRecorder) lambdaBody() (string, bool) {
+	if isTextContentType(r.headers["Content-Type"]) {
+		return string(r.body), false
+	}
+	return base64.StdEncoding.EncodeToString(r.body), true
+}
+
+// isTextContentType reports whether a response with this Content-Type can be
+// returned as-is. An empty type is treated as text, as before the file proxy.
+func isTextContentType(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	return mediaType == "" ||
+		strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "json") ||
+		strings.HasSuffix(mediaType, "xml") ||
+		mediaType == "application/javascript"
+}
+
 func main() {
 	lambda.Start(Handler)
 }
@@ -1,13 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-lambda-go/events"
 	_ "github.com/lib/pq"
+
+	"telegram-content-organizer-shared/storage"
+	"telegram-content-organizer-shared/textcrypt"
 )
 
 func TestGetUserTagsHandler(t *testing.T) {
@@ -70,7 +85,7 @@ func TestGetUserTagsHandler(t *testing.T) {
 
 		expectedHeaders := map[string]string{
 			"Access-Control-Allow-Origin":  "*",
-			"Access-Control-Allow-Methods": "GET, POST, PUT, DELETE, OPTIONS",
+			"Access-Control-Allow-Methods": "GET, POST, PUT, PATCH, DELETE, OPTIONS",
 			"Access-Control-Allow-Headers": "Origin, Content-Type, Authorization",
 		}
 
@@ -95,7 +110,7 @@ func TestGetUserTagsWithCounts(t *testing.T) {
 	defer testDB.Close()
 
 	// Test with non-existent user (should return empty slice, not error)
-	tags, err := getUserTagsWithCounts(testDB, 999999)
+	tags, err := getUserTagsWithCounts(testDB, 999999, TagSortCount)
 	if err != nil {
 		t.Errorf("Expected no error for non-existent user, got: %v", err)
 	}
@@ -104,3 +119,1960 @@ func TestGetUserTagsWithCounts(t *testing.T) {
 		t.Errorf("Expected empty tags for non-existent user, got %d tags", len(tags))
 	}
 }
+
+func TestExportUserData(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	// Test with non-existent user (should return an empty export, not error)
+	export, err := storage.ExportUserData(testDB, 999999)
+	if err != nil {
+		t.Fatalf("Expected no error for non-existent user, got: %v", err)
+	}
+
+	if export.User != nil || len(export.Tags) != 0 || len(export.Messages) != 0 {
+		t.Errorf("Expected empty export for non-existent user, got %+v", export)
+	}
+}
+
+func TestDeleteAllUserData(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	// Test with non-existent user (nothing to delete, should not error)
+	if _, err := storage.DeleteUserData(testDB, 999999, true); err != nil {
+		t.Errorf("Expected no error for non-existent user, got: %v", err)
+	}
+}
+
+func TestConvertLambdaRequestBody(t *testing.T) {
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod: "DELETE",
+		Path:       "/api/user",
+		Body:       `{"confirm": "DELETE"}`,
+	}
+
+	req, err := convertLambdaRequest(request)
+	if err != nil {
+		t.Fatalf("Failed to convert request: %v", err)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("Failed to read body: %v", err)
+	}
+
+	if string(body) != request.Body {
+		t.Errorf("Expected body %q, got %q", request.Body, string(body))
+	}
+}
+
+func TestConvertLambdaRequestBase64Body(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		base64   bool
+		expected string
+	}{
+		{"plain", `{"note": "hi"}`, false, `{"note": "hi"}`},
+		{"base64", base64.StdEncoding.EncodeToString([]byte(`{"note": "héllo"}`)), true, `{"note": "héllo"}`},
+		{"base64 binary", base64.StdEncoding.EncodeToString([]byte{0x00, 0xff, 0x10}), true, string([]byte{0x00, 0xff, 0x10})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := convertLambdaRequest(events.APIGatewayProxyRequest{
+				HTTPMethod:      "PUT",
+				Path:            "/api/user/messages/1/note",
+				Body:            tt.body,
+				IsBase64Encoded: tt.base64,
+				Headers: map[string]string{
+					"Content-Type":   "application/json",
+					"Content-Length": strconv.Itoa(len(tt.body)),
+				},
+			})
+			if err != nil {
+				t.Fatalf("Failed to convert request: %v", err)
+			}
+
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				t.Fatalf("Failed to read body: %v", err)
+			}
+			if string(body) != tt.expected {
+				t.Errorf("Expected body %q, got %q", tt.expected, string(body))
+			}
+			if req.ContentLength != int64(len(tt.expected)) || req.Header.Get("Content-Length") != strconv.Itoa(len(tt.expected)) {
+				t.Errorf("Expected Content-Length %d, got %d / %q", len(tt.expected), req.ContentLength, req.Header.Get("Content-Length"))
+			}
+			if contentType := req.Header.Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("Expected Content-Type to be preserved, got %q", contentType)
+			}
+		})
+	}
+
+	_, err := convertLambdaRequest(events.APIGatewayProxyRequest{
+		HTTPMethod:      "POST",
+		Path:            "/api/user/import",
+		Body:            "not base64!",
+		IsBase64Encoded: true,
+	})
+	if err == nil {
+		t.Error("Expected an error for a malformed base64 body")
+	}
+}
+
+func TestPingDoesNotTouchDB(t *testing.T) {
+	// With no DATABASE_URL and no connection, any DB access would fail the request
+	t.Setenv("DATABASE_URL", "")
+	previousDB := db
+	db = nil
+	defer func() { db = previousDB }()
+
+	for _, request := range []events.APIGatewayProxyRequest{
+		{HTTPMethod: "GET", Path: "/api/ping"},
+		{HTTPMethod: "GET", Path: "/ping", Headers: map[string]string{"X-Envoy-Original-Path": "/api/ping"}},
+	} {
+		response, err := Handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("Expected status %d, got %d", http.StatusOK, response.StatusCode)
+		}
+		if response.Body != "pong" {
+			t.Errorf("Expected body %q, got %q", "pong", response.Body)
+		}
+		if db != nil {
+			t.Error("Expected ping not to initialize the database")
+		}
+	}
+
+	// The router route must not touch the DB either
+	router := setupRoutes(nil)
+	req := httptest.NewRequest("GET", "/api/ping", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || w.Body.String() != "pong" {
+		t.Errorf("Expected 200 pong, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestHealthChecksDB(t *testing.T) {
+	closedDB, err := sql.Open("postgres", "")
+	if err != nil {
+		t.Fatalf("Failed to open database handle: %v", err)
+	}
+	closedDB.Close()
+
+	router := setupRoutes(closedDB)
+	req := httptest.NewRequest("GET", "/api/health", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	assertHealthStatus(t, w, "unhealthy")
+}
+
+// assertHealthStatus checks the health response's status and that its
+// timestamp is the current time
+func assertHealthStatus(t *testing.T, w *httptest.ResponseRecorder, status string) {
+	t.Helper()
+
+	var response struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response.Data["status"] != status {
+		t.Errorf("Expected status %q, got %q", status, response.Data["status"])
+	}
+	timestamp, err := time.Parse(time.RFC3339, response.Data["timestamp"])
+	if err != nil {
+		t.Fatalf("Expected an RFC 3339 timestamp, got %q: %v", response.Data["timestamp"], err)
+	}
+	if age := time.Since(timestamp); age < -time.Second || age > time.Minute {
+		t.Errorf("Expected a current timestamp, got %s", timestamp)
+	}
+}
+
+func TestHealthReportsHealthyDB(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	router := setupRoutes(testDB)
+	req := httptest.NewRequest("GET", "/api/health", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	assertHealthStatus(t, w, "healthy")
+}
+
+func TestGetMessagesByTags(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID := int64(999998)
+	storage.DeleteUserData(testDB, userID, true)
+	defer storage.DeleteUserData(testDB, userID, true)
+
+	if _, err := testDB.Exec(`INSERT INTO users (telegram_id, username) VALUES ($1, 'multitag')`, userID); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	insertMessage := func(telegramMessageID int) int64 {
+		var id int64
+		err := testDB.QueryRow(`INSERT INTO messages (user_id, telegram_message_id, message_type) VALUES ($1, $2, 'text') RETURNING id`,
+			userID, telegramMessageID).Scan(&id)
+		if err != nil {
+			t.Fatalf("Failed to create message: %v", err)
+		}
+		return id
+	}
+	insertTag := func(name string) int64 {
+		var id int64
+		if err := testDB.QueryRow(`INSERT INTO tags (user_id, name) VALUES ($1, $2) RETURNING id`, userID, name).Scan(&id); err != nil {
+			t.Fatalf("Failed to create tag: %v", err)
+		}
+		return id
+	}
+	link := func(messageID, tagID int64) {
+		if _, err := testDB.Exec(`INSERT INTO message_tags (message_id, tag_id) VALUES ($1, $2)`, messageID, tagID); err != nil {
+			t.Fatalf("Failed to tag message: %v", err)
+		}
+	}
+
+	// work: m1, m2; urgent: m2, m3; home: m4
+	work, urgent, home := insertTag("work"), insertTag("urgent"), insertTag("home")
+	m1, m2, m3, m4 := insertMessage(1), insertMessage(2), insertMessage(3), insertMessage(4)
+	link(m1, work)
+	link(m2, work)
+	link(m2, urgent)
+	link(m3, urgent)
+	link(m4, home)
+
+	messageIDs := func(messages []MessageResponse) map[int64]bool {
+		ids := make(map[int64]bool)
+		for _, msg := range messages {
+			ids[msg.ID] = true
+		}
+		return ids
+	}
+
+	allTagged, err := getMessagesByTags(testDB, userID, []int64{work, urgent}, "all", MessageFilters{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ids := messageIDs(allTagged); len(ids) != 1 || !ids[m2] {
+		t.Errorf("Expected only the message with both tags, got %v", ids)
+	}
+
+	anyTagged, err := getMessagesByTags(testDB, userID, []int64{work, urgent}, "any", MessageFilters{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ids := messageIDs(anyTagged); len(ids) != 3 || !ids[m1] || !ids[m2] || !ids[m3] {
+		t.Errorf("Expected messages with either tag, got %v", ids)
+	}
+
+	none, err := getMessagesByTags(testDB, userID, []int64{work, home}, "all", MessageFilters{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(none) != 0 {
+		t.Errorf("Expected no messages with both work and home, got %d", len(none))
+	}
+
+	// Tags of other users are rejected
+	if _, err := getMessagesByTags(testDB, userID, []int64{work, -1}, "any", MessageFilters{}); err == nil {
+		t.Error("Expected error for a tag the user doesn't own")
+	}
+}
+
+func TestHandlerAllowedOrigins(t *testing.T) {
+	t.Setenv("DATABASE_URL", "")
+	request := func(origin string) events.APIGatewayProxyRequest {
+		return events.APIGatewayProxyRequest{
+			HTTPMethod: "OPTIONS",
+			Path:       "/api/user/tags",
+			Headers:    map[string]string{"origin": origin},
+		}
+	}
+
+	// The Lambda path needs a database; an unreachable one is never dialed for preflights
+	previous := db
+	db, _ = sql.Open("postgres", "postgres://localhost:1/none?sslmode=disable")
+	defer func() { db.Close(); db = previous }()
+
+	t.Setenv("ALLOWED_ORIGINS", "https://app.example.com")
+	response, err := Handler(context.Background(), request("https://app.example.com"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := response.Headers["Access-Control-Allow-Origin"]; got != "https://app.example.com" {
+		t.Errorf("Expected the allowed origin to be echoed, got %q", got)
+	}
+
+	response, err = Handler(context.Background(), request("https://evil.net"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got, ok := response.Headers["Access-Control-Allow-Origin"]; ok {
+		t.Errorf("Expected no Access-Control-Allow-Origin for another origin, got %q", got)
+	}
+}
+
+func TestHandlerErrorResponsesAllowedOrigins(t *testing.T) {
+	// Without a database the Handler answers with errorResponse
+	t.Setenv("DATABASE_URL", "")
+	previous := db
+	db = nil
+	defer func() { db = previous }()
+	t.Setenv("ALLOWED_ORIGINS", "https://app.example.com")
+
+	request := func(path, origin string) events.APIGatewayProxyRequest {
+		return events.APIGatewayProxyRequest{
+			HTTPMethod: "GET",
+			Path:       path,
+			Headers:    map[string]string{"Origin": origin},
+		}
+	}
+
+	for _, path := range []string{"/api/user/tags", "/api/ping"} {
+		response, err := Handler(context.Background(), request(path, "https://evil.net"))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if got, ok := response.Headers["Access-Control-Allow-Origin"]; ok {
+			t.Errorf("%s: expected no Access-Control-Allow-Origin for another origin, got %q", path, got)
+		}
+
+		response, err = Handler(context.Background(), request(path, "https://app.example.com"))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if got := response.Headers["Access-Control-Allow-Origin"]; got != "https://app.example.com" {
+			t.Errorf("%s: expected the allowed origin to be echoed, got %q", path, got)
+		}
+	}
+
+	if response := errorResponse(500, "Database connection failed", "https://evil.net", ""); response.Headers["Access-Control-Allow-Origin"] == "*" {
+		t.Error("Expected error responses not to allow every origin")
+	}
+}
+
+// captureLogs sends the default logger's output, and the log package's with it,
+// to the returned buffer for the rest of the test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var output bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&output, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &output
+}
+
+func TestHandlerLogsNoRequestContent(t *testing.T) {
+	previous := db
+	db, _ = sql.Open("postgres", "postgres://localhost:1/none?sslmode=disable")
+	defer func() { db.Close(); db = previous }()
+
+	tests := []struct {
+		name    string
+		request events.APIGatewayProxyRequest
+	}{
+		{
+			name: "Note",
+			request: events.APIGatewayProxyRequest{
+				HTTPMethod:            "PUT",
+				Path:                  "/api/user/messages/1/note",
+				Headers:               map[string]string{"Authorization": "secret-init-data"},
+				QueryStringParameters: map[string]string{"q": "secret query"},
+				Body:                  `{"note": "my secret plans"}`,
+			},
+		},
+		{
+			name: "Import",
+			request: events.APIGatewayProxyRequest{
+				HTTPMethod:      "POST",
+				Path:            "/api/user/import",
+				Headers:         map[string]string{"Authorization": "secret-init-data"},
+				Body:            base64.StdEncoding.EncodeToString([]byte(`{"messages": [{"id": 1, "text": "my secret plans"}]}`)),
+				IsBase64Encoded: true,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := captureLogs(t)
+
+			if _, err := Handler(context.Background(), tt.request); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			logs := output.String()
+			if !strings.Contains(logs, "Request received") {
+				t.Errorf("Expected the request to be logged, got %s", logs)
+			}
+			for _, secret := range []string{"secret-init-data", "secret query", "my secret plans", tt.request.Body} {
+				if strings.Contains(logs, secret) {
+					t.Errorf("Expected %q to stay out of the logs, got %s", secret, logs)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	t.Run("Lambda response echoes the API Gateway request ID", func(t *testing.T) {
+		request := events.APIGatewayProxyRequest{
+			HTTPMethod:     "GET",
+			Path:           "/api/ping",
+			RequestContext: events.APIGatewayProxyRequestContext{RequestID: "req-123"},
+		}
+
+		response, err := Handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if got := response.Headers[requestIDHeader]; got != "req-123" {
+			t.Errorf("Expected %s header %q, got %q", requestIDHeader, "req-123", got)
+		}
+	})
+
+	t.Run("Router echoes the gateway ID and includes it in errors", func(t *testing.T) {
+		router := setupRoutes(nil)
+		req := withRequestID(httptest.NewRequest("GET", "/api/user/tags", nil), "req-456")
+		req.Header.Set(requestIDHeader, "forged")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if got := w.Header().Get(requestIDHeader); got != "req-456" {
+			t.Errorf("Expected %s header %q, got %q", requestIDHeader, "req-456", got)
+		}
+
+		var response APIResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		if response.RequestID != "req-456" {
+			t.Errorf("Expected request_id %q in error response, got %q", "req-456", response.RequestID)
+		}
+	})
+
+	t.Run("Router ignores a client's request ID header", func(t *testing.T) {
+		router := setupRoutes(nil)
+		req := httptest.NewRequest("GET", "/api/user/tags", nil)
+		req.Header.Set(requestIDHeader, "forged")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if got := w.Header().Get(requestIDHeader); got != "" {
+			t.Errorf("Expected no %s header, got %q", requestIDHeader, got)
+		}
+		if strings.Contains(w.Body.String(), "forged") {
+			t.Errorf("Expected the client's request ID to be ignored, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("Errors outside the router carry the request ID", func(t *testing.T) {
+		response := errorResponse(500, "Database connection failed", "", "req-789")
+
+		var body APIResponse
+		if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		if body.RequestID != "req-789" || response.Headers[requestIDHeader] != "req-789" {
+			t.Errorf("Expected request ID in body and header, got %+v", response)
+		}
+	})
+}
+
+func TestSetMessageNote(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID := int64(999997)
+	storage.DeleteUserData(testDB, userID, true)
+	defer storage.DeleteUserData(testDB, userID, true)
+
+	if _, err := testDB.Exec(`INSERT INTO users (telegram_id, username) VALUES ($1, 'notes')`, userID); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	var messageID int64
+	err = testDB.QueryRow(`INSERT INTO messages (user_id, telegram_message_id, message_type) VALUES ($1, 1, 'text') RETURNING id`,
+		userID).Scan(&messageID)
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+
+	storedNote := func() *string {
+		export, err := storage.ExportUserData(testDB, userID)
+		if err != nil || len(export.Messages) != 1 {
+			t.Fatalf("Failed to export message: %v", err)
+		}
+		return export.Messages[0].UserNote
+	}
+
+	if err := setMessageNote(testDB, userID, messageID, "check the comments"); err != nil {
+		t.Fatalf("Failed to set note: %v", err)
+	}
+	if note := storedNote(); note == nil || *note != "check the comments" {
+		t.Errorf("Expected note to be set, got %v", note)
+	}
+
+	if err := setMessageNote(testDB, userID, messageID, ""); err != nil {
+		t.Fatalf("Failed to clear note: %v", err)
+	}
+	if note := storedNote(); note != nil {
+		t.Errorf("Expected note to be cleared, got %q", *note)
+	}
+
+	// Another user's message is indistinguishable from a missing one
+	var notFound *NotFoundError
+	if err := setMessageNote(testDB, userID+1, messageID, "not mine"); !errors.As(err, &notFound) {
+		t.Errorf("Expected NotFoundError, got %v", err)
+	}
+}
+
+func TestResponseRecorderLambdaBody(t *testing.T) {
+	recorder := &ResponseRecorder{headers: map[string]string{"Content-Type": "application/json; charset=utf-8"}}
+	recorder.Write([]byte(`{"success":`))
+	recorder.Write([]byte(`true}`))
+
+	body, isBase64 := recorder.lambdaBody()
+	if isBase64 || body != `{"success":true}` {
+		t.Errorf("Expected JSON body as text, got %q (base64: %t)", body, isBase64)
+	}
+
+	binary := &ResponseRecorder{headers: map[string]string{"Content-Type": "image/jpeg"}}
+	binary.Write([]byte{0xff, 0xd8, 0xff})
+
+	body, isBase64 = binary.lambdaBody()
+	if !isBase64 || body != "/9j/" {
+		t.Errorf("Expected base64 body, got %q (base64: %t)", body, isBase64)
+	}
+
+	// Headers set through Header() are kept, unlike a copy
+	binary.Header().Set("Content-Range", "bytes 0-2/3")
+	if binary.Header().Get("Content-Range") != "bytes 0-2/3" {
+		t.Error("Expected header to persist on the recorder")
+	}
+}
+
+func TestAssertOwnership(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	owner, other := int64(999996), int64(999995)
+	for _, userID := range []int64{owner, other} {
+		storage.DeleteUserData(testDB, userID, true)
+		defer storage.DeleteUserData(testDB, userID, true)
+		if _, err := testDB.Exec(`INSERT INTO users (telegram_id, username) VALUES ($1, 'owner')`, userID); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	var tagID, messageID int64
+	if err := testDB.QueryRow(`INSERT INTO tags (user_id, name) VALUES ($1, 'mine') RETURNING id`, owner).Scan(&tagID); err != nil {
+		t.Fatalf("Failed to create tag: %v", err)
+	}
+	err = testDB.QueryRow(`INSERT INTO messages (user_id, telegram_message_id, message_type) VALUES ($1, 1, 'text') RETURNING id`,
+		owner).Scan(&messageID)
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+
+	for resource, id := range map[ResourceType]int64{ResourceTag: tagID, ResourceMessage: messageID} {
+		if err := assertOwnership(testDB, owner, resource, id); err != nil {
+			t.Errorf("%s: expected owner to pass, got %v", resource, err)
+		}
+
+		for name, userID := range map[string]int64{"other user": other, "nonexistent": owner} {
+			checkedID := id
+			if name == "nonexistent" {
+				checkedID = -1
+			}
+			var notFound *NotFoundError
+			err := assertOwnership(testDB, userID, resource, checkedID)
+			if !errors.As(err, &notFound) || notFound.Resource != resource || notFound.ID != checkedID {
+				t.Errorf("%s, %s: expected NotFoundError, got %v", resource, name, err)
+			}
+		}
+	}
+}
+
+func TestGetUserProfile(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID, missingID := int64(999994), int64(999993)
+	for _, id := range []int64{userID, missingID} {
+		storage.DeleteUserData(testDB, id, true)
+		defer storage.DeleteUserData(testDB, id, true)
+	}
+	_, err = testDB.Exec(`INSERT INTO users (telegram_id, username, first_name) VALUES ($1, 'profile_user', 'Ada')`, userID)
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	profile, err := getUserProfile(testDB, userID)
+	if err != nil {
+		t.Fatalf("Expected profile, got %v", err)
+	}
+	if profile.TelegramID != userID || profile.Username == nil || *profile.Username != "profile_user" {
+		t.Errorf("Unexpected profile: %+v", profile)
+	}
+	if profile.FirstName == nil || *profile.FirstName != "Ada" {
+		t.Errorf("Expected first name Ada, got %v", profile.FirstName)
+	}
+	if profile.LastName != nil {
+		t.Errorf("Expected no last name, got %q", *profile.LastName)
+	}
+	if profile.CreatedAt.IsZero() {
+		t.Error("Expected created_at to be set")
+	}
+
+	_, err = getUserProfile(testDB, missingID)
+	var notFound *NotFoundError
+	if !errors.As(err, &notFound) || notFound.Resource != ResourceUser {
+		t.Errorf("Expected user not found error, got %v", err)
+	}
+}
+
+func TestGetMinAuthDate(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID, missingID := int64(999985), int64(999984)
+	for _, id := range []int64{userID, missingID} {
+		storage.DeleteUserData(testDB, id, true)
+		defer storage.DeleteUserData(testDB, id, true)
+	}
+	_, err = testDB.Exec(`INSERT INTO users (telegram_id, username) VALUES ($1, 'revoke_user')`, userID)
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	if minAuthDate, err := getMinAuthDate(testDB, userID); err != nil || !minAuthDate.IsZero() {
+		t.Errorf("Expected no min_auth_date before /revoke, got %v, %v", minAuthDate, err)
+	}
+	if minAuthDate, err := getMinAuthDate(testDB, missingID); err != nil || !minAuthDate.IsZero() {
+		t.Errorf("Expected no min_auth_date for an unknown user, got %v, %v", minAuthDate, err)
+	}
+
+	revokedAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	if _, err := testDB.Exec(`UPDATE users SET min_auth_date = $2 WHERE telegram_id = $1`, userID, revokedAt); err != nil {
+		t.Fatalf("Failed to set min_auth_date: %v", err)
+	}
+	minAuthDate, err := getMinAuthDate(testDB, userID)
+	if err != nil || !minAuthDate.Equal(revokedAt) {
+		t.Errorf("Expected min_auth_date %v, got %v, %v", revokedAt, minAuthDate, err)
+	}
+	if !isAuthDateRevoked(revokedAt.Unix()-1, minAuthDate) || isAuthDateRevoked(revokedAt.Unix(), minAuthDate) {
+		t.Error("Expected initData older than min_auth_date to be revoked")
+	}
+}
+
+func TestUpdateTags(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID, otherID := int64(999991), int64(999990)
+	for _, id := range []int64{userID, otherID} {
+		storage.DeleteUserData(testDB, id, true)
+		defer storage.DeleteUserData(testDB, id, true)
+		if _, err := testDB.Exec(`INSERT INTO users (telegram_id, username) VALUES ($1, 'tag_editor')`, id); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	createTag := func(userID int64, name string) int64 {
+		var id int64
+		if err := testDB.QueryRow(`INSERT INTO tags (user_id, name, color) VALUES ($1, $2, '#FF6B6B') RETURNING id`, userID, name).Scan(&id); err != nil {
+			t.Fatalf("Failed to create tag: %v", err)
+		}
+		return id
+	}
+	work, music, books := createTag(userID, "work"), createTag(userID, "music"), createTag(userID, "books")
+	otherTag := createTag(otherID, "private")
+
+	tagNames := func() map[int64]string {
+		tags, err := getUserTagsWithCounts(testDB, userID, TagSortCount)
+		if err != nil {
+			t.Fatalf("Failed to get tags: %v", err)
+		}
+		names := make(map[int64]string)
+		for _, tag := range tags {
+			names[tag.ID] = tag.Name
+		}
+		return names
+	}
+
+	// A mixed batch where the last rename conflicts rolls back the earlier updates
+	_, err = updateTags(testDB, userID, []TagUpdate{
+		{ID: work, Name: stringPtr("job")},
+		{ID: music, Color: stringPtr("#4ECDC4")},
+		{ID: books, Name: stringPtr("job")},
+	})
+	var conflict *TagConflictError
+	if !errors.As(err, &conflict) || conflict.Name != "job" {
+		t.Fatalf("Expected TagConflictError, got %v", err)
+	}
+	if names := tagNames(); names[work] != "work" || names[books] != "books" {
+		t.Errorf("Expected names to be rolled back, got %v", names)
+	}
+
+	// Another user's tag fails the batch as not found
+	_, err = updateTags(testDB, userID, []TagUpdate{{ID: work, Name: stringPtr("job")}, {ID: otherTag, Name: stringPtr("mine")}})
+	var notFound *NotFoundError
+	if !errors.As(err, &notFound) || notFound.ID != otherTag {
+		t.Errorf("Expected NotFoundError for tag %d, got %v", otherTag, err)
+	}
+	if names := tagNames(); names[work] != "work" {
+		t.Errorf("Expected rename to be rolled back, got %v", names)
+	}
+
+	// A valid batch is applied and returned in request order
+	tags, err := updateTags(testDB, userID, []TagUpdate{
+		{ID: books, Name: stringPtr("reading"), Color: stringPtr("")},
+		{ID: work, Name: stringPtr("job")},
+		{ID: music, Color: stringPtr("#4ECDC4")},
+	})
+	if err != nil {
+		t.Fatalf("Expected batch to succeed, got %v", err)
+	}
+	if len(tags) != 3 || tags[0].ID != books || tags[1].ID != work || tags[2].ID != music {
+		t.Fatalf("Unexpected tags: %+v", tags)
+	}
+	if tags[0].Name != "reading" || tags[0].Color != nil {
+		t.Errorf("Expected books to be renamed and uncolored, got %+v", tags[0])
+	}
+	if tags[1].Name != "job" || tags[1].Color == nil || *tags[1].Color != "#FF6B6B" {
+		t.Errorf("Expected work to be renamed and keep its color, got %+v", tags[1])
+	}
+	if tags[2].Name != "music" || tags[2].Color == nil || *tags[2].Color != "#4ECDC4" {
+		t.Errorf("Expected music to be recolored, got %+v", tags[2])
+	}
+}
+
+func TestGetTagBreakdown(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID := int64(999989)
+	storage.DeleteUserData(testDB, userID, true)
+	defer storage.DeleteUserData(testDB, userID, true)
+	if _, err := testDB.Exec(`INSERT INTO users (telegram_id, username) VALUES ($1, 'breakdown')`, userID); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	var tagID, otherTagID int64
+	if err := testDB.QueryRow(`INSERT INTO tags (user_id, name) VALUES ($1, 'trip') RETURNING id`, userID).Scan(&tagID); err != nil {
+		t.Fatalf("Failed to create tag: %v", err)
+	}
+	if err := testDB.QueryRow(`INSERT INTO tags (user_id, name) VALUES ($1, 'other') RETURNING id`, userID).Scan(&otherTagID); err != nil {
+		t.Fatalf("Failed to create tag: %v", err)
+	}
+
+	types := []string{"photo", "photo", "photo", "text", "text", "document"}
+	for i, messageType := range types {
+		var messageID int64
+		err := testDB.QueryRow(`INSERT INTO messages (user_id, telegram_message_id, message_type) VALUES ($1, $2, $3) RETURNING id`,
+			userID, i+1, messageType).Scan(&messageID)
+		if err != nil {
+			t.Fatalf("Failed to create message: %v", err)
+		}
+		if _, err := testDB.Exec(`INSERT INTO message_tags (message_id, tag_id) VALUES ($1, $2)`, messageID, tagID); err != nil {
+			t.Fatalf("Failed to tag message: %v", err)
+		}
+	}
+	// Untagged messages aren't counted
+	if _, err := testDB.Exec(`INSERT INTO messages (user_id, telegram_message_id, message_type) VALUES ($1, 100, 'video')`, userID); err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+
+	breakdown, err := getTagBreakdown(testDB, userID, tagID)
+	if err != nil {
+		t.Fatalf("Expected breakdown, got %v", err)
+	}
+	expected := []TypeCount{{"photo", 3}, {"text", 2}, {"document", 1}}
+	if len(breakdown) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, breakdown)
+	}
+	for i := range expected {
+		if breakdown[i] != expected[i] {
+			t.Errorf("Expected %v at %d, got %v", expected[i], i, breakdown[i])
+		}
+	}
+
+	breakdown, err = getTagBreakdown(testDB, userID, otherTagID)
+	if err != nil || len(breakdown) != 0 {
+		t.Errorf("Expected an empty breakdown, got %v, %v", breakdown, err)
+	}
+
+	var notFound *NotFoundError
+	if _, err := getTagBreakdown(testDB, userID+1, tagID); !errors.As(err, &notFound) {
+		t.Errorf("Expected NotFoundError, got %v", err)
+	}
+}
+
+func TestMarkMessageSeen(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID := int64(999988)
+	storage.DeleteUserData(testDB, userID, true)
+	defer storage.DeleteUserData(testDB, userID, true)
+	if _, err := testDB.Exec(`INSERT INTO users (telegram_id, username) VALUES ($1, 'inbox')`, userID); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	var tagID int64
+	if err := testDB.QueryRow(`INSERT INTO tags (user_id, name) VALUES ($1, 'later') RETURNING id`, userID).Scan(&tagID); err != nil {
+		t.Fatalf("Failed to create tag: %v", err)
+	}
+	// Newest first: m3, m2, m1
+	var ids []int64
+	for i := 1; i <= 3; i++ {
+		var id int64
+		err := testDB.QueryRow(`INSERT INTO messages (user_id, telegram_message_id, message_type, created_at)
+			VALUES ($1, $2, 'text', NOW() - $3 * INTERVAL '1 hour') RETURNING id`, userID, i, 4-i).Scan(&id)
+		if err != nil {
+			t.Fatalf("Failed to create message: %v", err)
+		}
+		if _, err := testDB.Exec(`INSERT INTO message_tags (message_id, tag_id) VALUES ($1, $2)`, id, tagID); err != nil {
+			t.Fatalf("Failed to tag message: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	m1, m2, m3 := ids[0], ids[1], ids[2]
+
+	listIDs := func(filters MessageFilters) []int64 {
+		messages, _, err := getTagMessages(testDB, userID, tagID, filters, "", Page{Limit: defaultPageLimit})
+		if err != nil {
+			t.Fatalf("Failed to list messages: %v", err)
+		}
+		var listed []int64
+		for _, msg := range messages {
+			listed = append(listed, msg.ID)
+		}
+		return listed
+	}
+	equalIDs := func(name string, got, want []int64) {
+		if len(got) != len(want) {
+			t.Errorf("%s: expected %v, got %v", name, want, got)
+			return
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s: expected %v, got %v", name, want, got)
+				return
+			}
+		}
+	}
+
+	// Messages start unseen
+	seen, unseen := true, false
+	equalIDs("unseen by default", listIDs(MessageFilters{Seen: &unseen}), []int64{m3, m2, m1})
+
+	seenAt, err := markMessageSeen(testDB, userID, m3)
+	if err != nil {
+		t.Fatalf("Failed to mark message seen: %v", err)
+	}
+	again, err := markMessageSeen(testDB, userID, m3)
+	if err != nil || !again.Equal(seenAt) {
+		t.Errorf("Expected marking again to keep %v, got %v, %v", seenAt, again, err)
+	}
+
+	equalIDs("seen", listIDs(MessageFilters{Seen: &seen}), []int64{m3})
+	equalIDs("unseen", listIDs(MessageFilters{Seen: &unseen}), []int64{m2, m1})
+	equalIDs("unseen first", listIDs(MessageFilters{UnseenFirst: true}), []int64{m2, m1, m3})
+
+	messages, _, err := getTagMessages(testDB, userID, tagID, MessageFilters{Seen: &seen}, "", Page{Limit: defaultPageLimit})
+	if err != nil || len(messages) != 1 || messages[0].SeenAt == nil {
+		t.Errorf("Expected seen_at on the seen message, got %+v, %v", messages, err)
+	}
+
+	// Another user's message is indistinguishable from a missing one
+	var notFound *NotFoundError
+	if _, err := markMessageSeen(testDB, userID+1, m1); !errors.As(err, &notFound) {
+		t.Errorf("Expected NotFoundError, got %v", err)
+	}
+}
+
+func TestGetRelatedMessages(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID, otherID := int64(999987), int64(999986)
+	for _, id := range []int64{userID, otherID} {
+		storage.DeleteUserData(testDB, id, true)
+		defer storage.DeleteUserData(testDB, id, true)
+		if _, err := testDB.Exec(`INSERT INTO users (telegram_id, username) VALUES ($1, 'related')`, id); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	insertMessage := func(userID int64, telegramMessageID int, hashtags string) int64 {
+		var id int64
+		err := testDB.QueryRow(`INSERT INTO messages (user_id, telegram_message_id, message_type, hashtags) VALUES ($1, $2, 'text', $3) RETURNING id`,
+			userID, telegramMessageID, hashtags).Scan(&id)
+		if err != nil {
+			t.Fatalf("Failed to create message: %v", err)
+		}
+		return id
+	}
+	insertTag := func(name string) int64 {
+		var id int64
+		if err := testDB.QueryRow(`INSERT INTO tags (user_id, name) VALUES ($1, $2) RETURNING id`, userID, name).Scan(&id); err != nil {
+			t.Fatalf("Failed to create tag: %v", err)
+		}
+		return id
+	}
+	link := func(messageID int64, tagIDs ...int64) {
+		for _, tagID := range tagIDs {
+			if _, err := testDB.Exec(`INSERT INTO message_tags (message_id, tag_id) VALUES ($1, $2)`, messageID, tagID); err != nil {
+				t.Fatalf("Failed to tag message: %v", err)
+			}
+		}
+	}
+
+	work, golang, reading := insertTag("work"), insertTag("golang"), insertTag("reading")
+
+	source := insertMessage(userID, 1, "{go,tips}")
+	link(source, work, golang, reading)
+
+	threeTags := insertMessage(userID, 2, "{}")             // 3 shared tags
+	tagsAndHashtag := insertMessage(userID, 3, "{go}")      // 1 tag + 1 hashtag
+	oneHashtag := insertMessage(userID, 4, "{tips,cats}")   // 1 hashtag
+	unrelated := insertMessage(userID, 5, "{cats}")         // nothing shared
+	othersMessage := insertMessage(otherID, 6, "{go,tips}") // another user's
+	link(threeTags, work, golang, reading)
+	link(tagsAndHashtag, golang)
+
+	related, err := getRelatedMessages(testDB, userID, source)
+	if err != nil {
+		t.Fatalf("Expected related messages, got %v", err)
+	}
+	expected := []int64{threeTags, tagsAndHashtag, oneHashtag}
+	if len(related) != len(expected) {
+		t.Fatalf("Expected %d related messages, got %+v", len(expected), related)
+	}
+	for i, id := range expected {
+		if related[i].ID != id {
+			t.Errorf("Expected message %d at rank %d, got %d", id, i, related[i].ID)
+		}
+	}
+	for _, msg := range related {
+		if msg.ID == source || msg.ID == unrelated || msg.ID == othersMessage {
+			t.Errorf("Unexpected related message %d", msg.ID)
+		}
+	}
+
+	var notFound *NotFoundError
+	if _, err := getRelatedMessages(testDB, otherID, source); !errors.As(err, &notFound) {
+		t.Errorf("Expected NotFoundError, got %v", err)
+	}
+}
+
+func TestGetAvailableTags(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID, otherID := int64(999983), int64(999982)
+	for _, id := range []int64{userID, otherID} {
+		storage.DeleteUserData(testDB, id, true)
+		defer storage.DeleteUserData(testDB, id, true)
+		if _, err := testDB.Exec(`INSERT INTO users (telegram_id, username) VALUES ($1, 'available_tags')`, id); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	var messageID int64
+	err = testDB.QueryRow(`INSERT INTO messages (user_id, telegram_message_id, message_type) VALUES ($1, 1, 'text') RETURNING id`, userID).Scan(&messageID)
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	insertTag := func(userID int64, name string) int64 {
+		var id int64
+		if err := testDB.QueryRow(`INSERT INTO tags (user_id, name) VALUES ($1, $2) RETURNING id`, userID, name).Scan(&id); err != nil {
+			t.Fatalf("Failed to create tag: %v", err)
+		}
+		return id
+	}
+	work, music, books := insertTag(userID, "work"), insertTag(userID, "music"), insertTag(userID, "books")
+	insertTag(otherID, "other user's tag")
+	for _, tagID := range []int64{work, music} {
+		if _, err := testDB.Exec(`INSERT INTO message_tags (message_id, tag_id) VALUES ($1, $2)`, messageID, tagID); err != nil {
+			t.Fatalf("Failed to tag message: %v", err)
+		}
+	}
+
+	tags, err := getAvailableTags(testDB, userID, messageID)
+	if err != nil {
+		t.Fatalf("Failed to get available tags: %v", err)
+	}
+	if len(tags) != 1 || tags[0].ID != books {
+		t.Errorf("Expected only the books tag, got %+v", tags)
+	}
+
+	// Another user's message is indistinguishable from a missing one
+	var notFound *NotFoundError
+	if _, err := getAvailableTags(testDB, otherID, messageID); !errors.As(err, &notFound) {
+		t.Errorf("Expected NotFoundError, got %v", err)
+	}
+}
+
+func TestGetTagMessagesStableOrder(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID := int64(999981)
+	storage.DeleteUserData(testDB, userID, true)
+	defer storage.DeleteUserData(testDB, userID, true)
+	if _, err := testDB.Exec(`INSERT INTO users (telegram_id, username) VALUES ($1, 'stable_order')`, userID); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	var tagID int64
+	if err := testDB.QueryRow(`INSERT INTO tags (user_id, name) VALUES ($1, 'album') RETURNING id`, userID).Scan(&tagID); err != nil {
+		t.Fatalf("Failed to create tag: %v", err)
+	}
+
+	// An album: every message saved in the same second
+	var expected []int64
+	for i := 1; i <= 5; i++ {
+		var id int64
+		err := testDB.QueryRow(`INSERT INTO messages (user_id, telegram_message_id, message_type, created_at)
+			VALUES ($1, $2, 'photo', '2024-03-01 12:00:00') RETURNING id`, userID, i).Scan(&id)
+		if err != nil {
+			t.Fatalf("Failed to create message: %v", err)
+		}
+		if _, err := testDB.Exec(`INSERT INTO message_tags (message_id, tag_id) VALUES ($1, $2)`, id, tagID); err != nil {
+			t.Fatalf("Failed to tag message: %v", err)
+		}
+		expected = append([]int64{id}, expected...)
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		messages, _, err := getTagMessages(testDB, userID, tagID, MessageFilters{}, "", Page{Limit: defaultPageLimit})
+		if err != nil {
+			t.Fatalf("Failed to get tag messages: %v", err)
+		}
+		var ids []int64
+		for _, message := range messages {
+			ids = append(ids, message.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(expected) {
+			t.Errorf("Attempt %d: expected %v, got %v", attempt, expected, ids)
+		}
+	}
+}
+
+func TestCopyMessageTags(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID, otherID := int64(999980), int64(999979)
+	for _, id := range []int64{userID, otherID} {
+		storage.DeleteUserData(testDB, id, true)
+		defer storage.DeleteUserData(testDB, id, true)
+		if _, err := testDB.Exec(`INSERT INTO users (telegram_id, username) VALUES ($1, 'copy_tags')`, id); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	insertMessage := func(userID int64, telegramMessageID int) int64 {
+		var id int64
+		err := testDB.QueryRow(`INSERT INTO messages (user_id, telegram_message_id, message_type) VALUES ($1, $2, 'text') RETURNING id`,
+			userID, telegramMessageID).Scan(&id)
+		if err != nil {
+			t.Fatalf("Failed to create message: %v", err)
+		}
+		return id
+	}
+	insertTag := func(name string) int64 {
+		var id int64
+		if err := testDB.QueryRow(`INSERT INTO tags (user_id, name) VALUES ($1, $2) RETURNING id`, userID, name).Scan(&id); err != nil {
+			t.Fatalf("Failed to create tag: %v", err)
+		}
+		return id
+	}
+	link := func(messageID int64, tagIDs ...int64) {
+		for _, tagID := range tagIDs {
+			if _, err := testDB.Exec(`INSERT INTO message_tags (message_id, tag_id) VALUES ($1, $2)`, messageID, tagID); err != nil {
+				t.Fatalf("Failed to tag message: %v", err)
+			}
+		}
+	}
+	tagNames := func(tags []Tag) string {
+		var names []string
+		for _, tag := range tags {
+			names = append(names, tag.Name)
+		}
+		return fmt.Sprint(names)
+	}
+
+	source, target, other := insertMessage(userID, 1), insertMessage(userID, 2), insertMessage(otherID, 1)
+	work, music, books := insertTag("work"), insertTag("music"), insertTag("books")
+	link(source, work, music)
+	link(target, music, books)
+
+	// Overlapping tags are kept once, the target's own tags stay
+	tags, err := copyMessageTags(testDB, userID, target, source)
+	if err != nil {
+		t.Fatalf("Failed to copy tags: %v", err)
+	}
+	if got := tagNames(tags); got != "[books music work]" {
+		t.Errorf("Expected [books music work], got %s", got)
+	}
+
+	// Copying again changes nothing
+	if tags, err := copyMessageTags(testDB, userID, target, source); err != nil || tagNames(tags) != "[books music work]" {
+		t.Errorf("Expected copying again to be a no-op, got %s, %v", tagNames(tags), err)
+	}
+
+	// The source is untouched
+	if tags, err := getMessageTags(testDB, userID, source); err != nil || tagNames(tags) != "[music work]" {
+		t.Errorf("Expected the source to keep [music work], got %s, %v", tagNames(tags), err)
+	}
+
+	// Both messages must belong to the caller
+	var notFound *NotFoundError
+	if _, err := copyMessageTags(testDB, userID, target, other); !errors.As(err, &notFound) {
+		t.Errorf("Expected NotFoundError for another user's source, got %v", err)
+	}
+	if _, err := copyMessageTags(testDB, userID, other, source); !errors.As(err, &notFound) {
+		t.Errorf("Expected NotFoundError for another user's target, got %v", err)
+	}
+}
+
+func TestDeleteTagHandler(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID, otherID := int64(999978), int64(999977)
+	for _, id := range []int64{userID, otherID} {
+		storage.DeleteUserData(testDB, id, true)
+		defer storage.DeleteUserData(testDB, id, true)
+		if _, err := testDB.Exec(`INSERT INTO users (telegram_id, username) VALUES ($1, 'delete_tag')`, id); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	var messageID, tagID, keptTagID, otherTagID int64
+	if err := testDB.QueryRow(`INSERT INTO messages (user_id, telegram_message_id, message_type) VALUES ($1, 1, 'text') RETURNING id`, userID).Scan(&messageID); err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	for _, tag := range []struct {
+		userID int64
+		name   string
+		id     *int64
+	}{{userID, "junk", &tagID}, {userID, "kept", &keptTagID}, {otherID, "junk", &otherTagID}} {
+		if err := testDB.QueryRow(`INSERT INTO tags (user_id, name) VALUES ($1, $2) RETURNING id`, tag.userID, tag.name).Scan(tag.id); err != nil {
+			t.Fatalf("Failed to create tag: %v", err)
+		}
+	}
+	for _, id := range []int64{tagID, keptTagID} {
+		if _, err := testDB.Exec(`INSERT INTO message_tags (message_id, tag_id) VALUES ($1, $2)`, messageID, id); err != nil {
+			t.Fatalf("Failed to tag message: %v", err)
+		}
+	}
+
+	useMockParser(t, userID)
+	router := setupRoutes(testDB)
+	deleteRequest := func(id int64) int {
+		req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/api/user/tags/%d", id), nil)
+		req.Header.Set("Authorization", "Bearer init_data")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Another user's tag is indistinguishable from a missing one
+	if code := deleteRequest(otherTagID); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for another user's tag, got %d", code)
+	}
+
+	if code := deleteRequest(tagID); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	tags, err := getMessageTags(testDB, userID, messageID)
+	if err != nil || len(tags) != 1 || tags[0].ID != keptTagID {
+		t.Errorf("Expected only the kept tag on the message, got %+v, %v", tags, err)
+	}
+
+	if code := deleteRequest(tagID); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an already deleted tag, got %d", code)
+	}
+}
+
+func TestSetTagColorHandler(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID, otherID := int64(999976), int64(999975)
+	tagIDs := make(map[int64]int64)
+	for _, id := range []int64{userID, otherID} {
+		storage.DeleteUserData(testDB, id, true)
+		defer storage.DeleteUserData(testDB, id, true)
+		if _, err := testDB.Exec(`INSERT INTO users (telegram_id, username) VALUES ($1, 'tag_color')`, id); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+		var tagID int64
+		if err := testDB.QueryRow(`INSERT INTO tags (user_id, name) VALUES ($1, 'work') RETURNING id`, id).Scan(&tagID); err != nil {
+			t.Fatalf("Failed to create tag: %v", err)
+		}
+		tagIDs[id] = tagID
+	}
+
+	useMockParser(t, userID)
+	router := setupRoutes(testDB)
+	putColor := func(tagID int64, body string) int {
+		req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/api/user/tags/%d/color", tagID), strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer init_data")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	tagColor := func(userID int64) *string {
+		tags, err := getUserTagsWithCounts(testDB, userID, TagSortCount)
+		if err != nil || len(tags) != 1 {
+			t.Fatalf("Failed to get tags: %+v, %v", tags, err)
+		}
+		return tags[0].Color
+	}
+
+	if code := putColor(tagIDs[userID], `{"color": "#ff0000"}`); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	if color := tagColor(userID); color == nil || *color != "#FF0000" {
+		t.Errorf("Expected color #FF0000, got %v", color)
+	}
+
+	if code := putColor(tagIDs[userID], `{"color": "red"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a malformed color, got %d", code)
+	}
+	if color := tagColor(userID); color == nil || *color != "#FF0000" {
+		t.Errorf("Expected a malformed color to keep #FF0000, got %v", color)
+	}
+
+	// Another user's tag is indistinguishable from a missing one
+	if code := putColor(tagIDs[otherID], `{"color": "#00FF00"}`); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for another user's tag, got %d", code)
+	}
+	if color := tagColor(otherID); color != nil {
+		t.Errorf("Expected another user's tag to stay uncolored, got %q", *color)
+	}
+}
+
+func TestMergeTags(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID, otherID := int64(999970), int64(999969)
+	for _, id := range []int64{userID, otherID} {
+		storage.DeleteUserData(testDB, id, true)
+		defer storage.DeleteUserData(testDB, id, true)
+		if _, err := testDB.Exec(`INSERT INTO users (telegram_id, username) VALUES ($1, 'merge_tags')`, id); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	insertTag := func(userID int64, name string) int64 {
+		var id int64
+		if err := testDB.QueryRow(`INSERT INTO tags (user_id, name) VALUES ($1, $2) RETURNING id`, userID, name).Scan(&id); err != nil {
+			t.Fatalf("Failed to create tag: %v", err)
+		}
+		return id
+	}
+	insertMessage := func(telegramMessageID int, tagIDs ...int64) {
+		var id int64
+		err := testDB.QueryRow(`INSERT INTO messages (user_id, telegram_message_id, message_type) VALUES ($1, $2, 'text') RETURNING id`,
+			userID, telegramMessageID).Scan(&id)
+		if err != nil {
+			t.Fatalf("Failed to create message: %v", err)
+		}
+		for _, tagID := range tagIDs {
+			if _, err := testDB.Exec(`INSERT INTO message_tags (message_id, tag_id) VALUES ($1, $2)`, id, tagID); err != nil {
+				t.Fatalf("Failed to tag message: %v", err)
+			}
+		}
+	}
+
+	job, work, otherTag := insertTag(userID, "job"), insertTag(userID, "work"), insertTag(otherID, "work")
+	insertMessage(1, job)
+	insertMessage(2, job, work)
+	insertMessage(3, work)
+
+	useMockParser(t, userID)
+	router := setupRoutes(testDB)
+	merge := func(tagID, into int64) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"into": %d}`, into)
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/user/tags/%d/merge", tagID), strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer init_data")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Another user's tag is indistinguishable from a missing one, on either side
+	if w := merge(job, otherTag); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 merging into another user's tag, got %d", w.Code)
+	}
+	if w := merge(otherTag, job); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 merging another user's tag, got %d", w.Code)
+	}
+
+	w := merge(job, work)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		Data Tag `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response.Data.ID != work || response.Data.MessageCount != 3 {
+		t.Errorf("Expected work with 3 messages, got %+v", response.Data)
+	}
+
+	var duplicates int
+	err = testDB.QueryRow(`SELECT COUNT(*) FROM (
+		SELECT message_id FROM message_tags WHERE tag_id = $1 GROUP BY message_id HAVING COUNT(*) > 1) d`, work).Scan(&duplicates)
+	if err != nil || duplicates != 0 {
+		t.Errorf("Expected no duplicate relations, got %d (%v)", duplicates, err)
+	}
+
+	tags, err := getUserTagsWithCounts(testDB, userID, TagSortCount)
+	if err != nil || len(tags) != 1 || tags[0].ID != work {
+		t.Errorf("Expected only work to remain, got %+v (%v)", tags, err)
+	}
+	if err := assertOwnership(testDB, otherID, ResourceTag, otherTag); err != nil {
+		t.Errorf("Expected another user's tag to be kept: %v", err)
+	}
+}
+
+func TestGetMessage(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID := int64(999974)
+	storage.DeleteUserData(testDB, userID, true)
+	defer storage.DeleteUserData(testDB, userID, true)
+
+	if _, err := testDB.Exec(`INSERT INTO users (telegram_id, username) VALUES ($1, 'full_text')`, userID); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	fullText := strings.Repeat("a", 2000)
+	var messageID, oldMessageID int64
+	err = testDB.QueryRow(`INSERT INTO messages (user_id, telegram_message_id, message_type, text_content, full_text, text_truncated)
+		VALUES ($1, 1, 'text', $2, $3, FALSE) RETURNING id`, userID, fullText[:150]+"...", fullText).Scan(&messageID)
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	err = testDB.QueryRow(`INSERT INTO messages (user_id, telegram_message_id, message_type, text_content)
+		VALUES ($1, 2, 'text', 'saved before full_text') RETURNING id`, userID).Scan(&oldMessageID)
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+
+	message, err := getMessage(testDB, userID, messageID)
+	if err != nil {
+		t.Fatalf("Failed to get message: %v", err)
+	}
+	if message.FullText == nil || *message.FullText != fullText || message.TextTruncated {
+		t.Errorf("Expected the 2000-character full text, got %v (truncated: %v)", message.FullText, message.TextTruncated)
+	}
+	if message.TextContent == nil || *message.TextContent != fullText[:150]+"..." {
+		t.Errorf("Expected the 150-character preview, got %v", message.TextContent)
+	}
+
+	old, err := getMessage(testDB, userID, oldMessageID)
+	if err != nil {
+		t.Fatalf("Failed to get message: %v", err)
+	}
+	if old.FullText != nil {
+		t.Errorf("Expected no full text for an old message, got %q", *old.FullText)
+	}
+
+	// Another user's message is indistinguishable from a missing one
+	var notFound *NotFoundError
+	if _, err := getMessage(testDB, userID+1, messageID); !errors.As(err, &notFound) {
+		t.Errorf("Expected NotFoundError for another user's message, got %v", err)
+	}
+}
+
+func TestGetMessageLocation(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID := int64(999967)
+	storage.DeleteUserData(testDB, userID, true)
+	defer storage.DeleteUserData(testDB, userID, true)
+
+	if _, err := testDB.Exec(`INSERT INTO users (telegram_id, username) VALUES ($1, 'venue')`, userID); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	var messageID int64
+	err = testDB.QueryRow(`INSERT INTO messages (user_id, telegram_message_id, message_type, latitude, longitude, venue_title, venue_address)
+		VALUES ($1, 1, 'location', 48.8584, 2.2945, 'Eiffel Tower', 'Champ de Mars, Paris') RETURNING id`, userID).Scan(&messageID)
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+
+	message, err := getMessage(testDB, userID, messageID)
+	if err != nil {
+		t.Fatalf("Failed to get message: %v", err)
+	}
+	if message.Latitude == nil || *message.Latitude != 48.8584 || message.Longitude == nil || *message.Longitude != 2.2945 {
+		t.Errorf("Expected coordinates 48.8584, 2.2945, got %v, %v", message.Latitude, message.Longitude)
+	}
+	if message.VenueTitle == nil || *message.VenueTitle != "Eiffel Tower" {
+		t.Errorf("Expected the venue title, got %v", message.VenueTitle)
+	}
+	if message.VenueAddress == nil || *message.VenueAddress != "Champ de Mars, Paris" {
+		t.Errorf("Expected the venue address, got %v", message.VenueAddress)
+	}
+	if message.Preview != "Eiffel Tower" {
+		t.Errorf("Expected the venue title as preview, got %q", message.Preview)
+	}
+}
+
+func TestGetUserTagsSorted(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID := int64(999966)
+	storage.DeleteUserData(testDB, userID, true)
+	defer storage.DeleteUserData(testDB, userID, true)
+	if _, err := testDB.Exec(`INSERT INTO users (telegram_id, username) VALUES ($1, 'tag_sort')`, userID); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	// Tags are created oldest first; each is applied at the given minute
+	now := time.Now().UTC()
+	insertTag := func(name string, createdMinutesAgo int) int64 {
+		var id int64
+		err := testDB.QueryRow(`INSERT INTO tags (user_id, name, created_at) VALUES ($1, $2, $3) RETURNING id`,
+			userID, name, now.Add(-time.Duration(createdMinutesAgo)*time.Minute)).Scan(&id)
+		if err != nil {
+			t.Fatalf("Failed to create tag: %v", err)
+		}
+		return id
+	}
+	apply := func(tagID int64, telegramMessageID int, minutesAgo int) {
+		var messageID int64
+		err := testDB.QueryRow(`INSERT INTO messages (user_id, telegram_message_id, message_type) VALUES ($1, $2, 'text') RETURNING id`,
+			userID, telegramMessageID).Scan(&messageID)
+		if err != nil {
+			t.Fatalf("Failed to create message: %v", err)
+		}
+		_, err = testDB.Exec(`INSERT INTO message_tags (message_id, tag_id, created_at) VALUES ($1, $2, $3)`,
+			messageID, tagID, now.Add(-time.Duration(minutesAgo)*time.Minute))
+		if err != nil {
+			t.Fatalf("Failed to tag message: %v", err)
+		}
+	}
+
+	books := insertTag("books", 50)
+	work := insertTag("Work", 40)
+	art := insertTag("art", 30)
+	insertTag("zen", 20) // never applied
+	apply(work, 1, 30)
+	apply(work, 2, 25)
+	apply(books, 3, 5)
+	apply(art, 4, 10)
+
+	names := func(order TagSort) []string {
+		tags, err := getUserTagsWithCounts(testDB, userID, order)
+		if err != nil {
+			t.Fatalf("Failed to get tags sorted by %q: %v", order, err)
+		}
+		var names []string
+		for _, tag := range tags {
+			names = append(names, tag.Name)
+		}
+		return names
+	}
+
+	for order, expected := range map[TagSort][]string{
+		TagSortCount:  {"Work", "art", "books", "zen"},
+		TagSortName:   {"art", "books", "Work", "zen"},
+		TagSortRecent: {"books", "art", "Work", "zen"},
+	} {
+		if got := names(order); strings.Join(got, ",") != strings.Join(expected, ",") {
+			t.Errorf("Sorted by %q: expected %v, got %v", order, expected, got)
+		}
+	}
+}
+
+func TestGetTagMessagesByType(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID := int64(999968)
+	storage.DeleteUserData(testDB, userID, true)
+	defer storage.DeleteUserData(testDB, userID, true)
+	if _, err := testDB.Exec(`INSERT INTO users (telegram_id, username) VALUES ($1, 'tag_types')`, userID); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	var tagID int64
+	if err := testDB.QueryRow(`INSERT INTO tags (user_id, name) VALUES ($1, 'mixed') RETURNING id`, userID).Scan(&tagID); err != nil {
+		t.Fatalf("Failed to create tag: %v", err)
+	}
+	for i, messageType := range []string{"photo", "text", "photo", "document"} {
+		var id int64
+		err := testDB.QueryRow(`INSERT INTO messages (user_id, telegram_message_id, message_type) VALUES ($1, $2, $3) RETURNING id`,
+			userID, i+1, messageType).Scan(&id)
+		if err != nil {
+			t.Fatalf("Failed to create message: %v", err)
+		}
+		if _, err := testDB.Exec(`INSERT INTO message_tags (message_id, tag_id) VALUES ($1, $2)`, id, tagID); err != nil {
+			t.Fatalf("Failed to tag message: %v", err)
+		}
+	}
+
+	useMockParser(t, userID)
+	router := setupRoutes(testDB)
+	getTypes := func(query string) ([]string, int) {
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/user/tags/%d/messages?%s", tagID, query), nil)
+		req.Header.Set("Authorization", "Bearer init_data")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for %q, got %d: %s", query, w.Code, w.Body.String())
+		}
+
+		var response struct {
+			Data       []MessageResponse `json:"data"`
+			Pagination *Pagination       `json:"pagination"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		var types []string
+		for _, message := range response.Data {
+			types = append(types, message.MessageType)
+		}
+		return types, response.Pagination.Total
+	}
+
+	if types, total := getTypes("type=photo"); len(types) != 2 || total != 2 || types[0] != "photo" || types[1] != "photo" {
+		t.Errorf("Expected 2 photos, got %v (total %d)", types, total)
+	}
+	if types, total := getTypes("type=PHOTO&limit=1"); len(types) != 1 || total != 2 {
+		t.Errorf("Expected 1 of 2 photos, got %v (total %d)", types, total)
+	}
+	if types, total := getTypes("type=voice"); len(types) != 0 || total != 0 {
+		t.Errorf("Expected no voice messages, got %v (total %d)", types, total)
+	}
+	if types, total := getTypes(""); len(types) != 4 || total != 4 {
+		t.Errorf("Expected all 4 messages without a type, got %v (total %d)", types, total)
+	}
+}
+
+func TestGetTagMessagesPagination(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID := int64(999973)
+	storage.DeleteUserData(testDB, userID, true)
+	defer storage.DeleteUserData(testDB, userID, true)
+	if _, err := testDB.Exec(`INSERT INTO users (telegram_id, username) VALUES ($1, 'pages')`, userID); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	var tagID int64
+	if err := testDB.QueryRow(`INSERT INTO tags (user_id, name) VALUES ($1, 'many') RETURNING id`, userID).Scan(&tagID); err != nil {
+		t.Fatalf("Failed to create tag: %v", err)
+	}
+	// Newest first: m5, m4, m3, m2, m1
+	var newestFirst []int64
+	for i := 1; i <= 5; i++ {
+		var id int64
+		err := testDB.QueryRow(`INSERT INTO messages (user_id, telegram_message_id, message_type, created_at)
+			VALUES ($1, $2, 'text', NOW() - $3 * INTERVAL '1 hour') RETURNING id`, userID, i, 6-i).Scan(&id)
+		if err != nil {
+			t.Fatalf("Failed to create message: %v", err)
+		}
+		if _, err := testDB.Exec(`INSERT INTO message_tags (message_id, tag_id) VALUES ($1, $2)`, id, tagID); err != nil {
+			t.Fatalf("Failed to tag message: %v", err)
+		}
+		newestFirst = append([]int64{id}, newestFirst...)
+	}
+
+	useMockParser(t, userID)
+	router := setupRoutes(testDB)
+	getPage := func(query string) ([]int64, *Pagination) {
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/user/tags/%d/messages?%s", tagID, query), nil)
+		req.Header.Set("Authorization", "Bearer init_data")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for %q, got %d: %s", query, w.Code, w.Body.String())
+		}
+
+		var response struct {
+			Data       []MessageResponse `json:"data"`
+			Pagination *Pagination       `json:"pagination"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		var ids []int64
+		for _, message := range response.Data {
+			ids = append(ids, message.ID)
+		}
+		return ids, response.Pagination
+	}
+
+	ids, pagination := getPage("limit=2")
+	if fmt.Sprint(ids) != fmt.Sprint(newestFirst[:2]) {
+		t.Errorf("First page: expected %v, got %v", newestFirst[:2], ids)
+	}
+	if pagination == nil || *pagination != (Pagination{Total: 5, Limit: 2, Offset: 0}) {
+		t.Errorf("First page: unexpected pagination %+v", pagination)
+	}
+
+	ids, pagination = getPage("limit=2&offset=2")
+	if fmt.Sprint(ids) != fmt.Sprint(newestFirst[2:4]) {
+		t.Errorf("Second page: expected %v, got %v", newestFirst[2:4], ids)
+	}
+	if pagination == nil || *pagination != (Pagination{Total: 5, Limit: 2, Offset: 2}) {
+		t.Errorf("Second page: unexpected pagination %+v", pagination)
+	}
+
+	// Past the end is an empty page, not an error
+	ids, pagination = getPage("offset=10")
+	if len(ids) != 0 {
+		t.Errorf("Past the end: expected no messages, got %v", ids)
+	}
+	if pagination == nil || *pagination != (Pagination{Total: 5, Limit: defaultPageLimit, Offset: 10}) {
+		t.Errorf("Past the end: unexpected pagination %+v", pagination)
+	}
+}
+
+func TestSearchMessages(t *testing.T) {
+	// Skip if DATABASE_URL is not set
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL not set, skipping database test")
+	}
+
+	testDB, err := initDB()
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer testDB.Close()
+
+	userID, otherID := int64(999972), int64(999971)
+	for _, id := range []int64{userID, otherID} {
+		storage.DeleteUserData(testDB, id, true)
+		defer storage.DeleteUserData(testDB, id, true)
+		if _, err := testDB.Exec(`INSERT INTO users (telegram_id, username) VALUES ($1, 'search')`, id); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	// Newest first: m5, m4, m3, m2, m1
+	seed := []struct {
+		userID      int64
+		messageType string
+		text        *string
+		caption     *string
+		fullText    *string
+		hashtags    string
+	}{
+		{userID, "text", stringPtr("Pancake recipe"), nil, nil, "{breakfast}"},
+		{userID, "photo", nil, stringPtr("Soup RECIPE for dinner"), nil, "{}"},
+		{userID, "text", stringPtr("Buy milk"), nil, nil, "{recipes}"},
+		{userID, "text", stringPtr("100% off sale"), nil, nil, "{}"},
+		{otherID, "text", stringPtr("Someone else's recipe"), nil, nil, "{recipes}"},
+		{userID, "text", stringPtr("A long story..."), nil, stringPtr("A long story that ends with a recipe"), "{}"},
+	}
+	var ids []int64
+	for i, m := range seed {
+		var id int64
+		err := testDB.QueryRow(`INSERT INTO messages (user_id, telegram_message_id, message_type, text_content, caption, full_text, hashtags, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, NOW() - $8 * INTERVAL '1 hour') RETURNING id`,
+			m.userID, i+1, m.messageType, m.text, m.caption, m.fullText, m.hashtags, len(seed)-i).Scan(&id)
+		if err != nil {
+			t.Fatalf("Failed to create message: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	m1, m2, m3, m4, m5 := ids[0], ids[1], ids[2], ids[3], ids[5]
+
+	search := func(params SearchParams) []int64 {
+		if params.Fields == "" {
+			params.Fields = SearchFieldsAll
+		}
+		messages, _, err := searchMessages(testDB, userID, params, Page{Limit: defaultPageLimit})
+		if err != nil {
+			t.Fatalf("Failed to search for %+v: %v", params, err)
+		}
+		var found []int64
+		for _, msg := range messages {
+			found = append(found, msg.ID)
+		}
+		return found
+	}
+
+	cases := []struct {
+		name     string
+		params   SearchParams
+		expected []int64
+	}{
+		{"text, caption and hashtags", SearchParams{Query: "recipe"}, []int64{m5, m3, m2, m1}},
+		{"hashtag with #", SearchParams{Query: "#recipes"}, []int64{m3}},
+		{"text only", SearchParams{Query: "recipe", Fields: SearchFieldsText}, []int64{m5, m1}},
+		{"past the preview", SearchParams{Query: "ends with"}, []int64{m5}},
+		{"caption only", SearchParams{Query: "recipe", Fields: SearchFieldsCaption}, []int64{m2}},
+		{"type filter", SearchParams{Query: "recipe", MessageType: "photo"}, []int64{m2}},
+		{"wildcards are literal", SearchParams{Query: "100%"}, []int64{m4}},
+		{"no match", SearchParams{Query: "pizza"}, nil},
+	}
+	for _, tc := range cases {
+		if got := search(tc.params); fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+
+	// With text encrypted at rest the same messages match, decoded in Go
+	t.Run("Encrypted", func(t *testing.T) {
+		c, err := textcrypt.NewCipher("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+		if err != nil {
+			t.Fatalf("Failed to create cipher: %v", err)
+		}
+		t.Cleanup(textcrypt.Use(c))
+
+		for _, tc := range cases {
+			if got := search(tc.params); fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+				t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, got)
+			}
+		}
+
+		messages, total, err := searchMessages(testDB, userID, SearchParams{Query: "recipe", Fields: SearchFieldsAll}, Page{Limit: 2, Offset: 1})
+		if err != nil {
+			t.Fatalf("Failed to search: %v", err)
+		}
+		if total != 4 || len(messages) != 2 || messages[0].ID != m3 || messages[1].ID != m2 {
+			t.Errorf("Expected m3 and m2 of 4 matches, got %d: %+v", total, messages)
+		}
+	})
+
+	useMockParser(t, userID)
+	router := setupRoutes(testDB)
+	req := httptest.NewRequest(http.MethodGet, "/api/user/messages/search?q=recipe&limit=2", nil)
+	req.Header.Set("Authorization", "Bearer init_data")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		Data       []MessageResponse `json:"data"`
+		Pagination *Pagination       `json:"pagination"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(response.Data) != 2 || response.Pagination == nil || response.Pagination.Total != 4 {
+		t.Errorf("Expected 2 of 4 matches, got %d, %+v", len(response.Data), response.Pagination)
+	}
+}
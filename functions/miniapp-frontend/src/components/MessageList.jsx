@@ -7,7 +7,9 @@ import telegramApp from '../utils/telegram.js';
 
 const MessageList = () => {
   const [messages, setMessages] = useState([]);
+  const [total, setTotal] = useState(0);
   const [loading, setLoading] = useState(true);
+  const [loadingMore, setLoadingMore] = useState(false);
   const { selectedTag, navigateBack } = useNavigation();
   const { addError, clearError, hasApiError } = useError();
   const theme = telegramApp.getTheme();
@@ -23,8 +25,9 @@ const MessageList = () => {
       setLoading(true);
       clearError('api');
       
-      const tagMessages = await apiService.getTagMessages(tagId);
-      setMessages(tagMessages);
+      const page = await apiService.getTagMessages(tagId);
+      setMessages(page.messages);
+      setTotal(page.total);
       
     } catch (error) {
       console.error('Failed to load messages :', error);
@@ -37,6 +40,34 @@ const MessageList = () => {
     }
   };
 
+  // Loads the next page below the messages already shown
+  const loadMoreMessages = async () => {
+    if (!selectedTag || loadingMore) {
+      return;
+    }
+    try {
+      setLoadingMore(true);
+      clearError('api');
+
+      const page = await apiService.getTagMessages(selectedTag.id, messages.length);
+      setMessages((loaded) => [...loaded, ...page.messages]);
+      setTotal(page.total);
+    } catch (error) {
+      console.error('Failed to load more messages:', error);
+      addError('api', error, {
+        endpoint: `/api/user/tags/${selectedTag.id}/messages`,
+        tagId: selectedTag.id
+      });
+    } finally {
+      setLoadingMore(false);
+    }
+  };
+
+  const handleLoadMore = () => {
+    telegramApp.hapticFeedback('impact', 'light');
+    loadMoreMessages();
+  };
+
   const handleRetry = () => {
     if (selectedTag) {
       telegramApp.hapticFeedback('impact', 'light');
@@ -117,8 +148,8 @@ const MessageList = () => {
               color: theme.hint_color
             }}>
               {loading ? 'Loading messages...' : 
-               messages.length === 0 ? 'No messages' :
-               `${messages.length} message${messages.length !== 1 ? 's' : ''}`}
+               total === 0 ? 'No messages' :
+               `${total} message${total !== 1 ? 's' : ''}`}
             </p>
           </div>
 
@@ -240,6 +271,25 @@ const MessageList = () => {
                 message={message}
               />
             ))}
+            {messages.length < total && (
+              <button
+                onClick={handleLoadMore}
+                disabled={loadingMore}
+                style={{
+                  width: '100%',
+                  backgroundColor: 'transparent',
+                  border: `1px solid ${theme.hint_color}40`,
+                  color: theme.link_color,
+                  fontSize: '14px',
+                  cursor: 'pointer',
+                  padding: '12px',
+                  marginTop: '8px',
+                  borderRadius: '8px'
+                }}
+              >
+                {loadingMore ? 'Loading...' : `Load more (${total - messages.length} left)`}
+              </button>
+            )}
           </div>
         )}
       </div>
@@ -4,6 +4,9 @@
 
 import telegramApp from '../utils/telegram.js';
 
+// Messages loaded per page of a tag; the list loads more on demand
+const MESSAGES_PAGE_SIZE = 50;
+
 class ApiService {
   constructor() {
     // Use API Gateway URL instead of direct function URL for proper HTTP handling
@@ -100,23 +103,28 @@ class ApiService {
   }
 
   /**
-   * Get messages for a specific tag
+   * Get one page of messages for a specific tag
    * @param {number} tagId - The tag ID to get messages for
-   * @returns {Promise<Array>} Array of message objects
+   * @param {number} offset - How many messages to skip, i.e. how many are already loaded
+   * @returns {Promise<{messages: Array, total: number}>} The page and the tag's message count
    */
-  async getTagMessages(tagId) {
+  async getTagMessages(tagId, offset = 0) {
     try {
       if (!tagId) {
         throw new Error('Tag ID is required');
       }
 
-      const response = await this.request(`/api/user/tags/${tagId}/messages`);
-      
+      const response = await this.request(
+        `/api/user/tags/${tagId}/messages?limit=${MESSAGES_PAGE_SIZE}&offset=${offset}`
+      );
+
       if (!response.success) {
         throw new Error(response.error || 'Failed to fetch messages');
       }
 
-      return response.data || [];
+      const messages = response.data || [];
+      const total = response.pagination ? response.pagination.total : offset + messages.length;
+      return { messages, total };
     } catch (error) {
       console.error(`Failed to get messages for tag ${tagId}:`, error);
       
@@ -18,6 +18,8 @@ export const getMessageTypeIcon = (messageType) => {
     'video_note': '📹',
     'animation': '🎬',
     'sticker': '🏷️',
+    'story': '📖',
+    'unknown': '❓',
     'location': '📍',
     'contact': '👤',
     'poll': '📊',
@@ -35,7 +37,12 @@ export const getMessageTypeIcon = (messageType) => {
  * @returns {string} Preview text for the message
  */
 export const getMessagePreview = (message) => {
-  const { message_type, text_content, caption, file_name } = message;
+  const { message_type, text_content, caption, file_name, preview } = message;
+  
+  // The API computes the preview so all clients agree; older responses lack it
+  if (preview) {
+    return truncateText(preview, 100);
+  }
   
   // For text messages, use the text content
   if (message_type === 'text' && text_content) {
@@ -61,6 +68,8 @@ export const getMessagePreview = (message) => {
     'video_note': 'Video note',
     'animation': 'GIF',
     'sticker': 'Sticker',
+    'story': 'Story',
+    'unknown': 'Unsupported message',
     'document': 'Document',
     'location': 'Location',
     'contact': 'Contact',
@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// DirObjectStore stores archived media as files under Root, e.g. a mounted
+// bucket. The bot writes objects and both functions delete them with the
+// messages they belong to.
+type DirObjectStore struct {
+	Root string
+}
+
+// Put stores data under key, replacing any existing object
+func (s DirObjectStore) Put(key string, data []byte, contentType string) error {
+	path := filepath.Join(s.Root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// Delete removes the object; a missing one isn't an error
+func (s DirObjectStore) Delete(key string) error {
+	err := os.Remove(filepath.Join(s.Root, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirObjectStore(t *testing.T) {
+	store := DirObjectStore{Root: t.TempDir()}
+
+	assert.NoError(t, store.Put("media/123/file1", []byte("first"), "image/jpeg"))
+	assert.NoError(t, store.Put("media/123/file1", []byte("second"), "image/jpeg"))
+
+	data, err := os.ReadFile(filepath.Join(store.Root, "media", "123", "file1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("second"), data, "Put replaces existing objects")
+
+	assert.NoError(t, store.Delete("media/123/file1"))
+	_, err = os.Stat(filepath.Join(store.Root, "media", "123", "file1"))
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, store.Delete("media/123/file1"), "Deleting a missing object isn't an error")
+}
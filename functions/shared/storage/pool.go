@@ -0,0 +1,56 @@
+// Package storage holds the database code shared by the bot and the mini-app
+// API: connection pool settings, the user data export and deletion, tag creation
+// and the MAX_STORED_TEXT limit. Both functions deploy separately but use the same schema.
+package storage
+
+import (
+	"database/sql"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Connection pool defaults suited to Lambda: a warm container serves one request
+// at a time, so a few connections are enough, and connections are recycled
+// before idle containers pile up stale ones on Postgres
+const (
+	defaultMaxOpenConns    = 5
+	defaultMaxIdleConns    = 2
+	defaultConnMaxLifetime = 5 * time.Minute
+)
+
+// PoolConfig holds the connection pool limits applied by ConfigurePool
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// LoadPoolConfig reads DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS and
+// DB_CONN_MAX_LIFETIME (a duration like "10m"), keeping the default for unset
+// or invalid values
+func LoadPoolConfig() PoolConfig {
+	config := PoolConfig{
+		MaxOpenConns:    defaultMaxOpenConns,
+		MaxIdleConns:    defaultMaxIdleConns,
+		ConnMaxLifetime: defaultConnMaxLifetime,
+	}
+	if n, err := strconv.Atoi(os.Getenv("DB_MAX_OPEN_CONNS")); err == nil && n > 0 {
+		config.MaxOpenConns = n
+	}
+	// Zero idle connections is valid: every connection closes after use
+	if n, err := strconv.Atoi(os.Getenv("DB_MAX_IDLE_CONNS")); err == nil && n >= 0 {
+		config.MaxIdleConns = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("DB_CONN_MAX_LIFETIME")); err == nil && d > 0 {
+		config.ConnMaxLifetime = d
+	}
+	return config
+}
+
+// ConfigurePool applies the pool limits to db
+func ConfigurePool(db *sql.DB, config PoolConfig) {
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	db.SetMaxIdleConns(config.MaxIdleConns)
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
+}
@@ -0,0 +1,424 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"telegram-content-organizer-shared/storagetest"
+)
+
+func createUser(t *testing.T, db *sql.DB, telegramID int64, username string) {
+	_, err := db.Exec(`INSERT INTO users (telegram_id, username, first_name, last_name) VALUES (?, ?, 'Test', 'User')`, telegramID, username)
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+}
+
+func createMessage(t *testing.T, db *sql.DB, userID, telegramMessageID int64, text string) int64 {
+	result, err := db.Exec(`INSERT INTO messages (user_id, telegram_message_id, message_type, text_content, urls, hashtags, mentions)
+		VALUES (?, ?, 'text', ?, '{}', '{}', '{}')`, userID, telegramMessageID, text)
+	if err != nil {
+		t.Fatalf("Failed to create test message: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatalf("Failed to get message ID: %v", err)
+	}
+	return id
+}
+
+func createTag(t *testing.T, db *sql.DB, userID int64, name string) int64 {
+	result, err := db.Exec(`INSERT INTO tags (user_id, name) VALUES (?, ?)`, userID, name)
+	if err != nil {
+		t.Fatalf("Failed to create test tag: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatalf("Failed to get tag ID: %v", err)
+	}
+	return id
+}
+
+func tagMessage(t *testing.T, db *sql.DB, messageID, tagID int64) {
+	if _, err := db.Exec(`INSERT INTO message_tags (message_id, tag_id) VALUES (?, ?)`, messageID, tagID); err != nil {
+		t.Fatalf("Failed to tag test message: %v", err)
+	}
+}
+
+func TestLoadPoolConfig(t *testing.T) {
+	defaults := PoolConfig{MaxOpenConns: defaultMaxOpenConns, MaxIdleConns: defaultMaxIdleConns, ConnMaxLifetime: defaultConnMaxLifetime}
+	tests := []struct {
+		name        string
+		maxOpen     string
+		maxIdle     string
+		maxLifetime string
+		expected    PoolConfig
+	}{
+		{
+			name:     "Defaults",
+			expected: defaults,
+		},
+		{
+			name:        "Overrides",
+			maxOpen:     "20",
+			maxIdle:     "0",
+			maxLifetime: "90s",
+			expected:    PoolConfig{MaxOpenConns: 20, MaxIdleConns: 0, ConnMaxLifetime: 90 * time.Second},
+		},
+		{
+			name:        "Invalid values keep the defaults",
+			maxOpen:     "0",
+			maxIdle:     "-1",
+			maxLifetime: "forever",
+			expected:    defaults,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DB_MAX_OPEN_CONNS", tt.maxOpen)
+			t.Setenv("DB_MAX_IDLE_CONNS", tt.maxIdle)
+			t.Setenv("DB_CONN_MAX_LIFETIME", tt.maxLifetime)
+			assert.Equal(t, tt.expected, LoadPoolConfig())
+		})
+	}
+
+	t.Run("Applied to the pool", func(t *testing.T) {
+		t.Setenv("DB_MAX_OPEN_CONNS", "7")
+		db := storagetest.OpenDB(t)
+
+		ConfigurePool(db, LoadPoolConfig())
+		assert.Equal(t, 7, db.Stats().MaxOpenConnections)
+	})
+}
+
+func TestMaxStoredText(t *testing.T) {
+	t.Setenv("MAX_STORED_TEXT", "")
+	assert.Equal(t, defaultMaxStoredText, MaxStoredText())
+
+	t.Setenv("MAX_STORED_TEXT", "20000")
+	assert.Equal(t, 20000, MaxStoredText())
+
+	for _, invalid := range []string{"0", "-5", "lots"} {
+		t.Setenv("MAX_STORED_TEXT", invalid)
+		assert.Equal(t, defaultMaxStoredText, MaxStoredText(), invalid)
+	}
+}
+
+func TestLimitStoredText(t *testing.T) {
+	text, truncated := LimitStoredText("привет мир", 6)
+	assert.Equal(t, "привет", text)
+	assert.True(t, truncated)
+
+	text, truncated = LimitStoredText("привет", 6)
+	assert.Equal(t, "привет", text)
+	assert.False(t, truncated)
+}
+
+func TestGetOrCreateTag(t *testing.T) {
+	db := storagetest.OpenDB(t)
+	createUser(t, db, 123, "testuser")
+	createUser(t, db, 456, "other")
+	existingID := createTag(t, db, 123, "Work")
+
+	tagID, created, err := GetOrCreateTag(db, 123, "work")
+	assert.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, existingID, tagID, "Names match ignoring case")
+
+	newID, created, err := GetOrCreateTag(db, 123, "music")
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.NotEqual(t, existingID, newID)
+
+	otherID, created, err := GetOrCreateTag(db, 456, "work")
+	assert.NoError(t, err)
+	assert.True(t, created, "Other users' tags don't count")
+	assert.NotEqual(t, existingID, otherID)
+
+	t.Run("Concurrent callers get the same tag", func(t *testing.T) {
+		// In-memory SQLite databases are per connection; statements from the
+		// goroutines still interleave on the shared one
+		db.SetMaxOpenConns(1)
+
+		const callers = 8
+		ids := make([]int64, callers)
+		errs := make([]error, callers)
+		var wg sync.WaitGroup
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				ids[i], _, errs[i] = GetOrCreateTag(db, 123, "shared")
+			}(i)
+		}
+		wg.Wait()
+
+		for i := 0; i < callers; i++ {
+			assert.NoError(t, errs[i])
+			assert.Equal(t, ids[0], ids[i])
+		}
+
+		var count int
+		assert.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM tags WHERE user_id = 123 AND name = 'shared'`).Scan(&count))
+		assert.Equal(t, 1, count)
+	})
+}
+
+// TestMergeTags tests that merging combines message counts without duplicate relations
+func TestMergeTags(t *testing.T) {
+	db := storagetest.OpenDB(t)
+	createUser(t, db, 123, "testuser")
+	createUser(t, db, 456, "other")
+	job := createTag(t, db, 123, "job")
+	work := createTag(t, db, 123, "work")
+	music := createTag(t, db, 123, "music")
+	otherTag := createTag(t, db, 456, "work")
+
+	jobOnly := createMessage(t, db, 123, 1, "job only")
+	both := createMessage(t, db, 123, 2, "both")
+	workOnly := createMessage(t, db, 123, 3, "work only")
+	tagMessage(t, db, jobOnly, job)
+	tagMessage(t, db, both, job)
+	tagMessage(t, db, both, work)
+	tagMessage(t, db, both, music)
+	tagMessage(t, db, workOnly, work)
+
+	merge := func(userID, sourceID, destID int64) error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := MergeTags(tx, userID, sourceID, destID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	countTagged := func(tagID int64) int {
+		var count int
+		assert.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM message_tags WHERE tag_id = ?`, tagID).Scan(&count))
+		return count
+	}
+
+	assert.Equal(t, ErrMergeSameTag, merge(123, job, job))
+	assert.Equal(t, ErrTagNotFound, merge(123, job, otherTag))
+	assert.Equal(t, ErrTagNotFound, merge(456, job, otherTag))
+	assert.Equal(t, 2, countTagged(job), "Failed merges change nothing")
+
+	assert.NoError(t, merge(123, job, work))
+	assert.Equal(t, 3, countTagged(work), "work now has every message of job and work")
+
+	var duplicates int
+	assert.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM (
+		SELECT message_id FROM message_tags WHERE tag_id = ? GROUP BY message_id HAVING COUNT(*) > 1)`, work).Scan(&duplicates))
+	assert.Equal(t, 0, duplicates)
+
+	var remaining int
+	assert.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM tags WHERE id = ?`, job).Scan(&remaining))
+	assert.Equal(t, 0, remaining, "The source tag is deleted")
+	assert.Equal(t, 0, countTagged(job))
+	assert.Equal(t, 1, countTagged(music), "Other tags are untouched")
+}
+
+// TestDeleteUserData tests that a reset only removes the requesting user's data
+func TestDeleteUserData(t *testing.T) {
+	countRows := func(t *testing.T, db *sql.DB, query string, userID int64) int {
+		var count int
+		assert.NoError(t, db.QueryRow(query, userID).Scan(&count))
+		return count
+	}
+
+	// setupUserData creates a user with two messages tagged with two tags, one
+	// with archived media
+	setupUserData := func(t *testing.T, db *sql.DB, userID int64) {
+		createUser(t, db, userID, fmt.Sprintf("user%d", userID))
+		for i := int64(1); i <= 2; i++ {
+			messageID := createMessage(t, db, userID, i, "Test message")
+			tagMessage(t, db, messageID, createTag(t, db, userID, fmt.Sprintf("tag%d", i)))
+		}
+		_, err := db.Exec(`UPDATE messages SET media_key = ? WHERE user_id = ? AND telegram_message_id = 1`, fmt.Sprintf("%d/photo", userID), userID)
+		assert.NoError(t, err)
+	}
+
+	messageTagsQuery := `SELECT COUNT(*) FROM message_tags mt JOIN messages m ON m.id = mt.message_id WHERE m.user_id = ?`
+
+	for _, removeUser := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Remove user %v", removeUser), func(t *testing.T) {
+			db := storagetest.OpenDB(t)
+			userID, otherUserID := int64(123), int64(456)
+			setupUserData(t, db, userID)
+			setupUserData(t, db, otherUserID)
+
+			deleted, err := DeleteUserData(db, userID, removeUser)
+			assert.NoError(t, err)
+
+			// Requesting user's data is gone
+			assert.Equal(t, 0, countRows(t, db, `SELECT COUNT(*) FROM messages WHERE user_id = ?`, userID))
+			assert.Equal(t, 0, countRows(t, db, `SELECT COUNT(*) FROM tags WHERE user_id = ?`, userID))
+			assert.Equal(t, 0, countRows(t, db, messageTagsQuery, userID))
+
+			expectedUsers := 1
+			if removeUser {
+				expectedUsers = 0
+			}
+			assert.Equal(t, expectedUsers, countRows(t, db, `SELECT COUNT(*) FROM users WHERE telegram_id = ?`, userID))
+			assert.Equal(t, DeletedUserData{
+				MessageTags: 2, Messages: 2, Tags: 2, Users: int64(1 - expectedUsers),
+				MediaKeys: []string{"123/photo"},
+			}, deleted)
+
+			// Other user's data is untouched
+			assert.Equal(t, 2, countRows(t, db, `SELECT COUNT(*) FROM messages WHERE user_id = ?`, otherUserID))
+			assert.Equal(t, 2, countRows(t, db, `SELECT COUNT(*) FROM tags WHERE user_id = ?`, otherUserID))
+			assert.Equal(t, 2, countRows(t, db, messageTagsQuery, otherUserID))
+			assert.Equal(t, 1, countRows(t, db, `SELECT COUNT(*) FROM users WHERE telegram_id = ?`, otherUserID))
+		})
+	}
+
+	t.Run("Closed database", func(t *testing.T) {
+		db := storagetest.OpenDB(t)
+		db.Close()
+
+		_, err := DeleteUserData(db, 123, false)
+		assert.Error(t, err)
+	})
+}
+
+// TestExportUserData tests that an export contains exactly the user's own data
+func TestExportUserData(t *testing.T) {
+	t.Run("Export with messages and tags", func(t *testing.T) {
+		db := storagetest.OpenDB(t)
+		createUser(t, db, 123, "exporter")
+		createUser(t, db, 456, "other")
+
+		first := createMessage(t, db, 123, 1, "Read https://example.com #go @gopher")
+		_, err := db.Exec(`UPDATE messages SET urls = '{https://example.com}', hashtags = '{go}', mentions = '{gopher}' WHERE id = ?`, first)
+		assert.NoError(t, err)
+		second := createMessage(t, db, 123, 2, "Forwarded")
+		_, err = db.Exec(`UPDATE messages SET forwarded_from = 'Original Author', forwarded_date = ? WHERE id = ?`, time.Unix(1640995200, 0).UTC(), second)
+		assert.NoError(t, err)
+		createMessage(t, db, 456, 3, "Not mine")
+
+		tagID := createTag(t, db, 123, "reading")
+		_, err = db.Exec(`UPDATE tags SET color = '#FF0000' WHERE id = ?`, tagID)
+		assert.NoError(t, err)
+		tagMessage(t, db, first, tagID)
+		createTag(t, db, 456, "secret")
+
+		export, err := ExportUserData(db, 123)
+		assert.NoError(t, err)
+
+		if assert.NotNil(t, export.User) {
+			assert.Equal(t, int64(123), export.User.TelegramID)
+			assert.Equal(t, "exporter", *export.User.Username)
+		}
+
+		if assert.Len(t, export.Tags, 1) {
+			assert.Equal(t, "reading", export.Tags[0].Name)
+			assert.Equal(t, "#FF0000", *export.Tags[0].Color)
+		}
+
+		if assert.Len(t, export.Messages, 2) {
+			msg := export.Messages[0]
+			assert.Equal(t, int64(1), msg.TelegramMessageID)
+			assert.Equal(t, "Read https://example.com #go @gopher", *msg.TextContent)
+			assert.Equal(t, []string{"https://example.com"}, msg.URLs)
+			assert.Equal(t, []string{"go"}, msg.Hashtags)
+			assert.Equal(t, []string{"gopher"}, msg.Mentions)
+			assert.Equal(t, []string{"reading"}, msg.Tags)
+
+			msg = export.Messages[1]
+			assert.Equal(t, int64(2), msg.TelegramMessageID)
+			assert.Equal(t, "Original Author", *msg.ForwardedFrom)
+			assert.NotNil(t, msg.ForwardedDate)
+			assert.Equal(t, []string{}, msg.Tags)
+		}
+	})
+
+	t.Run("Columns added after the first export", func(t *testing.T) {
+		db := storagetest.OpenDB(t)
+		createUser(t, db, 123, "exporter")
+		id := createMessage(t, db, 123, 1, "Cafe")
+		_, err := db.Exec(`UPDATE messages SET source_chat_id = -100, full_text = 'Cafe on the corner', text_truncated = TRUE,
+			width = 1280, thumb_file_id = 'thumb', media_key = 'media/123/photo', media_group_id = 'album',
+			latitude = 52.5, longitude = 13.4, venue_title = 'Cafe', seen_at = ? WHERE id = ?`, time.Now().UTC(), id)
+		assert.NoError(t, err)
+
+		export, err := ExportUserData(db, 123)
+		assert.NoError(t, err)
+		if !assert.Len(t, export.Messages, 1) {
+			return
+		}
+		msg := export.Messages[0]
+		assert.Equal(t, int64(-100), msg.SourceChatID)
+		assert.Equal(t, "Cafe on the corner", *msg.FullText)
+		assert.True(t, msg.TextTruncated)
+		assert.Equal(t, int32(1280), *msg.Width)
+		assert.Nil(t, msg.Height)
+		assert.Equal(t, "thumb", *msg.ThumbFileID)
+		assert.Equal(t, "media/123/photo", *msg.MediaKey)
+		assert.Equal(t, "album", *msg.MediaGroupID)
+		assert.Equal(t, 52.5, *msg.Latitude)
+		assert.Equal(t, 13.4, *msg.Longitude)
+		assert.Equal(t, "Cafe", *msg.VenueTitle)
+		assert.Nil(t, msg.VenueAddress)
+		assert.NotNil(t, msg.SeenAt)
+	})
+
+	t.Run("Export for unknown user", func(t *testing.T) {
+		db := storagetest.OpenDB(t)
+
+		export, err := ExportUserData(db, 999)
+		assert.NoError(t, err)
+		assert.Nil(t, export.User)
+		assert.Empty(t, export.Tags)
+		assert.Empty(t, export.Messages)
+	})
+
+	t.Run("Closed database", func(t *testing.T) {
+		db := storagetest.OpenDB(t)
+		db.Close()
+
+		_, err := ExportUserData(db, 123)
+		assert.Error(t, err)
+	})
+}
+
+// TestExportedMessageColumns fails when a column of messages has no field in
+// ExportedMessage, so new columns don't silently drop out of exports
+func TestExportedMessageColumns(t *testing.T) {
+	fields := make(map[string]bool)
+	exported := reflect.TypeOf(ExportedMessage{})
+	for i := 0; i < exported.NumField(); i++ {
+		name, _, _ := strings.Cut(exported.Field(i).Tag.Get("json"), ",")
+		fields[name] = true
+	}
+
+	_, table, _ := strings.Cut(storagetest.Schema, "CREATE TABLE messages (")
+	table, _, _ = strings.Cut(table, ");")
+	var columns []string
+	for _, line := range strings.Split(table, "\n") {
+		column := strings.Fields(line)
+		if len(column) == 0 || strings.ToUpper(column[0]) == column[0] {
+			// Blank lines and constraints like UNIQUE (...)
+			continue
+		}
+		columns = append(columns, column[0])
+	}
+	assert.Contains(t, columns, "text_content", "Failed to read the messages columns from the schema")
+
+	for _, column := range columns {
+		if column == "user_id" {
+			continue
+		}
+		assert.True(t, fields[column], "Column %s is missing from ExportedMessage", column)
+	}
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+)
+
+var (
+	// ErrTagNotFound is returned for a tag that doesn't exist or belongs to
+	// another user
+	ErrTagNotFound = errors.New("tag not found")
+	// ErrMergeSameTag is returned by MergeTags for a tag merged into itself
+	ErrMergeSameTag = errors.New("cannot merge a tag into itself")
+)
+
+// GetOrCreateTag returns the ID of the user's tag with this name, ignoring case,
+// creating it if needed, and whether it was created. An existing tag keeps the
+// casing it was created with. Concurrent requests creating the same new tag
+// both get its ID instead of one failing on the unique constraint.
+func GetOrCreateTag(db *sql.DB, userID int64, tagName string) (int64, bool, error) {
+	var tagID int64
+
+	query := `SELECT id FROM tags WHERE user_id = $1 AND lower(name) = lower($2) ORDER BY id LIMIT 1`
+	err := db.QueryRow(query, userID, tagName).Scan(&tagID)
+	if err != sql.ErrNoRows {
+		return tagID, false, err
+	}
+
+	// Without a conflict target this skips a clash with any unique index,
+	// including idx_tags_user_lower_name where it exists
+	insertQuery := `INSERT INTO tags (user_id, name, created_at) VALUES ($1, $2, CURRENT_TIMESTAMP)
+		ON CONFLICT DO NOTHING
+		RETURNING id`
+	err = db.QueryRow(insertQuery, userID, tagName).Scan(&tagID)
+	if err == sql.ErrNoRows {
+		// Another request created the tag, possibly cased differently, since the lookup
+		err = db.QueryRow(query, userID, tagName).Scan(&tagID)
+		return tagID, false, err
+	}
+	return tagID, err == nil, err
+}
+
+// MergeTags moves every message of the user's source tag to their destination
+// tag and deletes the source tag, within tx. Messages that already carry both
+// tags keep their single destination row. Callers that need the tags locked
+// against concurrent changes lock them in tx first.
+func MergeTags(tx *sql.Tx, userID, sourceID, destID int64) error {
+	if sourceID == destID {
+		return ErrMergeSameTag
+	}
+
+	var owned int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM tags WHERE id IN ($1, $2) AND user_id = $3`, sourceID, destID, userID).Scan(&owned)
+	if err != nil {
+		return err
+	}
+	if owned != 2 {
+		return ErrTagNotFound
+	}
+
+	repoint := `UPDATE message_tags SET tag_id = $2
+		WHERE tag_id = $1
+		  AND message_id NOT IN (SELECT message_id FROM message_tags WHERE tag_id = $2)`
+	if _, err := tx.Exec(repoint, sourceID, destID); err != nil {
+		return err
+	}
+	// What's left are messages that already had the destination tag
+	if _, err := tx.Exec(`DELETE FROM message_tags WHERE tag_id = $1`, sourceID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM tags WHERE id = $1 AND user_id = $2`, sourceID, userID)
+	return err
+}
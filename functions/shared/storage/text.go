@@ -0,0 +1,28 @@
+package storage
+
+import (
+	"os"
+	"strconv"
+)
+
+// defaultMaxStoredText matches Telegram's own message length limit
+const defaultMaxStoredText = 4096
+
+// MaxStoredText reads MAX_STORED_TEXT, the most characters of a message's text
+// kept in full_text
+func MaxStoredText() int {
+	limit, err := strconv.Atoi(os.Getenv("MAX_STORED_TEXT"))
+	if err != nil || limit <= 0 {
+		return defaultMaxStoredText
+	}
+	return limit
+}
+
+// LimitStoredText cuts text to maxLength characters and reports whether it did
+func LimitStoredText(text string, maxLength int) (string, bool) {
+	runes := []rune(text)
+	if len(runes) <= maxLength {
+		return text, false
+	}
+	return string(runes[:maxLength]), true
+}
@@ -0,0 +1,363 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+
+	"telegram-content-organizer-shared/textcrypt"
+)
+
+// UserDataExport is everything stored about a user, as returned by the bot's
+// /export command and the mini-app API's GET /api/user/export
+type UserDataExport struct {
+	ExportedAt time.Time         `json:"exported_at"`
+	User       *ExportedUser     `json:"user"`
+	Tags       []ExportedTag     `json:"tags"`
+	Messages   []ExportedMessage `json:"messages"`
+}
+
+type ExportedUser struct {
+	TelegramID int64     `json:"telegram_id"`
+	Username   *string   `json:"username"`
+	FirstName  *string   `json:"first_name"`
+	LastName   *string   `json:"last_name"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type ExportedTag struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	Name      string    `json:"name"`
+	Color     *string   `json:"color"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ExportedMessage has a field for every column of messages, named after it,
+// except user_id, which is the exported user
+type ExportedMessage struct {
+	ID                    int64      `json:"id"`
+	TelegramMessageID     int64      `json:"telegram_message_id"`
+	SourceChatID          int64      `json:"source_chat_id"`
+	MessageType           string     `json:"message_type"`
+	TextContent           *string    `json:"text_content"`
+	Caption               *string    `json:"caption"`
+	FullText              *string    `json:"full_text"`
+	TextTruncated         bool       `json:"text_truncated"`
+	FileID                *string    `json:"file_id"`
+	FileName              *string    `json:"file_name"`
+	FileSize              *int64     `json:"file_size"`
+	MimeType              *string    `json:"mime_type"`
+	Duration              *int32     `json:"duration"`
+	Width                 *int32     `json:"width"`
+	Height                *int32     `json:"height"`
+	ThumbFileID           *string    `json:"thumb_file_id"`
+	ThumbWidth            *int32     `json:"thumb_width"`
+	ThumbHeight           *int32     `json:"thumb_height"`
+	MediaKey              *string    `json:"media_key"`
+	MediaGroupID          *string    `json:"media_group_id"`
+	ForwardedDate         *time.Time `json:"forwarded_date"`
+	ForwardedFrom         *string    `json:"forwarded_from"`
+	ForwardedChatUsername *string    `json:"forwarded_chat_username"`
+	ForwardedMessageID    *int64     `json:"forwarded_message_id"`
+	URLs                  []string   `json:"urls"`
+	Hashtags              []string   `json:"hashtags"`
+	Mentions              []string   `json:"mentions"`
+	HasSpoiler            bool       `json:"has_spoiler"`
+	ReplyToMessageID      *int64     `json:"reply_to_message_id"`
+	QuoteText             *string    `json:"quote_text"`
+	StoryChatID           *int64     `json:"story_chat_id"`
+	StoryID               *int64     `json:"story_id"`
+	Latitude              *float64   `json:"latitude"`
+	Longitude             *float64   `json:"longitude"`
+	VenueTitle            *string    `json:"venue_title"`
+	VenueAddress          *string    `json:"venue_address"`
+	UserNote              *string    `json:"user_note"`
+	SeenAt                *time.Time `json:"seen_at"`
+	CreatedAt             time.Time  `json:"created_at"`
+	Tags                  []string   `json:"tags"`
+}
+
+// ExportUserData collects the user's profile, tags and messages (with tag names)
+func ExportUserData(db *sql.DB, userID int64) (*UserDataExport, error) {
+	export := &UserDataExport{
+		ExportedAt: time.Now().UTC(),
+		Tags:       []ExportedTag{},
+		Messages:   []ExportedMessage{},
+	}
+
+	var user ExportedUser
+	var username, firstName, lastName sql.NullString
+	userQuery := `SELECT telegram_id, username, first_name, last_name, created_at FROM users WHERE telegram_id = $1`
+	err := db.QueryRow(userQuery, userID).Scan(&user.TelegramID, &username, &firstName, &lastName, &user.CreatedAt)
+	switch {
+	case err == sql.ErrNoRows:
+		// No user row, but there may still be data to export
+	case err != nil:
+		return nil, fmt.Errorf("failed to load user: %v", err)
+	default:
+		user.Username = NullStringPtr(username)
+		user.FirstName = NullStringPtr(firstName)
+		user.LastName = NullStringPtr(lastName)
+		export.User = &user
+	}
+
+	tagRows, err := db.Query(`SELECT id, name, color, created_at FROM tags WHERE user_id = $1 ORDER BY name`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tags: %v", err)
+	}
+	defer tagRows.Close()
+
+	for tagRows.Next() {
+		tag := ExportedTag{UserID: userID}
+		var color sql.NullString
+		if err := tagRows.Scan(&tag.ID, &tag.Name, &color, &tag.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan tag: %v", err)
+		}
+		tag.Color = NullStringPtr(color)
+		export.Tags = append(export.Tags, tag)
+	}
+	if err := tagRows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Tag names per message, looked up while scanning messages below
+	messageTags := make(map[int64][]string)
+	linkRows, err := db.Query(`
+		SELECT mt.message_id, t.name
+		FROM message_tags mt
+		INNER JOIN tags t ON t.id = mt.tag_id
+		WHERE t.user_id = $1
+		ORDER BY t.name`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query message tags: %v", err)
+	}
+	defer linkRows.Close()
+
+	for linkRows.Next() {
+		var messageID int64
+		var tagName string
+		if err := linkRows.Scan(&messageID, &tagName); err != nil {
+			return nil, fmt.Errorf("failed to scan message tag: %v", err)
+		}
+		messageTags[messageID] = append(messageTags[messageID], tagName)
+	}
+	if err := linkRows.Err(); err != nil {
+		return nil, err
+	}
+
+	messageRows, err := db.Query(`
+		SELECT id, telegram_message_id, source_chat_id, message_type, text_content, caption,
+			full_text, text_truncated, file_id, file_name, file_size, mime_type, duration,
+			width, height, thumb_file_id, thumb_width, thumb_height, media_key, media_group_id,
+			forwarded_date, forwarded_from, forwarded_chat_username, forwarded_message_id,
+			urls, hashtags, mentions, has_spoiler, reply_to_message_id, quote_text, story_chat_id, story_id,
+			latitude, longitude, venue_title, venue_address, user_note, seen_at, created_at
+		FROM messages
+		WHERE user_id = $1
+		ORDER BY created_at, id`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %v", err)
+	}
+	defer messageRows.Close()
+
+	for messageRows.Next() {
+		var msg ExportedMessage
+		var textContent, caption, fullText, fileID, fileName, mimeType, forwardedFrom, forwardedChatUsername, quoteText, userNote sql.NullString
+		var thumbFileID, mediaKey, mediaGroupID, venueTitle, venueAddress sql.NullString
+		var fileSize, forwardedMessageID, replyToMessageID, storyChatID, storyID sql.NullInt64
+		var duration, width, height, thumbWidth, thumbHeight sql.NullInt32
+		var latitude, longitude sql.NullFloat64
+		var forwardedDate, seenAt sql.NullTime
+		var urls, hashtags, mentions pq.StringArray
+
+		if err := messageRows.Scan(&msg.ID, &msg.TelegramMessageID, &msg.SourceChatID, &msg.MessageType, &textContent, &caption,
+			&fullText, &msg.TextTruncated, &fileID, &fileName, &fileSize, &mimeType, &duration,
+			&width, &height, &thumbFileID, &thumbWidth, &thumbHeight, &mediaKey, &mediaGroupID,
+			&forwardedDate, &forwardedFrom, &forwardedChatUsername, &forwardedMessageID,
+			&urls, &hashtags, &mentions, &msg.HasSpoiler, &replyToMessageID, &quoteText, &storyChatID, &storyID,
+			&latitude, &longitude, &venueTitle, &venueAddress, &userNote, &seenAt, &msg.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %v", err)
+		}
+
+		if textContent, err = textcrypt.Decode(textContent); err != nil {
+			return nil, fmt.Errorf("failed to decode text of message %d: %v", msg.ID, err)
+		}
+		if caption, err = textcrypt.Decode(caption); err != nil {
+			return nil, fmt.Errorf("failed to decode caption of message %d: %v", msg.ID, err)
+		}
+		if fullText, err = textcrypt.Decode(fullText); err != nil {
+			return nil, fmt.Errorf("failed to decode full text of message %d: %v", msg.ID, err)
+		}
+		if userNote, err = textcrypt.Decode(userNote); err != nil {
+			return nil, fmt.Errorf("failed to decode note of message %d: %v", msg.ID, err)
+		}
+		if quoteText, err = textcrypt.Decode(quoteText); err != nil {
+			return nil, fmt.Errorf("failed to decode quote of message %d: %v", msg.ID, err)
+		}
+		if msg.URLs, err = textcrypt.DecodeList(urls); err != nil {
+			return nil, fmt.Errorf("failed to decode urls of message %d: %v", msg.ID, err)
+		}
+		if msg.Hashtags, err = textcrypt.DecodeList(hashtags); err != nil {
+			return nil, fmt.Errorf("failed to decode hashtags of message %d: %v", msg.ID, err)
+		}
+		if msg.Mentions, err = textcrypt.DecodeList(mentions); err != nil {
+			return nil, fmt.Errorf("failed to decode mentions of message %d: %v", msg.ID, err)
+		}
+
+		msg.TextContent = NullStringPtr(textContent)
+		msg.Caption = NullStringPtr(caption)
+		msg.FullText = NullStringPtr(fullText)
+		msg.FileID = NullStringPtr(fileID)
+		msg.FileName = NullStringPtr(fileName)
+		msg.MimeType = NullStringPtr(mimeType)
+		msg.ThumbFileID = NullStringPtr(thumbFileID)
+		msg.MediaKey = NullStringPtr(mediaKey)
+		msg.MediaGroupID = NullStringPtr(mediaGroupID)
+		msg.ForwardedFrom = NullStringPtr(forwardedFrom)
+		msg.ForwardedChatUsername = NullStringPtr(forwardedChatUsername)
+		msg.QuoteText = NullStringPtr(quoteText)
+		msg.VenueTitle = NullStringPtr(venueTitle)
+		msg.VenueAddress = NullStringPtr(venueAddress)
+		msg.UserNote = NullStringPtr(userNote)
+		if fileSize.Valid {
+			msg.FileSize = &fileSize.Int64
+		}
+		if duration.Valid {
+			msg.Duration = &duration.Int32
+		}
+		if width.Valid {
+			msg.Width = &width.Int32
+		}
+		if height.Valid {
+			msg.Height = &height.Int32
+		}
+		if thumbWidth.Valid {
+			msg.ThumbWidth = &thumbWidth.Int32
+		}
+		if thumbHeight.Valid {
+			msg.ThumbHeight = &thumbHeight.Int32
+		}
+		if latitude.Valid {
+			msg.Latitude = &latitude.Float64
+		}
+		if longitude.Valid {
+			msg.Longitude = &longitude.Float64
+		}
+		if forwardedDate.Valid {
+			msg.ForwardedDate = &forwardedDate.Time
+		}
+		if seenAt.Valid {
+			msg.SeenAt = &seenAt.Time
+		}
+		if forwardedMessageID.Valid {
+			msg.ForwardedMessageID = &forwardedMessageID.Int64
+		}
+		if replyToMessageID.Valid {
+			msg.ReplyToMessageID = &replyToMessageID.Int64
+		}
+		if storyChatID.Valid {
+			msg.StoryChatID = &storyChatID.Int64
+		}
+		if storyID.Valid {
+			msg.StoryID = &storyID.Int64
+		}
+
+		// Ensure arrays are not nil for JSON serialization
+		msg.URLs = append([]string{}, msg.URLs...)
+		msg.Hashtags = append([]string{}, msg.Hashtags...)
+		msg.Mentions = append([]string{}, msg.Mentions...)
+		msg.Tags = append([]string{}, messageTags[msg.ID]...)
+
+		export.Messages = append(export.Messages, msg)
+	}
+
+	return export, messageRows.Err()
+}
+
+// DeletedUserData counts the rows DeleteUserData removed from the main tables
+// and lists the archived media objects the deleted messages referred to
+type DeletedUserData struct {
+	MessageTags int64
+	Messages    int64
+	Tags        int64
+	Users       int64
+	MediaKeys   []string
+}
+
+// DeleteUserData removes every message, tag and message-tag link owned by the
+// user in a single transaction. When removeUser is set the user row is removed
+// too. Archived media is left to the caller, which gets the keys to delete.
+func DeleteUserData(db *sql.DB, userID int64, removeUser bool) (DeletedUserData, error) {
+	var deleted DeletedUserData
+	tx, err := db.Begin()
+	if err != nil {
+		return deleted, err
+	}
+	defer tx.Rollback()
+
+	// Media keys are per user, so none of these objects is used by anyone else
+	keyRows, err := tx.Query(`SELECT DISTINCT media_key FROM messages WHERE user_id = $1 AND media_key IS NOT NULL`, userID)
+	if err != nil {
+		return deleted, err
+	}
+	for keyRows.Next() {
+		var key string
+		if err := keyRows.Scan(&key); err != nil {
+			keyRows.Close()
+			return DeletedUserData{}, err
+		}
+		deleted.MediaKeys = append(deleted.MediaKeys, key)
+	}
+	keyRows.Close()
+	if err := keyRows.Err(); err != nil {
+		return DeletedUserData{}, err
+	}
+
+	// count receives the number of deleted rows for the tables DeletedUserData reports
+	type deleteQuery struct {
+		query string
+		count *int64
+	}
+	queries := []deleteQuery{
+		{`DELETE FROM message_tags
+		 WHERE message_id IN (SELECT id FROM messages WHERE user_id = $1)
+		    OR tag_id IN (SELECT id FROM tags WHERE user_id = $1)`, &deleted.MessageTags},
+		{`DELETE FROM messages WHERE user_id = $1`, &deleted.Messages},
+		{`DELETE FROM tags WHERE user_id = $1`, &deleted.Tags},
+		{`DELETE FROM command_usage WHERE user_id = $1`, nil},
+		{`DELETE FROM raw_updates WHERE user_id = $1`, nil},
+		{`DELETE FROM pending_messages WHERE user_id = $1`, nil},
+		{`DELETE FROM media_groups WHERE user_id = $1`, nil},
+	}
+	if removeUser {
+		queries = append(queries, deleteQuery{`DELETE FROM users WHERE telegram_id = $1`, &deleted.Users})
+	}
+
+	for _, q := range queries {
+		result, err := tx.Exec(q.query, userID)
+		if err != nil {
+			return DeletedUserData{}, err
+		}
+		if q.count != nil {
+			if *q.count, err = result.RowsAffected(); err != nil {
+				return DeletedUserData{}, err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return DeletedUserData{}, err
+	}
+	return deleted, nil
+}
+
+// NullStringPtr returns nil for NULL and a pointer to the string otherwise
+func NullStringPtr(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
@@ -0,0 +1,143 @@
+// Package storagetest opens an in-memory SQLite database with the tables of
+// the Postgres schema, for tests of code that uses the database
+package storagetest
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+// Schema mirrors the Postgres schema in telegram_organizer_schema.md closely
+// enough for the queries under test. Arrays are stored as their text form.
+const Schema = `
+	CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		telegram_id INTEGER UNIQUE NOT NULL,
+		username TEXT,
+		first_name TEXT,
+		last_name TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		is_active BOOLEAN DEFAULT TRUE,
+		untagged_retention_days INTEGER,
+		digest_frequency TEXT,
+		ignored_message_types TEXT,
+		min_auth_date TIMESTAMP
+	);
+
+	CREATE TABLE messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		telegram_message_id INTEGER NOT NULL,
+		message_type TEXT NOT NULL,
+		text_content TEXT,
+		caption TEXT,
+		file_id TEXT,
+		file_name TEXT,
+		file_size INTEGER,
+		mime_type TEXT,
+		duration INTEGER,
+		width INTEGER,
+		height INTEGER,
+		thumb_file_id TEXT,
+		thumb_width INTEGER,
+		thumb_height INTEGER,
+		forwarded_date TIMESTAMP,
+		forwarded_from TEXT,
+		forwarded_chat_username TEXT,
+		forwarded_message_id INTEGER,
+		urls TEXT,
+		hashtags TEXT,
+		mentions TEXT,
+		has_spoiler BOOLEAN DEFAULT FALSE,
+		reply_to_message_id INTEGER,
+		quote_text TEXT,
+		story_chat_id INTEGER,
+		story_id INTEGER,
+		user_note TEXT,
+		seen_at TIMESTAMP,
+		media_key TEXT,
+		full_text TEXT,
+		text_truncated BOOLEAN DEFAULT FALSE,
+		media_group_id TEXT,
+		latitude REAL,
+		longitude REAL,
+		venue_title TEXT,
+		venue_address TEXT,
+		source_chat_id INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (telegram_id),
+		UNIQUE (user_id, source_chat_id, telegram_message_id)
+	);
+
+	CREATE TABLE tags (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		color TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(user_id, name),
+		FOREIGN KEY (user_id) REFERENCES users (telegram_id)
+	);
+
+	CREATE UNIQUE INDEX idx_tags_user_lower_name ON tags(user_id, lower(name));
+
+	CREATE TABLE message_tags (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		message_id INTEGER NOT NULL,
+		tag_id INTEGER NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(message_id, tag_id),
+		FOREIGN KEY (message_id) REFERENCES messages (id),
+		FOREIGN KEY (tag_id) REFERENCES tags (id)
+	);
+
+	CREATE TABLE command_usage (
+		user_id INTEGER NOT NULL,
+		command TEXT NOT NULL,
+		count INTEGER NOT NULL DEFAULT 0,
+		last_used_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, command),
+		FOREIGN KEY (user_id) REFERENCES users (telegram_id)
+	);
+
+	CREATE TABLE raw_updates (
+		update_id INTEGER PRIMARY KEY,
+		user_id INTEGER,
+		body TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE pending_messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER,
+		body TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE media_groups (
+		user_id INTEGER NOT NULL,
+		media_group_id TEXT NOT NULL,
+		telegram_message_id INTEGER NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (user_id, media_group_id)
+	);
+`
+
+// OpenDB returns an in-memory database with Schema, closed when the test ends
+func OpenDB(t testing.TB) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	if _, err := db.Exec(Schema); err != nil {
+		t.Fatalf("Failed to create test schema: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
@@ -0,0 +1,247 @@
+// Package textcrypt encrypts stored message content at rest with AES-GCM: the
+// text columns, the items of the urls, hashtags and mentions arrays, and the
+// raw update and pending message bodies.
+//
+// Encryption is optional. Encrypted values look like
+// "enc:v1:<key id>:<base64 data>"; anything else is plain text, so rows
+// written before encryption was enabled keep working. The bot writes these
+// values and the mini-app API reads them, so both use this package.
+package textcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Prefix starts every encrypted value
+const Prefix = "enc:v1:"
+
+// Cipher encrypts with the current key and decrypts with any known key,
+// so old rows stay readable after TEXT_ENCRYPTION_KEY is rotated
+type Cipher struct {
+	keyID string
+	aeads map[string]cipher.AEAD
+}
+
+// NewCipher returns a cipher that encrypts with keys[keyID]
+func NewCipher(keyID string, keys map[string][]byte) (*Cipher, error) {
+	if _, ok := keys[keyID]; !ok {
+		return nil, fmt.Errorf("no key for key id %q", keyID)
+	}
+
+	c := &Cipher{keyID: keyID, aeads: make(map[string]cipher.AEAD)}
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %v", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		c.aeads[id] = aead
+	}
+	return c, nil
+}
+
+// LoadCipher reads the encryption keys from env. It returns nil when
+// TEXT_ENCRYPTION_KEY is unset, which disables encryption.
+//
+//	TEXT_ENCRYPTION_KEY       base64 AES key (16, 24 or 32 bytes) used for new writes
+//	TEXT_ENCRYPTION_KEY_ID    id stored with each value (defaults to "default")
+//	TEXT_ENCRYPTION_OLD_KEYS  comma-separated "id:base64key" pairs still needed for reads
+func LoadCipher() (*Cipher, error) {
+	encodedKey := os.Getenv("TEXT_ENCRYPTION_KEY")
+	if encodedKey == "" {
+		return nil, nil
+	}
+
+	keyID := os.Getenv("TEXT_ENCRYPTION_KEY_ID")
+	if keyID == "" {
+		keyID = "default"
+	}
+
+	keys := make(map[string][]byte)
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TEXT_ENCRYPTION_KEY: %v", err)
+	}
+	keys[keyID] = key
+
+	for _, pair := range strings.Split(os.Getenv("TEXT_ENCRYPTION_OLD_KEYS"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid TEXT_ENCRYPTION_OLD_KEYS entry %q", pair)
+		}
+		oldKey, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in TEXT_ENCRYPTION_OLD_KEYS: %v", id, err)
+		}
+		keys[id] = oldKey
+	}
+
+	return NewCipher(keyID, keys)
+}
+
+var (
+	cipherOnce      sync.Once
+	activeCipher    *Cipher
+	activeCipherErr error
+)
+
+func current() (*Cipher, error) {
+	cipherOnce.Do(func() {
+		activeCipher, activeCipherErr = LoadCipher()
+	})
+	return activeCipher, activeCipherErr
+}
+
+// Use makes Encode and Decode use c instead of the keys in env, with nil
+// disabling encryption. It returns a function restoring the env keys, for
+// tests to defer.
+func Use(c *Cipher) (restore func()) {
+	cipherOnce = sync.Once{}
+	cipherOnce.Do(func() {
+		activeCipher, activeCipherErr = c, nil
+	})
+	return func() {
+		cipherOnce = sync.Once{}
+		activeCipher, activeCipherErr = nil, nil
+	}
+}
+
+// Encrypt returns plain unchanged when c is nil (encryption disabled)
+func (c *Cipher) Encrypt(plain string) (string, error) {
+	if c == nil {
+		return plain, nil
+	}
+
+	aead := c.aeads[c.keyID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plain), nil)
+	return Prefix + c.keyID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt returns stored unchanged unless it was written by Encrypt
+func (c *Cipher) Decrypt(stored string) (string, error) {
+	if !strings.HasPrefix(stored, Prefix) {
+		return stored, nil
+	}
+
+	keyID, encoded, ok := strings.Cut(strings.TrimPrefix(stored, Prefix), ":")
+	if !ok {
+		return "", fmt.Errorf("malformed encrypted text")
+	}
+	if c == nil {
+		return "", fmt.Errorf("text encrypted with key %q but encryption is not configured", keyID)
+	}
+	aead, ok := c.aeads[keyID]
+	if !ok {
+		return "", fmt.Errorf("unknown encryption key %q", keyID)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted text: %v", err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted text")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt text with key %q: %v", keyID, err)
+	}
+	return string(plain), nil
+}
+
+// Encode prepares message text for storage
+func Encode(value sql.NullString) (sql.NullString, error) {
+	if !value.Valid {
+		return value, nil
+	}
+	c, err := current()
+	if err != nil {
+		return value, err
+	}
+	value.String, err = c.Encrypt(value.String)
+	return value, err
+}
+
+// Decode reverses Encode for stored message text. A value that can't be
+// decrypted, e.g. after its key was dropped or for plain text that happens to
+// start with Prefix, is logged and returned as stored rather than failing every
+// query that reads it. Only a bad key configuration is an error.
+func Decode(value sql.NullString) (sql.NullString, error) {
+	if !value.Valid {
+		return value, nil
+	}
+	c, err := current()
+	if err != nil {
+		return value, err
+	}
+	plain, err := c.Decrypt(value.String)
+	if err != nil {
+		slog.Warn("Returning stored text that could not be decrypted", "error", err)
+		return value, nil
+	}
+	value.String = plain
+	return value, nil
+}
+
+// EncodeList encodes each item of a list column like urls or hashtags. The
+// items stay separate, so the list keeps its length.
+func EncodeList(values []string) ([]string, error) {
+	if len(values) == 0 {
+		return values, nil
+	}
+	encoded := make([]string, len(values))
+	for i, value := range values {
+		item, err := Encode(sql.NullString{String: value, Valid: true})
+		if err != nil {
+			return nil, err
+		}
+		encoded[i] = item.String
+	}
+	return encoded, nil
+}
+
+// DecodeList reverses EncodeList
+func DecodeList(values []string) ([]string, error) {
+	if len(values) == 0 {
+		return values, nil
+	}
+	decoded := make([]string, len(values))
+	for i, value := range values {
+		item, err := Decode(sql.NullString{String: value, Valid: true})
+		if err != nil {
+			return nil, err
+		}
+		decoded[i] = item.String
+	}
+	return decoded, nil
+}
+
+// Enabled reports whether new values are encrypted. A bad key configuration
+// counts as enabled, since the keys were meant to be used.
+func Enabled() bool {
+	c, err := current()
+	return c != nil || err != nil
+}
@@ -0,0 +1,196 @@
+package textcrypt
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+// TestCipherRoundTrip tests encrypting and decrypting stored text
+func TestCipherRoundTrip(t *testing.T) {
+	c, err := NewCipher("k1", map[string][]byte{"k1": testKey(1)})
+	assert.NoError(t, err)
+
+	for _, plain := range []string{"Hello, world!", "", "Hello世界 🎉", strings.Repeat("a", 150)} {
+		encrypted, err := c.Encrypt(plain)
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(encrypted, "enc:v1:k1:"), "Key id should be stored with the value")
+		if plain != "" {
+			assert.NotContains(t, encrypted, plain)
+		}
+
+		decrypted, err := c.Decrypt(encrypted)
+		assert.NoError(t, err)
+		assert.Equal(t, plain, decrypted)
+	}
+
+	t.Run("Same text encrypts differently each time", func(t *testing.T) {
+		first, _ := c.Encrypt("secret")
+		second, _ := c.Encrypt("secret")
+		assert.NotEqual(t, first, second)
+	})
+
+	t.Run("Plain text passes through", func(t *testing.T) {
+		decrypted, err := c.Decrypt("written before encryption was enabled")
+		assert.NoError(t, err)
+		assert.Equal(t, "written before encryption was enabled", decrypted)
+	})
+
+	t.Run("Tampered text fails", func(t *testing.T) {
+		encrypted, _ := c.Encrypt("secret")
+		_, err := c.Decrypt(encrypted[:len(encrypted)-4] + "AAAA")
+		assert.Error(t, err)
+	})
+}
+
+// TestCipherKeyRotation tests that old keys still decrypt after rotation
+func TestCipherKeyRotation(t *testing.T) {
+	oldCipher, err := NewCipher("k1", map[string][]byte{"k1": testKey(1)})
+	assert.NoError(t, err)
+	oldValue, err := oldCipher.Encrypt("old note")
+	assert.NoError(t, err)
+
+	rotated, err := NewCipher("k2", map[string][]byte{"k1": testKey(1), "k2": testKey(2)})
+	assert.NoError(t, err)
+
+	decrypted, err := rotated.Decrypt(oldValue)
+	assert.NoError(t, err)
+	assert.Equal(t, "old note", decrypted)
+
+	newValue, err := rotated.Encrypt("new note")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(newValue, "enc:v1:k2:"))
+
+	// Dropping the old key makes its rows unreadable rather than silently wrong
+	withoutOld, err := NewCipher("k2", map[string][]byte{"k2": testKey(2)})
+	assert.NoError(t, err)
+	_, err = withoutOld.Decrypt(oldValue)
+	assert.Error(t, err)
+}
+
+// TestLoadCipher tests reading keys from env
+func TestLoadCipher(t *testing.T) {
+	t.Run("Disabled without a key", func(t *testing.T) {
+		t.Setenv("TEXT_ENCRYPTION_KEY", "")
+		c, err := LoadCipher()
+		assert.NoError(t, err)
+		assert.Nil(t, c)
+	})
+
+	t.Run("Current and old keys", func(t *testing.T) {
+		t.Setenv("TEXT_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(testKey(2)))
+		t.Setenv("TEXT_ENCRYPTION_KEY_ID", "k2")
+		t.Setenv("TEXT_ENCRYPTION_OLD_KEYS", "k1:"+base64.StdEncoding.EncodeToString(testKey(1)))
+
+		c, err := LoadCipher()
+		assert.NoError(t, err)
+		assert.Equal(t, "k2", c.keyID)
+		assert.Len(t, c.aeads, 2)
+	})
+
+	t.Run("Invalid key", func(t *testing.T) {
+		t.Setenv("TEXT_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString([]byte("short")))
+		_, err := LoadCipher()
+		assert.Error(t, err)
+	})
+}
+
+// TestEncodeDecode tests the env-configured helpers, with and without a key
+func TestEncodeDecode(t *testing.T) {
+	t.Run("Disabled", func(t *testing.T) {
+		defer Use(nil)()
+
+		encoded, err := Encode(sql.NullString{String: "plain", Valid: true})
+		assert.NoError(t, err)
+		assert.Equal(t, "plain", encoded.String)
+
+		decoded, err := Decode(encoded)
+		assert.NoError(t, err)
+		assert.Equal(t, "plain", decoded.String)
+
+		decoded, err = Decode(sql.NullString{})
+		assert.NoError(t, err)
+		assert.False(t, decoded.Valid)
+
+		// Encrypted rows can't be read once the key is removed, but they don't
+		// fail the query either
+		c, _ := NewCipher("k1", map[string][]byte{"k1": testKey(1)})
+		encrypted, _ := c.Encrypt("secret")
+		decoded, err = Decode(sql.NullString{String: encrypted, Valid: true})
+		assert.NoError(t, err)
+		assert.Equal(t, encrypted, decoded.String)
+	})
+
+	t.Run("Values that fail to decode are returned as stored", func(t *testing.T) {
+		c, err := NewCipher("k1", map[string][]byte{"k1": testKey(1)})
+		assert.NoError(t, err)
+		defer Use(c)()
+
+		encrypted, err := c.Encrypt("secret")
+		assert.NoError(t, err)
+		for _, stored := range []string{
+			"enc:v1:written before encryption was enabled",
+			"enc:v1:k1:not base64!",
+			"enc:v1:k9:" + strings.TrimPrefix(encrypted, "enc:v1:k1:"),
+			encrypted[:len(encrypted)-4] + "AAAA",
+		} {
+			decoded, err := Decode(sql.NullString{String: stored, Valid: true})
+			assert.NoError(t, err, stored)
+			assert.Equal(t, stored, decoded.String)
+		}
+	})
+
+	t.Run("Rotated key", func(t *testing.T) {
+		// Values written with an old key stay readable after rotation
+		oldCipher, err := NewCipher("k1", map[string][]byte{"k1": testKey(1)})
+		assert.NoError(t, err)
+		encrypted, err := oldCipher.Encrypt("secret note")
+		assert.NoError(t, err)
+
+		rotated, err := NewCipher("k2", map[string][]byte{"k1": testKey(1), "k2": testKey(2)})
+		assert.NoError(t, err)
+		defer Use(rotated)()
+
+		decoded, err := Decode(sql.NullString{String: encrypted, Valid: true})
+		assert.NoError(t, err)
+		assert.Equal(t, "secret note", decoded.String)
+
+		encoded, err := Encode(sql.NullString{String: "new note", Valid: true})
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(encoded.String, "enc:v1:k2:"))
+	})
+}
+
+// TestEncodeList tests encrypting the items of list columns
+func TestEncodeList(t *testing.T) {
+	c, err := NewCipher("k1", map[string][]byte{"k1": testKey(1)})
+	assert.NoError(t, err)
+	defer Use(c)()
+
+	encoded, err := EncodeList([]string{"https://example.com", "https://example.org"})
+	assert.NoError(t, err)
+	if assert.Len(t, encoded, 2) {
+		assert.True(t, strings.HasPrefix(encoded[0], Prefix))
+		assert.NotEqual(t, "https://example.com", encoded[0])
+	}
+
+	decoded, err := DecodeList(append(encoded, "plain"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://example.com", "https://example.org", "plain"}, decoded)
+
+	empty, err := EncodeList([]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, empty, "Empty lists stay empty, not NULL")
+	assert.True(t, Enabled())
+
+	Use(nil)
+	assert.False(t, Enabled())
+}